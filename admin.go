@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"html/template"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"strings"
+)
+
+// adminListenAddress binds to localhost if addr gives no host, so that the
+// admin listener is never reachable from other hosts by accident
+func adminListenAddress(addr string) string {
+	if strings.HasPrefix(addr, unixSocketPrefix) {
+		return addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// adminHandler serves profiling and debugging endpoints. It must only be
+// served on the admin listener, never on the public metrics port.
+func adminHandler(collector *ErdmaCollector) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/goroutines", goroutinesHandler)
+	mux.HandleFunc("/debug/memstats", memStatsHandler)
+	mux.HandleFunc("/debug/config", effectiveConfigHandler)
+	mux.HandleFunc("/debug/tools", toolCallsHandler)
+	mux.Handle("/debug/bundle", bundleHandler(collector))
+	mux.HandleFunc("/-/log-level", logLevelHandler)
+	mux.HandleFunc("/", adminIndexHandler)
+	return mux
+}
+
+var adminIndexTemplate = template.Must(template.New("admin").Parse(`<html>
+<head><title>ERDMA Exporter Admin</title></head>
+<body>
+<h1>ERDMA Exporter Admin</h1>
+<ul>
+<li><a href="/debug/pprof/">/debug/pprof/</a>: profiles (heap, allocs, goroutine, CPU profile, trace)</li>
+<li><a href="/debug/goroutines">/debug/goroutines</a>: stack dump of all goroutines</li>
+<li><a href="/debug/memstats">/debug/memstats</a>: Go runtime memory statistics</li>
+<li><a href="/debug/config">/debug/config</a>: effective configuration and flags</li>
+<li><a href="/debug/tools">/debug/tools</a>: raw output of the last {{.}} tool invocations</li>
+<li><a href="/debug/bundle">/debug/bundle</a>: support bundle (tar.gz); <code>?redact=true</code> hashes GUIDs, MAC and IP addresses and host names</li>
+<li><a href="/-/log-level">/-/log-level</a>: current log level; POST to change it temporarily</li>
+</ul>
+</body>
+</html>
+`))
+
+// adminIndexHandler lists the admin endpoints
+func adminIndexHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	adminIndexTemplate.Execute(w, recentToolCallsSize)
+}
+
+// goroutinesHandler dumps the stacks of all goroutines
+func goroutinesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	runtimepprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// memStatsHandler serves the Go runtime memory statistics
+func memStatsHandler(w http.ResponseWriter, r *http.Request) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	writeJSON(w, stats)
+}
+
+// effectiveConfig is served by /debug/config
+type effectiveConfig struct {
+	Config *Config           `json:"config"`
+	Flags  map[string]string `json:"flags"`
+}
+
+// effectiveConfigHandler serves the config in effect and the flag values,
+// with credentials masked
+func effectiveConfigHandler(w http.ResponseWriter, r *http.Request) {
+	effective := effectiveConfig{Config: activeConfig().Redacted(), Flags: map[string]string{}}
+	flag.VisitAll(func(f *flag.Flag) {
+		effective.Flags[f.Name] = redactFlag(f)
+	})
+	writeJSON(w, effective)
+}
+
+// redactFlag returns the value of a flag with credentials masked: header
+// values and passwords in URLs
+func redactFlag(f *flag.Flag) string {
+	if headers, ok := f.Value.(headerFlag); ok {
+		return headers.String()
+	}
+	return redactURL(f.Value.String())
+}
+
+// toolCallsHandler serves the last tool invocations, optionally only those
+// of the tool given by the "tool" query parameter
+func toolCallsHandler(w http.ResponseWriter, r *http.Request) {
+	tool := r.URL.Query().Get("tool")
+	calls := []*toolCall{}
+	for _, call := range recentToolCalls.Calls() {
+		if tool == "" || call.Tool == tool {
+			calls = append(calls, call)
+		}
+	}
+	writeJSON(w, calls)
+}
+
+// writeJSON writes v as indented JSON
+func writeJSON(w http.ResponseWriter, v any) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+// writeJSONStatus writes v as indented JSON with a status code
+func writeJSONStatus(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
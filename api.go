@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiMaxAge is how old the last collection cycle may be before an API
+// request runs a new one, so that the API does not depend on scrapes
+const apiMaxAge = 5 * time.Second
+
+// apiResponse is part of every API response
+type apiResponse struct {
+	Node          string `json:"node"`
+	DriverVersion string `json:"driver_version"`
+	Error         string `json:"error,omitempty"`
+}
+
+// apiDevice is a device as listed by the API
+type apiDevice struct {
+	Name       string     `json:"name"`
+	NodeGUID   string     `json:"node_guid"`
+	LastSample *time.Time `json:"last_sample,omitempty"`
+	LastScrape time.Time  `json:"last_scrape"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// apiDevicesResponse is the response of /api/v1/devices
+type apiDevicesResponse struct {
+	apiResponse
+	Time    time.Time   `json:"time"`
+	Devices []apiDevice `json:"devices"`
+}
+
+// apiStatsResponse is the response of /api/v1/devices/{name}/stats
+type apiStatsResponse struct {
+	apiResponse
+	Device      apiDevice         `json:"device"`
+	Time        time.Time         `json:"time"`
+	Stats       map[string]uint64 `json:"stats"`
+	ParseErrors map[string]int    `json:"parse_errors,omitempty"`
+}
+
+// apiCounterDelta is the change of a counter between two samples. A
+// counter that went backwards was reset, and its delta is its new value.
+type apiCounterDelta struct {
+	Delta uint64  `json:"delta"`
+	Rate  float64 `json:"rate"`
+	Reset bool    `json:"reset,omitempty"`
+}
+
+// apiDeltaResponse is the response of /api/v1/devices/{name}/delta
+type apiDeltaResponse struct {
+	apiResponse
+	Device  apiDevice `json:"device"`
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Seconds float64   `json:"seconds"`
+	// Truncated is set if since is older than the oldest sample kept, so
+	// that the deltas cover a shorter period than asked for
+	Truncated bool                       `json:"truncated,omitempty"`
+	Counters  map[string]apiCounterDelta `json:"counters"`
+}
+
+// apiHandler serves the JSON API under /api/v1/
+type apiHandler struct {
+	collector *ErdmaCollector
+}
+
+// newAPIHandler creates the JSON API of collector
+func newAPIHandler(collector *ErdmaCollector) *apiHandler {
+	return &apiHandler{collector: collector}
+}
+
+// newAPIDevice converts a device state for the API
+func newAPIDevice(st *deviceState) apiDevice {
+	d := apiDevice{Name: st.Device.Name, NodeGUID: st.Device.GUID, LastScrape: st.LastScrape}
+	if st.Last != nil {
+		d.LastSample = &st.Last.Time
+	}
+	if st.Err != nil {
+		d.Error = st.Err.Error()
+	}
+	return d
+}
+
+// parseSince parses the since parameter of the delta endpoint: an RFC 3339
+// time, Unix seconds, or a duration before now such as 5m
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(0, int64(secs*float64(time.Second))), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid since %q: must be an RFC 3339 time, Unix seconds or a duration such as 5m", s)
+}
+
+// counterDeltas returns the deltas and rates of the counters present in
+// both samples
+func counterDeltas(from, to *DeviceSample) map[string]apiCounterDelta {
+	seconds := to.Time.Sub(from.Time).Seconds()
+	deltas := make(map[string]apiCounterDelta, len(to.Stats.Raw))
+	for key, value := range to.Stats.Raw {
+		prev, ok := from.Stats.Raw[key]
+		if !ok {
+			continue
+		}
+		d := apiCounterDelta{Delta: value - prev}
+		if value < prev {
+			d = apiCounterDelta{Delta: value, Reset: true}
+		}
+		if seconds > 0 {
+			d.Rate = float64(d.Delta) / seconds
+		}
+		deltas[key] = d
+	}
+	return deltas
+}
+
+func (a *apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		a.writeError(w, apiResponse{}, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	state, devices := a.collector.Refresh(apiMaxAge)
+	base := apiResponse{Node: a.collector.NodeName(), DriverVersion: state.Version}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/")
+	if path == "devices" {
+		resp := apiDevicesResponse{apiResponse: base, Time: state.CycleTime, Devices: []apiDevice{}}
+		if state.CycleErr != nil {
+			resp.Error = state.CycleErr.Error()
+		}
+		for i := range devices {
+			resp.Devices = append(resp.Devices, newAPIDevice(&devices[i]))
+		}
+		writeJSON(w, resp)
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) != 3 || parts[0] != "devices" || (parts[2] != "stats" && parts[2] != "delta") {
+		a.writeError(w, base, http.StatusNotFound, "not found")
+		return
+	}
+	var st *deviceState
+	for i := range devices {
+		if devices[i].Device.Name == parts[1] {
+			st = &devices[i]
+		}
+	}
+	if st == nil {
+		a.writeError(w, base, http.StatusNotFound, fmt.Sprintf("device %q not found", parts[1]))
+		return
+	}
+	if st.Last == nil {
+		a.writeError(w, base, http.StatusServiceUnavailable, fmt.Sprintf("no statistics for device %q: %v", parts[1], st.Err))
+		return
+	}
+
+	if parts[2] == "stats" {
+		writeJSON(w, apiStatsResponse{
+			apiResponse: base,
+			Device:      newAPIDevice(st),
+			Time:        st.Last.Time,
+			Stats:       st.Last.Stats.Raw,
+			ParseErrors: st.Last.Stats.ParseErrors,
+		})
+		return
+	}
+
+	from := st.Previous
+	truncated := false
+	if since := r.URL.Query().Get("since"); since != "" {
+		t, err := parseSince(since, time.Now())
+		if err != nil {
+			a.writeError(w, base, http.StatusBadRequest, err.Error())
+			return
+		}
+		// Without the history, only the previous sample is kept
+		if from = a.collector.history.sampleAt(st.Device.Name, t); from == nil {
+			from = st.Previous
+		}
+		truncated = from != nil && from.Time.After(t)
+	}
+	if from == nil || !from.Time.Before(st.Last.Time) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(apiMaxAge.Seconds())))
+		a.writeError(w, base, http.StatusServiceUnavailable, fmt.Sprintf("no earlier sample of device %q yet", parts[1]))
+		return
+	}
+	writeJSON(w, apiDeltaResponse{
+		apiResponse: base,
+		Device:      newAPIDevice(st),
+		From:        from.Time,
+		To:          st.Last.Time,
+		Seconds:     st.Last.Time.Sub(from.Time).Seconds(),
+		Truncated:   truncated,
+		Counters:    counterDeltas(from, st.Last),
+	})
+}
+
+// writeError writes an API response with an error and status code
+func (a *apiHandler) writeError(w http.ResponseWriter, resp apiResponse, code int, msg string) {
+	resp.Error = msg
+	writeJSONStatus(w, code, resp)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		in   string
+		want time.Time
+	}{
+		{"2024-05-01T11:55:00Z", now.Add(-5 * time.Minute)},
+		{"2024-05-01T13:55:00.5+02:00", now.Add(-5*time.Minute + 500*time.Millisecond)},
+		{"1714564500", now.Add(-5 * time.Minute)},
+		{"1714564500.5", now.Add(-5*time.Minute + 500*time.Millisecond)},
+		{"5m", now.Add(-5 * time.Minute)},
+		{"0s", now},
+	} {
+		got, err := parseSince(tc.in, now)
+		if err != nil || !got.Equal(tc.want) {
+			t.Errorf("parseSince(%q) = %v, %v, want %v", tc.in, got, err, tc.want)
+		}
+	}
+	for _, in := range []string{"", "-5m", "yesterday", "2024-05-01"} {
+		if _, err := parseSince(in, now); err == nil {
+			t.Errorf("parseSince(%q) succeeded", in)
+		}
+	}
+}
+
+func TestCounterDeltas(t *testing.T) {
+	now := time.Now()
+	from := &DeviceSample{Time: now, Stats: statsFromMap(map[string]uint64{"hw_tx_bytes_cnt": 100, "hw_rx_bytes_cnt": 500, "listen_ipv6_cnt": 1})}
+	to := &DeviceSample{Time: now.Add(2 * time.Second), Stats: statsFromMap(map[string]uint64{"hw_tx_bytes_cnt": 300, "hw_rx_bytes_cnt": 40, "connect_total_cnt": 9, "listen_ipv6_cnt": 1})}
+	want := map[string]apiCounterDelta{
+		"hw_tx_bytes_cnt": {Delta: 200, Rate: 100},
+		// After a reset the delta is the new value
+		"hw_rx_bytes_cnt": {Delta: 40, Rate: 20, Reset: true},
+		"listen_ipv6_cnt": {},
+		// Counters missing from either sample are left out
+	}
+	if got := counterDeltas(from, to); !reflect.DeepEqual(got, want) {
+		t.Errorf("deltas %+v, want %+v", got, want)
+	}
+}
+
+// newAPITestCollector returns a collector of erdma_0 whose hw_tx_bytes_cnt
+// is the value of tx
+func newAPITestCollector(t *testing.T, history bool) (*ErdmaCollector, *atomic.Uint64) {
+	t.Helper()
+	captureLogs(t)
+	c, err := NewErdmaCollector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tx atomic.Uint64
+	c.run = func(name string, args ...string) ([]byte, []byte, error) {
+		switch {
+		case name == "ibv_devices":
+			return []byte("erdma_0 0216:3eff:fe50:30b0\n"), nil, nil
+		case args[0] == "ver":
+			return []byte("Query kernel driver version: 0.2.41\n"), nil, nil
+		default:
+			return []byte(fmt.Sprintf("hw_tx_bytes_cnt : %d\nhw_rx_bytes_cnt : 7\n", tx.Load())), nil, nil
+		}
+	}
+	c.nodeName = "node-1"
+	if history {
+		c.history = newSampleHistory(time.Hour, time.Millisecond, prometheus.NewRegistry())
+	}
+	return c, &tx
+}
+
+// cycleAt runs a collection cycle with hw_tx_bytes_cnt at value and
+// returns the time of its sample
+func cycleAt(t *testing.T, c *ErdmaCollector, tx *atomic.Uint64, value uint64) time.Time {
+	t.Helper()
+	// Samples in the same history bucket would be coalesced
+	time.Sleep(5 * time.Millisecond)
+	tx.Store(value)
+	_, devices := c.Refresh(0)
+	if len(devices) != 1 || devices[0].Last == nil {
+		t.Fatalf("no sample of erdma_0: %+v", devices)
+	}
+	return devices[0].Last.Time
+}
+
+// apiGet serves a request to the API and decodes the response into v
+func apiGet(t *testing.T, c *ErdmaCollector, path string, v any) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	newAPIHandler(c).ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("%s: Content-Type %q", path, w.Header().Get("Content-Type"))
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("%s: %v\n%s", path, err, w.Body)
+	}
+	return w
+}
+
+func TestAPIDevicesAndStats(t *testing.T) {
+	c, tx := newAPITestCollector(t, false)
+	tx.Store(100)
+
+	var devices apiDevicesResponse
+	if w := apiGet(t, c, "/api/v1/devices", &devices); w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	if devices.Node != "node-1" || devices.DriverVersion != "0.2.41" || len(devices.Devices) != 1 ||
+		devices.Devices[0].Name != "erdma_0" || devices.Devices[0].NodeGUID != "0216:3eff:fe50:30b0" || devices.Devices[0].LastSample == nil {
+		t.Errorf("devices %+v", devices)
+	}
+
+	var stats apiStatsResponse
+	if w := apiGet(t, c, "/api/v1/devices/erdma_0/stats", &stats); w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	if want := map[string]uint64{"hw_tx_bytes_cnt": 100, "hw_rx_bytes_cnt": 7}; !reflect.DeepEqual(stats.Stats, want) {
+		t.Errorf("stats %v, want %v", stats.Stats, want)
+	}
+
+	for path, code := range map[string]int{
+		"/api/v1/devices/erdma_9/stats":  http.StatusNotFound,
+		"/api/v1/devices/erdma_0/counts": http.StatusNotFound,
+		"/api/v1/devices/erdma_0":        http.StatusNotFound,
+		// A single sample has no delta yet
+		"/api/v1/devices/erdma_0/delta":               http.StatusServiceUnavailable,
+		"/api/v1/devices/erdma_0/delta?since=invalid": http.StatusBadRequest,
+	} {
+		var resp apiResponse
+		if w := apiGet(t, c, path, &resp); w.Code != code || resp.Error == "" {
+			t.Errorf("%s: status %d, error %q, want %d", path, w.Code, resp.Error, code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	newAPIHandler(c).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/devices", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("POST: status %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+func TestAPIDelta(t *testing.T) {
+	c, tx := newAPITestCollector(t, true)
+	first := cycleAt(t, c, tx, 100)
+	second := cycleAt(t, c, tx, 300)
+	last := cycleAt(t, c, tx, 50)
+
+	for _, tc := range []struct {
+		name      string
+		since     string
+		from      time.Time
+		want      apiCounterDelta
+		truncated bool
+	}{
+		// Without since, the delta is to the previous sample
+		{"previous", "", second, apiCounterDelta{Delta: 50, Reset: true}, false},
+		{"within the history", first.Add(time.Millisecond).Format(time.RFC3339Nano), first, apiCounterDelta{Delta: 50, Reset: true}, false},
+		{"exact sample", second.Format(time.RFC3339Nano), second, apiCounterDelta{Delta: 50, Reset: true}, false},
+		// Before the oldest sample the delta covers less than asked for
+		{"before the history", "1h", first, apiCounterDelta{Delta: 50, Reset: true}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := "/api/v1/devices/erdma_0/delta"
+			if tc.since != "" {
+				path += "?since=" + url.QueryEscape(tc.since)
+			}
+			var delta apiDeltaResponse
+			if w := apiGet(t, c, path, &delta); w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			if !delta.From.Equal(tc.from) || !delta.To.Equal(last) || delta.Truncated != tc.truncated {
+				t.Errorf("from %v to %v, truncated %v; want from %v to %v, truncated %v", delta.From, delta.To, delta.Truncated, tc.from, last, tc.truncated)
+			}
+			got := delta.Counters["hw_tx_bytes_cnt"]
+			got.Rate = 0
+			if got != tc.want {
+				t.Errorf("hw_tx_bytes_cnt %+v, want %+v", got, tc.want)
+			}
+			if rx := delta.Counters["hw_rx_bytes_cnt"]; rx.Delta != 0 || rx.Reset {
+				t.Errorf("hw_rx_bytes_cnt %+v", rx)
+			}
+		})
+	}
+
+	// The rate is over the period of the delta
+	cycleAt(t, c, tx, 250)
+	var delta apiDeltaResponse
+	apiGet(t, c, "/api/v1/devices/erdma_0/delta", &delta)
+	if tx := delta.Counters["hw_tx_bytes_cnt"]; tx.Delta != 200 || tx.Reset || tx.Rate != 200/delta.Seconds {
+		t.Errorf("hw_tx_bytes_cnt %+v over %vs", tx, delta.Seconds)
+	}
+}
+
+// TestAPIDeltaWithoutHistory checks that without the history, since falls
+// back to the previous sample and the response says it is truncated
+func TestAPIDeltaWithoutHistory(t *testing.T) {
+	c, tx := newAPITestCollector(t, false)
+	cycleAt(t, c, tx, 100)
+	previous := cycleAt(t, c, tx, 300)
+	cycleAt(t, c, tx, 400)
+
+	var delta apiDeltaResponse
+	if w := apiGet(t, c, "/api/v1/devices/erdma_0/delta?since=1h", &delta); w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if !delta.Truncated || !delta.From.Equal(previous) || delta.Counters["hw_tx_bytes_cnt"].Delta != 100 {
+		t.Errorf("delta %+v, want truncated to the previous sample", delta)
+	}
+}
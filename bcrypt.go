@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// bcryptEncoding is the base64 alphabet used by bcrypt hashes
+var bcryptEncoding = base64.NewEncoding("./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789").WithPadding(base64.NoPadding)
+
+// bcryptMagic is encrypted 64 times with the derived state to produce the hash
+var bcryptMagic = []byte("OrpheanBeholderScryDoubt")
+
+// errBcryptMismatch is returned when a password does not match a hash
+var errBcryptMismatch = errors.New("password does not match bcrypt hash")
+
+// bcryptHash is a parsed "$2y$<cost>$<salt><hash>" string
+type bcryptHash struct {
+	prefix string
+	cost   int
+	salt   []byte
+	hash   string
+}
+
+// parseBcryptHash parses a bcrypt hash with a 2a, 2b or 2y prefix
+func parseBcryptHash(s string) (*bcryptHash, error) {
+	if len(s) != 60 || s[0] != '$' || s[3] != '$' || s[6] != '$' {
+		return nil, fmt.Errorf("malformed bcrypt hash")
+	}
+	h := &bcryptHash{prefix: s[1:3], hash: s[29:]}
+	switch h.prefix {
+	case "2a", "2b", "2y":
+	default:
+		return nil, fmt.Errorf("unsupported bcrypt version %q", h.prefix)
+	}
+	cost, err := strconv.Atoi(s[4:6])
+	if err != nil || cost < 4 || cost > 31 {
+		return nil, fmt.Errorf("invalid bcrypt cost %q", s[4:6])
+	}
+	h.cost = cost
+	salt, err := bcryptEncoding.DecodeString(s[7:29])
+	if err != nil {
+		return nil, fmt.Errorf("invalid bcrypt salt: %w", err)
+	}
+	h.salt = salt
+	return h, nil
+}
+
+// bcryptCompare checks password against a bcrypt hash in constant time
+func bcryptCompare(hash string, password []byte) error {
+	h, err := parseBcryptHash(hash)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(bcryptEncoding.EncodeToString(bcryptSum(password, h.salt, h.cost))), []byte(h.hash)) != 1 {
+		return errBcryptMismatch
+	}
+	return nil
+}
+
+// bcryptSum runs the expensive key setup and returns the 23-byte digest
+func bcryptSum(password, salt []byte, cost int) []byte {
+	key := append(append([]byte{}, password...), 0)
+	if len(key) > 72 {
+		key = key[:72]
+	}
+
+	c := newBlowfishState()
+	c.expandKey(key, salt)
+	for i := uint64(0); i < 1<<uint(cost); i++ {
+		c.expandKey(key, nil)
+		c.expandKey(salt, nil)
+	}
+
+	out := append([]byte{}, bcryptMagic...)
+	for i := 0; i < 64; i++ {
+		for j := 0; j < len(out); j += 8 {
+			c.encryptBlock(out[j : j+8])
+		}
+	}
+	return out[:23]
+}
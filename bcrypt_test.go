@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// Known answers from the OpenBSD and crypt_blowfish test vectors, checked
+// against libxcrypt
+var bcryptVectors = []struct {
+	password string
+	hash     string
+}{
+	{"U*U", "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"},
+	{"U*U*", "$2a$05$CCCCCCCCCCCCCCCCCCCCC.VGOzA784oUp/Z0DY336zx7pLYAy0lwK"},
+	{"U*U*U", "$2a$05$XXXXXXXXXXXXXXXXXXXXXOAcXxm9kjPGEMsLznoKqmqw7tc8WCx4a"},
+	{"", "$2a$05$CCCCCCCCCCCCCCCCCCCCC.7uG0VCzI2bS7j6ymqJi9CdcdxiRTWNy"},
+	{"U*U", "$2b$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"},
+	{"U*U", "$2y$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"},
+	{"secret", "$2b$04$abcdefghijklmnopqrstuu2r9OfJnfCsdneAXAGHnS4UpFFP8WIrW"},
+	// Only the first 72 bytes of a password are used
+	{"0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789chars after 72 are ignored", "$2a$05$abcdefghijklmnopqrstuu5s2v8.iXieOjg/.AySBTTZIIVFJeBui"},
+	{"0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789", "$2b$05$abcdefghijklmnopqrstuu5s2v8.iXieOjg/.AySBTTZIIVFJeBui"},
+}
+
+func TestBcryptCompare(t *testing.T) {
+	for _, v := range bcryptVectors {
+		if err := bcryptCompare(v.hash, []byte(v.password)); err != nil {
+			t.Errorf("bcryptCompare(%s, %q) = %v", v.hash, v.password, err)
+		}
+		if err := bcryptCompare(v.hash, []byte("x"+v.password)); !errors.Is(err, errBcryptMismatch) {
+			t.Errorf("bcryptCompare(%s, %q) = %v, want a mismatch", v.hash, "x"+v.password, err)
+		}
+	}
+}
+
+func TestBcryptCompareWrongPassword(t *testing.T) {
+	for _, password := range []string{"U*u", "U*U ", "", "u*u"} {
+		if err := bcryptCompare("$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", []byte(password)); !errors.Is(err, errBcryptMismatch) {
+			t.Errorf("password %q: error = %v, want a mismatch", password, err)
+		}
+	}
+}
+
+func TestParseBcryptHashInvalid(t *testing.T) {
+	for _, hash := range []string{
+		"",
+		"plaintext",
+		// Unsupported version
+		"$2x$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+		"$1$05$CCCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+		// Cost out of range
+		"$2a$03$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+		"$2a$32$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+		// Truncated
+		"$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOe",
+		// Salt outside the bcrypt alphabet
+		"$2a$05$CCCCCCCCCCCCCCCCCCCC*.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+	} {
+		if _, err := parseBcryptHash(hash); err == nil {
+			t.Errorf("parseBcryptHash(%q) succeeded", hash)
+		}
+		if err := bcryptCompare(hash, []byte("U*U")); err == nil || errors.Is(err, errBcryptMismatch) {
+			t.Errorf("bcryptCompare(%q) = %v, want a parse error", hash, err)
+		}
+	}
+}
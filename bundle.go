@@ -0,0 +1,659 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// Limits on what a bundle copies from sysfs and the kernel log
+const (
+	bundleMaxFileSize   = 1 << 20
+	bundleMaxSysfsDepth = 6
+	bundleMaxKmsgLines  = 1000
+)
+
+// Limits on the stats history sampled for a bundle
+const (
+	bundleMaxSamples  = 10
+	bundleMaxInterval = 10 * time.Second
+)
+
+// bundleOptions controls what goes into a support bundle
+type bundleOptions struct {
+	Redact bool
+	// Samples eadm stat outputs are taken per device, Interval apart
+	Samples  int
+	Interval time.Duration
+	// Collector, if set, contributes the samples of the last scrapes
+	Collector *ErdmaCollector
+}
+
+// bundleManifest describes a bundle and lists what could not be collected
+type bundleManifest struct {
+	Node     string    `json:"node"`
+	Time     time.Time `json:"time"`
+	Redacted bool      `json:"redacted"`
+	Errors   []string  `json:"errors,omitempty"`
+}
+
+// bundleVersions are the software versions recorded in a bundle
+type bundleVersions struct {
+	Driver    string `json:"driver"`
+	Module    string `json:"module"`
+	Kernel    string `json:"kernel"`
+	OS        string `json:"os"`
+	GoVersion string `json:"go"`
+}
+
+// bundleSample is an eadm stat output in the stats history of a bundle
+type bundleSample struct {
+	Time     time.Time         `json:"time"`
+	Device   string            `json:"device"`
+	Source   string            `json:"source"`
+	Counters map[string]uint64 `json:"counters,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// bundleWriter writes the files of a bundle into a tar archive below a
+// directory, redacting their content if requested
+type bundleWriter struct {
+	tw       *tar.Writer
+	dir      string
+	time     time.Time
+	redactor *redactor
+	manifest bundleManifest
+}
+
+// fail records something that could not be collected
+func (b *bundleWriter) fail(what string, err error) {
+	b.manifest.Errors = append(b.manifest.Errors, b.redact(fmt.Sprintf("%s: %v", what, err)))
+}
+
+// redact redacts s if redaction is enabled
+func (b *bundleWriter) redact(s string) string {
+	if b.redactor == nil {
+		return s
+	}
+	return b.redactor.Redact(s)
+}
+
+// addFile adds a file. Text is redacted, binary content is kept as is.
+func (b *bundleWriter) addFile(name string, data []byte) error {
+	if b.redactor != nil && utf8.Valid(data) {
+		data = []byte(b.redactor.Redact(string(data)))
+	}
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     b.dir + "/" + name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  b.time.Truncate(time.Second),
+	}
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := b.tw.Write(data)
+	return err
+}
+
+// addJSON adds v as an indented JSON file
+func (b *bundleWriter) addJSON(name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return b.addFile(name, append(data, '\n'))
+}
+
+// addSymlink adds a symbolic link
+func (b *bundleWriter) addSymlink(name, target string) error {
+	return b.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     b.dir + "/" + name,
+		Linkname: target,
+		Mode:     0777,
+		ModTime:  b.time.Truncate(time.Second),
+	})
+}
+
+// addTree copies the readable files below a sysfs directory. Symlinks are
+// kept as links rather than followed, since sysfs links form cycles.
+func (b *bundleWriter) addTree(name, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable directories are common in sysfs; skip them
+			if d != nil && d.IsDir() && path != root {
+				return fs.SkipDir
+			}
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		if d.IsDir() {
+			if strings.Count(rel, string(filepath.Separator)) >= bundleMaxSysfsDepth {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		dest := filepath.ToSlash(filepath.Join(name, rel))
+		if d.Type()&fs.ModeSymlink != 0 {
+			if target, err := os.Readlink(path); err == nil {
+				return b.addSymlink(dest, target)
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || skipSysfsFile(d.Name()) {
+			return nil
+		}
+		data, err := readLimited(path, bundleMaxFileSize)
+		if err != nil {
+			// Write-only attributes and ones the driver refuses to read
+			return nil
+		}
+		return b.addFile(dest, data)
+	})
+}
+
+// skipSysfsFile reports whether a sysfs file must not be read, because
+// reading it maps device memory or has side effects
+func skipSysfsFile(name string) bool {
+	return strings.HasPrefix(name, "resource") || name == "rom" || name == "remove" ||
+		name == "rescan" || name == "reset" || name == "uevent" || name == "new_id" || name == "remove_id"
+}
+
+// readLimited reads at most limit bytes of a file
+func readLimited(path string, limit int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, limit))
+}
+
+// writeBundle writes a support bundle as a tar.gz to w
+func writeBundle(w io.Writer, opts bundleOptions) error {
+	gz := gzip.NewWriter(w)
+	b := &bundleWriter{tw: tar.NewWriter(gz), time: time.Now()}
+	if opts.Redact {
+		b.redactor = newRedactor()
+	}
+	b.manifest = bundleManifest{Node: b.redact(getNodeName()), Time: b.time, Redacted: opts.Redact}
+	b.dir = bundleName(bundleNode(opts.Redact), b.time)
+
+	// The doctor discovers the devices and runs every tool once, so that
+	// their raw output is in the recent tool calls below
+	report := runDoctor()
+	if b.redactor != nil {
+		for _, device := range report.Devices {
+			b.redactor.AddGUID(device.GUID)
+		}
+	}
+	steps := []struct {
+		what string
+		fn   func() error
+	}{
+		{"doctor", func() error { return b.addJSON("doctor.json", report) }},
+		{"versions", func() error { return b.addJSON("versions.json", readVersions()) }},
+		{"config", func() error { return b.addJSON("config.json", activeConfig().Redacted()) }},
+		{"stats history", func() error { return b.addJSON("stats/history.json", sampleStats(report.Devices, opts)) }},
+		{"tool outputs", func() error { return addToolCalls(b) }},
+		{"sysfs", func() error { return addSysfs(b) }},
+		{"module", func() error { return addModule(b) }},
+		{"kernel log", func() error { return addKernelLog(b) }},
+	}
+	for _, step := range steps {
+		if err := step.fn(); err != nil {
+			b.fail(step.what, err)
+		}
+	}
+
+	if err := b.addJSON("manifest.json", b.manifest); err != nil {
+		return err
+	}
+	if err := b.tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// bundleNode is the node name used in the name of a bundle
+func bundleNode(redact bool) string {
+	if redact {
+		return "redacted"
+	}
+	return getNodeName()
+}
+
+// bundleName is the name of a bundle and its top-level directory
+func bundleName(node string, t time.Time) string {
+	return fmt.Sprintf("erdma-bundle-%s-%s", node, t.UTC().Format("20060102T150405Z"))
+}
+
+// readVersions reads the driver, kernel and OS versions
+func readVersions() bundleVersions {
+	versions := bundleVersions{
+		Driver:    currentDriverVersion(),
+		Module:    readSysfs(filepath.Join("/sys/module", erdmaModule, "version")),
+		Kernel:    readSysfs("/proc/sys/kernel/osrelease"),
+		GoVersion: runtime.Version(),
+	}
+	if data, err := os.ReadFile("/etc/os-release"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if value, ok := strings.CutPrefix(line, "PRETTY_NAME="); ok {
+				versions.OS = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return versions
+}
+
+// sampleStats returns the samples of the last scrapes, if any, followed by
+// opts.Samples fresh eadm stat outputs per device taken opts.Interval apart
+func sampleStats(devices []Device, opts bundleOptions) []bundleSample {
+	var samples []bundleSample
+	if opts.Collector != nil {
+		_, states := opts.Collector.Snapshot()
+		for _, st := range states {
+			for _, sample := range []*DeviceSample{st.Previous, st.Last} {
+				if sample != nil {
+					samples = append(samples, bundleSample{Time: sample.Time, Device: st.Device.Name, Source: "scrape", Counters: sample.Stats.Raw})
+				}
+			}
+		}
+	}
+	for i := 0; i < opts.Samples; i++ {
+		if i > 0 {
+			time.Sleep(opts.Interval)
+		}
+		for _, device := range devices {
+			sample := bundleSample{Time: time.Now(), Device: device.Name, Source: "bundle"}
+			if stats, err := getDeviceStats(device.Name); err != nil {
+				sample.Error = err.Error()
+			} else {
+				sample.Counters = stats.Raw
+			}
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
+
+// addToolCalls adds the raw output of the recent tool invocations
+func addToolCalls(b *bundleWriter) error {
+	for i, call := range recentToolCalls.Calls() {
+		name := strings.ReplaceAll(call.key(), " ", "-")
+		var data strings.Builder
+		fmt.Fprintf(&data, "# %s\n# time: %s\n# exit code: %d\n# duration: %.3fs\n",
+			call.key(), call.Time.Format(time.RFC3339Nano), call.ExitCode, call.Duration)
+		if call.Error != "" {
+			fmt.Fprintf(&data, "# error: %s\n", call.Error)
+		}
+		fmt.Fprintf(&data, "\n## stdout\n%s\n## stderr\n%s", call.Stdout, call.Stderr)
+		if err := b.addFile(fmt.Sprintf("tools/%03d-%s.txt", i, name), []byte(data.String())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addSysfs adds the sysfs directories of the RDMA devices and of their
+// PCI devices
+func addSysfs(b *bundleWriter) error {
+	entries, err := os.ReadDir(sysClassInfiniband)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		link := filepath.Join(sysClassInfiniband, entry.Name())
+		target, err := os.Readlink(link)
+		if err != nil {
+			b.fail("sysfs "+link, err)
+			continue
+		}
+		if err := b.addSymlink("sysfs"+link, target); err != nil {
+			return err
+		}
+		dir, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			b.fail("sysfs "+link, err)
+			continue
+		}
+		if err := b.addTree("sysfs"+dir, dir); err != nil {
+			b.fail("sysfs "+dir, err)
+		}
+
+		// The PCI device's own attributes, without descending into the
+		// other devices it hosts
+		pci, err := filepath.EvalSymlinks(filepath.Join(dir, "device"))
+		if err != nil {
+			continue
+		}
+		files, err := os.ReadDir(pci)
+		if err != nil {
+			b.fail("sysfs "+pci, err)
+			continue
+		}
+		for _, file := range files {
+			path := filepath.Join(pci, file.Name())
+			switch {
+			case file.Type()&fs.ModeSymlink != 0:
+				if target, err := os.Readlink(path); err == nil {
+					b.addSymlink("sysfs"+path, target)
+				}
+			case file.Type().IsRegular() && !skipSysfsFile(file.Name()):
+				if data, err := readLimited(path, bundleMaxFileSize); err == nil {
+					b.addFile("sysfs"+path, data)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// addModule adds the version and parameters of the erdma module
+func addModule(b *bundleWriter) error {
+	dir := filepath.Join("/sys/module", erdmaModule)
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	for _, name := range []string{"version", "srcversion", "initstate", "refcnt"} {
+		if data, err := readLimited(filepath.Join(dir, name), bundleMaxFileSize); err == nil {
+			if err := b.addFile("module/"+name, data); err != nil {
+				return err
+			}
+		}
+	}
+	params := filepath.Join(dir, "parameters")
+	if _, err := os.Stat(params); err != nil {
+		return nil
+	}
+	return b.addTree("module/parameters", params)
+}
+
+// addKernelLog adds the kernel messages mentioning erdma
+func addKernelLog(b *bundleWriter) error {
+	lines, err := readKernelLog(func(msg string) bool {
+		return strings.Contains(strings.ToLower(msg), erdmaModule)
+	})
+	if err != nil {
+		return err
+	}
+	return b.addFile("kernel/dmesg-erdma.txt", []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+// readKernelLog returns the last kernel messages that match, formatted
+// like dmesg. It reads /dev/kmsg without blocking, so it returns once the
+// messages currently in the ring buffer are read.
+func readKernelLog(match func(string) bool) ([]string, error) {
+	fd, err := syscall.Open("/dev/kmsg", syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open /dev/kmsg: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	var lines []string
+	buf := make([]byte, 8192)
+	for {
+		n, err := syscall.Read(fd, buf)
+		if errors.Is(err, syscall.EPIPE) {
+			// The message was overwritten while reading; skip it
+			continue
+		}
+		if errors.Is(err, syscall.EAGAIN) || n <= 0 {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read /dev/kmsg: %w", err)
+		}
+
+		// priority,sequence,timestamp_us,flags;message
+		header, msg, ok := strings.Cut(string(buf[:n]), ";")
+		if !ok {
+			continue
+		}
+		msg, _, _ = strings.Cut(msg, "\n")
+		if !match(msg) {
+			continue
+		}
+		fields := strings.Split(header, ",")
+		var usec int64
+		if len(fields) > 2 {
+			usec, _ = strconv.ParseInt(fields[2], 10, 64)
+		}
+		lines = append(lines, fmt.Sprintf("[%5d.%06d] %s", usec/1e6, usec%1e6, msg))
+		if len(lines) > bundleMaxKmsgLines {
+			lines = lines[1:]
+		}
+	}
+	return lines, nil
+}
+
+// redactor replaces identifying values with a keyed hash, so that equal
+// values still match within a bundle without revealing them. The key is
+// random per bundle.
+type redactor struct {
+	key   []byte
+	names []*regexp.Regexp
+	// guids are the GUIDs of the devices, in lower case without colons,
+	// which ibv_devices prints as bare hex numbers
+	guids map[string]bool
+}
+
+// Patterns of identifying values. IPv6 addresses go first since GIDs and
+// GUIDs also match the shorter patterns.
+var (
+	redactIPv6Candidate = regexp.MustCompile(`(?i)[0-9a-f]{0,4}(?::[0-9a-f]{0,4}){2,7}(?:%[0-9a-z]+)?`)
+	redactMAC           = regexp.MustCompile(`(?i)\b[0-9a-f]{2}(?::[0-9a-f]{2}){5}\b`)
+	redactGUID          = regexp.MustCompile(`(?i)\b[0-9a-f]{4}(?::[0-9a-f]{4}){3}\b`)
+	redactIPv4          = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	redactBareGUID      = regexp.MustCompile(`(?i)\b[0-9a-f]{16}\b`)
+)
+
+// newRedactor creates a redactor that also replaces the host and node names
+func newRedactor() *redactor {
+	names := []string{getNodeName(), os.Getenv("NODE_NAME")}
+	if hostname, err := os.Hostname(); err == nil {
+		names = append(names, hostname)
+	}
+	return newRedactorFor(names)
+}
+
+// newRedactorFor creates a redactor that also replaces the given host
+// names, and the short form of the fully qualified ones
+func newRedactorFor(hostnames []string) *redactor {
+	r := &redactor{key: make([]byte, 32), guids: map[string]bool{}}
+	rand.Read(r.key)
+	var names []string
+	for _, name := range hostnames {
+		names = append(names, name)
+		if short, _, ok := strings.Cut(name, "."); ok && net.ParseIP(name) == nil {
+			names = append(names, short)
+		}
+	}
+	// Longer names first, so that the short host name does not break up
+	// the fully qualified one
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+	seen := map[string]bool{}
+	for _, name := range names {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			r.names = append(r.names, regexp.MustCompile(`\b`+regexp.QuoteMeta(name)+`\b`))
+		}
+	}
+	return r
+}
+
+// AddGUID makes the redactor replace a GUID of a device also where it is
+// printed as a bare hex number. Other 16-digit hex numbers, such as kernel
+// addresses, are kept.
+func (r *redactor) AddGUID(guid string) {
+	r.guids[strings.ToLower(strings.ReplaceAll(guid, ":", ""))] = true
+}
+
+// hash returns the replacement of a value of the given kind
+func (r *redactor) hash(kind, value string) string {
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(value))
+	return kind + "-" + hex.EncodeToString(mac.Sum(nil)[:4])
+}
+
+// Redact replaces the identifying values in s
+func (r *redactor) Redact(s string) string {
+	s = redactIPv6Candidate.ReplaceAllStringFunc(s, func(m string) string {
+		addr, _, _ := strings.Cut(m, "%")
+		if ip := net.ParseIP(addr); ip != nil && strings.Trim(addr, ":") != "" {
+			return r.hash("ip", ip.String())
+		}
+		return m
+	})
+	s = redactMAC.ReplaceAllStringFunc(s, func(m string) string {
+		return r.hash("mac", strings.ToLower(m))
+	})
+	s = redactGUID.ReplaceAllStringFunc(s, func(m string) string {
+		return r.hash("guid", strings.ToLower(strings.ReplaceAll(m, ":", "")))
+	})
+	s = redactIPv4.ReplaceAllStringFunc(s, func(m string) string {
+		if net.ParseIP(m) == nil {
+			return m
+		}
+		return r.hash("ip", m)
+	})
+	s = redactBareGUID.ReplaceAllStringFunc(s, func(m string) string {
+		if guid := strings.ToLower(m); r.guids[guid] {
+			return r.hash("guid", guid)
+		}
+		return m
+	})
+	for _, name := range r.names {
+		s = name.ReplaceAllStringFunc(s, func(m string) string {
+			return r.hash("host", m)
+		})
+	}
+	return s
+}
+
+// bundleMu allows one bundle at a time, since each runs every tool
+var bundleMu sync.Mutex
+
+// bundleHandler serves a support bundle. The query parameters redact,
+// samples and interval correspond to the flags of "erdma-exporter bundle".
+func bundleHandler(collector *ErdmaCollector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		opts := bundleOptions{Samples: 2, Interval: 5 * time.Second, Collector: collector}
+		var err error
+		if v := query.Get("redact"); v != "" {
+			if opts.Redact, err = strconv.ParseBool(v); err != nil {
+				http.Error(w, "invalid redact: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if v := query.Get("samples"); v != "" {
+			if opts.Samples, err = strconv.Atoi(v); err != nil || opts.Samples < 0 || opts.Samples > bundleMaxSamples {
+				http.Error(w, fmt.Sprintf("invalid samples %q: must be 0 to %d", v, bundleMaxSamples), http.StatusBadRequest)
+				return
+			}
+		}
+		if v := query.Get("interval"); v != "" {
+			if opts.Interval, err = time.ParseDuration(v); err != nil || opts.Interval < 0 || opts.Interval > bundleMaxInterval {
+				http.Error(w, fmt.Sprintf("invalid interval %q: must be 0 to %s", v, bundleMaxInterval), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if !bundleMu.TryLock() {
+			http.Error(w, "a bundle is already being generated", http.StatusTooManyRequests)
+			return
+		}
+		defer bundleMu.Unlock()
+
+		// Buffer the bundle so that a failure can still be reported
+		var buf bytes.Buffer
+		if err := writeBundle(&buf, opts); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		name := bundleName(bundleNode(opts.Redact), time.Now())
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.tar.gz"`)
+		w.Write(buf.Bytes())
+	})
+}
+
+// runBundleCommand implements "erdma-exporter bundle", which writes a
+// support bundle for a ticket with Alibaba Cloud
+func runBundleCommand(args []string) int {
+	fs := flag.NewFlagSet("bundle", flag.ContinueOnError)
+	output := fs.String("output", "", "File to write the bundle to, or - for stdout (default: erdma-bundle-<node>-<time>.tar.gz).")
+	redact := fs.Bool("redact", false, "Replace GUIDs, MAC addresses, IP addresses and host names with hashes.")
+	samples := fs.Int("samples", 3, "Number of eadm stat outputs to take per device for the stats history.")
+	interval := fs.Duration("interval", 5*time.Second, "Interval between the eadm stat outputs of the stats history.")
+	configFile := fs.String("config.file", "", "YAML config file with tool paths and device filters.")
+	toolTimeout := fs.Duration("tool.timeout", 30*time.Second, "Timeout of a single eadm or ibv_devices invocation.")
+	verbose := fs.Bool("verbose", false, "Log tool invocations and errors to stderr.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *samples < 0 {
+		fmt.Fprintln(os.Stderr, "--samples must not be negative")
+		return 2
+	}
+	if err := setupCommand(*configFile, *toolTimeout, *verbose); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	path := *output
+	if path == "" {
+		path = bundleName(bundleNode(*redact), time.Now()) + ".tar.gz"
+	}
+	w := io.Writer(os.Stdout)
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := writeBundle(w, bundleOptions{Redact: *redact, Samples: *samples, Interval: *interval}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if f, ok := w.(*os.File); ok && path != "-" {
+		if err := f.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	if path != "-" {
+		fmt.Fprintln(os.Stderr, "Wrote", path)
+	}
+	return 0
+}
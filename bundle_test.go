@@ -0,0 +1,183 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// redactPlaceholder is <kind:value> in the expected output of the redactor,
+// for the hash of value
+var redactPlaceholder = regexp.MustCompile(`<(\w+):([^>]+)>`)
+
+func TestRedact(t *testing.T) {
+	r := newRedactorFor([]string{"erdma-node-1.cluster.local", "10.0.0.5"})
+	r.AddGUID("02163EFFFE5030B3")
+
+	for _, tc := range []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"MAC", "link/ether 02:16:3E:50:30:B3 brd ff:ff:ff:ff:ff:ff",
+			"link/ether <mac:02:16:3e:50:30:b3> brd <mac:ff:ff:ff:ff:ff:ff>"},
+		{"sysfs GUID", "node_guid: 0216:3eff:fe50:30b3",
+			"node_guid: <guid:02163efffe5030b3>"},
+		{"ibv_devices GUID", "    erdma_0         \t02163efffe5030b3",
+			"    erdma_0         \t<guid:02163efffe5030b3>"},
+		{"ibv_devices GUID in upper case", "erdma_0 02163EFFFE5030B3",
+			"erdma_0 <guid:02163efffe5030b3>"},
+		{"unknown 16-digit hex", "RIP: 0010:ffff888100a3c000 02163efffe5030b4",
+			"RIP: 0010:ffff888100a3c000 02163efffe5030b4"},
+		{"IPv4", "inet 192.168.1.10/24 brd 192.168.1.255",
+			"inet <ip:192.168.1.10>/24 brd <ip:192.168.1.255>"},
+		{"not IPv4", "driver 0.2.41, build 1.2.3.456",
+			"driver 0.2.41, build 1.2.3.456"},
+		// A GID of an IPv4 address hashes like the address
+		{"IPv6", "inet6 2001:db8::1/64, gid 0000:0000:0000:0000:0000:ffff:c0a8:010a",
+			"inet6 <ip:2001:db8::1>/64, gid <ip:192.168.1.10>"},
+		{"IPv6 link-local with zone", "peer fe80::216:3eff:fe50:30b3%eth0 via ::1",
+			"peer <ip:fe80::216:3eff:fe50:30b3> via <ip:::1>"},
+		{"FQDN", "node erdma-node-1.cluster.local ready",
+			"node <host:erdma-node-1.cluster.local> ready"},
+		{"short host name", "erdma-node-1 login: erdma-node-10",
+			"<host:erdma-node-1> login: erdma-node-10"},
+		{"IP as host name", "hostname 10.0.0.5",
+			"hostname <ip:10.0.0.5>"},
+		{"dmesg timestamps", "[Oct18 12:34:56] erdma: link up at 12:34:56.789 after 00:00:01",
+			"[Oct18 12:34:56] erdma: link up at 12:34:56.789 after 00:00:01"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			want := redactPlaceholder.ReplaceAllStringFunc(tc.want, func(m string) string {
+				parts := redactPlaceholder.FindStringSubmatch(m)
+				return r.hash(parts[1], parts[2])
+			})
+			if got := r.Redact(tc.in); got != want {
+				t.Errorf("Redact(%q)\n = %q\nwant %q", tc.in, got, want)
+			}
+		})
+	}
+
+	// Bundles cannot be linked by their hashes
+	if other := newRedactorFor(nil); other.Redact("192.168.1.10") == r.Redact("192.168.1.10") {
+		t.Error("same hash with a different key")
+	}
+}
+
+// bundleSecrets are identifying values the fake tools print
+var bundleSecrets = []string{
+	"192.168.1.10", "fe80::216:3eff:fe50:30b3", "2001:db8::1", "02:16:3e:50:30:b3",
+	"0216:3eff:fe50:30b3", "02163efffe5030b3", "erdma-node-1",
+}
+
+// TestBundleHandlerRedacts checks that no identifying value the tools
+// print ends up in a bundle fetched with redact=1
+func TestBundleHandlerRedacts(t *testing.T) {
+	dir := t.TempDir()
+	for name, script := range map[string]string{
+		"eadm": `#!/bin/sh
+case "$1" in
+ver) echo "Query kernel driver version: 0.2.41" ;;
+stat)
+	echo "hw_tx_bytes_cnt : 5"
+	echo "link up at 12:34:56, peer 192.168.1.10 fe80::216:3eff:fe50:30b3%eth0 2001:db8::1" >&2
+	echo "mac 02:16:3E:50:30:B3 guid 0216:3eff:fe50:30b3 on erdma-node-1.cluster.local (erdma-node-1)" >&2
+	;;
+esac
+`,
+		"ibv_devices": `#!/bin/sh
+printf '    device          \t   node GUID\n'
+printf '    ------          \t----------------\n'
+printf '    erdma_0         \t02163efffe5030b3\n'
+`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	config := defaultConfig()
+	config.NodeName = "erdma-node-1.cluster.local"
+	useConfig(t, config)
+	captureLogs(t)
+
+	collector, err := NewErdmaCollector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := adminHandler(collector)
+	fetch := func(redact string) (http.Header, map[string]string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/bundle?samples=1&interval=0s&redact="+redact, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		gz, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := map[string]string{}
+		tr := tar.NewReader(gz)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := io.ReadAll(tr)
+			files[hdr.Name] = hdr.Linkname + string(data)
+		}
+		return w.Header(), files
+	}
+
+	// Without redaction the values are there, so the check below means
+	// something
+	_, plain := fetch("0")
+	var all strings.Builder
+	for name, content := range plain {
+		all.WriteString(name + "\n" + content + "\n")
+	}
+	for _, secret := range bundleSecrets {
+		if !strings.Contains(strings.ToLower(all.String()), secret) {
+			t.Errorf("unredacted bundle does not contain %s", secret)
+		}
+	}
+
+	header, files := fetch("1")
+	if !strings.Contains(header.Get("Content-Disposition"), "erdma-bundle-redacted-") {
+		t.Errorf("Content-Disposition %q", header.Get("Content-Disposition"))
+	}
+	var manifest bundleManifest
+	var timestamps bool
+	for name, content := range files {
+		lower := strings.ToLower(name + "\n" + content)
+		for _, secret := range bundleSecrets {
+			if strings.Contains(lower, secret) {
+				t.Errorf("%s contains %s", name, secret)
+			}
+		}
+		timestamps = timestamps || strings.Contains(content, "link up at 12:34:56,")
+		if strings.HasSuffix(name, "/manifest.json") {
+			if err := json.Unmarshal([]byte(content), &manifest); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !manifest.Redacted || !strings.HasPrefix(manifest.Node, "host-") {
+		t.Errorf("manifest %+v", manifest)
+	}
+	if !timestamps {
+		t.Error("tool output with the timestamp missing from the bundle")
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cmsAPIVersion is the version of the CloudMonitor API with PutCustomMetric
+const cmsAPIVersion = "2019-01-01"
+
+// cmsMaxBatch is the number of metrics sent per PutCustomMetric request
+const cmsMaxBatch = 100
+
+// cmsCredentialsRefresh is how long before they expire RAM role
+// credentials are renewed
+const cmsCredentialsRefresh = 10 * time.Minute
+
+// cmsStatPrefixes are the groups of statistics sent to CloudMonitor
+var cmsStatPrefixes = []string{"hw_", "connect_", "verbs_"}
+
+// cmsEndpoint returns the CloudMonitor endpoint of a region
+func cmsEndpoint(region string) string {
+	return "https://metrics." + region + ".aliyuncs.com/"
+}
+
+// cmsEscape percent-encodes s as required by the RPC signature
+func cmsEscape(s string) string {
+	s = url.QueryEscape(s)
+	s = strings.ReplaceAll(s, "+", "%20")
+	s = strings.ReplaceAll(s, "*", "%2A")
+	return strings.ReplaceAll(s, "%7E", "~")
+}
+
+// cmsSign adds the common parameters of an RPC API request and its
+// signature, version 1.0 (HMAC-SHA1), to params
+func cmsSign(method string, params url.Values, creds ecsCredentials, now time.Time) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	params.Set("Format", "JSON")
+	params.Set("Version", cmsAPIVersion)
+	params.Set("AccessKeyId", creds.AccessKeyID)
+	params.Set("SignatureMethod", "HMAC-SHA1")
+	params.Set("SignatureVersion", "1.0")
+	params.Set("SignatureNonce", hex.EncodeToString(nonce))
+	params.Set("Timestamp", now.UTC().Format("2006-01-02T15:04:05Z"))
+	if creds.SecurityToken != "" {
+		params.Set("SecurityToken", creds.SecurityToken)
+	}
+	params.Set("Signature", cmsSignature(method, params, creds.AccessKeySecret))
+}
+
+// cmsSignature returns the signature of the parameters of a request
+func cmsSignature(method string, params url.Values, secret string) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		if key != "Signature" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, cmsEscape(key)+"="+cmsEscape(params.Get(key)))
+	}
+	stringToSign := method + "&" + cmsEscape("/") + "&" + cmsEscape(strings.Join(pairs, "&"))
+
+	mac := hmac.New(sha1.New, []byte(secret+"&"))
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// cmsSink sends the hw, connect and verbs statistics of each device to
+// CloudMonitor as custom metrics, so that CloudMonitor alarms can be used
+// instead of Prometheus. Each counter is sent as is and, from the second
+// collection on, as its per-second rate with a _rate suffix.
+type cmsSink struct {
+	endpoint   string
+	groupID    string
+	instanceID string
+	client     *http.Client
+
+	// Static AccessKey credentials, or the RAM role to get them for
+	static  bool
+	ramRole string
+
+	mu    sync.Mutex
+	creds ecsCredentials
+}
+
+// newCMSSink creates a CloudMonitor sink. It uses the AccessKey of the
+// config or the ALIBABA_CLOUD_ACCESS_KEY_ID and ALIBABA_CLOUD_ACCESS_KEY_SECRET
+// environment variables, and otherwise the RAM role of the ECS instance.
+func newCMSSink(c *SinkConfig) (*cmsSink, error) {
+	s := &cmsSink{
+		endpoint:   c.Address,
+		groupID:    c.GroupID,
+		instanceID: c.InstanceID,
+		client:     &http.Client{Timeout: time.Duration(c.Timeout)},
+		ramRole:    c.RAMRole,
+	}
+	if s.instanceID == "" || s.endpoint == "" {
+		instance, err := getECSInstance()
+		if s.instanceID == "" {
+			s.instanceID = instance.InstanceID
+		}
+		if s.instanceID == "" {
+			slog.Warn("Sending CloudMonitor metrics without instanceId dimension", "err", err)
+		}
+		if s.endpoint == "" {
+			region := c.Region
+			if region == "" {
+				region = instance.RegionID
+			}
+			if region == "" {
+				return nil, fmt.Errorf("region or address is required off ECS: %w", err)
+			}
+			s.endpoint = cmsEndpoint(region)
+		}
+	}
+
+	id, secret := c.AccessKeyID, ""
+	if c.AccessKeySecretFile != "" {
+		data, err := os.ReadFile(c.AccessKeySecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("read access key secret: %w", err)
+		}
+		secret = strings.TrimSpace(string(data))
+	}
+	if id == "" {
+		id, secret = os.Getenv("ALIBABA_CLOUD_ACCESS_KEY_ID"), os.Getenv("ALIBABA_CLOUD_ACCESS_KEY_SECRET")
+	}
+	if id != "" {
+		if secret == "" {
+			return nil, fmt.Errorf("access key %s has no secret", id)
+		}
+		s.static = true
+		s.creds = ecsCredentials{AccessKeyID: id, AccessKeySecret: secret}
+	}
+	return s, nil
+}
+
+// credentials returns the credentials to sign with, renewing RAM role
+// credentials before they expire
+func (s *cmsSink) credentials(ctx context.Context) (ecsCredentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.static || time.Until(s.creds.Expiration) > cmsCredentialsRefresh {
+		return s.creds, nil
+	}
+	creds, err := getECSRoleCredentials(ctx, s.ramRole)
+	if err != nil {
+		if s.creds.AccessKeyID != "" && time.Now().Before(s.creds.Expiration) {
+			slog.Warn("Renewing RAM role credentials failed, using the current ones", "err", err)
+			return s.creds, nil
+		}
+		return creds, fmt.Errorf("no AccessKey configured and %w", err)
+	}
+	s.creds = creds
+	return creds, nil
+}
+
+// cmsMetric is an entry of the MetricList of PutCustomMetric
+type cmsMetric struct {
+	Name       string
+	Dimensions string
+	Time       time.Time
+	Value      float64
+}
+
+// metrics converts points to custom metrics with the instanceId dimension
+// and the mapped device and node dimensions
+func (s *cmsSink) metrics(points []sinkPoint) []cmsMetric {
+	var metrics []cmsMetric
+	for _, p := range points {
+		selected := false
+		for _, prefix := range cmsStatPrefixes {
+			selected = selected || strings.HasPrefix(p.Stat, prefix)
+		}
+		if !selected {
+			continue
+		}
+		dimensions := map[string]string{}
+		if s.instanceID != "" {
+			dimensions["instanceId"] = s.instanceID
+		}
+		for _, tag := range p.Tags {
+			dimensions[tag.Name] = tag.Value
+		}
+		data, _ := json.Marshal(dimensions)
+		metrics = append(metrics, cmsMetric{p.Name, string(data), p.Time, float64(p.Value)})
+		if p.HasRate {
+			metrics = append(metrics, cmsMetric{p.Name + "_rate", string(data), p.Time, p.Rate})
+		}
+	}
+	return metrics
+}
+
+// put sends a batch of metrics with PutCustomMetric
+func (s *cmsSink) put(ctx context.Context, metrics []cmsMetric) error {
+	creds, err := s.credentials(ctx)
+	if err != nil {
+		return err
+	}
+	params := url.Values{"Action": {"PutCustomMetric"}}
+	for i, m := range metrics {
+		prefix := "MetricList." + strconv.Itoa(i+1) + "."
+		params.Set(prefix+"MetricName", m.Name)
+		params.Set(prefix+"GroupId", s.groupID)
+		params.Set(prefix+"Dimensions", m.Dimensions)
+		params.Set(prefix+"Time", strconv.FormatInt(m.Time.UnixMilli(), 10))
+		params.Set(prefix+"Type", "0")
+		params.Set(prefix+"Values", `{"value":`+strconv.FormatFloat(m.Value, 'g', -1, 64)+`}`)
+	}
+	cmsSign(http.MethodPost, params, creds, time.Now())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", "erdma-exporter")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var result struct {
+		Code      string
+		Message   string
+		RequestID string `json:"RequestId"`
+	}
+	json.Unmarshal(body, &result)
+	if resp.StatusCode != http.StatusOK || result.Code != "200" {
+		if result.Code == "" {
+			return fmt.Errorf("server returned %s: %q", resp.Status, body)
+		}
+		return fmt.Errorf("PutCustomMetric failed: %s: %s (request %s)", result.Code, result.Message, result.RequestID)
+	}
+	return nil
+}
+
+func (s *cmsSink) Send(ctx context.Context, points []sinkPoint) error {
+	metrics := s.metrics(points)
+	for len(metrics) > 0 {
+		batch := metrics[:min(len(metrics), cmsMaxBatch)]
+		metrics = metrics[len(batch):]
+		if err := s.put(ctx, batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
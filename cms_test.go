@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestCMSSignatureExample checks the signature of the example request in
+// the Alibaba Cloud documentation of RPC signatures
+func TestCMSSignatureExample(t *testing.T) {
+	params := url.Values{
+		"AccessKeyId":      {"testid"},
+		"Action":           {"DescribeRegions"},
+		"Format":           {"XML"},
+		"SignatureMethod":  {"HMAC-SHA1"},
+		"SignatureNonce":   {"3ee8c1b8-83d3-44af-a94f-4e0ad82fd6cf"},
+		"SignatureVersion": {"1.0"},
+		"Timestamp":        {"2016-02-23T12:46:24Z"},
+		"Version":          {"2014-05-26"},
+	}
+	if got, want := cmsSignature(http.MethodGet, params, "testsecret"), "OLeaidS1JvxuMvnyHOwuJ+uX5qY="; got != want {
+		t.Errorf("signature = %s, want %s", got, want)
+	}
+}
+
+func TestCMSEscape(t *testing.T) {
+	for in, want := range map[string]string{
+		"abc-_.~XYZ019":          "abc-_.~XYZ019",
+		"a b":                    "a%20b",
+		"a*b":                    "a%2Ab",
+		"a+b":                    "a%2Bb",
+		"/":                      "%2F",
+		`{"instanceId":"i-bp1"}`: "%7B%22instanceId%22%3A%22i-bp1%22%7D",
+		"2016-02-23T12:46:24Z":   "2016-02-23T12%3A46%3A24Z",
+		"节点":                     "%E8%8A%82%E7%82%B9",
+	} {
+		if got := cmsEscape(in); got != want {
+			t.Errorf("cmsEscape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// fakeCMS is a stand-in for the CloudMonitor endpoint that checks the
+// signature of every request with secret and answers with respond
+type fakeCMS struct {
+	*httptest.Server
+	secret string
+
+	mu       sync.Mutex
+	requests []url.Values
+	errors   []string
+}
+
+func newFakeCMS(t *testing.T, secret string, respond func(n int, w http.ResponseWriter)) *fakeCMS {
+	t.Helper()
+	f := &fakeCMS{secret: secret}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if err := r.ParseForm(); err != nil || r.Method != http.MethodPost {
+			f.errors = append(f.errors, fmt.Sprintf("%s request: %v", r.Method, err))
+		}
+		if got, want := r.PostForm.Get("Signature"), cmsSignature(http.MethodPost, r.PostForm, f.secret); got != want {
+			f.errors = append(f.errors, fmt.Sprintf("signature %s, want %s", got, want))
+		}
+		f.requests = append(f.requests, r.PostForm)
+		respond(len(f.requests), w)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// cmsOK answers that the metrics were accepted
+func cmsOK(n int, w http.ResponseWriter) {
+	fmt.Fprintf(w, `{"Code":"200","Message":"","RequestId":"req-%d"}`, n)
+}
+
+// newTestCMSSink creates a sink for endpoint with a static AccessKey
+func newTestCMSSink(t *testing.T, endpoint string) *cmsSink {
+	t.Helper()
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte("test-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c := &SinkConfig{Type: sinkCMS, Address: endpoint, InstanceID: "i-bp1abc", AccessKeyID: "test-id", AccessKeySecretFile: secretFile}
+	return newTestSink(t, c).(*cmsSink)
+}
+
+// cmsPoints returns points of n devices with a selected and an unselected
+// statistic each, the selected one with a rate
+func cmsPoints(n int) []sinkPoint {
+	var points []sinkPoint
+	for i := 0; i < n; i++ {
+		tags := []sinkTag{{"device", fmt.Sprintf("erdma_%d", i)}, {"node", "node-1"}}
+		points = append(points,
+			sinkPoint{Name: "hw_tx_bytes_cnt", Stat: "hw_tx_bytes_cnt", Tags: tags, Value: uint64(i), Time: sinkTestTime, Rate: 1.5, HasRate: true},
+			sinkPoint{Name: "listen_ipv6_cnt", Stat: "listen_ipv6_cnt", Tags: tags, Value: 1, Time: sinkTestTime},
+		)
+	}
+	return points
+}
+
+func TestCMSSinkBatches(t *testing.T) {
+	cms := newFakeCMS(t, "test-secret", cmsOK)
+	sink := newTestCMSSink(t, cms.URL+"/")
+
+	// 60 devices make 120 metrics, a counter and a rate each
+	if err := sink.Send(context.Background(), cmsPoints(60)); err != nil {
+		t.Fatal(err)
+	}
+	if len(cms.errors) > 0 {
+		t.Fatal(cms.errors)
+	}
+	if len(cms.requests) != 2 {
+		t.Fatalf("%d requests, want 2", len(cms.requests))
+	}
+	for i, want := range []int{100, 20} {
+		req := cms.requests[i]
+		if req.Get("Action") != "PutCustomMetric" || req.Get("Version") != cmsAPIVersion || req.Get("AccessKeyId") != "test-id" || req.Get("SecurityToken") != "" {
+			t.Errorf("request %d: parameters %v", i, req)
+		}
+		if req.Get(fmt.Sprintf("MetricList.%d.MetricName", want)) == "" || req.Get(fmt.Sprintf("MetricList.%d.MetricName", want+1)) != "" {
+			t.Errorf("request %d: want %d metrics", i, want)
+		}
+	}
+	first := cms.requests[0]
+	for key, want := range map[string]string{
+		"MetricList.1.MetricName": "hw_tx_bytes_cnt",
+		"MetricList.1.GroupId":    "0",
+		"MetricList.1.Dimensions": `{"device":"erdma_0","instanceId":"i-bp1abc","node":"node-1"}`,
+		"MetricList.1.Time":       "1700000000000",
+		"MetricList.1.Type":       "0",
+		"MetricList.1.Values":     `{"value":0}`,
+		"MetricList.2.MetricName": "hw_tx_bytes_cnt_rate",
+		"MetricList.2.Values":     `{"value":1.5}`,
+		"MetricList.3.Values":     `{"value":1}`,
+	} {
+		if got := first.Get(key); got != want {
+			t.Errorf("%s = %s, want %s", key, got, want)
+		}
+	}
+	// Every request has its own nonce
+	if first.Get("SignatureNonce") == cms.requests[1].Get("SignatureNonce") {
+		t.Error("nonce reused")
+	}
+}
+
+func TestCMSSinkErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		respond func(n int, w http.ResponseWriter)
+		want    string
+	}{
+		{"error code", func(n int, w http.ResponseWriter) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"Code":"InvalidAccessKeyId.NotFound","Message":"Specified access key is not found.","RequestId":"req-1"}`)
+		}, "PutCustomMetric failed: InvalidAccessKeyId.NotFound: Specified access key is not found. (request req-1)"},
+		{"error code with 200", func(n int, w http.ResponseWriter) {
+			fmt.Fprint(w, `{"Code":"206","Message":"some metrics rejected","RequestId":"req-1"}`)
+		}, "PutCustomMetric failed: 206"},
+		{"not JSON", func(n int, w http.ResponseWriter) {
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+		}, `server returned 502 Bad Gateway: "bad gateway\n"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cms := newFakeCMS(t, "test-secret", tc.respond)
+			sink := newTestCMSSink(t, cms.URL+"/")
+			err := sink.Send(context.Background(), cmsPoints(60))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("error = %v, want %q", err, tc.want)
+			}
+			// The remaining batches are not sent
+			if len(cms.requests) != 1 {
+				t.Errorf("%d requests after a failure", len(cms.requests))
+			}
+		})
+	}
+}
+
+// TestCMSRoleCredentials checks that RAM role credentials are fetched
+// once, renewed before they expire, and kept while renewal fails until
+// they expire
+func TestCMSRoleCredentials(t *testing.T) {
+	captureLogs(t)
+	m := newFakeMetadata(t, true)
+	t.Setenv("ALIBABA_CLOUD_ACCESS_KEY_ID", "")
+	t.Setenv("ALIBABA_CLOUD_ACCESS_KEY_SECRET", "")
+	cms := newFakeCMS(t, "sts-secret-1", cmsOK)
+	sink := newTestSink(t, &SinkConfig{Type: sinkCMS, Address: cms.URL + "/", InstanceID: "i-bp1abc"}).(*cmsSink)
+	if sink.static {
+		t.Fatal("static credentials without an AccessKey")
+	}
+
+	m.setCredentials(ecsCredentials{AccessKeyID: "STS.1", AccessKeySecret: "sts-secret-1", SecurityToken: "token-1", Expiration: time.Now().Add(time.Hour), Code: "Success"})
+	for i := 0; i < 2; i++ {
+		if err := sink.Send(context.Background(), cmsPoints(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := m.credRequests.Load(); got != 1 {
+		t.Errorf("credentials fetched %d times for two sends, want 1", got)
+	}
+	if len(cms.errors) > 0 || cms.requests[1].Get("AccessKeyId") != "STS.1" || cms.requests[1].Get("SecurityToken") != "token-1" {
+		t.Errorf("signed with %s and %s: %v", cms.requests[1].Get("AccessKeyId"), cms.requests[1].Get("SecurityToken"), cms.errors)
+	}
+
+	// Within the refresh margin of the expiry, new credentials are fetched
+	sink.creds.Expiration = time.Now().Add(cmsCredentialsRefresh - time.Minute)
+	m.setCredentials(ecsCredentials{AccessKeyID: "STS.2", AccessKeySecret: "sts-secret-1", SecurityToken: "token-2", Expiration: time.Now().Add(time.Hour), Code: "Success"})
+	if err := sink.Send(context.Background(), cmsPoints(1)); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.credRequests.Load(); got != 2 {
+		t.Errorf("credentials fetched %d times, want a renewal", got)
+	}
+	if got := cms.requests[2].Get("SecurityToken"); got != "token-2" {
+		t.Errorf("signed with token %s after renewal, want token-2", got)
+	}
+
+	// A failed renewal keeps the credentials until they expire
+	m.down.Store(true)
+	sink.creds.Expiration = time.Now().Add(time.Minute)
+	if creds, err := sink.credentials(context.Background()); err != nil || creds.AccessKeyID != "STS.2" {
+		t.Errorf("credentials %+v, %v during failed renewal, want STS.2", creds, err)
+	}
+	sink.creds.Expiration = time.Now().Add(-time.Second)
+	if _, err := sink.credentials(context.Background()); err == nil {
+		t.Error("expired credentials used")
+	}
+}
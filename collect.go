@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// textfileName is the file written for the node_exporter textfile collector
+const textfileName = "erdma.prom"
+
+// Exit codes of "erdma-exporter collect"
+const (
+	collectOK = 0
+	// collectFailed means the file could not be written and is unchanged
+	collectFailed = 1
+	collectUsage  = 2
+	// collectIncomplete means the file was written, but device discovery
+	// or the statistics of a device failed
+	collectIncomplete = 3
+)
+
+// writeTextfile gathers reg and atomically replaces dir/erdma.prom. The
+// file is written to a temporary file in the same directory and renamed,
+// so node_exporter never reads a partial file.
+func writeTextfile(reg prometheus.Gatherer, dir string) error {
+	families, err := reg.Gather()
+	if err != nil {
+		return fmt.Errorf("gather metrics: %w", err)
+	}
+
+	// node_exporter only reads files ending in .prom
+	tmp, err := os.CreateTemp(dir, "."+textfileName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(tmp, family); err != nil {
+			tmp.Close()
+			return fmt.Errorf("write %s: %w", tmp.Name(), err)
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// node_exporter usually runs as a different user
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, textfileName))
+}
+
+// collectOnce writes the textfile and returns the exit code for the run
+func collectOnce(reg prometheus.Gatherer, collector *ErdmaCollector, dir string) int {
+	start := time.Now()
+	if err := writeTextfile(reg, dir); err != nil {
+		slog.Error("Failed to write textfile", "dir", dir, "err", err)
+		return collectFailed
+	}
+
+	state, devices := collector.Snapshot()
+	code := collectOK
+	if state.CycleErr != nil {
+		slog.Warn("Device discovery failed", "err", state.CycleErr)
+		code = collectIncomplete
+	}
+	for _, device := range devices {
+		if device.Err != nil {
+			slog.Warn("Failed to get statistics", "device", device.Device.Name, "err", device.Err)
+			code = collectIncomplete
+		}
+	}
+	slog.Info("Wrote textfile", "file", filepath.Join(dir, textfileName), "devices", len(devices), "duration", time.Since(start))
+	return code
+}
+
+// runCollectCommand implements "erdma-exporter collect", which writes the
+// metrics for the node_exporter textfile collector once, or on an interval
+// until it receives SIGTERM
+func runCollectCommand(args []string) int {
+	fs := flag.NewFlagSet("collect", flag.ContinueOnError)
+	dir := fs.String("textfile", "", "Directory of the node_exporter textfile collector to write "+textfileName+" to.")
+	interval := fs.Duration("interval", 0, "Write the file on this interval until terminated instead of once.")
+	configFile := fs.String("config.file", "", "YAML config file, as for the exporter.")
+	toolTimeout := fs.Duration("tool.timeout", 30*time.Second, "Timeout of a single eadm or ibv_devices invocation.")
+	level := fs.String("log.level", "warn", "Log level: debug, info, warn or error.")
+	if err := fs.Parse(args); err != nil {
+		return collectUsage
+	}
+	if *dir == "" {
+		fmt.Fprintln(os.Stderr, "usage: erdma-exporter collect --textfile <dir> [--interval <duration>]")
+		return collectUsage
+	}
+	if info, err := os.Stat(*dir); err != nil || !info.IsDir() {
+		fmt.Fprintf(os.Stderr, "--textfile %s is not a directory\n", *dir)
+		return collectUsage
+	}
+	if err := setupLogging(os.Stderr, *level, "logfmt", 0); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return collectUsage
+	}
+
+	collector, err := NewErdmaCollector()
+	if err != nil {
+		slog.Error("Failed to create ERDMA collector", "err", err)
+		return collectFailed
+	}
+	// node_exporter already exports the process and Go runtime metrics
+	base := defaultConfig()
+	base.Timeouts.Tool = duration(*toolTimeout)
+	reg := prometheus.NewRegistry()
+	reloader := NewConfigReloader(*configFile, base, reg, collector)
+	if err := reloader.Load(); err != nil {
+		slog.Error("Failed to load config", "err", err)
+		return collectUsage
+	}
+
+	if *interval <= 0 {
+		return collectOnce(reg, collector, *dir)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go reloader.Run(ctx, *interval)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		collectOnce(reg, collector, *dir)
+		select {
+		case <-ctx.Done():
+			return collectOK
+		case <-ticker.C:
+		}
+	}
+}
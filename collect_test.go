@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// failingGatherer fails every gather
+type failingGatherer struct{}
+
+func (failingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	return nil, errors.New("collector failed")
+}
+
+func TestWriteTextfile(t *testing.T) {
+	dir := t.TempDir()
+	reg := prometheus.NewRegistry()
+	up := prometheus.NewGauge(prometheus.GaugeOpts{Name: "erdma_up", Help: "Whether the devices were listed."})
+	reg.MustRegister(up)
+	path := filepath.Join(dir, textfileName)
+
+	up.Set(1)
+	if err := writeTextfile(reg, dir); err != nil {
+		t.Fatal(err)
+	}
+	up.Set(0)
+	if err := writeTextfile(reg, dir); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "# HELP erdma_up Whether the devices were listed.\n# TYPE erdma_up gauge\nerdma_up 0\n"; string(data) != want {
+		t.Errorf("file\n%s\nwant\n%s", data, want)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o644 {
+		t.Errorf("mode %v, want 0644", perm)
+	}
+
+	// A failed write leaves the previous file in place and no temporary
+	// file behind
+	if err := writeTextfile(failingGatherer{}, dir); err == nil {
+		t.Error("no error from a failed gather")
+	}
+	if after, _ := os.ReadFile(path); string(after) != string(data) {
+		t.Errorf("file changed by a failed write:\n%s", after)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("files %v, want only %s", names, textfileName)
+	}
+}
+
+// newCollectTestCollector returns a collector of erdma_0 and erdma_1 whose
+// statistics of failing fail, and a registry with it
+func newCollectTestCollector(t *testing.T, discoveryFails bool, failing string) (*prometheus.Registry, *ErdmaCollector) {
+	t.Helper()
+	c, err := NewErdmaCollector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.run = func(name string, args ...string) ([]byte, []byte, error) {
+		switch {
+		case name == "ibv_devices" && discoveryFails:
+			return nil, []byte("Failed to get IB devices list"), errors.New("exit status 1")
+		case name == "ibv_devices":
+			return []byte("erdma_0 0216:3eff:fe50:30b0\nerdma_1 0216:3eff:fe50:30b1\n"), nil, nil
+		case args[0] == "ver":
+			return []byte("Query kernel driver version: 0.2.41\n"), nil, nil
+		case args[len(args)-1] == failing:
+			return nil, []byte("device busy"), errors.New("exit status 1")
+		default:
+			return []byte("hw_tx_bytes_cnt : 5\n"), nil, nil
+		}
+	}
+	c.nodeName = "node-1"
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	return reg, c
+}
+
+func TestCollectOnceExitCodes(t *testing.T) {
+	captureLogs(t)
+	for _, tc := range []struct {
+		name           string
+		discoveryFails bool
+		failing        string
+		code           int
+		want           string
+	}{
+		{"complete", false, "", collectOK, `erdma_hw_tx_bytes_total{device="erdma_1",node="node-1"} 5`},
+		// The devices that worked are still written
+		{"device failed", false, "erdma_1", collectIncomplete, `erdma_hw_tx_bytes_total{device="erdma_0",node="node-1"} 5`},
+		{"discovery failed", true, "", collectIncomplete, "erdma_driver_version"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			reg, c := newCollectTestCollector(t, tc.discoveryFails, tc.failing)
+			if code := collectOnce(reg, c, dir); code != tc.code {
+				t.Errorf("exit code %d, want %d", code, tc.code)
+			}
+			data, err := os.ReadFile(filepath.Join(dir, textfileName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(data), tc.want) {
+				t.Errorf("file does not contain %s\n%s", tc.want, data)
+			}
+			if failed := `erdma_hw_tx_bytes_total{device="` + tc.failing + `"`; tc.failing != "" && strings.Contains(string(data), failed) {
+				t.Errorf("file contains statistics of the failed device\n%s", data)
+			}
+		})
+	}
+
+	reg, c := newCollectTestCollector(t, false, "")
+	if code := collectOnce(reg, c, filepath.Join(t.TempDir(), "missing")); code != collectFailed {
+		t.Errorf("exit code %d for a missing directory, want %d", code, collectFailed)
+	}
+}
+
+func TestCollectCommandUsage(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		nil,
+		{"--textfile", file},
+		{"--textfile", filepath.Join(t.TempDir(), "missing")},
+		{"--textfile", t.TempDir(), "--log.level", "loud"},
+		{"--bogus"},
+	} {
+		if code := runCollectCommand(args); code != collectUsage {
+			t.Errorf("%q: exit code %d, want %d", args, code, collectUsage)
+		}
+	}
+}
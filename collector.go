@@ -1,15 +1,12 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
-	"regexp"
-	"strconv"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -78,6 +75,31 @@ type ErdmaCollector struct {
 	hwRxDisableDropCntDesc      *prometheus.Desc
 	hwRxBpsLimitDropCntDesc     *prometheus.Desc
 	hwRxPpsLimitDropCntDesc     *prometheus.Desc
+
+	// Statistics validation and parsing
+	validator      *StatValidator
+	parseErrors    *prometheus.CounterVec
+	unknownFormats *prometheus.CounterVec
+
+	// Tool runner and node name, overridden for simulated nodes
+	run      toolRunner
+	nodeName string
+
+	// Outcome of the last device discovery
+	discoveryMu   sync.Mutex
+	lastDiscovery discoveryStatus
+
+	// What the last collection cycles saw
+	stateMu sync.Mutex
+	state   collectorState
+	// history keeps the recent samples of every device; nil if disabled
+	history *sampleHistory
+
+	// cycleMu serializes collection cycles; the metrics of the last one
+	// are kept for callers that can use them, see cycle
+	cycleMu      sync.Mutex
+	cycleMetrics []prometheus.Metric
+	cycleEnd     time.Time
 }
 
 // NewErdmaCollector creates a new ERDMA collector
@@ -425,6 +447,26 @@ func NewErdmaCollector() (*ErdmaCollector, error) {
 			[]string{"device", "node"},
 			nil,
 		),
+		validator: NewStatValidator(),
+		parseErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "stat",
+				Name:      "parse_errors_total",
+				Help:      "Total number of eadm stat output lines skipped by the parser",
+			},
+			[]string{"device", "reason"},
+		),
+		unknownFormats: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "parser",
+				Name:      "unknown_format_total",
+				Help:      "Total number of tool outputs not recognized by any registered parser",
+			},
+			[]string{"tool"},
+		),
+		run: runTool,
 	}, nil
 }
 
@@ -487,15 +529,31 @@ func (c *ErdmaCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.hwRxDisableDropCntDesc
 	ch <- c.hwRxBpsLimitDropCntDesc
 	ch <- c.hwRxPpsLimitDropCntDesc
+	c.validator.Describe(ch)
+	c.parseErrors.Describe(ch)
+	c.unknownFormats.Describe(ch)
 }
 
 // Collect implements prometheus.Collector
 func (c *ErdmaCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c.cycle(cycleShareAge) {
+		ch <- m
+	}
+	c.validator.Collect(ch)
+	c.parseErrors.Collect(ch)
+	c.unknownFormats.Collect(ch)
+}
+
+// collect runs a collection cycle: it queries the tools and sends the
+// device metrics to ch. The caller holds cycleMu.
+func (c *ErdmaCollector) collect(ch chan<- prometheus.Metric) {
 	// Get node name
-	nodeName := getNodeName()
+	nodeName := c.NodeName()
 
 	// Get version
-	version, err := getVersion()
+	version, err := getVersionWith(c.run)
+	c.countUnknownFormat(err)
+	c.recordVersion(version, err)
 	if err == nil {
 		ch <- prometheus.MustNewConstMetric(
 			c.versionDesc,
@@ -507,10 +565,13 @@ func (c *ErdmaCollector) Collect(ch chan<- prometheus.Metric) {
 	}
 
 	// Get devices
-	devices, err := getDevices()
+	devices, err := c.discover()
 	if err != nil {
+		c.recordCycle(err)
 		return
 	}
+	c.retainDevices(devices)
+	defer c.recordCycle(nil)
 
 	// Collect metrics for each device
 	for _, device := range devices {
@@ -525,78 +586,149 @@ func (c *ErdmaCollector) Collect(ch chan<- prometheus.Metric) {
 		)
 
 		// Get statistics for this device
-		stats, err := getDeviceStats(device.Name)
+		stats, err := getDeviceStatsWith(c.run, device.Name)
+		c.countUnknownFormat(err)
+		c.recordStats(device, stats, err)
 		if err != nil {
 			continue
 		}
 
+		// Account for lines the parser skipped
+		for reason, count := range stats.ParseErrors {
+			c.parseErrors.WithLabelValues(device.Name, reason).Add(float64(count))
+		}
+
+		// Check statistics invariants
+		c.validator.Validate(device.Name, stats)
+
 		// Emit all statistics
 		c.emitStats(ch, device.Name, nodeName, stats)
 	}
 }
 
-func (c *ErdmaCollector) emitStats(ch chan<- prometheus.Metric, device string, nodeName string, stats map[string]uint64) {
-	emitMetric := func(desc *prometheus.Desc, key string) {
-		if val, ok := stats[key]; ok {
-			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(val), device, nodeName)
+// NodeName returns the node label of the collected metrics
+func (c *ErdmaCollector) NodeName() string {
+	if c.nodeName != "" {
+		return c.nodeName
+	}
+	return getNodeName()
+}
+
+// discover lists the devices passing the configured filter and records the
+// outcome for readiness checks
+func (c *ErdmaCollector) discover() ([]Device, error) {
+	devices, err := getDevicesWith(c.run)
+	c.countUnknownFormat(err)
+	filter := &activeConfig().Filters.Devices
+	selected := devices[:0]
+	for _, device := range devices {
+		if filter.Match(device.Name) {
+			selected = append(selected, device)
 		}
 	}
+	devices = selected
 
-	emitMetric(c.listenCreateCntDesc, "listen_create_cnt")
-	emitMetric(c.listenIpv6CntDesc, "listen_ipv6_cnt")
-	emitMetric(c.listenSuccessCntDesc, "listen_success_cnt")
-	emitMetric(c.listenFailedCntDesc, "listen_failed_cnt")
-	emitMetric(c.listenDestroyCntDesc, "listen_destroy_cnt")
-	emitMetric(c.acceptTotalCntDesc, "accept_total_cnt")
-	emitMetric(c.acceptSuccessCntDesc, "accept_success_cnt")
-	emitMetric(c.acceptFailedCntDesc, "accept_failed_cnt")
-	emitMetric(c.rejectCntDesc, "reject_cnt")
-	emitMetric(c.rejectFailedCntDesc, "reject_failed_cnt")
-	emitMetric(c.connectTotalCntDesc, "connect_total_cnt")
-	emitMetric(c.connectSuccessCntDesc, "connect_success_cnt")
-	emitMetric(c.connectFailedCntDesc, "connect_failed_cnt")
-	emitMetric(c.connectTimeoutCntDesc, "connect_timeout_cnt")
-	emitMetric(c.connectResetCntDesc, "connect_reset_cnt")
-	emitMetric(c.cmdqSubmittedCntDesc, "cmdq_submitted_cnt")
-	emitMetric(c.cmdqCompCntDesc, "cmdq_comp_cnt")
-	emitMetric(c.cmdqEqNotifyCntDesc, "cmdq_eq_notify_cnt")
-	emitMetric(c.cmdqEqEventCntDesc, "cmdq_eq_event_cnt")
-	emitMetric(c.cmdqCqArmedCntDesc, "cmdq_cq_armed_cnt")
-	emitMetric(c.erdmaAeqEventCntDesc, "erdma_aeq_event_cnt")
-	emitMetric(c.erdmaAeqNotifyCntDesc, "erdma_aeq_notify_cnt")
-	emitMetric(c.verbsAllocMrCntDesc, "verbs_alloc_mr_cnt")
-	emitMetric(c.verbsAllocMrFailedCntDesc, "verbs_alloc_mr_failed_cnt")
-	emitMetric(c.verbsAllocPdCntDesc, "verbs_alloc_pd_cnt")
-	emitMetric(c.verbsAllocPdFailedCntDesc, "verbs_alloc_pd_failed_cnt")
-	emitMetric(c.verbsAllocUctxCntDesc, "verbs_alloc_uctx_cnt")
-	emitMetric(c.verbsAllocUctxFailedCntDesc, "verbs_alloc_uctx_failed_cnt")
-	emitMetric(c.verbsCreateCqCntDesc, "verbs_create_cq_cnt")
-	emitMetric(c.verbsCreateCqFailedCntDesc, "verbs_create_cq_failed_cnt")
-	emitMetric(c.verbsCreateQpCntDesc, "verbs_create_qp_cnt")
-	emitMetric(c.verbsCreateQpFailedCntDesc, "verbs_create_qp_failed_cnt")
-	emitMetric(c.verbsDeallocPdCntDesc, "verbs_dealloc_pd_cnt")
-	emitMetric(c.verbsDeallocUctxCntDesc, "verbs_dealloc_uctx_cnt")
-	emitMetric(c.verbsDeregMrCntDesc, "verbs_dereg_mr_cnt")
-	emitMetric(c.verbsDeregMrFailedCntDesc, "verbs_dereg_mr_failed_cnt")
-	emitMetric(c.verbsDestroyCqCntDesc, "verbs_destroy_cq_cnt")
-	emitMetric(c.verbsDestroyCqFailedCntDesc, "verbs_destroy_cq_failed_cnt")
-	emitMetric(c.verbsDestroyQpCntDesc, "verbs_destroy_qp_cnt")
-	emitMetric(c.verbsDestroyQpFailedCntDesc, "verbs_destroy_qp_failed_cnt")
-	emitMetric(c.verbsGetDmaMrCntDesc, "verbs_get_dma_mr_cnt")
-	emitMetric(c.verbsGetDmaMrFailedCntDesc, "verbs_get_dma_mr_failed_cnt")
-	emitMetric(c.verbsRegUsrMrCntDesc, "verbs_reg_usr_mr_cnt")
-	emitMetric(c.verbsRegUsrMrFailedCntDesc, "verbs_reg_usr_mr_failed_cnt")
-	emitMetric(c.hwTxReqsCntDesc, "hw_tx_reqs_cnt")
-	emitMetric(c.hwTxPacketsCntDesc, "hw_tx_packets_cnt")
-	emitMetric(c.hwTxBytesCntDesc, "hw_tx_bytes_cnt")
-	emitMetric(c.hwDisableDropCntDesc, "hw_disable_drop_cnt")
-	emitMetric(c.hwBpsLimitDropCntDesc, "hw_bps_limit_drop_cnt")
-	emitMetric(c.hwPpsLimitDropCntDesc, "hw_pps_limit_drop_cnt")
-	emitMetric(c.hwRxPacketsCntDesc, "hw_rx_packets_cnt")
-	emitMetric(c.hwRxBytesCntDesc, "hw_rx_bytes_cnt")
-	emitMetric(c.hwRxDisableDropCntDesc, "hw_rx_disable_drop_cnt")
-	emitMetric(c.hwRxBpsLimitDropCntDesc, "hw_rx_bps_limit_drop_cnt")
-	emitMetric(c.hwRxPpsLimitDropCntDesc, "hw_rx_pps_limit_drop_cnt")
+	c.discoveryMu.Lock()
+	c.lastDiscovery = discoveryStatus{Time: time.Now(), Devices: devices, Err: err}
+	c.discoveryMu.Unlock()
+
+	return devices, err
+}
+
+// LastDiscovery returns the outcome of the last device discovery
+func (c *ErdmaCollector) LastDiscovery() discoveryStatus {
+	c.discoveryMu.Lock()
+	defer c.discoveryMu.Unlock()
+	return c.lastDiscovery
+}
+
+// countUnknownFormat counts err if no parser recognized a tool's output
+func (c *ErdmaCollector) countUnknownFormat(err error) {
+	if tool, ok := isUnknownFormat(err); ok {
+		slog.Warn("Unrecognized tool output format", "tool", tool)
+		c.unknownFormats.WithLabelValues(tool).Inc()
+	}
+}
+
+func (c *ErdmaCollector) emitStats(ch chan<- prometheus.Metric, device string, nodeName string, stats *DeviceStats) {
+	emitMetric := func(desc *prometheus.Desc, stat StatValue) {
+		if stat.Present {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(stat.Value), device, nodeName)
+		}
+	}
+
+	enabled := activeConfig().Collectors
+	if enabled.Listen {
+		emitMetric(c.listenCreateCntDesc, stats.Listen.Create)
+		emitMetric(c.listenIpv6CntDesc, stats.Listen.Ipv6)
+		emitMetric(c.listenSuccessCntDesc, stats.Listen.Success)
+		emitMetric(c.listenFailedCntDesc, stats.Listen.Failed)
+		emitMetric(c.listenDestroyCntDesc, stats.Listen.Destroy)
+	}
+	if enabled.Accept {
+		emitMetric(c.acceptTotalCntDesc, stats.Accept.Total)
+		emitMetric(c.acceptSuccessCntDesc, stats.Accept.Success)
+		emitMetric(c.acceptFailedCntDesc, stats.Accept.Failed)
+		emitMetric(c.rejectCntDesc, stats.Accept.Reject)
+		emitMetric(c.rejectFailedCntDesc, stats.Accept.RejectFailed)
+	}
+	if enabled.Connect {
+		emitMetric(c.connectTotalCntDesc, stats.Connect.Total)
+		emitMetric(c.connectSuccessCntDesc, stats.Connect.Success)
+		emitMetric(c.connectFailedCntDesc, stats.Connect.Failed)
+		emitMetric(c.connectTimeoutCntDesc, stats.Connect.Timeout)
+		emitMetric(c.connectResetCntDesc, stats.Connect.Reset)
+	}
+	if enabled.Cmdq {
+		emitMetric(c.cmdqSubmittedCntDesc, stats.Cmdq.Submitted)
+		emitMetric(c.cmdqCompCntDesc, stats.Cmdq.Completed)
+		emitMetric(c.cmdqEqNotifyCntDesc, stats.Cmdq.EqNotify)
+		emitMetric(c.cmdqEqEventCntDesc, stats.Cmdq.EqEvent)
+		emitMetric(c.cmdqCqArmedCntDesc, stats.Cmdq.CqArmed)
+	}
+	if enabled.Aeq {
+		emitMetric(c.erdmaAeqEventCntDesc, stats.Aeq.Event)
+		emitMetric(c.erdmaAeqNotifyCntDesc, stats.Aeq.Notify)
+	}
+	if enabled.Verbs {
+		emitMetric(c.verbsAllocMrCntDesc, stats.Verbs.AllocMr)
+		emitMetric(c.verbsAllocMrFailedCntDesc, stats.Verbs.AllocMrFailed)
+		emitMetric(c.verbsAllocPdCntDesc, stats.Verbs.AllocPd)
+		emitMetric(c.verbsAllocPdFailedCntDesc, stats.Verbs.AllocPdFailed)
+		emitMetric(c.verbsAllocUctxCntDesc, stats.Verbs.AllocUctx)
+		emitMetric(c.verbsAllocUctxFailedCntDesc, stats.Verbs.AllocUctxFailed)
+		emitMetric(c.verbsCreateCqCntDesc, stats.Verbs.CreateCq)
+		emitMetric(c.verbsCreateCqFailedCntDesc, stats.Verbs.CreateCqFailed)
+		emitMetric(c.verbsCreateQpCntDesc, stats.Verbs.CreateQp)
+		emitMetric(c.verbsCreateQpFailedCntDesc, stats.Verbs.CreateQpFailed)
+		emitMetric(c.verbsDeallocPdCntDesc, stats.Verbs.DeallocPd)
+		emitMetric(c.verbsDeallocUctxCntDesc, stats.Verbs.DeallocUctx)
+		emitMetric(c.verbsDeregMrCntDesc, stats.Verbs.DeregMr)
+		emitMetric(c.verbsDeregMrFailedCntDesc, stats.Verbs.DeregMrFailed)
+		emitMetric(c.verbsDestroyCqCntDesc, stats.Verbs.DestroyCq)
+		emitMetric(c.verbsDestroyCqFailedCntDesc, stats.Verbs.DestroyCqFailed)
+		emitMetric(c.verbsDestroyQpCntDesc, stats.Verbs.DestroyQp)
+		emitMetric(c.verbsDestroyQpFailedCntDesc, stats.Verbs.DestroyQpFailed)
+		emitMetric(c.verbsGetDmaMrCntDesc, stats.Verbs.GetDmaMr)
+		emitMetric(c.verbsGetDmaMrFailedCntDesc, stats.Verbs.GetDmaMrFailed)
+		emitMetric(c.verbsRegUsrMrCntDesc, stats.Verbs.RegUsrMr)
+		emitMetric(c.verbsRegUsrMrFailedCntDesc, stats.Verbs.RegUsrMrFailed)
+	}
+	if enabled.HwTx {
+		emitMetric(c.hwTxReqsCntDesc, stats.HwTx.Requests)
+		emitMetric(c.hwTxPacketsCntDesc, stats.HwTx.Packets)
+		emitMetric(c.hwTxBytesCntDesc, stats.HwTx.Bytes)
+		emitMetric(c.hwDisableDropCntDesc, stats.HwTx.DisableDrop)
+		emitMetric(c.hwBpsLimitDropCntDesc, stats.HwTx.BpsLimitDrop)
+		emitMetric(c.hwPpsLimitDropCntDesc, stats.HwTx.PpsLimitDrop)
+	}
+	if enabled.HwRx {
+		emitMetric(c.hwRxPacketsCntDesc, stats.HwRx.Packets)
+		emitMetric(c.hwRxBytesCntDesc, stats.HwRx.Bytes)
+		emitMetric(c.hwRxDisableDropCntDesc, stats.HwRx.DisableDrop)
+		emitMetric(c.hwRxBpsLimitDropCntDesc, stats.HwRx.BpsLimitDrop)
+		emitMetric(c.hwRxPpsLimitDropCntDesc, stats.HwRx.PpsLimitDrop)
+	}
 }
 
 // Device represents an ERDMA device
@@ -605,8 +737,12 @@ type Device struct {
 	GUID string
 }
 
-// findCommand finds a command in PATH (container has erdma-tools installed)
+// findCommand finds a command at its configured path or in PATH
+// (container has erdma-tools installed)
 func findCommand(cmdName string) string {
+	if path := activeConfig().toolPath(cmdName); path != "" {
+		return path
+	}
 	// Try standard PATH (container has erdma-tools installed)
 	if path, err := exec.LookPath(cmdName); err == nil {
 		return path
@@ -617,158 +753,92 @@ func findCommand(cmdName string) string {
 
 // getVersion gets the ERDMA driver version
 func getVersion() (string, error) {
-	eadmPath := findCommand("eadm")
-	log.Printf("Debug: Using eadm path: %s", eadmPath)
-	
-	cmd := exec.Command(eadmPath, "ver")
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	
-	err := cmd.Run()
+	return getVersionWith(runTool)
+}
+
+// getVersionWith gets the ERDMA driver version using the given tool runner
+func getVersionWith(run toolRunner) (string, error) {
+	output, stderr, err := run("eadm", "ver")
 	if err != nil {
-		log.Printf("Debug: eadm ver command failed: %v, stderr: %s", err, stderr.String())
-		return "", fmt.Errorf("failed to execute eadm ver: %w, stderr: %s", err, stderr.String())
+		slog.Error("eadm ver command failed", "err", err, "stderr", string(stderr))
+		return "", fmt.Errorf("failed to execute eadm ver: %w, stderr: %s", err, stderr)
 	}
-	
-	output := stdout.Bytes()
-	if stderr.Len() > 0 {
-		log.Printf("Debug: eadm ver stderr: %s", stderr.String())
+
+	if len(stderr) > 0 {
+		slog.Debug("eadm ver stderr", "stderr", string(stderr))
 	}
 
-	// Parse output: "Query kernel driver version: 0.2.38"
-	re := regexp.MustCompile(`Query kernel driver version:\s+(\S+)`)
-	matches := re.FindStringSubmatch(string(output))
-	if len(matches) > 1 {
-		return matches[1], nil
+	version, format, err := parseVersionOutput(string(output))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse version from output: %w: %s", err, string(output))
 	}
+	slog.Debug("Parsed eadm ver output", "format", format, "version", version)
 
-	return "", fmt.Errorf("failed to parse version from output: %s", string(output))
+	setDriverVersion(version)
+	return version, nil
 }
 
 // getDevices gets the list of ERDMA devices
 func getDevices() ([]Device, error) {
-	ibvDevicesPath := findCommand("ibv_devices")
-	log.Printf("Debug: Using ibv_devices path: %s", ibvDevicesPath)
-	
-	// Check if command exists and is executable
-	if _, err := os.Stat(ibvDevicesPath); err != nil {
-		log.Printf("Debug: Command file check failed: %v", err)
-	}
-	
-	cmd := exec.Command(ibvDevicesPath)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	
-	err := cmd.Run()
+	return getDevicesWith(runTool)
+}
+
+// getDevicesWith gets the list of ERDMA devices using the given tool runner
+func getDevicesWith(run toolRunner) ([]Device, error) {
+	output, stderr, err := run("ibv_devices")
 	if err != nil {
-		log.Printf("Debug: ibv_devices command failed with error: %v", err)
-		log.Printf("Debug: stderr output: %s", stderr.String())
-		return nil, fmt.Errorf("failed to execute ibv_devices command: %w, stderr: %s", err, stderr.String())
+		slog.Error("ibv_devices command failed", "err", err, "stderr", string(stderr))
+		return nil, fmt.Errorf("failed to execute ibv_devices command: %w, stderr: %s", err, stderr)
 	}
 
-	output := stdout.Bytes()
-	// Debug: log raw output
-	log.Printf("Debug: ibv_devices raw output (stdout):\n%s", string(output))
-	if stderr.Len() > 0 {
-		log.Printf("Debug: ibv_devices stderr output:\n%s", stderr.String())
+	slog.Debug("ibv_devices raw output", "stdout", string(output))
+	if len(stderr) > 0 {
+		slog.Debug("ibv_devices stderr", "stderr", string(stderr))
 	}
 
-	var devices []Device
-	scanner := bufio.NewScanner(strings.NewReader(string(output)))
-
-	// Skip header lines
-	lineNum := 0
-	for scanner.Scan() {
-		lineNum++
-		line := strings.TrimSpace(scanner.Text())
-
-		// Skip header lines (first 2 lines)
-		if lineNum <= 2 {
-			log.Printf("Debug: Skipping header line %d: %s", lineNum, line)
-			continue
-		}
-
-		// Skip empty lines
-		if line == "" {
-			continue
-		}
-
-		// Parse device line: "erdma_0             02163efffe5030b3"
-		fields := strings.Fields(line)
-		log.Printf("Debug: Parsing line %d: %s (fields: %d)", lineNum, line, len(fields))
-		if len(fields) >= 2 {
-			devices = append(devices, Device{
-				Name: fields[0],
-				GUID: fields[1],
-			})
-			log.Printf("Debug: Found device: %s (GUID: %s)", fields[0], fields[1])
-		} else {
-			log.Printf("Debug: Line %d does not match device format (expected 2+ fields, got %d)", lineNum, len(fields))
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		return devices, fmt.Errorf("error scanning ibv_devices output: %w", err)
+	devices, format, err := parseDevicesOutput(string(output), currentDriverVersion())
+	if err != nil {
+		return nil, err
 	}
-
-	log.Printf("Debug: Total devices found: %d", len(devices))
+	slog.Debug("Parsed ibv_devices output", "format", format, "devices", len(devices))
 	return devices, nil
 }
 
 // getDeviceStats gets statistics for a specific device
-func getDeviceStats(device string) (map[string]uint64, error) {
-	eadmPath := findCommand("eadm")
-	log.Printf("Debug: Getting stats for device %s using eadm path: %s", device, eadmPath)
-	
-	cmd := exec.Command(eadmPath, "stat", "-d", device)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	
-	err := cmd.Run()
-	if err != nil {
-		log.Printf("Debug: eadm stat command failed for device %s: %v, stderr: %s", device, err, stderr.String())
-		return nil, fmt.Errorf("failed to execute eadm stat: %w, stderr: %s", err, stderr.String())
-	}
-	
-	output := stdout.Bytes()
-	if stderr.Len() > 0 {
-		log.Printf("Debug: eadm stat stderr for device %s: %s", device, stderr.String())
-	}
-
-	stats := make(map[string]uint64)
-	scanner := bufio.NewScanner(strings.NewReader(string(output)))
-
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
-		}
+func getDeviceStats(device string) (*DeviceStats, error) {
+	return getDeviceStatsWith(runTool, device)
+}
 
-		// Parse line: "listen_create_cnt : 0"
-		parts := strings.Split(line, ":")
-		if len(parts) != 2 {
-			continue
-		}
+// getDeviceStatsWith gets statistics for a specific device using the given tool runner
+func getDeviceStatsWith(run toolRunner, device string) (*DeviceStats, error) {
+	slog.Debug("Getting device stats", "device", device)
 
-		key := strings.TrimSpace(parts[0])
-		valStr := strings.TrimSpace(parts[1])
+	output, stderr, err := run("eadm", "stat", "-d", device)
+	if err != nil {
+		slog.Error("eadm stat command failed", "device", device, "err", err, "stderr", string(stderr))
+		return nil, fmt.Errorf("failed to execute eadm stat: %w, stderr: %s", err, stderr)
+	}
 
-		val, err := strconv.ParseUint(valStr, 10, 64)
-		if err != nil {
-			continue
-		}
+	if len(stderr) > 0 {
+		slog.Debug("eadm stat stderr", "device", device, "stderr", string(stderr))
+	}
 
-		stats[key] = val
+	stats, format, err := parseStatsOutput(string(output), currentDriverVersion())
+	if err != nil {
+		return nil, err
 	}
+	slog.Debug("Parsed eadm stat output", "device", device, "format", format)
 
-	return stats, scanner.Err()
+	stats.Output = string(output)
+	return stats, nil
 }
 
-// getNodeName gets the node name from environment variable or hostname
+// getNodeName gets the node name from the config file, environment variable or hostname
 func getNodeName() string {
+	if nodeName := activeConfig().NodeName; nodeName != "" {
+		return nodeName
+	}
+
 	// Try to get from environment variable first (Kubernetes)
 	if nodeName := os.Getenv("NODE_NAME"); nodeName != "" {
 		return nodeName
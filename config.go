@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Config is the exporter configuration file. Fields missing from the file
+// keep the values given by command-line flags.
+type Config struct {
+	// NodeName overrides the NODE_NAME environment variable and hostname
+	NodeName string `json:"node_name"`
+	// StaticLabels are added to every erdma_* metric
+	StaticLabels map[string]string `json:"static_labels"`
+	Collectors   CollectorsConfig  `json:"collectors"`
+	Filters      FiltersConfig     `json:"filters"`
+	Tools        ToolsConfig       `json:"tools"`
+	Timeouts     TimeoutsConfig    `json:"timeouts"`
+	Outputs      OutputsConfig     `json:"outputs"`
+}
+
+// CollectorsConfig enables groups of statistics
+type CollectorsConfig struct {
+	Listen  bool `json:"listen"`
+	Accept  bool `json:"accept"`
+	Connect bool `json:"connect"`
+	Cmdq    bool `json:"cmdq"`
+	Aeq     bool `json:"aeq"`
+	Verbs   bool `json:"verbs"`
+	HwTx    bool `json:"hw_tx"`
+	HwRx    bool `json:"hw_rx"`
+}
+
+// FiltersConfig selects what is collected
+type FiltersConfig struct {
+	Devices DeviceFilter `json:"devices"`
+}
+
+// DeviceFilter selects devices by name. A device is collected if it matches
+// any include pattern (or there are none) and no exclude pattern.
+// Patterns are regular expressions matched against the whole name.
+type DeviceFilter struct {
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// ToolsConfig sets the paths of the ERDMA tools instead of looking them up in PATH
+type ToolsConfig struct {
+	Eadm       string `json:"eadm"`
+	IbvDevices string `json:"ibv_devices"`
+}
+
+// TimeoutsConfig bounds how long collection may take
+type TimeoutsConfig struct {
+	// Tool bounds a single eadm or ibv_devices invocation
+	Tool duration `json:"tool"`
+}
+
+// OutputsConfig configures where metrics are exposed
+type OutputsConfig struct {
+	Metrics MetricsOutputConfig `json:"metrics"`
+	// Sinks push the device statistics to other monitoring systems
+	Sinks []SinkConfig `json:"sinks"`
+}
+
+// MetricsOutputConfig configures the /metrics endpoint
+type MetricsOutputConfig struct {
+	// ExporterMetrics includes the go_* and process_* metrics of the exporter
+	ExporterMetrics bool `json:"exporter_metrics"`
+}
+
+// Enabled reports whether the group of an eadm stat key is collected
+func (c CollectorsConfig) Enabled(key string) bool {
+	switch {
+	case strings.HasPrefix(key, "listen_"):
+		return c.Listen
+	case strings.HasPrefix(key, "accept_"), strings.HasPrefix(key, "reject_"):
+		return c.Accept
+	case strings.HasPrefix(key, "connect_"):
+		return c.Connect
+	case strings.HasPrefix(key, "cmdq_"):
+		return c.Cmdq
+	case strings.HasPrefix(key, "erdma_aeq_"):
+		return c.Aeq
+	case strings.HasPrefix(key, "verbs_"):
+		return c.Verbs
+	case strings.HasPrefix(key, "hw_rx_"):
+		return c.HwRx
+	case strings.HasPrefix(key, "hw_"):
+		return c.HwTx
+	}
+	return true
+}
+
+// reservedLabels are label names used by the exporter's own metrics
+var reservedLabels = map[string]bool{
+	"device": true, "node": true, "node_guid": true, "version": true,
+	"reason": true, "rule": true, "tool": true,
+}
+
+// labelNameRE matches valid Prometheus label names
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// defaultConfig returns the configuration used without a config file
+func defaultConfig() *Config {
+	return &Config{
+		Collectors: CollectorsConfig{
+			Listen: true, Accept: true, Connect: true, Cmdq: true,
+			Aeq: true, Verbs: true, HwTx: true, HwRx: true,
+		},
+		Timeouts: TimeoutsConfig{Tool: duration(30 * time.Second)},
+		Outputs:  OutputsConfig{Metrics: MetricsOutputConfig{ExporterMetrics: true}},
+	}
+}
+
+// currentConfig is the configuration in effect, replaced on reload
+var currentConfig atomic.Pointer[Config]
+
+// activeConfig returns the configuration in effect
+func activeConfig() *Config {
+	if c := currentConfig.Load(); c != nil {
+		return c
+	}
+	return defaultConfig()
+}
+
+// redactedValue replaces credentials in the config and flags shown by
+// /debug/config and written to support bundles
+const redactedValue = "<redacted>"
+
+// Redacted returns a copy of the config with its credentials masked: the
+// values of sink headers, AccessKey IDs and passwords in sink addresses
+func (c *Config) Redacted() *Config {
+	r := *c
+	r.Outputs.Sinks = make([]SinkConfig, len(c.Outputs.Sinks))
+	for i, sink := range c.Outputs.Sinks {
+		if sink.Headers != nil {
+			headers := make(map[string]string, len(sink.Headers))
+			for key := range sink.Headers {
+				headers[key] = redactedValue
+			}
+			sink.Headers = headers
+		}
+		if sink.AccessKeyID != "" {
+			sink.AccessKeyID = redactedValue
+		}
+		sink.Address = redactURL(sink.Address)
+		r.Outputs.Sinks[i] = sink
+	}
+	return &r
+}
+
+// redactURL masks the password of a URL with user info
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); !ok {
+		return s
+	}
+	return u.Redacted()
+}
+
+// parseConfig decodes a config file on top of base and validates it
+func parseConfig(data []byte, base *Config) (*Config, error) {
+	config := *base
+	if err := decodeYAML(data, &config); err != nil {
+		return nil, err
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// validate checks the config and compiles its filters
+func (c *Config) validate() error {
+	for name := range c.StaticLabels {
+		if !labelNameRE.MatchString(name) || len(name) >= 2 && name[:2] == "__" {
+			return fmt.Errorf("static_labels: invalid label name %q", name)
+		}
+		if reservedLabels[name] {
+			return fmt.Errorf("static_labels: label name %q is used by the exporter", name)
+		}
+	}
+
+	f := &c.Filters.Devices
+	f.include, f.exclude = nil, nil
+	for _, p := range f.Include {
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return fmt.Errorf("filters.devices.include: %w", err)
+		}
+		f.include = append(f.include, re)
+	}
+	for _, p := range f.Exclude {
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return fmt.Errorf("filters.devices.exclude: %w", err)
+		}
+		f.exclude = append(f.exclude, re)
+	}
+
+	for name, path := range map[string]string{"eadm": c.Tools.Eadm, "ibv_devices": c.Tools.IbvDevices} {
+		if path != "" && !filepath.IsAbs(path) {
+			return fmt.Errorf("tools.%s: %q is not an absolute path", name, path)
+		}
+	}
+
+	if c.Timeouts.Tool <= 0 {
+		return fmt.Errorf("timeouts.tool must be positive")
+	}
+
+	ids := make(map[string]bool, len(c.Outputs.Sinks))
+	for i := range c.Outputs.Sinks {
+		sink := &c.Outputs.Sinks[i]
+		if err := sink.validate(); err != nil {
+			return fmt.Errorf("outputs.sinks[%d]: %w", i, err)
+		}
+		if ids[sink.ID] {
+			return fmt.Errorf("outputs.sinks[%d]: duplicate id %q", i, sink.ID)
+		}
+		ids[sink.ID] = true
+	}
+	return nil
+}
+
+// Match reports whether a device passes the filter
+func (f *DeviceFilter) Match(name string) bool {
+	for _, re := range f.exclude {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, re := range f.include {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// toolPath returns the configured path of a tool, or "" to look it up in PATH
+func (c *Config) toolPath(name string) string {
+	switch name {
+	case "eadm":
+		return c.Tools.Eadm
+	case "ibv_devices":
+		return c.Tools.IbvDevices
+	}
+	return ""
+}
+
+// configHash returns the first 52 bits of the SHA-256 of data, so that it
+// can be exported exactly as a float
+func configHash(data []byte) float64 {
+	sum := sha256.Sum256(data)
+	return float64(binary.BigEndian.Uint64(sum[:8]) >> 12)
+}
+
+// ConfigReloader loads the config file, applies it and reloads it on SIGHUP
+// or when the file changes
+type ConfigReloader struct {
+	path string
+	base *Config
+	reg  *prometheus.Registry
+
+	// collector is registered with the static labels of the config
+	collector prometheus.Collector
+	// exporterCollectors are registered if outputs.metrics.exporter_metrics is set
+	exporterCollectors []prometheus.Collector
+
+	mu         sync.Mutex
+	data       []byte
+	registered prometheus.Registerer
+	exporter   bool
+
+	hash          prometheus.Gauge
+	lastSuccess   prometheus.Gauge
+	lastSuccessTS prometheus.Gauge
+	reloads       *prometheus.CounterVec
+}
+
+// NewConfigReloader creates a reloader for the config file at path, or for
+// base alone if path is empty. It registers collector and the exporter's
+// own metrics with reg once the config is applied.
+func NewConfigReloader(path string, base *Config, reg *prometheus.Registry, collector prometheus.Collector, exporterCollectors ...prometheus.Collector) *ConfigReloader {
+	r := &ConfigReloader{
+		path:               path,
+		base:               base,
+		reg:                reg,
+		collector:          collector,
+		exporterCollectors: exporterCollectors,
+		hash: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "exporter", Name: "config_hash",
+			Help: "Hash of the loaded config file",
+		}),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "exporter", Name: "config_last_reload_successful",
+			Help: "Whether the last config reload attempt was successful",
+		}),
+		lastSuccessTS: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "exporter", Name: "config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful config reload",
+		}),
+		reloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "exporter", Name: "config_reloads_total",
+			Help: "Total number of config reload attempts",
+		}, []string{"result"}),
+	}
+	reg.MustRegister(r.hash, r.lastSuccess, r.lastSuccessTS, r.reloads)
+	return r
+}
+
+// Load reads the config file, if any, and applies it
+func (r *ConfigReloader) Load() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	config := r.base
+	var data []byte
+	if r.path != "" {
+		var err error
+		if data, err = os.ReadFile(r.path); err != nil {
+			return err
+		}
+		if config, err = parseConfig(data, r.base); err != nil {
+			return fmt.Errorf("%s: %w", r.path, err)
+		}
+	} else if err := config.validate(); err != nil {
+		return err
+	}
+
+	if err := r.apply(config); err != nil {
+		return err
+	}
+	for _, name := range []string{"eadm", "ibv_devices"} {
+		if path := config.toolPath(name); path != "" {
+			if _, err := os.Stat(path); err != nil {
+				slog.Warn("Configured tool not found", "tool", name, "err", err)
+			}
+		}
+	}
+	r.data = data
+	r.hash.Set(configHash(data))
+	r.lastSuccess.Set(1)
+	r.lastSuccessTS.SetToCurrentTime()
+	return nil
+}
+
+// apply makes config current and updates the registrations that depend on it
+func (r *ConfigReloader) apply(config *Config) error {
+	labels := prometheus.Labels(config.StaticLabels)
+	if r.registered == nil || !sameLabels(labels, activeConfig().StaticLabels) {
+		next := prometheus.WrapRegistererWith(labels, r.reg)
+		if r.registered != nil {
+			r.registered.Unregister(r.collector)
+		}
+		if err := next.Register(r.collector); err != nil {
+			// Put the collector back with the labels it had
+			if r.registered != nil {
+				r.registered.MustRegister(r.collector)
+			}
+			return fmt.Errorf("registering collector with static labels: %w", err)
+		}
+		r.registered = next
+	}
+
+	exporter := config.Outputs.Metrics.ExporterMetrics
+	if exporter != r.exporter {
+		for _, c := range r.exporterCollectors {
+			if exporter {
+				r.reg.MustRegister(c)
+			} else {
+				r.reg.Unregister(c)
+			}
+		}
+		r.exporter = exporter
+	}
+
+	currentConfig.Store(config)
+	return nil
+}
+
+// sameLabels reports whether two label sets are equal
+func sameLabels(a prometheus.Labels, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Reload loads the config file again, keeping the current config if the
+// new one is invalid
+func (r *ConfigReloader) Reload() error {
+	if err := r.Load(); err != nil {
+		r.lastSuccess.Set(0)
+		r.reloads.WithLabelValues("failure").Inc()
+		slog.Error("Failed to reload config, keeping the previous one", "file", r.path, "err", err)
+		return err
+	}
+	r.reloads.WithLabelValues("success").Inc()
+	slog.Info("Reloaded config", "file", r.path)
+	return nil
+}
+
+// changed reports whether the file content differs from the loaded config.
+// Content is compared rather than modification times, as Kubernetes updates
+// mounted ConfigMaps by swapping symlinks.
+func (r *ConfigReloader) changed() bool {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return string(data) != string(r.data)
+}
+
+// Run reloads the config on SIGHUP and when the file changes, checked every
+// interval, until ctx is done
+func (r *ConfigReloader) Run(ctx context.Context, interval time.Duration) {
+	if r.path == "" {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var failed []byte
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("Received SIGHUP, reloading config", "file", r.path)
+			r.Reload()
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			// Do not retry a broken file until it changes again
+			data, _ := os.ReadFile(r.path)
+			if failed != nil && string(data) == string(failed) {
+				continue
+			}
+			slog.Info("Config file changed, reloading", "file", r.path)
+			if r.Reload() != nil {
+				failed = data
+			} else {
+				failed = nil
+			}
+		}
+	}
+}
+
+// runConfigCommand implements "erdma-exporter config validate <file>"
+func runConfigCommand(args []string) int {
+	if len(args) != 2 || args[0] != "validate" {
+		fmt.Fprintln(os.Stderr, "usage: erdma-exporter config validate <file>")
+		return 2
+	}
+	data, err := os.ReadFile(args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if _, err := parseConfig(data, defaultConfig()); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[1], err)
+		return 1
+	}
+	fmt.Printf("%s: OK (hash %.0f)\n", args[1], configHash(data))
+	return 0
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// doctorStatus is the outcome of a doctor check
+type doctorStatus string
+
+const (
+	doctorPass doctorStatus = "pass"
+	doctorWarn doctorStatus = "warn"
+	doctorFail doctorStatus = "fail"
+)
+
+// doctorCheck is the result of a single doctor check. Hint tells the
+// operator how to fix a warning or failure.
+type doctorCheck struct {
+	Name   string       `json:"name"`
+	Status doctorStatus `json:"status"`
+	Detail string       `json:"detail,omitempty"`
+	Hint   string       `json:"hint,omitempty"`
+}
+
+// doctorReport is the JSON output of "erdma-exporter doctor"
+type doctorReport struct {
+	Node    string        `json:"node"`
+	Time    time.Time     `json:"time"`
+	Status  doctorStatus  `json:"status"`
+	Checks  []doctorCheck `json:"checks"`
+	Devices []Device      `json:"devices,omitempty"`
+}
+
+// Linux capability bits checked by the doctor
+const (
+	capNetAdmin = 12
+	capSysAdmin = 21
+)
+
+// erdmaModule is the name of the ERDMA kernel module
+const erdmaModule = "erdma"
+
+// runDoctor runs all checks. Host checks are skipped if tool output is
+// replayed or simulated, since they would describe this machine rather
+// than the devices being served.
+func runDoctor() doctorReport {
+	report := doctorReport{Node: getNodeName(), Time: time.Now()}
+	if toolBackend == nil {
+		for _, path := range requiredPaths {
+			report.Checks = append(report.Checks, doctorCheckPath(path))
+		}
+		report.Checks = append(report.Checks, doctorCheckMounts()...)
+		report.Checks = append(report.Checks, doctorCheckModule(), doctorCheckCapabilities())
+		for _, tool := range readinessTools {
+			report.Checks = append(report.Checks, doctorCheckTool(tool))
+		}
+	}
+	report.Checks = append(report.Checks, doctorCheckVersion())
+
+	devices, check := doctorCheckDiscovery()
+	report.Devices = devices
+	report.Checks = append(report.Checks, check)
+	for _, device := range devices {
+		report.Checks = append(report.Checks, doctorCheckStats(device))
+	}
+
+	report.Status = doctorPass
+	for _, check := range report.Checks {
+		switch {
+		case check.Status == doctorFail:
+			report.Status = doctorFail
+		case check.Status == doctorWarn && report.Status == doctorPass:
+			report.Status = doctorWarn
+		}
+	}
+	return report
+}
+
+// doctorCheckPath checks that a host path the exporter relies on exists
+func doctorCheckPath(path string) doctorCheck {
+	check := doctorCheck{Name: "path:" + path}
+	info, err := os.Stat(path)
+	if err != nil {
+		check.Status = doctorWarn
+		check.Detail = err.Error()
+		check.Hint = "mount " + path + " from the host (hostPath volume in deploy/daemonset.yaml)"
+		for _, required := range readinessPaths {
+			if path == required {
+				check.Status = doctorFail
+			}
+		}
+		return check
+	}
+	check.Status = doctorPass
+	if !info.IsDir() {
+		check.Detail = "file"
+		return check
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		check.Status = doctorWarn
+		check.Detail = err.Error()
+		check.Hint = "make " + path + " readable by the exporter user"
+		return check
+	}
+	check.Detail = fmt.Sprintf("directory, %d entries", len(entries))
+	if path == sysClassInfiniband && len(entries) == 0 {
+		check.Status = doctorFail
+		check.Detail = "no RDMA devices registered"
+		check.Hint = "check that the instance has an ERDMA interface attached and the erdma module is loaded"
+	}
+	return check
+}
+
+// mountInfo is a mount point read from /proc/self/mountinfo
+type mountInfo struct {
+	Point   string
+	FSType  string
+	Options string
+}
+
+// readMounts parses /proc/self/mountinfo
+func readMounts() ([]mountInfo, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []mountInfo
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// id parent major:minor root mountpoint options [optional...] - fstype source superoptions
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 6 || sep < 0 || sep+1 >= len(fields) {
+			continue
+		}
+		mounts = append(mounts, mountInfo{Point: unescapeMountPath(fields[4]), FSType: fields[sep+1], Options: fields[5]})
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPath decodes the octal escapes used in mountinfo paths
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// mountFor returns the mount that contains path
+func mountFor(mounts []mountInfo, path string) (mountInfo, bool) {
+	var best mountInfo
+	found := false
+	for _, m := range mounts {
+		if (m.Point == "/" || path == m.Point || strings.HasPrefix(path, m.Point+"/")) && len(m.Point) >= len(best.Point) {
+			best, found = m, true
+		}
+	}
+	return best, found
+}
+
+// doctorCheckMounts checks that sysfs and the RDMA device nodes are
+// mounted from the host
+func doctorCheckMounts() []doctorCheck {
+	mounts, err := readMounts()
+	if err != nil {
+		return []doctorCheck{{Name: "mounts", Status: doctorWarn, Detail: err.Error(), Hint: "mount /proc so that mounts can be inspected"}}
+	}
+
+	sys := doctorCheck{Name: "mount:" + sysClassInfiniband}
+	m, ok := mountFor(mounts, sysClassInfiniband)
+	switch {
+	case !ok:
+		sys.Status = doctorFail
+		sys.Detail = "no mount found"
+		sys.Hint = "mount the host /sys into the container"
+	case m.FSType != "sysfs":
+		sys.Status = doctorFail
+		sys.Detail = fmt.Sprintf("on %s (%s), not sysfs", m.Point, m.FSType)
+		sys.Hint = "mount the host /sys into the container"
+	default:
+		sys.Status = doctorPass
+		sys.Detail = fmt.Sprintf("%s (%s, %s)", m.Point, m.FSType, m.Options)
+	}
+
+	dev := doctorCheck{Name: "mount:/dev/infiniband"}
+	nodes, _ := filepath.Glob("/dev/infiniband/uverbs*")
+	var usable []string
+	for _, node := range nodes {
+		info, err := os.Stat(node)
+		if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+			continue
+		}
+		if syscall.Access(node, 0x6) == nil { // R_OK|W_OK
+			usable = append(usable, filepath.Base(node))
+		}
+	}
+	switch {
+	case len(nodes) == 0:
+		dev.Status = doctorFail
+		dev.Detail = "no uverbs device nodes in /dev/infiniband"
+		dev.Hint = "mount the host /dev/infiniband into the container"
+	case len(usable) == 0:
+		dev.Status = doctorFail
+		dev.Detail = fmt.Sprintf("%d uverbs device node(s), none readable and writable", len(nodes))
+		dev.Hint = "run the exporter as root or grant access to /dev/infiniband/uverbs*"
+	default:
+		dev.Status = doctorPass
+		dev.Detail = strings.Join(usable, ", ")
+	}
+	if m, ok := mountFor(mounts, "/dev/infiniband"); ok {
+		dev.Detail += fmt.Sprintf(" on %s (%s)", m.Point, m.FSType)
+	}
+	return []doctorCheck{sys, dev}
+}
+
+// doctorCheckModule checks that the erdma kernel module is loaded
+func doctorCheckModule() doctorCheck {
+	check := doctorCheck{Name: "module:" + erdmaModule}
+	dir := filepath.Join("/sys/module", erdmaModule)
+	if _, err := os.Stat(dir); err != nil {
+		check.Status = doctorFail
+		check.Detail = "module not loaded"
+		check.Hint = "load the driver on the host with 'modprobe erdma'; install the ERDMA driver package if it is missing"
+		return check
+	}
+	check.Status = doctorPass
+	check.Detail = "loaded"
+	if version := readSysfs(filepath.Join(dir, "version")); version != "" {
+		check.Detail += ", version " + version
+	}
+	return check
+}
+
+// doctorCheckCapabilities checks the effective capabilities eadm may need
+// to query the driver
+func doctorCheckCapabilities() doctorCheck {
+	check := doctorCheck{Name: "capabilities"}
+	data, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		check.Status = doctorWarn
+		check.Detail = err.Error()
+		return check
+	}
+	var capEff uint64
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "CapEff:"); ok {
+			capEff, _ = strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		}
+	}
+
+	var missing []string
+	if capEff&(1<<capNetAdmin) == 0 {
+		missing = append(missing, "CAP_NET_ADMIN")
+	}
+	if capEff&(1<<capSysAdmin) == 0 {
+		missing = append(missing, "CAP_SYS_ADMIN")
+	}
+	check.Detail = fmt.Sprintf("uid %d, CapEff %016x", os.Geteuid(), capEff)
+	if len(missing) > 0 {
+		check.Status = doctorWarn
+		check.Detail += ", missing " + strings.Join(missing, ", ")
+		check.Hint = "eadm may be unable to read statistics without these; run privileged or add the capabilities"
+		return check
+	}
+	check.Status = doctorPass
+	return check
+}
+
+// doctorCheckTool checks that a tool is found and executable
+func doctorCheckTool(name string) doctorCheck {
+	check := doctorCheck{Name: "tool:" + name}
+	path := findCommand(name)
+	if !filepath.IsAbs(path) {
+		if _, err := exec.LookPath(path); err != nil {
+			check.Status = doctorFail
+			check.Detail = err.Error()
+			check.Hint = "install erdma-tools, add it to PATH or set tools." + name + " in the config file"
+			return check
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		check.Status = doctorFail
+		check.Detail = err.Error()
+		check.Hint = "fix tools." + name + " in the config file or install erdma-tools"
+		return check
+	}
+	check.Detail = fmt.Sprintf("%s (%s)", path, info.Mode())
+	if info.IsDir() || syscall.Access(path, 0x1) != nil { // X_OK
+		check.Status = doctorFail
+		check.Hint = "make " + path + " executable for the exporter user (chmod +x)"
+		return check
+	}
+	check.Status = doctorPass
+	return check
+}
+
+// doctorCheckVersion checks that the driver version can be read
+func doctorCheckVersion() doctorCheck {
+	check := doctorCheck{Name: "driver-version"}
+	version, err := getVersion()
+	if err != nil {
+		check.Status = doctorFail
+		check.Detail = err.Error()
+		check.Hint = "run 'eadm ver' by hand; the ERDMA driver or erdma-tools may be missing or too old"
+		return check
+	}
+	check.Status = doctorPass
+	check.Detail = version
+	return check
+}
+
+// doctorCheckDiscovery discovers devices with ibv_devices and compares
+// them with the devices registered in sysfs
+func doctorCheckDiscovery() ([]Device, doctorCheck) {
+	check := doctorCheck{Name: "devices"}
+	devices, err := getDevices()
+	if err != nil {
+		check.Status = doctorFail
+		check.Detail = err.Error()
+		check.Hint = "run 'ibv_devices' by hand; check /dev/infiniband and the rdma-core libraries"
+		return nil, check
+	}
+	filter := &activeConfig().Filters.Devices
+	devices = slices.DeleteFunc(devices, func(device Device) bool { return !filter.Match(device.Name) })
+	if len(devices) == 0 {
+		check.Status = doctorFail
+		check.Detail = "no ERDMA devices discovered"
+		check.Hint = "attach an ERDMA interface to the instance, or check the device filters in the config file"
+		return nil, check
+	}
+
+	names := make([]string, len(devices))
+	for i, device := range devices {
+		names[i] = device.Name
+	}
+	check.Status = doctorPass
+	check.Detail = strings.Join(names, ", ")
+
+	if toolBackend == nil {
+		var missing []string
+		for _, name := range names {
+			if _, err := os.Stat(filepath.Join(sysClassInfiniband, name)); err != nil {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			check.Status = doctorWarn
+			check.Detail += "; not in " + sysClassInfiniband + ": " + strings.Join(missing, ", ")
+			check.Hint = "mount the host /sys so that device topology can be read"
+		}
+	}
+	return devices, check
+}
+
+// doctorCheckStats checks that the statistics of a device can be read and parsed
+func doctorCheckStats(device Device) doctorCheck {
+	check := doctorCheck{Name: "stats:" + device.Name}
+	stats, err := getDeviceStats(device.Name)
+	if err != nil {
+		check.Status = doctorFail
+		check.Detail = err.Error()
+		check.Hint = "run 'eadm stat -d " + device.Name + "' by hand; check the capabilities and the driver version"
+		if _, ok := isUnknownFormat(err); ok {
+			check.Hint = "the eadm stat output format is not recognized; record it with --record-dir and report it"
+		}
+		return check
+	}
+
+	present := 0
+	for _, field := range statFields {
+		if field(stats).Present {
+			present++
+		}
+	}
+	skipped := 0
+	for _, n := range stats.ParseErrors {
+		skipped += n
+	}
+	check.Detail = fmt.Sprintf("%d of %d known counters, %d total", present, len(statFields), len(stats.Raw))
+	switch {
+	case present == 0:
+		check.Status = doctorFail
+		check.Hint = "the eadm stat output format is not recognized; record it with --record-dir and report it"
+	case skipped > 0:
+		check.Status = doctorWarn
+		check.Detail += fmt.Sprintf(", %d line(s) skipped", skipped)
+		check.Hint = "part of the eadm stat output is not recognized; record it with --record-dir and report it"
+	default:
+		check.Status = doctorPass
+	}
+	return check
+}
+
+// writeDoctorTable writes a report as an aligned table
+func writeDoctorTable(w io.Writer, report doctorReport) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tCHECK\tDETAIL")
+	for _, check := range report.Checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", strings.ToUpper(string(check.Status)), check.Name, check.Detail)
+		if check.Hint != "" && check.Status != doctorPass {
+			fmt.Fprintf(tw, "\t\t-> %s\n", check.Hint)
+		}
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nnode %s: %s\n", report.Node, report.Status)
+}
+
+// setupCommand prepares a subcommand that runs tools: it loads the config
+// file, if any, and logs to stderr only if verbose, since tool errors are
+// reported in the command's own output
+func setupCommand(configFile string, toolTimeout time.Duration, verbose bool) error {
+	logOutput, logLevelName := io.Discard, "error"
+	if verbose {
+		logOutput, logLevelName = os.Stderr, "debug"
+	}
+	if err := setupLogging(logOutput, logLevelName, "logfmt", 0); err != nil {
+		return err
+	}
+
+	config := defaultConfig()
+	config.Timeouts.Tool = duration(toolTimeout)
+	if configFile != "" {
+		data, err := os.ReadFile(configFile)
+		if err == nil {
+			config, err = parseConfig(data, config)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", configFile, err)
+		}
+	}
+	currentConfig.Store(config)
+	return nil
+}
+
+// logDoctorReport logs each check at a level matching its status
+func logDoctorReport(report doctorReport) {
+	for _, check := range report.Checks {
+		args := []any{"check", check.Name, "detail", check.Detail}
+		switch check.Status {
+		case doctorFail:
+			slog.Error("Check failed", append(args, "hint", check.Hint)...)
+		case doctorWarn:
+			slog.Warn("Check warning", append(args, "hint", check.Hint)...)
+		default:
+			slog.Info("Check passed", args...)
+		}
+	}
+}
+
+// runDoctorCommand implements "erdma-exporter doctor". It exits with 1 if
+// any check failed, or with --fail-on-warn also if any check warned.
+func runDoctorCommand(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	format := fs.String("format", "table", "Output format, table or json.")
+	configFile := fs.String("config.file", "", "YAML config file with tool paths and device filters.")
+	toolTimeout := fs.Duration("tool.timeout", 30*time.Second, "Timeout of a single eadm or ibv_devices invocation.")
+	failOnWarn := fs.Bool("fail-on-warn", false, "Exit non-zero if any check warned.")
+	verbose := fs.Bool("verbose", false, "Log tool invocations and errors to stderr.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *format != "table" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "unknown format %q, use table or json\n", *format)
+		return 2
+	}
+
+	if err := setupCommand(*configFile, *toolTimeout, *verbose); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	report := runDoctor()
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		writeDoctorTable(os.Stdout, report)
+	}
+
+	if report.Status == doctorFail || (*failOnWarn && report.Status == doctorWarn) {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// toolBackendFunc is a ToolBackend backed by a function
+type toolBackendFunc func(name string, args ...string) ([]byte, []byte, error)
+
+func (f toolBackendFunc) Run(name string, args ...string) ([]byte, []byte, error) {
+	return f(name, args...)
+}
+
+// doctorTools returns tools that discover erdma_0 with the given eadm stat
+// output, or fail ibv_devices if stats is empty
+func doctorTools(stats string) toolBackendFunc {
+	return func(name string, args ...string) ([]byte, []byte, error) {
+		switch {
+		case name == "ibv_devices" && stats == "":
+			return nil, []byte("Failed to get IB devices list"), errors.New("exit status 1")
+		case name == "ibv_devices":
+			return []byte("erdma_0 0216:3eff:fe50:30b0\n"), nil, nil
+		case args[0] == "ver":
+			return []byte("Query kernel driver version: 0.2.41\n"), nil, nil
+		default:
+			return []byte(stats), nil, nil
+		}
+	}
+}
+
+// runDoctorCommandOutput runs the doctor command with the tool backend and
+// returns its exit code and standard output. With a tool backend the host
+// checks are skipped, so the outcome does not depend on this machine.
+func runDoctorCommandOutput(t *testing.T, tools ToolBackend, args ...string) (int, string) {
+	t.Helper()
+	toolBackend = tools
+	t.Cleanup(func() { toolBackend = nil })
+	captureLogs(t)
+	level := logLevel.Level()
+	t.Cleanup(func() { logLevel.Set(level) })
+	useConfig(t, activeConfig())
+	t.Setenv("NODE_NAME", "node-1")
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	code := runDoctorCommand(args)
+	os.Stdout = stdout
+
+	data, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code, string(data)
+}
+
+func TestDoctorCommandExitCodes(t *testing.T) {
+	healthy := "hw_tx_bytes_cnt : 5\nhw_rx_bytes_cnt : 7\n"
+	skipped := healthy + "hw_rx_packets_cnt : -1\n"
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configFile, []byte("timeouts:\n  tool: -1s\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		stats string
+		args  []string
+		code  int
+		want  []string
+	}{
+		{"pass", healthy, nil, 0, []string{"PASS    devices         erdma_0", "PASS    stats:erdma_0   2 of", "node node-1: pass"}},
+		{"warning", skipped, nil, 0, []string{"WARN    stats:erdma_0", "1 line(s) skipped", "-> part of the eadm stat output", "node node-1: warn"}},
+		{"warning with --fail-on-warn", skipped, []string{"--fail-on-warn"}, 1, []string{"node node-1: warn"}},
+		{"failure", "", nil, 1, []string{"FAIL    devices", "-> run 'ibv_devices' by hand", "node node-1: fail"}},
+		{"unknown format", healthy, []string{"--format=yaml"}, 2, nil},
+		{"unknown flag", healthy, []string{"--bogus"}, 2, nil},
+		{"invalid config file", healthy, []string{"--config.file=" + configFile}, 2, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			code, out := runDoctorCommandOutput(t, doctorTools(tc.stats), tc.args...)
+			if code != tc.code {
+				t.Errorf("exit code %d, want %d\n%s", code, tc.code, out)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("output does not contain %q\n%s", want, out)
+				}
+			}
+		})
+	}
+}
+
+func TestDoctorCommandJSON(t *testing.T) {
+	code, out := runDoctorCommandOutput(t, doctorTools("hw_tx_bytes_cnt : 5\n"), "--format=json")
+	if code != 0 {
+		t.Errorf("exit code %d", code)
+	}
+	var report doctorReport
+	if err := json.Unmarshal([]byte(out), &report); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	if report.Node != "node-1" || report.Status != doctorPass || len(report.Devices) != 1 || report.Devices[0].Name != "erdma_0" {
+		t.Errorf("report %+v", report)
+	}
+	var names []string
+	for _, check := range report.Checks {
+		names = append(names, check.Name)
+	}
+	if got := strings.Join(names, ","); got != "driver-version,devices,stats:erdma_0" {
+		t.Errorf("checks %s, want the host checks skipped", got)
+	}
+}
+
+func TestDoctorCheckPath(t *testing.T) {
+	dir := t.TempDir()
+	if check := doctorCheckPath(dir); check.Status != doctorPass || check.Detail != "directory, 0 entries" {
+		t.Errorf("empty directory: %+v", check)
+	}
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if check := doctorCheckPath(file); check.Status != doctorPass || check.Detail != "file" {
+		t.Errorf("file: %+v", check)
+	}
+	// Missing paths only fail the check if readiness depends on them
+	if check := doctorCheckPath(filepath.Join(dir, "missing")); check.Status != doctorWarn || !strings.Contains(check.Hint, "hostPath") {
+		t.Errorf("missing path: %+v", check)
+	}
+}
+
+func TestDoctorCheckTool(t *testing.T) {
+	captureLogs(t)
+	dir := t.TempDir()
+	script := filepath.Join(dir, "eadm")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config := defaultConfig()
+	config.Tools.Eadm = script
+	useConfig(t, config)
+	if check := doctorCheckTool("eadm"); check.Status != doctorFail || !strings.Contains(check.Hint, "chmod +x") {
+		t.Errorf("not executable: %+v", check)
+	}
+	if err := os.Chmod(script, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if check := doctorCheckTool("eadm"); check.Status != doctorPass || !strings.HasPrefix(check.Detail, script) {
+		t.Errorf("executable: %+v", check)
+	}
+
+	t.Setenv("PATH", dir)
+	if check := doctorCheckTool("ibv_devices"); check.Status != doctorFail || !strings.Contains(check.Hint, "tools.ibv_devices") {
+		t.Errorf("missing: %+v", check)
+	}
+}
+
+func TestMountFor(t *testing.T) {
+	mounts := []mountInfo{
+		{Point: "/", FSType: "overlay"},
+		{Point: "/sys", FSType: "sysfs"},
+		{Point: "/sys/fs/cgroup", FSType: "cgroup2"},
+		{Point: "/dev/infini band", FSType: "devtmpfs"},
+	}
+	for path, want := range map[string]string{
+		"/sys/class/infiniband": "sysfs",
+		"/sys/fs/cgroup":        "cgroup2",
+		"/system":               "overlay",
+		"/dev/infini band/x":    "devtmpfs",
+	} {
+		if m, ok := mountFor(mounts, path); !ok || m.FSType != want {
+			t.Errorf("mountFor(%q) = %+v, %v, want %s", path, m, ok, want)
+		}
+	}
+	if _, ok := mountFor(mounts[1:2], "/dev"); ok {
+		t.Error("mount found outside every mount point")
+	}
+	if got := unescapeMountPath(`/dev/infini\040band`); got != "/dev/infini band" {
+		t.Errorf("unescapeMountPath = %q", got)
+	}
+}
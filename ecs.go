@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ecsMetadataURL is the ECS instance metadata service
+var ecsMetadataURL = "http://100.100.100.200/latest"
+
+// ecsMetadataTimeout bounds a metadata request, which hangs off ECS
+const ecsMetadataTimeout = 2 * time.Second
+
+// ecsMetadataTokenTTL is the lifetime requested for metadata tokens
+const ecsMetadataTokenTTL = 6 * time.Hour
+
+// ecsInstance is the identity of the ECS instance the exporter runs on
+type ecsInstance struct {
+	InstanceID string
+	RegionID   string
+	ZoneID     string
+}
+
+var ecsIdentity struct {
+	sync.Once
+	instance ecsInstance
+	err      error
+}
+
+// ecsMetadataToken requests a token for the metadata service in hardened
+// mode. Instances in normal mode answer without a token, so failure to get
+// one is not an error.
+func ecsMetadataToken(ctx context.Context, client *http.Client) string {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, ecsMetadataURL+"/api/token", nil)
+	if err != nil {
+		return ""
+	}
+	req.Header.Set("X-aliyun-ecs-metadata-token-ttl-seconds", fmt.Sprint(int(ecsMetadataTokenTTL.Seconds())))
+	resp, err := client.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// ecsMetadata reads a path below latest/ from the metadata service
+func ecsMetadata(ctx context.Context, client *http.Client, token, path string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ecsMetadataURL+"/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		req.Header.Set("X-aliyun-ecs-metadata-token", token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata %s: %s", path, resp.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// getECSInstance returns the instance, region and zone ID from the ECS
+// metadata service. The result, or the failure off ECS, is cached.
+func getECSInstance() (ecsInstance, error) {
+	ecsIdentity.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), ecsMetadataTimeout)
+		defer cancel()
+		client := &http.Client{}
+		token := ecsMetadataToken(ctx, client)
+		for _, item := range []struct {
+			path string
+			dst  *string
+		}{
+			{"meta-data/instance-id", &ecsIdentity.instance.InstanceID},
+			{"meta-data/region-id", &ecsIdentity.instance.RegionID},
+			{"meta-data/zone-id", &ecsIdentity.instance.ZoneID},
+		} {
+			value, err := ecsMetadata(ctx, client, token, item.path)
+			if err != nil {
+				ecsIdentity.err = fmt.Errorf("ECS metadata service unavailable: %w", err)
+				return
+			}
+			*item.dst = value
+		}
+	})
+	return ecsIdentity.instance, ecsIdentity.err
+}
+
+// ecsCredentials are temporary credentials of the RAM role of the instance
+type ecsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	AccessKeySecret string    `json:"AccessKeySecret"`
+	SecurityToken   string    `json:"SecurityToken"`
+	Expiration      time.Time `json:"Expiration"`
+	Code            string    `json:"Code"`
+}
+
+// getECSRoleCredentials returns STS credentials of the RAM role attached to
+// the instance. If role is empty, the attached role is looked up.
+func getECSRoleCredentials(ctx context.Context, role string) (ecsCredentials, error) {
+	var creds ecsCredentials
+	ctx, cancel := context.WithTimeout(ctx, ecsMetadataTimeout)
+	defer cancel()
+	client := &http.Client{}
+	token := ecsMetadataToken(ctx, client)
+	if role == "" {
+		roles, err := ecsMetadata(ctx, client, token, "meta-data/ram/security-credentials/")
+		if err != nil {
+			return creds, fmt.Errorf("look up RAM role: %w", err)
+		}
+		role, _, _ = strings.Cut(roles, "\n")
+		if role == "" {
+			return creds, fmt.Errorf("no RAM role is attached to the instance")
+		}
+	}
+	data, err := ecsMetadata(ctx, client, token, "meta-data/ram/security-credentials/"+role)
+	if err != nil {
+		return creds, fmt.Errorf("RAM role %s: %w", role, err)
+	}
+	if err := json.Unmarshal([]byte(data), &creds); err != nil {
+		return creds, fmt.Errorf("RAM role %s: %w", role, err)
+	}
+	if creds.Code != "Success" || creds.AccessKeyID == "" {
+		return creds, fmt.Errorf("RAM role %s: metadata service returned code %q", role, creds.Code)
+	}
+	return creds, nil
+}
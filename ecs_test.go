@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeMetadata is a stand-in for the ECS metadata service
+type fakeMetadata struct {
+	// hardened requires a token for every request
+	hardened bool
+	// creds are returned for the RAM role erdma-role
+	mu    sync.Mutex
+	creds ecsCredentials
+	// down fails every request
+	down atomic.Bool
+	// credRequests counts the requests for role credentials
+	credRequests atomic.Int32
+}
+
+// newFakeMetadata points ecsMetadataURL to a new stand-in for the rest of
+// the test
+func newFakeMetadata(t *testing.T, hardened bool) *fakeMetadata {
+	t.Helper()
+	m := &fakeMetadata{hardened: hardened}
+	server := httptest.NewServer(m)
+	t.Cleanup(server.Close)
+	saved := ecsMetadataURL
+	ecsMetadataURL = server.URL + "/latest"
+	t.Cleanup(func() { ecsMetadataURL = saved })
+	return m
+}
+
+func (m *fakeMetadata) setCredentials(creds ecsCredentials) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.creds = creds
+}
+
+func (m *fakeMetadata) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.down.Load() {
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Path == "/latest/api/token" {
+		if r.Method != http.MethodPut || r.Header.Get("X-aliyun-ecs-metadata-token-ttl-seconds") != "21600" || !m.hardened {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("token-1"))
+		return
+	}
+	if m.hardened && r.Header.Get("X-aliyun-ecs-metadata-token") != "token-1" {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	switch r.URL.Path {
+	case "/latest/meta-data/instance-id":
+		w.Write([]byte("i-bp1abc\n"))
+	case "/latest/meta-data/region-id":
+		w.Write([]byte("cn-hangzhou"))
+	case "/latest/meta-data/zone-id":
+		w.Write([]byte("cn-hangzhou-h"))
+	case "/latest/meta-data/ram/security-credentials/":
+		w.Write([]byte("erdma-role"))
+	case "/latest/meta-data/ram/security-credentials/erdma-role":
+		m.credRequests.Add(1)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		json.NewEncoder(w).Encode(m.creds)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// resetECSIdentity forgets the cached instance identity
+func resetECSIdentity(t *testing.T) {
+	ecsIdentity.Once = sync.Once{}
+	ecsIdentity.instance, ecsIdentity.err = ecsInstance{}, nil
+	t.Cleanup(func() {
+		ecsIdentity.Once = sync.Once{}
+		ecsIdentity.instance, ecsIdentity.err = ecsInstance{}, nil
+	})
+}
+
+func TestGetECSInstance(t *testing.T) {
+	want := ecsInstance{InstanceID: "i-bp1abc", RegionID: "cn-hangzhou", ZoneID: "cn-hangzhou-h"}
+	for _, hardened := range []bool{false, true} {
+		resetECSIdentity(t)
+		newFakeMetadata(t, hardened)
+		instance, err := getECSInstance()
+		if err != nil || instance != want {
+			t.Errorf("hardened %v: instance %+v, %v, want %+v", hardened, instance, err, want)
+		}
+	}
+
+	// Off ECS the failure is cached
+	resetECSIdentity(t)
+	m := newFakeMetadata(t, false)
+	m.down.Store(true)
+	if _, err := getECSInstance(); err == nil || !strings.Contains(err.Error(), "metadata service unavailable") {
+		t.Errorf("error = %v", err)
+	}
+	m.down.Store(false)
+	if _, err := getECSInstance(); err == nil {
+		t.Error("failure not cached")
+	}
+}
+
+func TestGetECSRoleCredentials(t *testing.T) {
+	m := newFakeMetadata(t, true)
+	expiration := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	m.setCredentials(ecsCredentials{AccessKeyID: "STS.1", AccessKeySecret: "secret", SecurityToken: "sts-token", Expiration: expiration, Code: "Success"})
+
+	// The attached role is looked up unless one is given
+	for _, role := range []string{"", "erdma-role"} {
+		creds, err := getECSRoleCredentials(context.Background(), role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if creds.AccessKeyID != "STS.1" || creds.SecurityToken != "sts-token" || !creds.Expiration.Equal(expiration) {
+			t.Errorf("role %q: credentials %+v", role, creds)
+		}
+	}
+	if _, err := getECSRoleCredentials(context.Background(), "other-role"); err == nil || !strings.Contains(err.Error(), "other-role") {
+		t.Errorf("unknown role: error = %v", err)
+	}
+	m.setCredentials(ecsCredentials{Code: "Failed"})
+	if _, err := getECSRoleCredentials(context.Background(), ""); err == nil || !strings.Contains(err.Error(), `code "Failed"`) {
+		t.Errorf("failed code: error = %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// requiredPaths are the host paths the exporter relies on
+var requiredPaths = []string{
+	"/dev/infiniband",
+	"/sys/class/infiniband",
+	"/sys/bus/pci",
+	"/sys/devices",
+	"/usr/bin",
+	"/usr/sbin",
+}
+
+// readinessPaths must exist for the node to expose ERDMA devices
+var readinessPaths = []string{
+	"/dev/infiniband",
+	"/sys/class/infiniband",
+}
+
+// readinessTools must be resolvable for the exporter to collect anything
+var readinessTools = []string{"eadm", "ibv_devices"}
+
+// discoveryMaxAge is how old the last device discovery may be before
+// /readyz runs a fresh one
+const discoveryMaxAge = 5 * time.Minute
+
+// discoveryStatus is the outcome of a device discovery
+type discoveryStatus struct {
+	Time    time.Time
+	Devices []Device
+	Err     error
+}
+
+// healthCheck is the result of a single readiness check
+type healthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// healthReport is the JSON body served by /readyz
+type healthReport struct {
+	Status string        `json:"status"`
+	Checks []healthCheck `json:"checks"`
+}
+
+// checkTool reports whether a tool can be run from where the collector
+// runs it: its path in the config file, or else PATH. It is resolved on
+// every check, so that a reloaded config takes effect.
+func checkTool(name string) healthCheck {
+	check := healthCheck{Name: "tool:" + name}
+	if toolBackend != nil {
+		check.OK = true
+		check.Detail = "skipped: tool output is replayed or simulated"
+		return check
+	}
+	// LookPath also checks that a configured absolute path is executable
+	path, err := exec.LookPath(findCommand(name))
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	check.OK = true
+	check.Detail = path
+	return check
+}
+
+// checkPath reports whether a host path exists
+func checkPath(path string) healthCheck {
+	check := healthCheck{Name: "path:" + path}
+	if toolBackend != nil {
+		check.OK = true
+		check.Detail = "skipped: tool output is replayed or simulated"
+		return check
+	}
+	if _, err := os.Stat(path); err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	check.OK = true
+	return check
+}
+
+// checkDiscovery reports whether the last discovery found at least one device
+func checkDiscovery(status discoveryStatus) healthCheck {
+	check := healthCheck{Name: "devices"}
+	switch {
+	case status.Err != nil:
+		check.Detail = status.Err.Error()
+	case len(status.Devices) == 0:
+		check.Detail = "no ERDMA devices discovered"
+	default:
+		check.OK = true
+		check.Detail = fmt.Sprintf("%d device(s) discovered", len(status.Devices))
+	}
+	check.Detail += fmt.Sprintf(" at %s", status.Time.Format(time.RFC3339))
+	return check
+}
+
+// healthzHandler reports process liveness
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// readyzHandler reports whether the tools and host paths are present and
+// the last collection cycle discovered at least one device
+func readyzHandler(collector *ErdmaCollector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := healthReport{Status: "ok"}
+		for _, tool := range readinessTools {
+			report.Checks = append(report.Checks, checkTool(tool))
+		}
+		for _, path := range readinessPaths {
+			report.Checks = append(report.Checks, checkPath(path))
+		}
+
+		// Run a discovery if no collection cycle has happened recently,
+		// so that readiness does not depend on being scraped first
+		status := collector.LastDiscovery()
+		if time.Since(status.Time) > discoveryMaxAge {
+			collector.discover()
+			status = collector.LastDiscovery()
+		}
+		report.Checks = append(report.Checks, checkDiscovery(status))
+
+		code := http.StatusOK
+		for _, check := range report.Checks {
+			if !check.OK {
+				report.Status = "fail"
+				code = http.StatusServiceUnavailable
+				break
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(report)
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useConfig makes config the active configuration for the rest of the test
+func useConfig(t *testing.T, config *Config) {
+	t.Helper()
+	prev := currentConfig.Load()
+	currentConfig.Store(config)
+	t.Cleanup(func() { currentConfig.Store(prev) })
+}
+
+// TestCheckToolConfiguredPath checks that the readiness check finds tools
+// at their configured paths outside PATH, and follows config reloads
+func TestCheckToolConfiguredPath(t *testing.T) {
+	dir := t.TempDir()
+	eadm := filepath.Join(dir, "eadm-2.0")
+	if err := os.WriteFile(eadm, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	notExecutable := filepath.Join(dir, "eadm.txt")
+	if err := os.WriteFile(notExecutable, []byte("#!/bin/sh\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", t.TempDir())
+
+	config := defaultConfig()
+	config.Tools.Eadm = eadm
+	useConfig(t, config)
+	if check := checkTool("eadm"); !check.OK || check.Detail != eadm {
+		t.Errorf("configured path: %+v", check)
+	}
+	if check := checkTool("ibv_devices"); check.OK {
+		t.Errorf("ibv_devices found outside PATH: %+v", check)
+	}
+
+	for _, path := range []string{filepath.Join(dir, "missing"), notExecutable} {
+		reloaded := defaultConfig()
+		reloaded.Tools.Eadm = path
+		currentConfig.Store(reloaded)
+		if check := checkTool("eadm"); check.OK || !strings.Contains(check.Detail, path) {
+			t.Errorf("%s after reload: %+v", path, check)
+		}
+	}
+
+	// Without a configured path the tool is looked up in PATH
+	currentConfig.Store(defaultConfig())
+	t.Setenv("PATH", dir)
+	if err := os.Rename(eadm, filepath.Join(dir, "eadm")); err != nil {
+		t.Fatal(err)
+	}
+	if check := checkTool("eadm"); !check.OK || check.Detail != filepath.Join(dir, "eadm") {
+		t.Errorf("PATH: %+v", check)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	w := httptest.NewRecorder()
+	healthzHandler(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "ok\n" {
+		t.Errorf("status %d, body %q", w.Code, w.Body)
+	}
+}
+
+// TestReadyz checks that /readyz runs a discovery when none happened
+// recently, reuses a recent one, and fails while no device was found
+func TestReadyz(t *testing.T) {
+	captureLogs(t)
+	// The tool and path checks are skipped with a tool backend, the
+	// collector's own runner is used for discovery
+	toolBackend = NewSimulator(&Scenario{})
+	t.Cleanup(func() { toolBackend = nil })
+	c, calls := newDiscoveryCollector(t, 1)
+	handler := readyzHandler(c)
+	ready := func() (int, healthReport) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if got := w.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("Content-Type = %q", got)
+		}
+		var report healthReport
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, report
+	}
+	devices := func(report healthReport) healthCheck {
+		return report.Checks[len(report.Checks)-1]
+	}
+
+	code, report := ready()
+	if code != http.StatusServiceUnavailable || report.Status != "fail" || calls.Load() != 1 {
+		t.Errorf("failed discovery: status %d, report %+v, %d discoveries", code, report, calls.Load())
+	}
+	if check := devices(report); check.Name != "devices" || check.OK || !strings.Contains(check.Detail, "failed to execute ibv_devices") {
+		t.Errorf("devices check %+v", check)
+	}
+	for _, check := range report.Checks[:len(report.Checks)-1] {
+		if !check.OK || !strings.HasPrefix(check.Detail, "skipped") {
+			t.Errorf("check %+v not skipped with a tool backend", check)
+		}
+	}
+
+	// A recent discovery is reused, even a failed one
+	if code, _ := ready(); code != http.StatusServiceUnavailable || calls.Load() != 1 {
+		t.Errorf("status %d after %d discoveries, want the first reused", code, calls.Load())
+	}
+
+	c.discoveryMu.Lock()
+	c.lastDiscovery.Time = time.Now().Add(-discoveryMaxAge - time.Second)
+	c.discoveryMu.Unlock()
+	code, report = ready()
+	if code != http.StatusOK || report.Status != "ok" || calls.Load() != 2 {
+		t.Errorf("stale discovery: status %d, report %+v, %d discoveries", code, report, calls.Load())
+	}
+	if check := devices(report); !check.OK || !strings.HasPrefix(check.Detail, "1 device(s) discovered at ") {
+		t.Errorf("devices check %+v", check)
+	}
+}
+
+func TestCheckDiscoveryNoDevices(t *testing.T) {
+	check := checkDiscovery(discoveryStatus{Time: time.Now()})
+	if check.OK || !strings.HasPrefix(check.Detail, "no ERDMA devices discovered at ") {
+		t.Errorf("check %+v", check)
+	}
+}
+
+func TestCheckPath(t *testing.T) {
+	dir := t.TempDir()
+	if check := checkPath(dir); !check.OK || check.Name != "path:"+dir {
+		t.Errorf("existing path: %+v", check)
+	}
+	missing := filepath.Join(dir, "infiniband")
+	if check := checkPath(missing); check.OK || !strings.Contains(check.Detail, "no such file") {
+		t.Errorf("missing path: %+v", check)
+	}
+}
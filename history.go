@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// historyColumn is the values of one statistic in a ring, by slot
+type historyColumn struct {
+	values  []uint64
+	present []bool
+}
+
+// sampleRing is a ring of the samples of a device, at most one per
+// resolution. It grows up to size samples and then overwrites the oldest.
+// Statistics are stored as columns rather than a map per sample.
+type sampleRing struct {
+	size       int
+	resolution time.Duration
+	times      []int64 // Unix nanoseconds
+	// start is the slot of the oldest sample once the ring is full
+	start   int
+	columns map[string]*historyColumn
+}
+
+// slot returns the slot of the i-th oldest sample
+func (r *sampleRing) slot(i int) int {
+	return (r.start + i) % len(r.times)
+}
+
+// push adds a sample. A sample in the same resolution interval as the
+// newest one replaces it, so that the ring spans at least size-1
+// intervals however often the collector runs.
+func (r *sampleRing) push(t time.Time, stats map[string]uint64) {
+	var slot int
+	switch newest := len(r.times) - 1; {
+	case newest >= 0 && t.UnixNano() < r.times[r.slot(newest)]:
+		return
+	case newest >= 0 && time.Unix(0, r.times[r.slot(newest)]).Truncate(r.resolution).Equal(t.Truncate(r.resolution)):
+		slot = r.slot(newest)
+	case len(r.times) < r.size:
+		slot = len(r.times)
+		r.times = append(r.times, 0)
+		for _, c := range r.columns {
+			c.values = append(c.values, 0)
+			c.present = append(c.present, false)
+		}
+	default:
+		slot = r.start
+		r.start = (r.start + 1) % len(r.times)
+	}
+	r.times[slot] = t.UnixNano()
+	for _, c := range r.columns {
+		c.present[slot] = false
+	}
+	for key, value := range stats {
+		c, ok := r.columns[key]
+		if !ok {
+			c = &historyColumn{values: make([]uint64, len(r.times)), present: make([]bool, len(r.times))}
+			r.columns[key] = c
+		}
+		c.values[slot] = value
+		c.present[slot] = true
+	}
+}
+
+// sample returns the sample in a slot
+func (r *sampleRing) sample(slot int) *DeviceSample {
+	raw := make(map[string]uint64, len(r.columns))
+	for key, c := range r.columns {
+		if c.present[slot] {
+			raw[key] = c.values[slot]
+		}
+	}
+	return &DeviceSample{Time: time.Unix(0, r.times[slot]), Stats: &DeviceStats{Raw: raw}}
+}
+
+// sampleAt returns the newest sample taken at or before t, or the oldest
+// sample if all are newer
+func (r *sampleRing) sampleAt(t time.Time) *DeviceSample {
+	if len(r.times) == 0 {
+		return nil
+	}
+	i := sort.Search(len(r.times), func(i int) bool { return r.times[r.slot(i)] > t.UnixNano() })
+	return r.sample(r.slot(max(i-1, 0)))
+}
+
+// bytes estimates the memory used by the ring
+func (r *sampleRing) bytes() int {
+	size := 8 * cap(r.times)
+	for key, c := range r.columns {
+		// Values, presence, the key and the map entry
+		size += 8*cap(c.values) + cap(c.present) + len(key) + 64
+	}
+	return size
+}
+
+// historyPoint is a value of a statistic at a point in time. It is encoded
+// as [unix seconds, value], as in the Prometheus query API.
+type historyPoint struct {
+	Time  time.Time
+	Value uint64
+}
+
+func (p historyPoint) MarshalJSON() ([]byte, error) {
+	b := []byte{'['}
+	b = strconv.AppendFloat(b, float64(p.Time.UnixNano())/1e9, 'f', 3, 64)
+	b = append(b, ',')
+	b = strconv.AppendUint(b, p.Value, 10)
+	return append(b, ']'), nil
+}
+
+// query returns the values of the statistics selected by patterns between
+// start and end, oldest first
+func (r *sampleRing) query(patterns []string, start, end time.Time) map[string][]historyPoint {
+	series := map[string][]historyPoint{}
+	for key, c := range r.columns {
+		if !matchPattern(patterns, key) {
+			continue
+		}
+		var points []historyPoint
+		for i := range r.times {
+			slot := r.slot(i)
+			t := time.Unix(0, r.times[slot])
+			if t.Before(start) || t.After(end) || !c.present[slot] {
+				continue
+			}
+			points = append(points, historyPoint{t, c.values[slot]})
+		}
+		if len(points) > 0 {
+			series[key] = points
+		}
+	}
+	return series
+}
+
+// sampleHistory keeps the samples of the last retention period for every
+// device, at most one per resolution, so that what happened on the node
+// recently can be seen at a finer resolution than the scrape interval. It
+// records the samples of every collection cycle, whatever ran it;
+// runHistoryCollection runs cycles for it when nothing else does. Its
+// methods do nothing on a nil history, which is disabled.
+type sampleHistory struct {
+	retention  time.Duration
+	resolution time.Duration
+	size       int
+
+	mu    sync.Mutex
+	rings map[string]*sampleRing
+}
+
+// newSampleHistory creates a history and registers its memory usage with reg
+func newSampleHistory(retention, resolution time.Duration, reg *prometheus.Registry) *sampleHistory {
+	h := &sampleHistory{
+		retention:  retention,
+		resolution: resolution,
+		size:       int((retention+resolution-1)/resolution) + 1,
+		rings:      map[string]*sampleRing{},
+	}
+	reg.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "exporter", Name: "history_bytes",
+			Help: "Estimated memory used by the in-memory history of device samples",
+		}, func() float64 {
+			bytes, _ := h.usage()
+			return float64(bytes)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "exporter", Name: "history_samples",
+			Help: "Number of device samples in the in-memory history",
+		}, func() float64 {
+			_, samples := h.usage()
+			return float64(samples)
+		}),
+	)
+	return h
+}
+
+// usage returns the estimated memory used by the history and the number of
+// samples in it
+func (h *sampleHistory) usage() (bytes, samples int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name, r := range h.rings {
+		bytes += r.bytes() + len(name)
+		samples += len(r.times)
+	}
+	return bytes, samples
+}
+
+// record adds a sample of a device
+func (h *sampleHistory) record(device string, sample *DeviceSample) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r, ok := h.rings[device]
+	if !ok {
+		r = &sampleRing{size: h.size, resolution: h.resolution, columns: map[string]*historyColumn{}}
+		h.rings[device] = r
+	}
+	r.push(sample.Time, sample.Stats.Raw)
+}
+
+// retain drops the history of devices that are no longer present
+func (h *sampleHistory) retain(present map[string]bool) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name := range h.rings {
+		if !present[name] {
+			delete(h.rings, name)
+		}
+	}
+}
+
+// sampleAt returns the newest sample of a device taken at or before t, or
+// the oldest kept if all are newer, or nil if there is none
+func (h *sampleHistory) sampleAt(device string, t time.Time) *DeviceSample {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if r, ok := h.rings[device]; ok {
+		return r.sampleAt(t)
+	}
+	return nil
+}
+
+// runHistoryCollection runs a collection cycle per interval until ctx is
+// done, unless something else just did, so that the history has samples
+// at that resolution even if nothing scrapes
+func runHistoryCollection(ctx context.Context, collector *ErdmaCollector, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		collector.Refresh(interval / 2)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// historyDevice is a device in a query_range response
+type historyDevice struct {
+	Name  string                    `json:"name"`
+	Stats map[string][]historyPoint `json:"stats"`
+}
+
+// historyResponse is the response of /api/v1/query_range
+type historyResponse struct {
+	apiResponse
+	Start      time.Time       `json:"start"`
+	End        time.Time       `json:"end"`
+	Resolution float64         `json:"resolution_seconds"`
+	Devices    []historyDevice `json:"devices"`
+}
+
+// queryRangeHandler serves /api/v1/query_range, which returns the recorded
+// samples of the selected devices and statistics. Query parameters:
+//
+//	device  device names, comma-separated or repeated; all if absent
+//	stat    eadm stat keys, comma-separated or repeated; all if absent
+//	start   beginning of the range; the whole history if absent
+//	end     end of the range; now if absent
+//
+// Names may end in * to select a prefix. Times are RFC 3339 times, Unix
+// seconds or durations before now such as 5m.
+type queryRangeHandler struct {
+	collector *ErdmaCollector
+}
+
+func (q *queryRangeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	state, _ := q.collector.Snapshot()
+	base := apiResponse{Node: q.collector.NodeName(), DriverVersion: state.Version}
+	writeError := func(code int, msg string) {
+		base.Error = msg
+		writeJSONStatus(w, code, base)
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	history := q.collector.history
+	if history == nil {
+		writeError(http.StatusNotFound, "history is disabled, see --history.retention")
+		return
+	}
+
+	query := r.URL.Query()
+	now := time.Now()
+	start, end := now.Add(-history.retention), now
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"start", &start}, {"end", &end}} {
+		if v := query.Get(p.name); v != "" {
+			t, err := parseSince(v, now)
+			if err != nil {
+				writeError(http.StatusBadRequest, fmt.Sprintf("invalid %s %q: must be an RFC 3339 time, Unix seconds or a duration such as 5m", p.name, v))
+				return
+			}
+			*p.t = t
+		}
+	}
+	if end.Before(start) {
+		writeError(http.StatusBadRequest, "end is before start")
+		return
+	}
+	devices := queryList(query["device"])
+	stats := queryList(query["stat"])
+
+	resp := historyResponse{
+		apiResponse: base, Start: start, End: end,
+		Resolution: history.resolution.Seconds(),
+		Devices:    []historyDevice{},
+	}
+	history.mu.Lock()
+	for name, ring := range history.rings {
+		if matchPattern(devices, name) {
+			resp.Devices = append(resp.Devices, historyDevice{Name: name, Stats: ring.query(stats, start, end)})
+		}
+	}
+	history.mu.Unlock()
+	if len(resp.Devices) == 0 && len(devices) > 0 {
+		writeError(http.StatusNotFound, fmt.Sprintf("no recorded device matches %q", strings.Join(devices, ",")))
+		return
+	}
+	sort.Slice(resp.Devices, func(i, j int) bool { return resp.Devices[i].Name < resp.Devices[j].Name })
+	writeJSON(w, resp)
+}
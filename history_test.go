@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestHistoryCollectionWithoutScrapes checks that the history fills up at
+// its collection interval while nothing scrapes
+func TestHistoryCollectionWithoutScrapes(t *testing.T) {
+	c, err := NewErdmaCollector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats atomic.Int64
+	c.run = func(name string, args ...string) ([]byte, []byte, error) {
+		switch {
+		case name == "ibv_devices":
+			return []byte("erdma_0 0216:3eff:fe50:30b0\n"), nil, nil
+		case args[0] == "ver":
+			return []byte("Query kernel driver version: 0.2.41\n"), nil, nil
+		default:
+			return []byte(fmt.Sprintf("hw_tx_bytes_cnt : %d\n", 100*stats.Add(1))), nil, nil
+		}
+	}
+	c.nodeName = "node-1"
+	c.history = newSampleHistory(time.Minute, time.Millisecond, prometheus.NewRegistry())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runHistoryCollection(ctx, c, 20*time.Millisecond)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, samples := c.history.usage(); samples >= 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			_, samples := c.history.usage()
+			t.Fatalf("%d samples after 5s, want 5", samples)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	// Every cycle was recorded, in order
+	c.history.mu.Lock()
+	points := c.history.rings["erdma_0"].query([]string{"hw_tx_bytes_cnt"}, time.Time{}, time.Now())["hw_tx_bytes_cnt"]
+	c.history.mu.Unlock()
+	if int64(len(points)) != stats.Load() {
+		t.Fatalf("%d samples of %d cycles", len(points), stats.Load())
+	}
+	for i, p := range points {
+		if p.Value != uint64(100*(i+1)) {
+			t.Errorf("sample %d = %d, want %d", i, p.Value, 100*(i+1))
+		}
+		if i > 0 && !p.Time.After(points[i-1].Time) {
+			t.Errorf("sample %d at %s, not after %s", i, p.Time, points[i-1].Time)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxLogLevelOverride bounds how long the admin endpoint may raise verbosity
+const maxLogLevelOverride = time.Hour
+
+var (
+	// logLevel is the active level, adjustable at runtime
+	logLevel = new(slog.LevelVar)
+
+	// logLevelOverride restores the configured level after a temporary change
+	logLevelOverride struct {
+		sync.Mutex
+		configured slog.Level
+		timer      *time.Timer
+		until      time.Time
+	}
+)
+
+// parseLogLevel parses debug, info, warn or error
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q: must be debug, info, warn or error", s)
+	}
+	return level, nil
+}
+
+// setupLogging installs the default slog logger writing to w
+func setupLogging(w io.Writer, level string, format string, dedupInterval time.Duration) error {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(lvl)
+	logLevelOverride.configured = lvl
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch format {
+	case "logfmt":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format %q: must be logfmt or json", format)
+	}
+	if dedupInterval > 0 {
+		handler = newDedupHandler(handler, dedupInterval)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs at error level and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// dedupState is shared by a dedupHandler and the handlers derived from it
+type dedupState struct {
+	mu       sync.Mutex
+	interval time.Duration
+	seen     map[string]*dedupEntry
+}
+
+// dedupEntry tracks a repeated record within the current interval
+type dedupEntry struct {
+	first      time.Time
+	suppressed int
+}
+
+// dedupHandler suppresses repeats of identical warnings and errors.
+// A record is logged the first time it is seen in an interval; repeats within
+// the interval are dropped and reported as a "suppressed" count on the next
+// record logged after the interval has passed.
+type dedupHandler struct {
+	next  slog.Handler
+	state *dedupState
+	scope string
+}
+
+// newDedupHandler wraps next with deduplication of warnings and errors
+func newDedupHandler(next slog.Handler, interval time.Duration) *dedupHandler {
+	return &dedupHandler{
+		next: next,
+		state: &dedupState{
+			interval: interval,
+			seen:     make(map[string]*dedupEntry),
+		},
+	}
+}
+
+// Enabled implements slog.Handler
+func (h *dedupHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+// Handle implements slog.Handler
+func (h *dedupHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn {
+		return h.next.Handle(ctx, r)
+	}
+
+	var key strings.Builder
+	key.WriteString(h.scope)
+	key.WriteString(r.Level.String())
+	key.WriteString(r.Message)
+	r.Attrs(func(a slog.Attr) bool {
+		key.WriteString(a.String())
+		return true
+	})
+
+	s := h.state
+	s.mu.Lock()
+	entry, ok := s.seen[key.String()]
+	if ok && r.Time.Sub(entry.first) < s.interval {
+		entry.suppressed++
+		s.mu.Unlock()
+		return nil
+	}
+	suppressed := 0
+	if ok {
+		suppressed = entry.suppressed
+	}
+	s.seen[key.String()] = &dedupEntry{first: r.Time}
+	// Forget entries that can no longer suppress anything
+	for k, e := range s.seen {
+		if r.Time.Sub(e.first) >= s.interval && e.suppressed == 0 {
+			delete(s.seen, k)
+		}
+	}
+	s.mu.Unlock()
+
+	if suppressed > 0 {
+		r = r.Clone()
+		r.AddAttrs(slog.Int("suppressed", suppressed))
+	}
+	return h.next.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler
+func (h *dedupHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	scope := h.scope
+	for _, a := range attrs {
+		scope += a.String()
+	}
+	return &dedupHandler{next: h.next.WithAttrs(attrs), state: h.state, scope: scope}
+}
+
+// WithGroup implements slog.Handler
+func (h *dedupHandler) WithGroup(name string) slog.Handler {
+	return &dedupHandler{next: h.next.WithGroup(name), state: h.state, scope: h.scope + name + "."}
+}
+
+// overrideLogLevel changes the level for d, then restores the configured level
+func overrideLogLevel(level slog.Level, d time.Duration) time.Time {
+	o := &logLevelOverride
+	o.Lock()
+	defer o.Unlock()
+
+	if o.timer != nil {
+		o.timer.Stop()
+	}
+	logLevel.Set(level)
+	o.until = time.Now().Add(d)
+	o.timer = time.AfterFunc(d, func() {
+		o.Lock()
+		defer o.Unlock()
+		logLevel.Set(o.configured)
+		o.timer = nil
+		slog.Info("Log level restored", "level", o.configured)
+	})
+	return o.until
+}
+
+// logLevelHandler serves the current log level on GET and raises it
+// temporarily on POST with "level" and "duration" query parameters
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		logLevelOverride.Lock()
+		until := logLevelOverride.until
+		logLevelOverride.Unlock()
+		fmt.Fprintf(w, "level=%s\n", logLevel.Level())
+		if time.Now().Before(until) {
+			fmt.Fprintf(w, "until=%s\n", until.Format(time.RFC3339))
+		}
+	case http.MethodPost:
+		level, err := parseLogLevel(r.URL.Query().Get("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		d := 10 * time.Minute
+		if s := r.URL.Query().Get("duration"); s != "" {
+			d, err = time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				http.Error(w, fmt.Sprintf("invalid duration %q", s), http.StatusBadRequest)
+				return
+			}
+		}
+		if d > maxLogLevelOverride {
+			d = maxLogLevelOverride
+		}
+		until := overrideLogLevel(level, d)
+		slog.Info("Log level changed", "level", level, "until", until.Format(time.RFC3339), "remote", r.RemoteAddr)
+		fmt.Fprintf(w, "level=%s\nuntil=%s\n", level, until.Format(time.RFC3339))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
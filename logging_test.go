@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogLevelHandler(t *testing.T) {
+	logLevel.Set(slog.LevelInfo)
+	logLevelOverride.configured = slog.LevelInfo
+	t.Cleanup(func() { logLevel.Set(slog.LevelInfo) })
+
+	do := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		logLevelHandler(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+	if w := do(http.MethodGet, "/-/log-level"); w.Code != http.StatusOK || w.Body.String() != "level=INFO\n" {
+		t.Errorf("GET = %d %q", w.Code, w.Body)
+	}
+	for _, target := range []string{"/-/log-level?level=verbose", "/-/log-level?level=debug&duration=-1s", "/-/log-level?level=debug&duration=soon"} {
+		if w := do(http.MethodPost, target); w.Code != http.StatusBadRequest {
+			t.Errorf("POST %s = %d, want 400", target, w.Code)
+		}
+	}
+	if w := do(http.MethodPut, "/-/log-level?level=debug"); w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, POST" {
+		t.Errorf("PUT = %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+	if logLevel.Level() != slog.LevelInfo {
+		t.Fatalf("level changed by a rejected request to %s", logLevel.Level())
+	}
+
+	// The level is raised for the duration and then restored
+	if w := do(http.MethodPost, "/-/log-level?level=debug&duration=100ms"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "level=DEBUG\nuntil=") {
+		t.Fatalf("POST = %d %q", w.Code, w.Body)
+	}
+	if logLevel.Level() != slog.LevelDebug {
+		t.Errorf("level = %s, want DEBUG", logLevel.Level())
+	}
+	if w := do(http.MethodGet, "/-/log-level"); !strings.Contains(w.Body.String(), "until=") {
+		t.Errorf("GET during the override = %q", w.Body)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for logLevel.Level() != slog.LevelInfo && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if logLevel.Level() != slog.LevelInfo {
+		t.Errorf("level = %s after the override, want INFO", logLevel.Level())
+	}
+}
+
+func TestDedupHandler(t *testing.T) {
+	var buf bytes.Buffer
+	h := newDedupHandler(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}), time.Minute)
+	start := time.Now()
+	log := func(at time.Duration, level slog.Level, msg string, args ...any) {
+		r := slog.NewRecord(start.Add(at), level, msg, 0)
+		r.Add(args...)
+		if err := h.Handle(context.Background(), r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	log(0, slog.LevelError, "eadm stat command failed", "device", "erdma_0")
+	log(time.Second, slog.LevelError, "eadm stat command failed", "device", "erdma_0")
+	log(2*time.Second, slog.LevelError, "eadm stat command failed", "device", "erdma_0")
+	// Different attributes and levels below warn are not deduplicated
+	log(3*time.Second, slog.LevelError, "eadm stat command failed", "device", "erdma_1")
+	log(4*time.Second, slog.LevelInfo, "Collected")
+	log(5*time.Second, slog.LevelInfo, "Collected")
+	// After the interval the repeat is logged with the suppressed count
+	log(61*time.Second, slog.LevelError, "eadm stat command failed", "device", "erdma_0")
+
+	want := `level=ERROR msg="eadm stat command failed" device=erdma_0
+level=ERROR msg="eadm stat command failed" device=erdma_1
+level=INFO msg=Collected
+level=INFO msg=Collected
+level=ERROR msg="eadm stat command failed" device=erdma_0 suppressed=2
+`
+	if buf.String() != want {
+		t.Errorf("logged\n%s\nwant\n%s", buf.String(), want)
+	}
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -14,182 +20,400 @@ const (
 	namespace = "erdma"
 )
 
-// printInitialInfo prints initial debug information
-func printInitialInfo() {
-	log.Println("================================================================================")
-	log.Println("ERDMA Exporter Initial Information")
-	log.Println("================================================================================")
+// printInitialInfo logs the node name and the doctor checks at startup and
+// returns the number of devices found
+func printInitialInfo() int {
+	slog.Info("ERDMA exporter initial information", "node", getNodeName())
+	report := runDoctor()
+	logDoctorReport(report)
+	slog.Info("Startup checks finished", "status", report.Status, "devices", len(report.Devices))
+	return len(report.Devices)
+}
 
-	// Get node name
-	nodeName := getNodeName()
-	log.Printf("Node Name: %s", nodeName)
+var (
+	listenAddress = flag.String("web.listen-address", ":9101", "Address on which to expose metrics and web interface, or unix:/path for a Unix domain socket.")
+	systemdSocket = flag.Bool("web.systemd-socket", false, "Use the socket passed by systemd socket activation instead of --web.listen-address.")
+	metricsPath   = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+	adminAddress  = flag.String("admin.listen-address", "", "Address of the admin listener serving pprof and debug endpoints; a bare :port binds to localhost. Disabled if empty.")
+	webConfigFile = flag.String("web.config.file", "", "Path to a configuration file that can enable TLS or authentication, in the Prometheus exporter-toolkit format.")
+	recordDir     = flag.String("record-dir", "", "Directory in which to record the raw output of every eadm and ibv_devices call.")
+	replayDir     = flag.String("replay-dir", "", "Directory with a recording to replay instead of executing eadm and ibv_devices.")
+	simulate      = flag.String("simulate", "", "Scenario file describing virtual devices to serve instead of executing eadm and ibv_devices.")
+	simNodes      = flag.Int("simulate.nodes", 1, "Number of virtual nodes to serve in --simulate mode.")
+	simBasePort   = flag.Int("simulate.base-port", 9102, "First port used for virtual nodes beyond the first in --simulate mode.")
+	logLevelFlag  = flag.String("log.level", "info", "Only log messages with the given severity or above. One of: debug, info, warn, error.")
+	logFormat     = flag.String("log.format", "logfmt", "Output format of log messages. One of: logfmt, json.")
+	logDedup      = flag.Duration("log.dedup-interval", time.Minute, "Suppress identical warnings and errors repeated within this interval (0 disables).")
 
-	// Get version
-	version, err := getVersion()
-	if err != nil {
-		log.Printf("Failed to get ERDMA driver version: %v", err)
-	} else {
-		log.Printf("ERDMA Driver Version: %s", version)
-	}
-
-	// Get devices
-	log.Printf("Attempting to discover ERDMA devices...")
-
-	// Check required directories and files
-	checkPaths := []string{
-		"/dev/infiniband",
-		"/sys/class/infiniband",
-		"/sys/bus/pci",
-		"/sys/devices",
-		"/usr/bin",
-		"/usr/sbin",
-	}
-	log.Printf("Checking required paths:")
-	for _, path := range checkPaths {
-		if info, err := os.Stat(path); err == nil {
-			if info.IsDir() {
-				log.Printf("  ✓ %s (directory exists)", path)
-				// List contents for key directories
-				if path == "/sys/class/infiniband" {
-					if entries, err := os.ReadDir(path); err == nil {
-						if len(entries) == 0 {
-							log.Printf("    Warning: %s is empty (no devices found)", path)
-						} else {
-							log.Printf("    Found %d entries in %s:", len(entries), path)
-							for _, entry := range entries {
-								log.Printf("      - %s", entry.Name())
-							}
-						}
-					}
-				}
-			} else {
-				log.Printf("  ✓ %s (file exists)", path)
-			}
-		} else {
-			log.Printf("  ✗ %s (not found: %v)", path, err)
+	readHeaderTimeout = flag.Duration("web.read-header-timeout", 10*time.Second, "Maximum duration for reading request headers.")
+	readTimeout       = flag.Duration("web.read-timeout", 30*time.Second, "Maximum duration for reading an entire request.")
+	writeTimeout      = flag.Duration("web.write-timeout", 0, "Maximum duration for writing a response, including the time to collect metrics. 0 derives it from the tool timeout and the number of devices, so that a scrape in which every tool times out still gets a response.")
+	idleTimeout       = flag.Duration("web.idle-timeout", 2*time.Minute, "Maximum time to wait for the next request on a keep-alive connection.")
+	maxHeaderBytes    = flag.Int("web.max-header-bytes", 16<<10, "Maximum size of request headers in bytes.")
+	maxScrapes        = flag.Int("web.max-requests", 4, "Maximum number of concurrent scrapes; further scrapes get 503 (0 disables the limit).")
+	shutdownTimeout   = flag.Duration("web.shutdown-timeout", 20*time.Second, "How long to wait for in-flight requests on SIGTERM before killing running tools.")
+	toolTimeoutFlag   = flag.Duration("tool.timeout", 30*time.Second, "Maximum duration of a single eadm or ibv_devices invocation.")
+	streamMinInterval = flag.Duration("api.stream-min-interval", time.Second, "Shortest interval between events that clients of /api/v1/stream may request.")
+	historyRetention  = flag.Duration("history.retention", 15*time.Minute, "How long to keep device samples in memory for /api/v1/query_range (0 disables).")
+	historyResolution = flag.Duration("history.resolution", time.Second, "Finest interval between device samples kept in the in-memory history.")
+	historyCollect    = flag.Duration("history.collect-interval", 0, "How often to run a collection for the in-memory history when nothing else does, so that it keeps recording while nothing scrapes; each forks eadm for every device. 0 uses --history.resolution.")
+
+	pushURL          = flag.String("push.gateway-url", "", "URL of a Pushgateway to push metrics to on an interval and on shutdown. Disabled if empty.")
+	pushJob          = flag.String("push.job", "erdma-exporter", "Job name of the pushed group.")
+	pushInterval     = flag.Duration("push.interval", 15*time.Second, "How often to push metrics to the Pushgateway.")
+	pushTimeout      = flag.Duration("push.timeout", 10*time.Second, "Timeout of a single push.")
+	pushRetries      = flag.Int("push.retries", 3, "How often to retry a failed push, with exponential backoff.")
+	pushUsername     = flag.String("push.basic-auth.username", "", "Username for basic auth against the Pushgateway.")
+	pushPasswordFile = flag.String("push.basic-auth.password-file", "", "File containing the password for basic auth against the Pushgateway.")
+	pushDelete       = flag.Bool("push.delete-on-exit", false, "Delete the pushed group on a clean shutdown instead of pushing a last time.")
+
+	remoteWriteURL          = flag.String("remote-write.url", "", "URL of a Prometheus remote write endpoint to send samples to. Disabled if empty.")
+	remoteWriteInterval     = flag.Duration("remote-write.interval", 15*time.Second, "How often to collect and send samples to the remote write endpoint.")
+	remoteWriteTimeout      = flag.Duration("remote-write.timeout", 10*time.Second, "Timeout of a single remote write request.")
+	remoteWriteQueueSize    = flag.Int("remote-write.queue-size", 240, "Number of collections to keep in memory while the remote write endpoint is unavailable.")
+	remoteWriteUsername     = flag.String("remote-write.basic-auth.username", "", "Username for basic auth against the remote write endpoint.")
+	remoteWritePasswordFile = flag.String("remote-write.basic-auth.password-file", "", "File containing the password for basic auth against the remote write endpoint.")
+	remoteWriteLabels       = labelFlag{}
+
+	otlpEndpoint    = flag.String("otlp.endpoint", "", "URL of an OTLP/HTTP metrics endpoint, such as http://collector:4318/v1/metrics. Defaults to $OTEL_EXPORTER_OTLP_METRICS_ENDPOINT; disabled if both are empty.")
+	otlpInterval    = flag.Duration("otlp.interval", 15*time.Second, "How often to export metrics over OTLP.")
+	otlpTimeout     = flag.Duration("otlp.timeout", 10*time.Second, "Timeout of a single OTLP export request.")
+	otlpRetries     = flag.Int("otlp.retries", 3, "How often to retry a failed OTLP export, with exponential backoff.")
+	otlpCompression = flag.String("otlp.compression", "none", "Compression of OTLP export requests. One of: none, gzip.")
+	otlpHeadersFile = flag.String("otlp.headers-file", "", "File with HTTP headers sent with every OTLP export request, one key=value per line, such as Authorization=Bearer <token>.")
+	otlpHeaders     = headerFlag{}
+	otlpAttributes  = attributeFlag{}
+
+	configFile          = flag.String("config.file", "", "Path to the YAML configuration file. Reloaded on SIGHUP and when it changes.")
+	configCheckInterval = flag.Duration("config.check-interval", 10*time.Second, "How often to check the configuration file for changes.")
+)
+
+// subcommands are run instead of the exporter when named as the first argument
+var subcommands = map[string]func(args []string) int{
+	"config":          runConfigCommand,
+	"install-systemd": runInstallSystemdCommand,
+	"doctor":          runDoctorCommand,
+	"bundle":          runBundleCommand,
+	"collect":         runCollectCommand,
+}
+
+// scrapeTimeout returns how long a scrape of devices may take: it runs eadm
+// ver, ibv_devices and eadm stat for each device one after another, each up
+// to the tool timeout, plus a margin to encode and write the response
+func scrapeTimeout(devices int) time.Duration {
+	return time.Duration(2+devices)*time.Duration(activeConfig().Timeouts.Tool) + 10*time.Second
+}
+
+// webServerLimits returns the HTTP server limits set by flags, for a node
+// with the given number of devices
+func webServerLimits(devices int) serverLimits {
+	write := *writeTimeout
+	if write == 0 {
+		write = scrapeTimeout(devices)
+	}
+	return serverLimits{
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      write,
+		IdleTimeout:       *idleTimeout,
+		MaxHeaderBytes:    *maxHeaderBytes,
+	}
+}
+
+func init() {
+	flag.Var(remoteWriteLabels, "remote-write.external-label", "Label name=value added to every sample sent to the remote write endpoint; repeatable. Defaults to job=erdma-exporter and instance=<node>.")
+	flag.Var(otlpHeaders, "otlp.header", "HTTP header key=value sent with every OTLP export request; repeatable. Prefer --otlp.headers-file or $OTEL_EXPORTER_OTLP_HEADERS for credentials, which are visible on the command line.")
+	flag.Var(otlpAttributes, "otlp.resource-attribute", "Resource attribute key=value overriding the detected host and cloud attributes; repeatable.")
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
 		}
 	}
+	flag.Parse()
 
-	ibvDevicesPath := findCommand("ibv_devices")
-	log.Printf("Using ibv_devices command: %s", ibvDevicesPath)
+	if err := setupLogging(os.Stderr, *logLevelFlag, *logFormat, *logDedup); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
-	// Check if command exists and is executable
-	if info, err := os.Stat(ibvDevicesPath); err == nil {
-		log.Printf("Command file info: mode=%v, size=%d", info.Mode(), info.Size())
-		if info.Mode().Perm()&0111 == 0 {
-			log.Printf("Warning: Command file is not executable")
+	// Setup record and replay of tool invocations
+	if *recordDir != "" && *replayDir != "" {
+		fatal("--record-dir and --replay-dir are mutually exclusive")
+	}
+	if *simulate != "" && *replayDir != "" {
+		fatal("--simulate and --replay-dir are mutually exclusive")
+	}
+	if *simulate != "" && *recordDir != "" {
+		// Simulated output is never recorded, see runTool
+		fatal("--simulate and --record-dir are mutually exclusive")
+	}
+	if *replayDir != "" {
+		replayer, err := NewToolReplayer(*replayDir)
+		if err != nil {
+			fatal("Failed to load recording", "err", err)
 		}
-	} else {
-		log.Printf("Warning: ibv_devices command file check failed: %v", err)
-		log.Printf("Checking container paths...")
-		containerPaths := []string{
-			"/usr/bin/ibv_devices",
-			"/usr/sbin/ibv_devices",
-		}
-		found := false
-		for _, path := range containerPaths {
-			if info, err := os.Stat(path); err == nil {
-				log.Printf("Found ibv_devices at: %s (mode=%v)", path, info.Mode())
-				found = true
-				break
-			}
+		toolBackend = replayer
+		slog.Info("Replaying tool output", "dir", *replayDir)
+	}
+	if *recordDir != "" {
+		recorder, err := NewToolRecorder(*recordDir)
+		if err != nil {
+			fatal("Failed to create recorder", "err", err)
 		}
-		if !found {
-			log.Printf("Error: ibv_devices command not found in container (erdma-tools should be installed)")
+		toolRecorder = recorder
+		slog.Info("Recording tool output", "dir", *recordDir)
+	}
+
+	// Load the TLS and authentication config
+	var web *webConfigLoader
+	if *webConfigFile != "" {
+		var err error
+		web, err = newWebConfigLoader(*webConfigFile)
+		if err != nil {
+			fatal("Failed to load web config", "file", *webConfigFile, "err", err)
 		}
 	}
 
-	devices, err := getDevices()
+	// Create a new ERDMA collector
+	collector, err := NewErdmaCollector()
 	if err != nil {
-		log.Printf("Failed to get ERDMA devices: %v", err)
-		log.Println("================================================================================")
-		return
+		fatal("Failed to create ERDMA collector", "err", err)
 	}
 
-	log.Printf("Found %d ERDMA device(s):", len(devices))
-	for i, device := range devices {
-		log.Printf("  Device %d: %s (GUID: %s)", i+1, device.Name, device.GUID)
+	// Load the config and register the collector with its static labels
+	base := defaultConfig()
+	base.Timeouts.Tool = duration(*toolTimeoutFlag)
+	reg := prometheus.NewRegistry()
+	reloader := NewConfigReloader(*configFile, base, reg, collector,
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		prometheus.NewGoCollector())
+	if err := reloader.Load(); err != nil {
+		fatal("Failed to load config", "err", err)
+	}
+	if *configFile != "" {
+		slog.Info("Loaded config", "file", *configFile)
+	}
 
-		// Get initial statistics for this device
-		stats, err := getDeviceStats(device.Name)
+	// Stop on SIGTERM from the kubelet or Ctrl-C
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go reloader.Run(ctx, *configCheckInterval)
+	var servers []*http.Server
+
+	// Setup simulated devices
+	if *simulate != "" {
+		scenario, err := LoadScenario(*simulate)
 		if err != nil {
-			log.Printf("    Failed to get statistics: %v", err)
-			continue
-		}
-
-		log.Printf("    Statistics:")
-		log.Printf("      Listen: create=%d, success=%d, failed=%d, destroy=%d",
-			getStatValue(stats, "listen_create_cnt"),
-			getStatValue(stats, "listen_success_cnt"),
-			getStatValue(stats, "listen_failed_cnt"),
-			getStatValue(stats, "listen_destroy_cnt"))
-		log.Printf("      Accept: total=%d, success=%d, failed=%d",
-			getStatValue(stats, "accept_total_cnt"),
-			getStatValue(stats, "accept_success_cnt"),
-			getStatValue(stats, "accept_failed_cnt"))
-		log.Printf("      Connect: total=%d, success=%d, failed=%d, timeout=%d, reset=%d",
-			getStatValue(stats, "connect_total_cnt"),
-			getStatValue(stats, "connect_success_cnt"),
-			getStatValue(stats, "connect_failed_cnt"),
-			getStatValue(stats, "connect_timeout_cnt"),
-			getStatValue(stats, "connect_reset_cnt"))
-		log.Printf("      Hardware TX: requests=%d, packets=%d, bytes=%d",
-			getStatValue(stats, "hw_tx_reqs_cnt"),
-			getStatValue(stats, "hw_tx_packets_cnt"),
-			getStatValue(stats, "hw_tx_bytes_cnt"))
-		log.Printf("      Hardware RX: packets=%d, bytes=%d",
-			getStatValue(stats, "hw_rx_packets_cnt"),
-			getStatValue(stats, "hw_rx_bytes_cnt"))
-	}
-
-	log.Println("================================================================================")
-}
+			fatal("Failed to load scenario", "err", err)
+		}
+		if scenario.NodeName == "" {
+			scenario.NodeName = getNodeName()
+		}
+		toolBackend = NewSimulator(scenario)
+		collector.nodeName = scenario.NodeName
+		slog.Info("Simulating devices", "devices", len(scenario.Devices), "scenario", *simulate)
+		servers = serveSimulatedNodes(scenario, *simNodes, *simBasePort, web)
+	}
 
-// getStatValue safely gets a statistic value from the map
-func getStatValue(stats map[string]uint64, key string) uint64 {
-	if val, ok := stats[key]; ok {
-		return val
+	// Keep the recent samples of every collection in memory for
+	// /api/v1/query_range, and collect for it when nothing else does, so
+	// that it still records while Prometheus is down
+	historyDone := make(chan struct{})
+	if *historyRetention > 0 {
+		if *historyResolution <= 0 {
+			fatal("--history.resolution must be positive", "resolution", *historyResolution)
+		}
+		if *historyCollect < 0 {
+			fatal("--history.collect-interval must not be negative", "interval", *historyCollect)
+		}
+		if *historyCollect == 0 {
+			*historyCollect = *historyResolution
+		}
+		collector.history = newSampleHistory(*historyRetention, *historyResolution, reg)
+		slog.Info("Keeping in-memory history", "retention", *historyRetention, "resolution", *historyResolution,
+			"max_samples_per_device", collector.history.size, "collect_interval", *historyCollect)
+	}
+	if collector.history != nil {
+		go func() {
+			runHistoryCollection(ctx, collector, *historyCollect)
+			close(historyDone)
+		}()
+	} else {
+		close(historyDone)
 	}
-	return 0
-}
 
-var (
-	listenAddress = flag.String("web.listen-address", ":9101", "Address on which to expose metrics and web interface.")
-	metricsPath   = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
-)
+	// Push to a Pushgateway for nodes that live shorter than service discovery takes
+	pushDone := make(chan struct{})
+	if *pushURL != "" {
+		pusher, err := newGatewayPusher(pushOptions{
+			URL:          *pushURL,
+			Job:          *pushJob,
+			Interval:     *pushInterval,
+			Timeout:      *pushTimeout,
+			Retries:      *pushRetries,
+			Username:     *pushUsername,
+			PasswordFile: *pushPasswordFile,
+			DeleteOnExit: *pushDelete,
+		}, collector.NodeName(), reg)
+		if err != nil {
+			fatal("Failed to set up push to Pushgateway", "err", err)
+		}
+		go func() {
+			pusher.Run(ctx, *shutdownTimeout/2)
+			close(pushDone)
+		}()
+	} else {
+		close(pushDone)
+	}
 
-func main() {
-	flag.Parse()
+	// Send samples to a remote write endpoint for clusters without a local Prometheus
+	remoteWriteDone := make(chan struct{})
+	if *remoteWriteURL != "" {
+		labels := map[string]string{"job": "erdma-exporter", "instance": collector.NodeName()}
+		for name, value := range remoteWriteLabels {
+			labels[name] = value
+		}
+		writer, err := newRemoteWriter(remoteWriteOptions{
+			URL:            *remoteWriteURL,
+			Interval:       *remoteWriteInterval,
+			Timeout:        *remoteWriteTimeout,
+			QueueSize:      *remoteWriteQueueSize,
+			ExternalLabels: labels,
+			Username:       *remoteWriteUsername,
+			PasswordFile:   *remoteWritePasswordFile,
+		}, reg)
+		if err != nil {
+			fatal("Failed to set up remote write", "err", err)
+		}
+		go func() {
+			writer.Run(ctx, *shutdownTimeout/2)
+			close(remoteWriteDone)
+		}()
+	} else {
+		close(remoteWriteDone)
+	}
 
-	// Create a new ERDMA collector
-	collector, err := NewErdmaCollector()
-	if err != nil {
-		log.Fatalf("Failed to create ERDMA collector: %v", err)
+	// Export over OTLP for sites that collect metrics with OpenTelemetry
+	otlpDone := make(chan struct{})
+	if *otlpEndpoint == "" {
+		*otlpEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT")
+	}
+	if *otlpEndpoint != "" {
+		exporter, err := newOTLPExporter(otlpOptions{
+			Endpoint:    *otlpEndpoint,
+			Interval:    *otlpInterval,
+			Timeout:     *otlpTimeout,
+			Retries:     *otlpRetries,
+			Headers:     otlpHeaders,
+			HeadersFile: *otlpHeadersFile,
+			Compression: *otlpCompression,
+			Attributes:  otlpAttributes,
+		}, collector.NodeName(), reg)
+		if err != nil {
+			fatal("Failed to set up OTLP export", "err", err)
+		}
+		go func() {
+			exporter.Run(ctx, *shutdownTimeout/2)
+			close(otlpDone)
+		}()
+	} else {
+		close(otlpDone)
 	}
 
-	// Register the collector
-	reg := prometheus.NewRegistry()
-	reg.MustRegister(collector)
+	// Feed the push sinks of the config file; they may appear on reload
+	sinkDone := make(chan struct{})
+	sinks := newSinkRunner(collector, reg)
+	go func() {
+		sinks.Run(ctx)
+		close(sinkDone)
+	}()
 
-	// Add the standard process and Go metrics
-	reg.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
-	reg.MustRegister(prometheus.NewGoCollector())
+	// Print initial debug information; the write timeout depends on the
+	// number of devices found
+	devices := printInitialInfo()
+	if *writeTimeout != 0 && *writeTimeout < scrapeTimeout(devices) {
+		slog.Warn("--web.write-timeout is shorter than a scrape in which every tool times out; such scrapes get a reset connection instead of a response",
+			"write_timeout", *writeTimeout, "tool_timeout", time.Duration(activeConfig().Timeouts.Tool), "devices", devices, "needed", scrapeTimeout(devices))
+	}
 
 	// Setup HTTP server
-	http.Handle(*metricsPath, promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-			<head><title>ERDMA Exporter</title></head>
-			<body>
-			<h1>ERDMA Exporter</h1>
-			<p><a href="` + *metricsPath + `">Metrics</a></p>
-			</body>
-			</html>`))
-	})
-
-	// Print initial debug information
-	printInitialInfo()
-
-	log.Printf("Starting ERDMA exporter on %s", *listenAddress)
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	mux := http.NewServeMux()
+	mux.Handle(*metricsPath, promhttp.InstrumentMetricHandler(reg,
+		promhttp.HandlerFor(reg, promhttp.HandlerOpts{MaxRequestsInFlight: *maxScrapes})))
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.Handle("/readyz", readyzHandler(collector))
+	mux.Handle("/api/v1/", newAPIHandler(collector))
+	mux.Handle("/api/v1/stream", newStreamHandler(ctx, collector, *streamMinInterval))
+	mux.Handle("/api/v1/query_range", &queryRangeHandler{collector: collector})
+	mux.Handle("/", statusHandler(collector))
+	server := newHTTPServer(*listenAddress, mux, webServerLimits(devices))
+	servers = append(servers, server)
+
+	// Debug endpoints are only served on the admin listener. The log level
+	// control moves there with them; without an admin listener it is
+	// served here, behind the basic auth of the web config if any.
+	if *adminAddress != "" {
+		addr := adminListenAddress(*adminAddress)
+		admin := newHTTPServer(addr, adminHandler(collector), webServerLimits(devices))
+		servers = append(servers, admin)
+		adminLn, err := listen(addr)
+		if err != nil {
+			fatal("Failed to listen on admin address", "address", addr, "err", err)
+		}
+		slog.Info("Starting admin listener", "address", adminLn.Addr().String())
+		go func() {
+			if err := serve(admin, adminLn, web); err != nil {
+				fatal("Admin listener failed", "address", addr, "err", err)
+			}
+		}()
+	} else {
+		mux.HandleFunc("/-/log-level", logLevelHandler)
+	}
+
+	var ln net.Listener
+	if *systemdSocket {
+		listeners, err := systemdListeners()
+		if err != nil {
+			fatal("Failed to use systemd socket", "err", err)
+		}
+		ln = listeners[0]
+	} else if ln, err = listen(*listenAddress); err != nil {
+		fatal("Failed to listen", "address", *listenAddress, "err", err)
+	}
+
+	slog.Info("Starting ERDMA exporter", "address", ln.Addr().String(), "tls", web != nil && web.tls != nil)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- serve(server, ln, web)
+	}()
+
+	// Tell systemd the exporter is up once it collected, and keep its
+	// watchdog fed
+	go notifyReady(collector, "Serving on "+ln.Addr().String(), sdReadyTimeout, sdReadyRetry, ctx.Done())
+	if timeout := sdWatchdogInterval(); timeout > 0 {
+		go runWatchdog(collector, timeout, ctx.Done())
+	}
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			closeToolRecorder()
+			fatal("HTTP server failed", "err", err)
+		}
+	case <-ctx.Done():
+		stop()
+		sdNotify("STOPPING=1")
+		// The final push runs tools, which are killed by shutdownServers
+		<-pushDone
+		<-remoteWriteDone
+		<-otlpDone
+		<-sinkDone
+		<-historyDone
+		shutdownServers(servers, *shutdownTimeout)
+	}
+	// Only now that no tool runs any more is the recording complete
+	closeToolRecorder()
 }
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Delays between retries of a failed OTLP export
+const (
+	otlpMinBackoff = time.Second
+	otlpMaxBackoff = 30 * time.Second
+)
+
+// otlpScopeName is the instrumentation scope of the exported metrics
+const otlpScopeName = "github.com/shaowenchen/erdma-exporter"
+
+// otlpCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE
+const otlpCumulative = 2
+
+// otlpOptions configures exporting metrics over OTLP/HTTP
+type otlpOptions struct {
+	Endpoint string
+	Interval time.Duration
+	Timeout  time.Duration
+	Retries  int
+	Headers  map[string]string
+	// HeadersFile has more headers, one key=value per line, so that
+	// credentials need not be passed on the command line
+	HeadersFile string
+	Compression string
+	// Attributes override the detected resource attributes
+	Attributes map[string]string
+}
+
+// attributeFlag collects repeated key=value flags
+type attributeFlag map[string]string
+
+func (f attributeFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for key, value := range f {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f attributeFlag) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("invalid attribute %q: must be key=value", s)
+	}
+	f[key] = value
+	return nil
+}
+
+// headerFlag collects repeated key=value flags of HTTP headers. It does not
+// print their values, which are often credentials.
+type headerFlag map[string]string
+
+func (f headerFlag) String() string {
+	keys := make([]string, 0, len(f))
+	for key := range f {
+		keys = append(keys, key+"="+redactedValue)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+func (f headerFlag) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("invalid header %q: must be key=value", s)
+	}
+	f[key] = value
+	return nil
+}
+
+// loadOTLPHeaders returns the headers of OTLP export requests: those of
+// $OTEL_EXPORTER_OTLP_HEADERS and $OTEL_EXPORTER_OTLP_METRICS_HEADERS, as
+// comma-separated key=value pairs with percent-encoded values, overridden by
+// those of the headers file, one key=value per line, and then by flags
+func loadOTLPHeaders(flags map[string]string, file string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, env := range []string{"OTEL_EXPORTER_OTLP_HEADERS", "OTEL_EXPORTER_OTLP_METRICS_HEADERS"} {
+		for _, pair := range strings.Split(os.Getenv(env), ",") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+			key, value, ok := strings.Cut(pair, "=")
+			decoded, err := url.PathUnescape(strings.TrimSpace(value))
+			if !ok || strings.TrimSpace(key) == "" || err != nil {
+				return nil, fmt.Errorf("invalid header in $%s: must be key=value", env)
+			}
+			headers[strings.TrimSpace(key)] = decoded
+		}
+	}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("read OTLP headers: %w", err)
+		}
+		for i, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			key, value, ok := strings.Cut(line, "=")
+			if !ok || strings.TrimSpace(key) == "" {
+				return nil, fmt.Errorf("invalid header on line %d of %s: must be key=value", i+1, file)
+			}
+			headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	for key, value := range flags {
+		headers[key] = value
+	}
+	return headers, nil
+}
+
+// otlpResource returns the resource attributes of the exporter: the node
+// name, the ECS instance if the metadata service answers, and overrides
+func otlpResource(node string, overrides map[string]string) map[string]string {
+	attrs := map[string]string{
+		"service.name":        "erdma-exporter",
+		"service.instance.id": node,
+		"host.name":           node,
+	}
+	if nodeName := os.Getenv("NODE_NAME"); nodeName != "" {
+		attrs["k8s.node.name"] = nodeName
+	}
+	if instance, err := getECSInstance(); err != nil {
+		slog.Info("Not adding cloud resource attributes", "err", err)
+	} else {
+		attrs["cloud.provider"] = "alibaba_cloud"
+		attrs["cloud.platform"] = "alibaba_cloud_ecs"
+		attrs["host.id"] = instance.InstanceID
+		attrs["cloud.region"] = instance.RegionID
+		attrs["cloud.availability_zone"] = instance.ZoneID
+	}
+	for key, value := range overrides {
+		attrs[key] = value
+	}
+	return attrs
+}
+
+// otlpUnit derives the UCUM unit of a metric from its name
+func otlpUnit(name string) string {
+	switch {
+	case strings.Contains(name, "_bytes"):
+		return "By"
+	case strings.Contains(name, "_seconds"):
+		return "s"
+	}
+	return ""
+}
+
+// otlpEncoder builds an ExportMetricsServiceRequest. It remembers when each
+// counter series started, so that sums carry a start time that moves when
+// the driver resets its counters.
+type otlpEncoder struct {
+	resource     map[string]string
+	processStart time.Time
+	starts       map[string]otlpStart
+}
+
+// otlpStart is the start time of a counter series, and its value and time
+// at the last export
+type otlpStart struct {
+	time  time.Time
+	value float64
+	last  time.Time
+}
+
+// appendKeyValue appends a KeyValue { string key = 1; AnyValue value = 2; }
+// with a string_value = 1
+func appendKeyValue(b []byte, field protowire.Number, key, value string) []byte {
+	var anyValue []byte
+	anyValue = protowire.AppendTag(anyValue, 1, protowire.BytesType)
+	anyValue = protowire.AppendString(anyValue, value)
+	var kv []byte
+	kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+	kv = protowire.AppendString(kv, key)
+	kv = protowire.AppendTag(kv, 2, protowire.BytesType)
+	kv = protowire.AppendBytes(kv, anyValue)
+	b = protowire.AppendTag(b, field, protowire.BytesType)
+	return protowire.AppendBytes(b, kv)
+}
+
+// appendAttributes appends key/value pairs sorted by key
+func appendAttributes(b []byte, field protowire.Number, attrs map[string]string) []byte {
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		b = appendKeyValue(b, field, key, attrs[key])
+	}
+	return b
+}
+
+// appendMessage appends a length-delimited field
+func appendMessage(b []byte, field protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, field, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+// appendFixed64 appends a fixed64 or double field
+func appendFixed64(b []byte, field protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, field, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+// metricLabels returns the labels of a metric as attributes
+func metricLabels(m *dto.Metric) map[string]string {
+	attrs := make(map[string]string, len(m.GetLabel()))
+	for _, l := range m.GetLabel() {
+		attrs[l.GetName()] = l.GetValue()
+	}
+	return attrs
+}
+
+// seriesKey identifies a series across exports
+func seriesKey(name string, m *dto.Metric) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, l := range m.GetLabel() {
+		b.WriteString("\xff" + l.GetName() + "=" + l.GetValue())
+	}
+	return b.String()
+}
+
+// startTime returns the start time of a counter series, restarting it if
+// the counter went backwards
+func (e *otlpEncoder) startTime(key string, value float64, now time.Time, seen map[string]otlpStart) time.Time {
+	start, ok := e.starts[key]
+	switch {
+	case !ok && now.Sub(e.processStart) <= 2*time.Minute:
+		// Counters that exist when the exporter starts are assumed to
+		// have started with it
+		start.time = e.processStart
+	case !ok:
+		// The start of a later series is unknown. A first point that
+		// starts at its own time makes consumers use it as the base of
+		// the next ones instead of counting its value as an increase.
+		start.time = now
+	case value < start.value:
+		// The counter was reset after the last export
+		start.time = start.last
+	}
+	start.value = value
+	start.last = now
+	seen[key] = start
+	return start.time
+}
+
+// numberDataPoint encodes a NumberDataPoint with a double value
+func numberDataPoint(attrs map[string]string, start, now time.Time, value float64) []byte {
+	var dp []byte
+	if !start.IsZero() {
+		dp = appendFixed64(dp, 2, uint64(start.UnixNano()))
+	}
+	dp = appendFixed64(dp, 3, uint64(now.UnixNano()))
+	dp = appendFixed64(dp, 4, math.Float64bits(value))
+	return appendAttributes(dp, 7, attrs)
+}
+
+// Encode converts metric families to an ExportMetricsServiceRequest:
+// counters become cumulative monotonic sums, gauges and untyped metrics
+// gauges, and summaries and histograms their OTLP counterparts.
+func (e *otlpEncoder) Encode(families []*dto.MetricFamily, now time.Time) []byte {
+	seen := make(map[string]otlpStart, len(e.starts))
+	var metrics []byte
+	for _, family := range families {
+		name := family.GetName()
+		var data []byte
+		var field protowire.Number
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			// Sum { data_points = 1; aggregation_temporality = 2; is_monotonic = 3; }
+			field = 7
+			for _, m := range family.GetMetric() {
+				value := m.GetCounter().GetValue()
+				start := e.startTime(seriesKey(name, m), value, now, seen)
+				data = appendMessage(data, 1, numberDataPoint(metricLabels(m), start, now, value))
+			}
+			data = protowire.AppendTag(data, 2, protowire.VarintType)
+			data = protowire.AppendVarint(data, otlpCumulative)
+			data = protowire.AppendTag(data, 3, protowire.VarintType)
+			data = protowire.AppendVarint(data, 1)
+		case dto.MetricType_SUMMARY:
+			// Summary { SummaryDataPoint data_points = 1; }
+			field = 11
+			for _, m := range family.GetMetric() {
+				s := m.GetSummary()
+				start := e.startTime(seriesKey(name, m), float64(s.GetSampleCount()), now, seen)
+				var dp []byte
+				dp = appendFixed64(dp, 2, uint64(start.UnixNano()))
+				dp = appendFixed64(dp, 3, uint64(now.UnixNano()))
+				dp = appendFixed64(dp, 4, s.GetSampleCount())
+				dp = appendFixed64(dp, 5, math.Float64bits(s.GetSampleSum()))
+				for _, q := range s.GetQuantile() {
+					var vq []byte
+					vq = appendFixed64(vq, 1, math.Float64bits(q.GetQuantile()))
+					vq = appendFixed64(vq, 2, math.Float64bits(q.GetValue()))
+					dp = appendMessage(dp, 6, vq)
+				}
+				dp = appendAttributes(dp, 7, metricLabels(m))
+				data = appendMessage(data, 1, dp)
+			}
+		case dto.MetricType_HISTOGRAM:
+			// Histogram { HistogramDataPoint data_points = 1; aggregation_temporality = 2; }
+			field = 9
+			for _, m := range family.GetMetric() {
+				h := m.GetHistogram()
+				start := e.startTime(seriesKey(name, m), float64(h.GetSampleCount()), now, seen)
+				var dp []byte
+				dp = appendFixed64(dp, 2, uint64(start.UnixNano()))
+				dp = appendFixed64(dp, 3, uint64(now.UnixNano()))
+				dp = appendFixed64(dp, 4, h.GetSampleCount())
+				dp = appendFixed64(dp, 5, math.Float64bits(h.GetSampleSum()))
+				// OTLP buckets are not cumulative and end with an implicit +Inf bucket
+				var counts, bounds []byte
+				prev := uint64(0)
+				for _, b := range h.GetBucket() {
+					if math.IsInf(b.GetUpperBound(), 1) {
+						continue
+					}
+					counts = protowire.AppendFixed64(counts, b.GetCumulativeCount()-prev)
+					bounds = protowire.AppendFixed64(bounds, math.Float64bits(b.GetUpperBound()))
+					prev = b.GetCumulativeCount()
+				}
+				counts = protowire.AppendFixed64(counts, h.GetSampleCount()-prev)
+				dp = appendMessage(dp, 6, counts)
+				if len(bounds) > 0 {
+					dp = appendMessage(dp, 7, bounds)
+				}
+				dp = appendAttributes(dp, 9, metricLabels(m))
+				data = appendMessage(data, 1, dp)
+			}
+			data = protowire.AppendTag(data, 2, protowire.VarintType)
+			data = protowire.AppendVarint(data, otlpCumulative)
+		default:
+			// Gauge { NumberDataPoint data_points = 1; }
+			field = 5
+			for _, m := range family.GetMetric() {
+				value := m.GetGauge().GetValue()
+				if family.GetType() == dto.MetricType_UNTYPED {
+					value = m.GetUntyped().GetValue()
+				}
+				data = appendMessage(data, 1, numberDataPoint(metricLabels(m), time.Time{}, now, value))
+			}
+		}
+
+		// Metric { name = 1; description = 2; unit = 3; gauge = 5 | sum = 7 | histogram = 9 | summary = 11; }
+		var metric []byte
+		metric = protowire.AppendTag(metric, 1, protowire.BytesType)
+		metric = protowire.AppendString(metric, name)
+		metric = protowire.AppendTag(metric, 2, protowire.BytesType)
+		metric = protowire.AppendString(metric, family.GetHelp())
+		if unit := otlpUnit(name); unit != "" {
+			metric = protowire.AppendTag(metric, 3, protowire.BytesType)
+			metric = protowire.AppendString(metric, unit)
+		}
+		metric = appendMessage(metric, field, data)
+		metrics = appendMessage(metrics, 2, metric)
+	}
+	e.starts = seen
+
+	// ScopeMetrics { InstrumentationScope scope = 1; repeated Metric metrics = 2; }
+	var scope []byte
+	scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+	scope = protowire.AppendString(scope, otlpScopeName)
+	scopeMetrics := appendMessage(nil, 1, scope)
+	scopeMetrics = append(scopeMetrics, metrics...)
+
+	// ResourceMetrics { Resource resource = 1; repeated ScopeMetrics scope_metrics = 2; }
+	resourceMetrics := appendMessage(nil, 1, appendAttributes(nil, 1, e.resource))
+	resourceMetrics = appendMessage(resourceMetrics, 2, scopeMetrics)
+
+	// ExportMetricsServiceRequest { repeated ResourceMetrics resource_metrics = 1; }
+	return appendMessage(nil, 1, resourceMetrics)
+}
+
+// otlpExporter pushes the erdma_* metrics of a registry over OTLP/HTTP on
+// an interval. Since sums are cumulative, a failed export is not queued;
+// the next one carries the totals.
+type otlpExporter struct {
+	opts     otlpOptions
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	encoder  *otlpEncoder
+
+	exports     *prometheus.CounterVec
+	lastSuccess prometheus.Gauge
+}
+
+// newOTLPExporter creates an exporter for the erdma_* metrics of reg and
+// registers its own metrics with reg
+func newOTLPExporter(opts otlpOptions, node string, reg *prometheus.Registry) (*otlpExporter, error) {
+	if opts.Compression != "none" && opts.Compression != "gzip" {
+		return nil, fmt.Errorf("invalid OTLP compression %q: must be none or gzip", opts.Compression)
+	}
+	headers, err := loadOTLPHeaders(opts.Headers, opts.HeadersFile)
+	if err != nil {
+		return nil, err
+	}
+	opts.Headers = headers
+	e := &otlpExporter{
+		opts:     opts,
+		gatherer: reg,
+		client:   &http.Client{Timeout: opts.Timeout},
+		encoder: &otlpEncoder{
+			resource:     otlpResource(node, opts.Attributes),
+			processStart: time.Now(),
+			starts:       map[string]otlpStart{},
+		},
+		exports: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "exporter", Name: "otlp_exports_total",
+			Help: "Total number of OTLP export requests, including retries",
+		}, []string{"result"}),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "exporter", Name: "otlp_last_success_timestamp_seconds",
+			Help: "Timestamp of the last successful OTLP export",
+		}),
+	}
+	reg.MustRegister(e.exports, e.lastSuccess)
+	return e, nil
+}
+
+// gather returns the erdma_* metric families; the Go runtime and process
+// metrics are left to the OpenTelemetry collector's own receivers
+func (e *otlpExporter) gather() []*dto.MetricFamily {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		slog.Warn("Gathering metrics for OTLP returned errors", "err", err)
+	}
+	kept := families[:0]
+	for _, family := range families {
+		if strings.HasPrefix(family.GetName(), namespace+"_") {
+			kept = append(kept, family)
+		}
+	}
+	return kept
+}
+
+// send posts an encoded request. It reports whether a failure may be
+// retried, following the OTLP/HTTP specification, and the delay the
+// server asked for.
+func (e *otlpExporter) send(ctx context.Context, body []byte) (bool, time.Duration, error) {
+	if e.opts.Compression == "gzip" {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(body)
+		gz.Close()
+		body = buf.Bytes()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.opts.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "erdma-exporter")
+	if e.opts.Compression == "gzip" {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	for key, value := range e.opts.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return true, 0, err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 == 2 {
+		return false, 0, nil
+	}
+	err = fmt.Errorf("server returned %s: %q", resp.Status, msg)
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return true, time.Duration(retryAfter) * time.Second, err
+	}
+	return false, 0, err
+}
+
+// export gathers and sends the metrics, retrying retryable failures with
+// exponential backoff until the retries are used up or ctx is done
+func (e *otlpExporter) export(ctx context.Context) error {
+	body := e.encoder.Encode(e.gather(), time.Now())
+	backoff := otlpMinBackoff
+	for attempt := 0; ; attempt++ {
+		retryable, retryAfter, err := e.send(ctx, body)
+		if err == nil {
+			e.exports.WithLabelValues("success").Inc()
+			e.lastSuccess.SetToCurrentTime()
+			return nil
+		}
+		e.exports.WithLabelValues("failure").Inc()
+		if !retryable || attempt >= e.opts.Retries || ctx.Err() != nil {
+			return err
+		}
+		delay := max(backoff, retryAfter)
+		slog.Warn("OTLP export failed, retrying", "endpoint", e.opts.Endpoint, "attempt", attempt+1, "backoff", delay, "err", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		backoff = min(2*backoff, otlpMaxBackoff)
+	}
+}
+
+// Run exports every interval until ctx is done, then exports once more
+// within timeout, before running tools are stopped
+func (e *otlpExporter) Run(ctx context.Context, timeout time.Duration) {
+	slog.Info("Exporting metrics over OTLP", "endpoint", e.opts.Endpoint, "interval", e.opts.Interval)
+	ticker := time.NewTicker(e.opts.Interval)
+	defer ticker.Stop()
+	for {
+		if err := e.export(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("OTLP export failed", "endpoint", e.opts.Endpoint, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			final, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			if err := e.export(final); err != nil {
+				slog.Error("Final OTLP export failed", "endpoint", e.opts.Endpoint, "err", err)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
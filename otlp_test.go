@@ -0,0 +1,285 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// otlpPoint is a decoded NumberDataPoint or HistogramDataPoint
+type otlpPoint struct {
+	start, time uint64
+	value       float64
+	count       uint64
+	sum         float64
+	buckets     []uint64
+	bounds      []float64
+	attrs       map[string]string
+}
+
+// otlpMetric is a decoded Metric with the field number of its data
+type otlpMetric struct {
+	unit        string
+	field       protowire.Number
+	temporality uint64
+	monotonic   bool
+	points      []otlpPoint
+}
+
+// decodeOTLPAttributes decodes the KeyValue fields num of msg
+func decodeOTLPAttributes(t *testing.T, fields []protoField, num protowire.Number) map[string]string {
+	t.Helper()
+	attrs := map[string]string{}
+	for _, f := range fields {
+		if f.num != num {
+			continue
+		}
+		var key, value string
+		for _, kv := range decodeProtoFields(t, f.bytes) {
+			switch kv.num {
+			case 1:
+				key = string(kv.bytes)
+			case 2:
+				for _, av := range decodeProtoFields(t, kv.bytes) {
+					if av.num == 1 {
+						value = string(av.bytes)
+					}
+				}
+			}
+		}
+		attrs[key] = value
+	}
+	return attrs
+}
+
+// decodePackedFixed64 decodes a packed repeated fixed64 or double field
+func decodePackedFixed64(t *testing.T, b []byte) []uint64 {
+	t.Helper()
+	var values []uint64
+	for len(b) > 0 {
+		v, n := protowire.ConsumeFixed64(b)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		values = append(values, v)
+		b = b[n:]
+	}
+	return values
+}
+
+// decodeOTLPRequest decodes an ExportMetricsServiceRequest built by
+// otlpEncoder into its resource attributes and metrics by name
+func decodeOTLPRequest(t *testing.T, b []byte) (map[string]string, map[string]otlpMetric) {
+	t.Helper()
+	resource := map[string]string{}
+	metrics := map[string]otlpMetric{}
+	for _, rm := range decodeProtoFields(t, b) {
+		for _, f := range decodeProtoFields(t, rm.bytes) {
+			switch f.num {
+			case 1:
+				resource = decodeOTLPAttributes(t, decodeProtoFields(t, f.bytes), 1)
+			case 2:
+				for _, sm := range decodeProtoFields(t, f.bytes) {
+					if sm.num != 2 {
+						continue
+					}
+					name, metric := decodeOTLPMetric(t, sm.bytes)
+					metrics[name] = metric
+				}
+			}
+		}
+	}
+	return resource, metrics
+}
+
+func decodeOTLPMetric(t *testing.T, b []byte) (string, otlpMetric) {
+	t.Helper()
+	var name string
+	var metric otlpMetric
+	for _, f := range decodeProtoFields(t, b) {
+		switch f.num {
+		case 1:
+			name = string(f.bytes)
+		case 3:
+			metric.unit = string(f.bytes)
+		case 5, 7, 9, 11:
+			metric.field = f.num
+			for _, df := range decodeProtoFields(t, f.bytes) {
+				switch df.num {
+				case 1:
+					metric.points = append(metric.points, decodeOTLPPoint(t, f.num, df.bytes))
+				case 2:
+					metric.temporality = df.value
+				case 3:
+					metric.monotonic = df.value == 1
+				}
+			}
+		}
+	}
+	return name, metric
+}
+
+func decodeOTLPPoint(t *testing.T, kind protowire.Number, b []byte) otlpPoint {
+	t.Helper()
+	fields := decodeProtoFields(t, b)
+	var p otlpPoint
+	for _, f := range fields {
+		switch f.num {
+		case 2:
+			p.start = f.value
+		case 3:
+			p.time = f.value
+		}
+	}
+	if kind != 9 {
+		for _, f := range fields {
+			if f.num == 4 {
+				p.value = math.Float64frombits(f.value)
+			}
+		}
+		p.attrs = decodeOTLPAttributes(t, fields, 7)
+		return p
+	}
+	for _, f := range fields {
+		switch f.num {
+		case 4:
+			p.count = f.value
+		case 5:
+			p.sum = math.Float64frombits(f.value)
+		case 6:
+			p.buckets = decodePackedFixed64(t, f.bytes)
+		case 7:
+			for _, v := range decodePackedFixed64(t, f.bytes) {
+				p.bounds = append(p.bounds, math.Float64frombits(v))
+			}
+		}
+	}
+	p.attrs = decodeOTLPAttributes(t, fields, 9)
+	return p
+}
+
+// otlpTestFamilies gathers a counter per device with the given values, a
+// gauge and a histogram
+func otlpTestFamilies(t *testing.T, counters map[string]float64) []*dto.MetricFamily {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	tx := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "erdma_hw_tx_bytes_total", Help: "Bytes sent."}, []string{"device"})
+	for device, value := range counters {
+		tx.WithLabelValues(device).Add(value)
+	}
+	up := prometheus.NewGauge(prometheus.GaugeOpts{Name: "erdma_up", Help: "Whether the devices were listed."})
+	up.Set(1)
+	duration := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "erdma_exporter_cycle_duration_seconds", Help: "Duration of collection cycles.", Buckets: []float64{0.1, 1},
+	})
+	for _, v := range []float64{0.05, 0.05, 0.5, 0.5, 0.5, 5, 5} {
+		duration.Observe(v)
+	}
+	reg.MustRegister(tx, up, duration)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return families
+}
+
+func TestOTLPEncode(t *testing.T) {
+	captureLogs(t)
+	resetECSIdentity(t)
+	newFakeMetadata(t, true)
+	t.Setenv("NODE_NAME", "")
+	started := time.Unix(1700000000, 0)
+	encoder := &otlpEncoder{
+		resource:     otlpResource("node-1", map[string]string{"deployment.environment": "test"}),
+		processStart: started,
+		starts:       map[string]otlpStart{},
+	}
+	now := started.Add(15 * time.Second)
+	resource, metrics := decodeOTLPRequest(t, encoder.Encode(otlpTestFamilies(t, map[string]float64{"erdma_0": 100}), now))
+
+	for key, want := range map[string]string{
+		"service.name":           "erdma-exporter",
+		"host.name":              "node-1",
+		"service.instance.id":    "node-1",
+		"host.id":                "i-bp1abc",
+		"cloud.provider":         "alibaba_cloud",
+		"cloud.region":           "cn-hangzhou",
+		"deployment.environment": "test",
+	} {
+		if got := resource[key]; got != want {
+			t.Errorf("resource %s = %q, want %q", key, got, want)
+		}
+	}
+
+	tx := metrics["erdma_hw_tx_bytes_total"]
+	if tx.field != 7 || tx.temporality != otlpCumulative || !tx.monotonic || tx.unit != "By" {
+		t.Errorf("counter encoded as field %d, temporality %d, monotonic %v, unit %q; want a cumulative monotonic sum in By",
+			tx.field, tx.temporality, tx.monotonic, tx.unit)
+	}
+	want := otlpPoint{start: uint64(started.UnixNano()), time: uint64(now.UnixNano()), value: 100, attrs: map[string]string{"device": "erdma_0"}}
+	if len(tx.points) != 1 || !reflect.DeepEqual(tx.points[0], want) {
+		t.Errorf("counter points %+v, want %+v", tx.points, want)
+	}
+
+	up := metrics["erdma_up"]
+	if up.field != 5 || up.temporality != 0 || len(up.points) != 1 || up.points[0].start != 0 || up.points[0].value != 1 {
+		t.Errorf("gauge encoded as field %d with points %+v", up.field, up.points)
+	}
+
+	// Cumulative Prometheus buckets become per-bucket counts with a final
+	// +Inf bucket
+	hist := metrics["erdma_exporter_cycle_duration_seconds"]
+	if hist.field != 9 || hist.temporality != otlpCumulative || hist.unit != "s" || len(hist.points) != 1 {
+		t.Fatalf("histogram encoded as field %d, temporality %d, unit %q with %d points", hist.field, hist.temporality, hist.unit, len(hist.points))
+	}
+	p := hist.points[0]
+	if p.count != 7 || math.Abs(p.sum-11.6) > 1e-9 || !reflect.DeepEqual(p.buckets, []uint64{2, 3, 2}) || !reflect.DeepEqual(p.bounds, []float64{0.1, 1}) {
+		t.Errorf("histogram point count %d, sum %v, buckets %v, bounds %v; want 7, 11.6, [2 3 2], [0.1 1]", p.count, p.sum, p.buckets, p.bounds)
+	}
+	if p.start != uint64(started.UnixNano()) {
+		t.Errorf("histogram start %d, want the process start", p.start)
+	}
+}
+
+// TestOTLPStartTimes checks the start times of counters that exist at
+// startup, appear later, and are reset
+func TestOTLPStartTimes(t *testing.T) {
+	started := time.Unix(1700000000, 0)
+	encoder := &otlpEncoder{processStart: started, starts: map[string]otlpStart{}}
+	starts := func(now time.Time, counters map[string]float64) map[string]otlpPoint {
+		t.Helper()
+		_, metrics := decodeOTLPRequest(t, encoder.Encode(otlpTestFamilies(t, counters), now))
+		points := map[string]otlpPoint{}
+		for _, p := range metrics["erdma_hw_tx_bytes_total"].points {
+			points[p.attrs["device"]] = p
+		}
+		return points
+	}
+	at := func(d time.Duration) uint64 { return uint64(started.Add(d).UnixNano()) }
+
+	for i, step := range []struct {
+		after    time.Duration
+		counters map[string]float64
+		want     map[string]uint64
+	}{
+		{15 * time.Second, map[string]float64{"erdma_0": 100}, map[string]uint64{"erdma_0": at(0)}},
+		// A device hot-plugged later only sets the base of its next points
+		{5 * time.Minute, map[string]float64{"erdma_0": 200, "erdma_1": 500}, map[string]uint64{"erdma_0": at(0), "erdma_1": at(5 * time.Minute)}},
+		{5*time.Minute + 15*time.Second, map[string]float64{"erdma_0": 300, "erdma_1": 600}, map[string]uint64{"erdma_0": at(0), "erdma_1": at(5 * time.Minute)}},
+		// A reset restarts the series after its last point
+		{5*time.Minute + 30*time.Second, map[string]float64{"erdma_0": 7, "erdma_1": 700}, map[string]uint64{"erdma_0": at(5*time.Minute + 15*time.Second), "erdma_1": at(5 * time.Minute)}},
+		{5*time.Minute + 45*time.Second, map[string]float64{"erdma_0": 9, "erdma_1": 800}, map[string]uint64{"erdma_0": at(5*time.Minute + 15*time.Second), "erdma_1": at(5 * time.Minute)}},
+	} {
+		points := starts(started.Add(step.after), step.counters)
+		for device, want := range step.want {
+			if got := points[device].start; got != want {
+				t.Errorf("export %d: %s starts at %v, want %v", i+1, device, time.Unix(0, int64(got)).Sub(started), time.Unix(0, int64(want)).Sub(started))
+			}
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// unknownFormatError is returned when no registered parser recognizes a tool's output
+type unknownFormatError struct {
+	Tool string
+}
+
+func (e *unknownFormatError) Error() string {
+	return fmt.Sprintf("%s: unknown output format", e.Tool)
+}
+
+// isUnknownFormat returns the tool whose output was not recognized, if err is an unknownFormatError
+func isUnknownFormat(err error) (string, bool) {
+	var formatErr *unknownFormatError
+	if errors.As(err, &formatErr) {
+		return formatErr.Tool, true
+	}
+	return "", false
+}
+
+// Tools whose output is parsed through the registry
+const (
+	toolEadmVer    = "eadm_ver"
+	toolIbvDevices = "ibv_devices"
+	toolEadmStat   = "eadm_stat"
+)
+
+// parserSpec selects a parser for a tool's output.
+// MinDriver (inclusive) and MaxDriver (exclusive) bound the driver versions
+// the parser applies to; empty bounds are open. Detect reports whether the
+// output is in the parser's format. Parsers are tried in order, so output
+// that several parsers detect is parsed by the first one whose bounds
+// contain the detected driver version. Bounds are ignored while the driver
+// version is unknown.
+type parserSpec struct {
+	Format    string
+	MinDriver string
+	MaxDriver string
+	Detect    func(output string) bool
+}
+
+// matches reports whether the parser applies to the output and driver version
+func (p *parserSpec) matches(output string, driver string) bool {
+	if driver != "" {
+		if p.MinDriver != "" && compareVersions(driver, p.MinDriver) < 0 {
+			return false
+		}
+		if p.MaxDriver != "" && compareVersions(driver, p.MaxDriver) >= 0 {
+			return false
+		}
+	}
+	return p.Detect(output)
+}
+
+// versionParser parses eadm ver output into the driver version
+type versionParser struct {
+	parserSpec
+	Parse func(output string) string
+}
+
+// devicesParser parses ibv_devices output into devices
+type devicesParser struct {
+	parserSpec
+	Parse func(output string) []Device
+}
+
+// statsParser parses eadm stat output into device statistics
+type statsParser struct {
+	parserSpec
+	Parse func(output string) *DeviceStats
+}
+
+var (
+	queryDriverVersionRe   = regexp.MustCompile(`Query kernel driver version:\s+(\S+)`)
+	genericDriverVersionRe = regexp.MustCompile(`(?i)driver\s+version\s*[:=]?\s*v?(\d+(?:\.\d+)+\S*)`)
+	ibvDevicesHeaderRe     = regexp.MustCompile(`(?i)^device\s+node\s+guid$`)
+	guidRe                 = regexp.MustCompile(`^(?:[0-9a-fA-F]{16}|(?:[0-9a-fA-F]{4}:){3}[0-9a-fA-F]{4})$`)
+)
+
+// versionParsers is the registry of eadm ver formats, tried in order
+var versionParsers = []versionParser{
+	{
+		parserSpec: parserSpec{
+			Format: "query_kernel_driver",
+			Detect: queryDriverVersionRe.MatchString,
+		},
+		Parse: func(output string) string {
+			return queryDriverVersionRe.FindStringSubmatch(output)[1]
+		},
+	},
+	{
+		parserSpec: parserSpec{
+			Format: "driver_version",
+			Detect: genericDriverVersionRe.MatchString,
+		},
+		Parse: func(output string) string {
+			return genericDriverVersionRe.FindStringSubmatch(output)[1]
+		},
+	},
+}
+
+// devicesParsers is the registry of ibv_devices formats, tried in order
+var devicesParsers = []devicesParser{
+	{
+		parserSpec: parserSpec{
+			Format: "rdma_core_table",
+			Detect: func(output string) bool {
+				_, ok := findIbvDevicesHeader(output)
+				return ok
+			},
+		},
+		Parse: parseIbvDevicesTable,
+	},
+	{
+		parserSpec: parserSpec{
+			Format: "plain",
+			Detect: isPlainDeviceList,
+		},
+		Parse: parsePlainDeviceList,
+	},
+}
+
+// statsParsers is the registry of eadm stat formats, tried in order
+var statsParsers = []statsParser{
+	{
+		parserSpec: parserSpec{
+			Format: "colon",
+			Detect: func(output string) bool {
+				return hasStatLine(output, splitColonStat)
+			},
+		},
+		Parse: parseDeviceStats,
+	},
+	{
+		parserSpec: parserSpec{
+			Format: "columns",
+			Detect: func(output string) bool {
+				return hasStatLine(output, splitColumnStat)
+			},
+		},
+		Parse: func(output string) *DeviceStats {
+			return parseDeviceStatsWith(output, splitColumnStat)
+		},
+	},
+}
+
+// driverVersion caches the last detected driver version for parser selection
+var driverVersion struct {
+	sync.Mutex
+	value string
+}
+
+// setDriverVersion records the detected driver version
+func setDriverVersion(version string) {
+	driverVersion.Lock()
+	defer driverVersion.Unlock()
+	driverVersion.value = version
+}
+
+// currentDriverVersion returns the last detected driver version, or "" if unknown
+func currentDriverVersion() string {
+	driverVersion.Lock()
+	defer driverVersion.Unlock()
+	return driverVersion.value
+}
+
+// parseVersionOutput parses eadm ver output with the first matching parser
+func parseVersionOutput(output string) (string, string, error) {
+	for i := range versionParsers {
+		p := &versionParsers[i]
+		if p.matches(output, "") {
+			return p.Parse(output), p.Format, nil
+		}
+	}
+	return "", "", &unknownFormatError{Tool: toolEadmVer}
+}
+
+// parseDevicesOutput parses ibv_devices output with the first matching parser
+func parseDevicesOutput(output string, driver string) ([]Device, string, error) {
+	for i := range devicesParsers {
+		p := &devicesParsers[i]
+		if p.matches(output, driver) {
+			return p.Parse(output), p.Format, nil
+		}
+	}
+	return nil, "", &unknownFormatError{Tool: toolIbvDevices}
+}
+
+// parseStatsOutput parses eadm stat output with the first matching parser
+func parseStatsOutput(output string, driver string) (*DeviceStats, string, error) {
+	for i := range statsParsers {
+		p := &statsParsers[i]
+		if p.matches(output, driver) {
+			return p.Parse(output), p.Format, nil
+		}
+	}
+	return nil, "", &unknownFormatError{Tool: toolEadmStat}
+}
+
+// findIbvDevicesHeader returns the index of the ibv_devices header line
+func findIbvDevicesHeader(output string) (int, bool) {
+	for i, line := range strings.Split(output, "\n") {
+		if ibvDevicesHeaderRe.MatchString(strings.TrimSpace(line)) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// parseIbvDevicesTable parses the rdma-core table format:
+//
+//	device          	   node GUID
+//	------          	----------------
+//	erdma_0         	02163efffe5030b3
+//
+// Lines before the header, such as warnings, are ignored.
+func parseIbvDevicesTable(output string) []Device {
+	header, _ := findIbvDevicesHeader(output)
+	var devices []Device
+	for lineNum, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if lineNum <= header || line == "" || strings.Trim(line, "- \t") == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) >= 2 {
+			devices = append(devices, Device{Name: fields[0], GUID: fields[1]})
+			slog.Debug("Found device", "device", fields[0], "guid", fields[1])
+		} else {
+			slog.Debug("Line does not match device format", "line", lineNum+1, "fields", len(fields))
+		}
+	}
+	return devices
+}
+
+// isPlainDeviceList reports whether every non-empty line is a "name guid" pair
+func isPlainDeviceList(output string) bool {
+	found := false
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 || !guidRe.MatchString(fields[1]) {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// parsePlainDeviceList parses headerless "name guid" lines
+func parsePlainDeviceList(output string) []Device {
+	var devices []Device
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			devices = append(devices, Device{Name: fields[0], GUID: fields[1]})
+		}
+	}
+	return devices
+}
+
+// hasStatLine reports whether any line splits into a known stat key and a numeric value
+func hasStatLine(output string, split statSplitter) bool {
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		key, val, ok := split(strings.TrimSpace(scanner.Text()))
+		if !ok {
+			continue
+		}
+		if _, known := statFields[normalizeStatKey(key)]; !known {
+			continue
+		}
+		if _, reason := parseStatValue(strings.TrimSpace(val)); reason == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// compareVersions compares dotted numeric versions such as "0.2.38".
+// Non-numeric suffixes of a component are ignored.
+func compareVersions(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x = leadingInt(as[i])
+		}
+		if i < len(bs) {
+			y = leadingInt(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// leadingInt parses the leading digits of s
+func leadingInt(s string) int {
+	end := 0
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	n, _ := strconv.Atoi(s[:end])
+	return n
+}
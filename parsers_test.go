@@ -0,0 +1,315 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readFixture returns the contents of a file in testdata
+func readFixture(t *testing.T, name string) string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// The fixtures are synthetic rather than captured from nodes, see
+// testdata/README.md
+
+var versionFixtures = []struct {
+	file    string
+	format  string
+	version string
+}{
+	{"eadm_ver/query_kernel_driver.txt", "query_kernel_driver", "0.2.38"},
+	{"eadm_ver/driver_version.txt", "driver_version", "0.2.41"},
+}
+
+var devicesFixtures = []struct {
+	file    string
+	format  string
+	devices []Device
+}{
+	{"ibv_devices/plain.txt", "plain", []Device{
+		{Name: "erdma_0", GUID: "0216:3eff:fe50:30b3"},
+		{Name: "erdma_1", GUID: "0216:3eff:fe50:30b4"},
+	}},
+	{"ibv_devices/rdma_core_table.txt", "rdma_core_table", []Device{
+		{Name: "erdma_0", GUID: "02163efffe5030b3"},
+		{Name: "erdma_1", GUID: "02163efffe5030b4"},
+	}},
+	{"ibv_devices/rdma_core_table_warning.txt", "rdma_core_table", []Device{
+		{Name: "erdma_0", GUID: "02163efffe5030b3"},
+	}},
+}
+
+var statsFixtures = []struct {
+	file   string
+	format string
+}{
+	{"eadm_stat/colon.txt", "colon"},
+	{"eadm_stat/colon_sections.txt", "colon"},
+	{"eadm_stat/columns.txt", "columns"},
+}
+
+func TestParseVersionOutput(t *testing.T) {
+	for _, tc := range versionFixtures {
+		t.Run(tc.file, func(t *testing.T) {
+			version, format, err := parseVersionOutput(readFixture(t, tc.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != tc.format {
+				t.Errorf("format = %q, want %q", format, tc.format)
+			}
+			if version != tc.version {
+				t.Errorf("version = %q, want %q", version, tc.version)
+			}
+		})
+	}
+}
+
+func TestParseDevicesOutput(t *testing.T) {
+	for _, tc := range devicesFixtures {
+		t.Run(tc.file, func(t *testing.T) {
+			devices, format, err := parseDevicesOutput(readFixture(t, tc.file), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != tc.format {
+				t.Errorf("format = %q, want %q", format, tc.format)
+			}
+			if !reflect.DeepEqual(devices, tc.devices) {
+				t.Errorf("devices = %+v, want %+v", devices, tc.devices)
+			}
+		})
+	}
+}
+
+// TestParseStatsOutput checks that every stats fixture, which all encode the
+// same counters, parses to the same values
+func TestParseStatsOutput(t *testing.T) {
+	var want map[string]uint64
+	for _, tc := range statsFixtures {
+		t.Run(tc.file, func(t *testing.T) {
+			stats, format, err := parseStatsOutput(readFixture(t, tc.file), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != tc.format {
+				t.Errorf("format = %q, want %q", format, tc.format)
+			}
+			if len(stats.ParseErrors) != 0 {
+				t.Errorf("parse errors: %v", stats.ParseErrors)
+			}
+			for key := range statFields {
+				if _, ok := stats.Raw[key]; !ok {
+					t.Errorf("missing %s", key)
+				}
+			}
+			for _, c := range []struct {
+				name  string
+				value StatValue
+				want  uint64
+			}{
+				{"hw_tx_bytes_cnt", stats.HwTx.Bytes, 123456789},
+				{"hw_rx_bytes_cnt", stats.HwRx.Bytes, 987654321},
+				{"cmdq_submitted_cnt", stats.Cmdq.Submitted, 500},
+				{"listen_ipv6_cnt", stats.Listen.Ipv6, 7},
+			} {
+				if !c.value.Present || c.value.Value != c.want {
+					t.Errorf("%s = %+v, want %d", c.name, c.value, c.want)
+				}
+			}
+			if want == nil {
+				want = stats.Raw
+			} else if !reflect.DeepEqual(stats.Raw, want) {
+				t.Errorf("counters differ from %s: %v, want %v", statsFixtures[0].file, stats.Raw, want)
+			}
+		})
+	}
+}
+
+// TestFixturesCovered checks that every file in testdata is parsed by a test
+func TestFixturesCovered(t *testing.T) {
+	covered := map[string]bool{}
+	for _, tc := range versionFixtures {
+		covered[tc.file] = true
+	}
+	for _, tc := range devicesFixtures {
+		covered[tc.file] = true
+	}
+	for _, tc := range statsFixtures {
+		covered[tc.file] = true
+	}
+	files, err := filepath.Glob(filepath.Join("testdata", "*", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		name, _ := filepath.Rel("testdata", file)
+		if !covered[filepath.ToSlash(name)] {
+			t.Errorf("%s is not covered by a parser test", name)
+		}
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	const output = "Segmentation fault\n"
+	_, _, verErr := parseVersionOutput(output)
+	_, _, devErr := parseDevicesOutput(output, "")
+	_, _, statErr := parseStatsOutput(output, "")
+	for _, c := range []struct {
+		tool string
+		err  error
+	}{
+		{"eadm ver", verErr},
+		{"ibv_devices", devErr},
+		{"eadm stat", statErr},
+	} {
+		if _, ok := isUnknownFormat(c.err); !ok {
+			t.Errorf("%s: error = %v, want an unknown format error", c.tool, c.err)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"0.2.38", "0.2.38", 0},
+		{"0.2.38", "0.2.4", 1},
+		{"0.2.4", "0.2.38", -1},
+		{"v0.2.38", "0.2.38", 0},
+		{"0.2.38-1.al8", "0.2.38", 0},
+		{"0.2", "0.2.0", 0},
+		{"0.2", "0.2.1", -1},
+		{"1.0", "0.9.9", 1},
+	} {
+		if got := compareVersions(tc.a, tc.b); got != tc.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+// TestParserDriverBounds checks that the same output is parsed by different
+// parsers depending on the driver version, with registries in which a
+// parser for drivers before 0.2.40 precedes one for later drivers
+func TestParserDriverBounds(t *testing.T) {
+	savedDevices, savedStats := devicesParsers, statsParsers
+	t.Cleanup(func() {
+		devicesParsers, statsParsers = savedDevices, savedStats
+		setDriverVersion("")
+	})
+	// The older parser reports GUIDs in upper case and counters doubled, so
+	// that the tests can tell which one ran
+	devicesParsers = []devicesParser{
+		{
+			parserSpec: parserSpec{Format: "plain_legacy", MaxDriver: "0.2.40", Detect: isPlainDeviceList},
+			Parse: func(output string) []Device {
+				devices := parsePlainDeviceList(output)
+				for i := range devices {
+					devices[i].GUID = strings.ToUpper(devices[i].GUID)
+				}
+				return devices
+			},
+		},
+		{
+			parserSpec: parserSpec{Format: "plain", MinDriver: "0.2.40", Detect: isPlainDeviceList},
+			Parse:      parsePlainDeviceList,
+		},
+	}
+	statsParsers = []statsParser{
+		{
+			parserSpec: parserSpec{Format: "colon_legacy", MaxDriver: "0.2.40", Detect: func(output string) bool {
+				return hasStatLine(output, splitColonStat)
+			}},
+			Parse: func(output string) *DeviceStats {
+				stats := parseDeviceStats(output)
+				for key, val := range stats.Raw {
+					stats.set(key, 2*val)
+				}
+				return stats
+			},
+		},
+		{
+			parserSpec: parserSpec{Format: "colon", MinDriver: "0.2.40", Detect: func(output string) bool {
+				return hasStatLine(output, splitColonStat)
+			}},
+			Parse: parseDeviceStats,
+		},
+	}
+
+	devicesOutput := readFixture(t, "ibv_devices/plain.txt")
+	statsOutput := readFixture(t, "eadm_stat/colon.txt")
+	for _, tc := range []struct {
+		driver        string
+		devicesFormat string
+		guid          string
+		statsFormat   string
+		txBytes       uint64
+	}{
+		// Bounds are ignored while the driver version is unknown
+		{"", "plain_legacy", "0216:3EFF:FE50:30B3", "colon_legacy", 2 * 123456789},
+		{"0.2.38", "plain_legacy", "0216:3EFF:FE50:30B3", "colon_legacy", 2 * 123456789},
+		{"0.2.39.1", "plain_legacy", "0216:3EFF:FE50:30B3", "colon_legacy", 2 * 123456789},
+		{"0.2.40", "plain", "0216:3eff:fe50:30b3", "colon", 123456789},
+		{"0.2.41", "plain", "0216:3eff:fe50:30b3", "colon", 123456789},
+		{"1.0.0", "plain", "0216:3eff:fe50:30b3", "colon", 123456789},
+	} {
+		t.Run("driver "+tc.driver, func(t *testing.T) {
+			devices, format, err := parseDevicesOutput(devicesOutput, tc.driver)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != tc.devicesFormat || devices[0].GUID != tc.guid {
+				t.Errorf("devices parsed by %s with GUID %s, want %s with %s", format, devices[0].GUID, tc.devicesFormat, tc.guid)
+			}
+			stats, format, err := parseStatsOutput(statsOutput, tc.driver)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != tc.statsFormat || stats.HwTx.Bytes.Value != tc.txBytes {
+				t.Errorf("stats parsed by %s with hw_tx_bytes_cnt %d, want %s with %d", format, stats.HwTx.Bytes.Value, tc.statsFormat, tc.txBytes)
+			}
+		})
+	}
+
+	// Output that only a parser outside its bounds detects is unknown
+	devicesParsers = devicesParsers[1:]
+	if _, _, err := parseDevicesOutput(devicesOutput, "0.2.38"); err == nil {
+		t.Error("parsed by a parser for later drivers")
+	}
+
+	// The collector selects the parsers by the version eadm ver reported
+	for _, tc := range []struct {
+		version string
+		txBytes uint64
+	}{
+		{"0.2.38", 2 * 123456789},
+		{"0.2.41", 123456789},
+	} {
+		run := func(name string, args ...string) ([]byte, []byte, error) {
+			if name == "eadm" && args[0] == "ver" {
+				return []byte("Query kernel driver version: " + tc.version + "\n"), nil, nil
+			}
+			return []byte(statsOutput), nil, nil
+		}
+		if _, err := getVersionWith(run); err != nil {
+			t.Fatal(err)
+		}
+		stats, err := getDeviceStatsWith(run, "erdma_0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.HwTx.Bytes.Value != tc.txBytes {
+			t.Errorf("driver %s: hw_tx_bytes_cnt = %d, want %d", tc.version, stats.HwTx.Bytes.Value, tc.txBytes)
+		}
+	}
+}
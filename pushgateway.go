@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// pushMaxBackoff caps the delay between retries of a failed push
+const pushMaxBackoff = 30 * time.Second
+
+// pushOptions configures pushing to a Pushgateway
+type pushOptions struct {
+	URL          string
+	Job          string
+	Interval     time.Duration
+	Timeout      time.Duration
+	Retries      int
+	Username     string
+	PasswordFile string
+	DeleteOnExit bool
+}
+
+// gatewayPusher pushes a registry to a Pushgateway on an interval and
+// once more on shutdown. The group is keyed by job and by the node name
+// as instance, since the metrics already carry a node label and the
+// Pushgateway rejects metrics with a label of the grouping key.
+type gatewayPusher struct {
+	opts   pushOptions
+	pusher *push.Pusher
+
+	pushes      *prometheus.CounterVec
+	lastSuccess prometheus.Gauge
+}
+
+// newGatewayPusher creates a pusher for reg and registers its own metrics
+// with reg, so that they are pushed as well
+func newGatewayPusher(opts pushOptions, node string, reg *prometheus.Registry) (*gatewayPusher, error) {
+	pusher := push.New(opts.URL, opts.Job).
+		Gatherer(reg).
+		Grouping("instance", node).
+		Client(&http.Client{Timeout: opts.Timeout})
+	if opts.Username != "" {
+		password := ""
+		if opts.PasswordFile != "" {
+			data, err := os.ReadFile(opts.PasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("read push password: %w", err)
+			}
+			password = strings.TrimSpace(string(data))
+		}
+		pusher = pusher.BasicAuth(opts.Username, password)
+	}
+	if err := pusher.Error(); err != nil {
+		return nil, err
+	}
+
+	p := &gatewayPusher{
+		opts:   opts,
+		pusher: pusher,
+		pushes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "exporter", Name: "pushes_total",
+			Help: "Total number of pushes to the Pushgateway, including retries",
+		}, []string{"result"}),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "exporter", Name: "push_last_success_timestamp_seconds",
+			Help: "Timestamp of the last successful push to the Pushgateway",
+		}),
+	}
+	reg.MustRegister(p.pushes, p.lastSuccess)
+	return p, nil
+}
+
+// pushWithRetries pushes, retrying failures with exponential backoff until
+// the retries are used up or ctx is done
+func (p *gatewayPusher) pushWithRetries(ctx context.Context) error {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err := p.pusher.PushContext(ctx)
+		if err == nil {
+			p.pushes.WithLabelValues("success").Inc()
+			p.lastSuccess.SetToCurrentTime()
+			return nil
+		}
+		p.pushes.WithLabelValues("failure").Inc()
+		if attempt >= p.opts.Retries || ctx.Err() != nil {
+			return err
+		}
+		slog.Warn("Push to Pushgateway failed, retrying", "url", p.opts.URL, "attempt", attempt+1, "backoff", backoff, "err", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, pushMaxBackoff)
+	}
+}
+
+// Run pushes every interval until ctx is done, then pushes once more, or
+// deletes the group if DeleteOnExit is set. The final push or delete is
+// bounded by timeout and must happen before running tools are stopped.
+func (p *gatewayPusher) Run(ctx context.Context, timeout time.Duration) {
+	slog.Info("Pushing metrics to Pushgateway", "url", p.opts.URL, "job", p.opts.Job, "interval", p.opts.Interval)
+	ticker := time.NewTicker(p.opts.Interval)
+	defer ticker.Stop()
+	for {
+		if err := p.pushWithRetries(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("Push to Pushgateway failed", "url", p.opts.URL, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			p.final(timeout)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// final pushes the last metrics or deletes the group on shutdown
+func (p *gatewayPusher) final(timeout time.Duration) {
+	if p.opts.DeleteOnExit {
+		// Delete has no context; the client timeout bounds it
+		if err := p.pusher.Delete(); err != nil {
+			slog.Error("Failed to delete group from Pushgateway", "url", p.opts.URL, "err", err)
+			return
+		}
+		slog.Info("Deleted group from Pushgateway", "url", p.opts.URL)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := p.pushWithRetries(ctx); err != nil {
+		slog.Error("Final push to Pushgateway failed", "url", p.opts.URL, "err", err)
+		return
+	}
+	slog.Info("Pushed final metrics to Pushgateway", "url", p.opts.URL)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pushRequest is a request received by the fake Pushgateway
+type pushRequest struct {
+	method, path, user, password string
+}
+
+// fakePushgateway records requests and answers them with the next status
+// of statuses, then with 200
+type fakePushgateway struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []pushRequest
+	statuses []int
+	received chan struct{}
+}
+
+func newFakePushgateway(t *testing.T, statuses ...int) *fakePushgateway {
+	t.Helper()
+	g := &fakePushgateway{statuses: statuses, received: make(chan struct{}, 100)}
+	g.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		g.mu.Lock()
+		g.requests = append(g.requests, pushRequest{r.Method, r.URL.EscapedPath(), user, password})
+		status := http.StatusOK
+		if len(g.statuses) > 0 {
+			status, g.statuses = g.statuses[0], g.statuses[1:]
+		}
+		g.mu.Unlock()
+		w.WriteHeader(status)
+		g.received <- struct{}{}
+	}))
+	t.Cleanup(g.Close)
+	return g
+}
+
+func (g *fakePushgateway) Requests() []pushRequest {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]pushRequest(nil), g.requests...)
+}
+
+// newTestPusher creates a pusher of a registry with one gauge
+func newTestPusher(t *testing.T, opts pushOptions, node string) (*gatewayPusher, *prometheus.Registry) {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	up := prometheus.NewGauge(prometheus.GaugeOpts{Name: "erdma_up", Help: "Whether the devices were listed."})
+	up.Set(1)
+	reg.MustRegister(up)
+	if opts.Job == "" {
+		opts.Job = "erdma-exporter"
+	}
+	if opts.Interval == 0 {
+		opts.Interval = time.Hour
+	}
+	opts.Timeout = 5 * time.Second
+	p, err := newGatewayPusher(opts, node, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, reg
+}
+
+// runPusher runs p until the gateway received n requests, then stops it
+// and waits for the final push or delete
+func runPusher(t *testing.T, p *gatewayPusher, g *fakePushgateway, n int) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx, 5*time.Second)
+		close(done)
+	}()
+	for i := 0; i < n; i++ {
+		select {
+		case <-g.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of %d pushes received", i, n)
+		}
+	}
+	cancel()
+	<-done
+}
+
+func TestPushGrouping(t *testing.T) {
+	captureLogs(t)
+	g := newFakePushgateway(t)
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("push-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// A slash in the node name is encoded in the grouping key
+	p, _ := newTestPusher(t, pushOptions{URL: g.URL, Interval: 10 * time.Millisecond, Username: "pusher", PasswordFile: passwordFile}, "rack/node-1")
+	runPusher(t, p, g, 2)
+
+	requests := g.Requests()
+	if len(requests) < 3 {
+		t.Fatalf("%d requests, want two pushes and a final one", len(requests))
+	}
+	for _, r := range requests {
+		want := pushRequest{http.MethodPut, "/metrics/job/erdma-exporter/instance@base64/cmFjay9ub2RlLTE", "pusher", "push-secret"}
+		if r != want {
+			t.Errorf("request %+v, want %+v", r, want)
+		}
+	}
+	// A push in flight when Run is stopped may count as failed
+	if got := counterValue(t, p.pushes.WithLabelValues("success")); got < 2 {
+		t.Errorf("%v successful pushes counted, want at least 2", got)
+	}
+}
+
+func TestPushDeleteOnExit(t *testing.T) {
+	captureLogs(t)
+	g := newFakePushgateway(t)
+	p, _ := newTestPusher(t, pushOptions{URL: g.URL, DeleteOnExit: true}, "node-1")
+	runPusher(t, p, g, 1)
+
+	requests := g.Requests()
+	if len(requests) != 2 || requests[0].method != http.MethodPut || requests[1].method != http.MethodDelete {
+		t.Fatalf("requests %+v, want a push and a delete", requests)
+	}
+	if requests[1].path != "/metrics/job/erdma-exporter/instance/node-1" {
+		t.Errorf("deleted %s", requests[1].path)
+	}
+}
+
+func TestPushRetries(t *testing.T) {
+	logs := captureLogs(t)
+	g := newFakePushgateway(t, http.StatusServiceUnavailable)
+	p, _ := newTestPusher(t, pushOptions{URL: g.URL, Retries: 1}, "node-1")
+	if err := p.pushWithRetries(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Requests()) != 2 || counterValue(t, p.pushes.WithLabelValues("failure")) != 1 || counterValue(t, p.pushes.WithLabelValues("success")) != 1 {
+		t.Errorf("%d requests for a failure and a retry", len(g.Requests()))
+	}
+	if !strings.Contains(logs.String(), "retrying") {
+		t.Errorf("retry not logged:\n%s", logs)
+	}
+
+	// Once the retries are used up the error is returned
+	g = newFakePushgateway(t, http.StatusBadRequest, http.StatusBadRequest)
+	p, _ = newTestPusher(t, pushOptions{URL: g.URL}, "node-1")
+	if err := p.pushWithRetries(context.Background()); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("error = %v, want the status", err)
+	}
+}
+
+func TestNewGatewayPusherPasswordFile(t *testing.T) {
+	_, err := newGatewayPusher(pushOptions{URL: "http://localhost:9091", Job: "erdma-exporter", Username: "pusher", PasswordFile: filepath.Join(t.TempDir(), "missing")}, "node-1", prometheus.NewRegistry())
+	if err == nil || !strings.Contains(err.Error(), "read push password") {
+		t.Errorf("error = %v", err)
+	}
+}
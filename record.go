@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// recordFileName is the file inside a record directory holding one JSON call per line
+const recordFileName = "calls.jsonl"
+
+// toolCall is a single recorded tool invocation
+type toolCall struct {
+	Time     time.Time `json:"time"`
+	Tool     string    `json:"tool"`
+	Args     []string  `json:"args"`
+	Stdout   string    `json:"stdout"`
+	Stderr   string    `json:"stderr"`
+	ExitCode int       `json:"exit_code"`
+	Error    string    `json:"error,omitempty"`
+	Duration float64   `json:"duration_seconds,omitempty"`
+}
+
+// key identifies the invocation independent of when it happened
+func (c *toolCall) key() string {
+	return strings.Join(append([]string{c.Tool}, c.Args...), " ")
+}
+
+// toolRunner runs a tool by name and returns its stdout and stderr
+type toolRunner func(name string, args ...string) ([]byte, []byte, error)
+
+// ToolBackend serves tool invocations without executing the real tools
+type ToolBackend interface {
+	Run(name string, args ...string) ([]byte, []byte, error)
+}
+
+var (
+	// toolRecorder saves every tool invocation when --record-dir is set
+	toolRecorder *ToolRecorder
+	// toolBackend replaces the real tools when --replay-dir or --simulate is set
+	toolBackend ToolBackend
+
+	// toolContext is cancelled on shutdown to kill tools that are still running
+	toolContext, cancelTools = context.WithCancel(context.Background())
+	// runningTools counts the tools currently executing
+	runningTools sync.WaitGroup
+)
+
+// toolWaitDelay is how long to wait for output after a tool has been killed
+const toolWaitDelay = time.Second
+
+// runTool runs an ERDMA tool and returns its stdout and stderr.
+// With a backend configured the call is served by the backend instead.
+// Every call is kept in recentToolCalls for the admin listener.
+func runTool(name string, args ...string) ([]byte, []byte, error) {
+	start := time.Now()
+	var stdout, stderr []byte
+	var err error
+	if toolBackend != nil {
+		stdout, stderr, err = toolBackend.Run(name, args...)
+	} else {
+		stdout, stderr, err = execTool(name, args...)
+	}
+
+	call := &toolCall{
+		Time:     start,
+		Tool:     name,
+		Args:     args,
+		Stdout:   string(stdout),
+		Stderr:   string(stderr),
+		ExitCode: exitCode(err),
+		Duration: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		call.Error = err.Error()
+	}
+	recentToolCalls.Add(call)
+
+	if toolRecorder != nil && toolBackend == nil {
+		if rerr := toolRecorder.Record(call); rerr != nil {
+			slog.Error("Failed to record tool call", "tool", name, "err", rerr)
+		}
+	}
+
+	return stdout, stderr, err
+}
+
+// execTool executes an ERDMA tool, killing it after the configured timeout
+// or on shutdown
+func execTool(name string, args ...string) ([]byte, []byte, error) {
+	path := findCommand(name)
+	slog.Debug("Running tool", "tool", name, "path", path, "args", args)
+
+	// Check if command exists and is executable
+	if _, err := os.Stat(path); err != nil {
+		slog.Debug("Command file check failed", "tool", name, "err", err)
+	}
+
+	runningTools.Add(1)
+	defer runningTools.Done()
+	timeout := time.Duration(activeConfig().Timeouts.Tool)
+	ctx, cancel := context.WithTimeout(toolContext, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, args...)
+	// Run the tool in its own process group and kill the whole group, so
+	// that wrapper scripts do not leave their children behind
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = toolWaitDelay
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	switch {
+	case err == nil:
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		err = fmt.Errorf("%s timed out after %s: %w", name, timeout, err)
+	case errors.Is(ctx.Err(), context.Canceled):
+		err = fmt.Errorf("%s cancelled on shutdown: %w", name, err)
+	}
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// recentToolCallsSize is how many tool calls recentToolCalls keeps
+const recentToolCallsSize = 64
+
+// recentToolCalls holds the last tool invocations
+var recentToolCalls = &toolCallRing{}
+
+// toolCallRing keeps the most recent tool calls
+type toolCallRing struct {
+	mu    sync.Mutex
+	calls []*toolCall
+	next  int
+}
+
+// Add stores a call, replacing the oldest one once the ring is full
+func (r *toolCallRing) Add(call *toolCall) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.calls) < recentToolCallsSize {
+		r.calls = append(r.calls, call)
+		return
+	}
+	r.calls[r.next] = call
+	r.next = (r.next + 1) % recentToolCallsSize
+}
+
+// Calls returns the stored calls, oldest first
+func (r *toolCallRing) Calls() []*toolCall {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	calls := make([]*toolCall, 0, len(r.calls))
+	calls = append(calls, r.calls[r.next:]...)
+	calls = append(calls, r.calls[:r.next]...)
+	return calls
+}
+
+// stopTools kills running tools and waits for them to exit
+func stopTools() {
+	cancelTools()
+	done := make(chan struct{})
+	go func() {
+		runningTools.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * toolWaitDelay):
+		slog.Warn("Tools did not exit after being killed")
+	}
+}
+
+// exitCode extracts the process exit code from a command error
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// ToolRecorder appends tool invocations to a record directory
+type ToolRecorder struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewToolRecorder creates a recorder writing to dir, creating it if needed
+func NewToolRecorder(dir string) (*ToolRecorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create record directory: %w", err)
+	}
+	file, err := os.OpenFile(filepath.Join(dir, recordFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open record file: %w", err)
+	}
+	return &ToolRecorder{file: file}, nil
+}
+
+// Record appends a call to the recording
+func (r *ToolRecorder) Record(call *toolCall) error {
+	data, err := json.Marshal(call)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		// Calls still running at shutdown are not recorded
+		return nil
+	}
+	_, err = r.file.Write(append(data, '\n'))
+	return err
+}
+
+// Close flushes the record file to disk and closes it
+func (r *ToolRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Sync()
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	r.file = nil
+	return err
+}
+
+// closeToolRecorder closes the recorder of --record-dir, if any
+func closeToolRecorder() {
+	if toolRecorder == nil {
+		return
+	}
+	if err := toolRecorder.Close(); err != nil {
+		slog.Error("Failed to close record file", "err", err)
+	}
+}
+
+// ToolReplayer serves tool invocations from a recording as a single
+// timeline. The recording is split into cycles, each a run of calls without
+// a repeated invocation, such as the eadm ver, ibv_devices and eadm stat
+// calls of one collection. Calls are served from one recorded cycle until
+// an invocation is repeated, which moves on to the next cycle, starting
+// over from the first one once the timeline is exhausted. The outputs of
+// the different tools thus stay in step as they were recorded.
+type ToolReplayer struct {
+	cycles [][]*toolCall
+
+	mu sync.Mutex
+	// cycle is the index of the recorded cycle being served
+	cycle int
+	// served holds the invocations served from the current cycle
+	served map[string]bool
+}
+
+// NewToolReplayer loads a recording made with --record-dir
+func NewToolReplayer(dir string) (*ToolReplayer, error) {
+	file, err := os.Open(filepath.Join(dir, recordFileName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+	defer file.Close()
+
+	r := &ToolReplayer{served: make(map[string]bool)}
+	var cycle []*toolCall
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		call := &toolCall{}
+		if err := json.Unmarshal(line, call); err != nil {
+			return nil, fmt.Errorf("invalid call at line %d of recording: %w", lineNum, err)
+		}
+		if seen[call.key()] {
+			r.cycles = append(r.cycles, cycle)
+			cycle, seen = nil, make(map[string]bool)
+		}
+		cycle = append(cycle, call)
+		seen[call.key()] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading recording: %w", err)
+	}
+	if len(cycle) == 0 {
+		return nil, fmt.Errorf("recording in %s is empty", dir)
+	}
+	r.cycles = append(r.cycles, cycle)
+
+	return r, nil
+}
+
+// Run implements ToolBackend by returning the recorded result of the
+// invocation in the current cycle
+func (r *ToolReplayer) Run(name string, args ...string) ([]byte, []byte, error) {
+	key := (&toolCall{Tool: name, Args: args}).key()
+
+	r.mu.Lock()
+	if r.served[key] {
+		r.cycle = (r.cycle + 1) % len(r.cycles)
+		r.served = make(map[string]bool)
+	}
+	r.served[key] = true
+	var call *toolCall
+	for _, c := range r.cycles[r.cycle] {
+		if c.key() == key {
+			call = c
+			break
+		}
+	}
+	cycle := r.cycle
+	r.mu.Unlock()
+
+	if call == nil {
+		return nil, nil, fmt.Errorf("no recorded call for %q in cycle %d of the recording", key, cycle+1)
+	}
+	var err error
+	if call.ExitCode != 0 || call.Error != "" {
+		err = fmt.Errorf("replayed %q failed: %s", key, call.Error)
+	}
+	return []byte(call.Stdout), []byte(call.Stderr), err
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeToolScript prints its name, arguments and a call number shared by all
+// fake tools, and fails on the fifth call
+const fakeToolScript = `#!/bin/sh
+count="$(dirname "$0")/count"
+n=$(($(cat "$count" 2>/dev/null || echo 0) + 1))
+echo $n > "$count"
+if [ $n -eq 5 ]; then
+	echo "call $n failed" >&2
+	exit 2
+fi
+echo "$(basename "$0") $* call $n"
+`
+
+// installFakeTools puts fake eadm and ibv_devices tools first in PATH
+func installFakeTools(t *testing.T, script string) {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range []string{"eadm", "ibv_devices"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// replayedCall is the outcome of a tool call as seen by its caller
+type replayedCall struct {
+	Stdout, Stderr string
+	Failed         bool
+}
+
+func runAll(run toolRunner, calls [][]string) []replayedCall {
+	var results []replayedCall
+	for _, call := range calls {
+		stdout, stderr, err := run(call[0], call[1:]...)
+		results = append(results, replayedCall{string(stdout), string(stderr), err != nil})
+	}
+	return results
+}
+
+// TestRecordReplay records the calls of three collection cycles to a fake
+// tool and checks that replay returns the same outputs in the same order,
+// twice over
+func TestRecordReplay(t *testing.T) {
+	installFakeTools(t, fakeToolScript)
+	dir := t.TempDir()
+	recorder, err := NewToolRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toolRecorder = recorder
+	t.Cleanup(func() { toolRecorder = nil })
+
+	var calls [][]string
+	for i := 0; i < 3; i++ {
+		calls = append(calls,
+			[]string{"eadm", "ver"},
+			[]string{"ibv_devices"},
+			[]string{"eadm", "stat", "-d", "erdma_0"},
+			[]string{"eadm", "stat", "-d", "erdma_1"},
+		)
+	}
+	recorded := runAll(runTool, calls)
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := recorded[0], (replayedCall{Stdout: "eadm ver call 1\n"}); got != want {
+		t.Fatalf("first recorded call = %+v, want %+v", got, want)
+	}
+	if got, want := recorded[4], (replayedCall{Stderr: "call 5 failed\n", Failed: true}); got != want {
+		t.Fatalf("fifth recorded call = %+v, want %+v", got, want)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, recordFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != len(calls) {
+		t.Fatalf("recorded %d calls, want %d", len(lines), len(calls))
+	}
+	var failed toolCall
+	if err := json.Unmarshal([]byte(lines[4]), &failed); err != nil {
+		t.Fatal(err)
+	}
+	if failed.Tool != "eadm" || !reflect.DeepEqual(failed.Args, []string{"ver"}) || failed.ExitCode != 2 || failed.Time.IsZero() {
+		t.Errorf("failed call recorded as %+v", failed)
+	}
+
+	replayer, err := NewToolReplayer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for lap := 1; lap <= 2; lap++ {
+		if replayed := runAll(replayer.Run, calls); !reflect.DeepEqual(replayed, recorded) {
+			t.Errorf("lap %d replayed\n%+v\nwant\n%+v", lap, replayed, recorded)
+		}
+	}
+
+	// Nothing is recorded while replaying
+	toolBackend = replayer
+	t.Cleanup(func() { toolBackend = nil })
+	runTool("eadm", "ver")
+	if data2, _ := os.ReadFile(filepath.Join(dir, recordFileName)); len(data2) != len(data) {
+		t.Error("replayed call was recorded")
+	}
+}
+
+// writeRecording writes calls to a recording in a new directory
+func writeRecording(t *testing.T, calls []toolCall) string {
+	t.Helper()
+	dir := t.TempDir()
+	var b strings.Builder
+	for _, call := range calls {
+		data, err := json.Marshal(call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Write(append(data, '\n'))
+	}
+	if err := os.WriteFile(filepath.Join(dir, recordFileName), []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// TestReplayInStep replays a recording in which a device disappears for a
+// cycle and which ends in the middle of a cycle through a collector, and
+// checks that the statistics of every cycle are those recorded with its
+// device list, also after the timeline starts over
+func TestReplayInStep(t *testing.T) {
+	ver := func(v string) toolCall {
+		return toolCall{Tool: "eadm", Args: []string{"ver"}, Stdout: "Query kernel driver version: " + v + "\n"}
+	}
+	devices := func(names ...string) toolCall {
+		var out strings.Builder
+		for i, name := range names {
+			fmt.Fprintf(&out, "%s 0216:3eff:fe50:30b%d\n", name, i)
+		}
+		return toolCall{Tool: "ibv_devices", Stdout: out.String()}
+	}
+	stat := func(device string, bytes int) toolCall {
+		return toolCall{Tool: "eadm", Args: []string{"stat", "-d", device}, Stdout: fmt.Sprintf("hw_tx_bytes_cnt : %d\n", bytes)}
+	}
+	dir := writeRecording(t, []toolCall{
+		ver("0.2.1"), devices("erdma_0", "erdma_1"), stat("erdma_0", 10), stat("erdma_1", 11),
+		ver("0.2.2"), devices("erdma_0"), stat("erdma_0", 20),
+		ver("0.2.3"), devices("erdma_0", "erdma_1"), stat("erdma_0", 30), stat("erdma_1", 31),
+		// Recording stopped before the statistics of erdma_1
+		ver("0.2.4"), devices("erdma_0", "erdma_1"), stat("erdma_0", 40),
+	})
+	replayer, err := NewToolReplayer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayer.cycles) != 4 {
+		t.Fatalf("recording split into %d cycles, want 4", len(replayer.cycles))
+	}
+
+	c, err := NewErdmaCollector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.run = replayer.Run
+	c.nodeName = "node-1"
+	want := []struct {
+		version string
+		bytes   map[string]uint64
+		failed  []string
+	}{
+		{"0.2.1", map[string]uint64{"erdma_0": 10, "erdma_1": 11}, nil},
+		{"0.2.2", map[string]uint64{"erdma_0": 20}, nil},
+		{"0.2.3", map[string]uint64{"erdma_0": 30, "erdma_1": 31}, nil},
+		{"0.2.4", map[string]uint64{"erdma_0": 40}, []string{"erdma_1"}},
+	}
+	for i := 0; i < 2*len(want); i++ {
+		w := want[i%len(want)]
+		state, devices := c.Refresh(0)
+		got := map[string]uint64{}
+		var failed []string
+		for _, d := range devices {
+			if d.Err != nil {
+				failed = append(failed, d.Device.Name)
+				continue
+			}
+			got[d.Device.Name] = d.Last.Stats.HwTx.Bytes.Value
+		}
+		if state.Version != w.version || !reflect.DeepEqual(got, w.bytes) || !reflect.DeepEqual(failed, w.failed) {
+			t.Errorf("cycle %d: version %s, bytes %v, failed %v, want version %s, bytes %v, failed %v",
+				i+1, state.Version, got, failed, w.version, w.bytes, w.failed)
+		}
+	}
+}
+
+func TestReplayMissingCall(t *testing.T) {
+	dir := writeRecording(t, []toolCall{{Tool: "eadm", Args: []string{"ver"}, Stdout: "Query kernel driver version: 0.2.1\n"}})
+	replayer, err := NewToolReplayer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := replayer.Run("ibv_devices"); err == nil || !strings.Contains(err.Error(), "no recorded call") {
+		t.Errorf("error = %v, want no recorded call", err)
+	}
+	if _, err := NewToolReplayer(writeRecording(t, nil)); err == nil {
+		t.Error("loaded an empty recording")
+	}
+}
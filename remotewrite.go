@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Delays between retries of a failed remote write request
+const (
+	remoteWriteMinBackoff = time.Second
+	remoteWriteMaxBackoff = 30 * time.Second
+)
+
+// remoteWriteOptions configures sending samples to a remote write endpoint
+type remoteWriteOptions struct {
+	URL      string
+	Interval time.Duration
+	Timeout  time.Duration
+	// QueueSize is the number of batches, one per interval, kept while
+	// the endpoint is unavailable; the oldest batch is dropped beyond it
+	QueueSize      int
+	ExternalLabels map[string]string
+	Username       string
+	PasswordFile   string
+}
+
+// labelFlag collects repeated name=value flags
+type labelFlag map[string]string
+
+func (f labelFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for name, value := range f {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f labelFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+		return fmt.Errorf("invalid label %q: must be name=value with a valid label name", s)
+	}
+	f[name] = value
+	return nil
+}
+
+// rwLabel is a label of a remote write time series
+type rwLabel struct {
+	Name, Value string
+}
+
+// rwSeries is a time series with a single sample
+type rwSeries struct {
+	Labels    []rwLabel
+	Value     float64
+	Timestamp int64
+}
+
+// rwMetadata describes a metric family; Type is the remote write MetricType
+type rwMetadata struct {
+	Type uint64
+	Name string
+	Help string
+}
+
+// rwMetricTypes maps metric types to the MetricType enum of the remote
+// write protocol
+var rwMetricTypes = map[dto.MetricType]uint64{
+	dto.MetricType_UNTYPED:   0,
+	dto.MetricType_COUNTER:   1,
+	dto.MetricType_GAUGE:     2,
+	dto.MetricType_HISTOGRAM: 3,
+	dto.MetricType_SUMMARY:   5,
+}
+
+// seriesFromFamilies flattens gathered metric families into time series the
+// way Prometheus would scrape them, with the external labels added unless a
+// metric has a label of the same name
+func seriesFromFamilies(families []*dto.MetricFamily, external map[string]string, ts int64) ([]rwSeries, []rwMetadata) {
+	var series []rwSeries
+	var metadata []rwMetadata
+	for _, family := range families {
+		name := family.GetName()
+		metadata = append(metadata, rwMetadata{Type: rwMetricTypes[family.GetType()], Name: name, Help: family.GetHelp()})
+		for _, m := range family.GetMetric() {
+			base := make([]rwLabel, 0, len(m.GetLabel())+len(external)+2)
+			for _, l := range m.GetLabel() {
+				base = append(base, rwLabel{l.GetName(), l.GetValue()})
+			}
+			for lname, value := range external {
+				if !hasLabel(base, lname) {
+					base = append(base, rwLabel{lname, value})
+				}
+			}
+			add := func(suffix string, value float64, extra ...rwLabel) {
+				labels := make([]rwLabel, 0, len(base)+len(extra)+1)
+				labels = append(labels, rwLabel{"__name__", name + suffix})
+				labels = append(labels, base...)
+				labels = append(labels, extra...)
+				sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+				series = append(series, rwSeries{Labels: labels, Value: value, Timestamp: ts})
+			}
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", m.GetGauge().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add("", q.GetValue(), rwLabel{"quantile", formatFloat(q.GetQuantile())})
+				}
+				add("_sum", s.GetSampleSum())
+				add("_count", float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add("_bucket", float64(b.GetCumulativeCount()), rwLabel{"le", formatFloat(b.GetUpperBound())})
+				}
+				add("_bucket", float64(h.GetSampleCount()), rwLabel{"le", "+Inf"})
+				add("_sum", h.GetSampleSum())
+				add("_count", float64(h.GetSampleCount()))
+			default:
+				add("", m.GetUntyped().GetValue())
+			}
+		}
+	}
+	return series, metadata
+}
+
+// hasLabel reports whether labels contain a label with the given name
+func hasLabel(labels []rwLabel, name string) bool {
+	for _, l := range labels {
+		if l.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// formatFloat formats a quantile or bucket bound like Prometheus does
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeWriteRequest encodes a prometheus.WriteRequest message:
+//
+//	WriteRequest   { repeated TimeSeries timeseries = 1; repeated MetricMetadata metadata = 3; }
+//	TimeSeries     { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label          { string name = 1; string value = 2; }
+//	Sample         { double value = 1; int64 timestamp = 2; }
+//	MetricMetadata { MetricType type = 1; string metric_family_name = 2; string help = 4; }
+func encodeWriteRequest(series []rwSeries, metadata []rwMetadata) []byte {
+	var b, ts, msg []byte
+	for _, s := range series {
+		ts = ts[:0]
+		for _, l := range s.Labels {
+			msg = msg[:0]
+			msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.Name)
+			msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.Value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, msg)
+		}
+		msg = msg[:0]
+		msg = protowire.AppendTag(msg, 1, protowire.Fixed64Type)
+		msg = protowire.AppendFixed64(msg, math.Float64bits(s.Value))
+		msg = protowire.AppendTag(msg, 2, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(s.Timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, msg)
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+	for _, md := range metadata {
+		msg = msg[:0]
+		msg = protowire.AppendTag(msg, 1, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, md.Type)
+		msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+		msg = protowire.AppendString(msg, md.Name)
+		msg = protowire.AppendTag(msg, 4, protowire.BytesType)
+		msg = protowire.AppendString(msg, md.Help)
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, msg)
+	}
+	return b
+}
+
+// rwBatch is a compressed write request waiting to be sent
+type rwBatch struct {
+	data    []byte
+	samples int
+}
+
+// errRemoteWriteRejected marks a request the endpoint will never accept
+var errRemoteWriteRejected = errors.New("rejected by remote write endpoint")
+
+// remoteWriter gathers a registry on an interval and sends the samples to
+// a remote write endpoint. Batches wait in a bounded in-memory queue while
+// the endpoint is unavailable.
+type remoteWriter struct {
+	opts     remoteWriteOptions
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	password string
+
+	mu     sync.Mutex
+	queue  []*rwBatch
+	notify chan struct{}
+
+	requests    *prometheus.CounterVec
+	samples     *prometheus.CounterVec
+	lastSuccess prometheus.Gauge
+}
+
+// newRemoteWriter creates a remote writer for reg and registers its own
+// metrics with reg, so that they are sent as well
+func newRemoteWriter(opts remoteWriteOptions, reg *prometheus.Registry) (*remoteWriter, error) {
+	if opts.QueueSize < 1 {
+		return nil, fmt.Errorf("remote write queue size must be at least 1")
+	}
+	w := &remoteWriter{
+		opts:     opts,
+		gatherer: reg,
+		client:   &http.Client{Timeout: opts.Timeout},
+		notify:   make(chan struct{}, 1),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "exporter", Name: "remote_write_requests_total",
+			Help: "Total number of remote write requests by result: success, retried or rejected",
+		}, []string{"result"}),
+		samples: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "exporter", Name: "remote_write_samples_total",
+			Help: "Total number of samples by outcome: sent, rejected by the endpoint or dropped from a full queue",
+		}, []string{"result"}),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "exporter", Name: "remote_write_last_success_timestamp_seconds",
+			Help: "Timestamp of the last successful remote write request",
+		}),
+	}
+	if opts.Username != "" && opts.PasswordFile != "" {
+		data, err := os.ReadFile(opts.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("read remote write password: %w", err)
+		}
+		w.password = strings.TrimSpace(string(data))
+	}
+	queueLength := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "exporter", Name: "remote_write_queue_length",
+		Help: "Number of batches waiting to be sent to the remote write endpoint",
+	}, func() float64 {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return float64(len(w.queue))
+	})
+	queueCapacity := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "exporter", Name: "remote_write_queue_capacity",
+		Help: "Maximum number of batches waiting to be sent to the remote write endpoint",
+	}, func() float64 { return float64(opts.QueueSize) })
+	reg.MustRegister(w.requests, w.samples, w.lastSuccess, queueLength, queueCapacity)
+	return w, nil
+}
+
+// enqueue gathers the registry and queues the samples, dropping the oldest
+// batch if the queue is full
+func (w *remoteWriter) enqueue() {
+	families, err := w.gatherer.Gather()
+	if err != nil {
+		slog.Warn("Gathering metrics for remote write returned errors", "err", err)
+	}
+	series, metadata := seriesFromFamilies(families, w.opts.ExternalLabels, time.Now().UnixMilli())
+	if len(series) == 0 {
+		return
+	}
+	batch := &rwBatch{data: snappyEncode(encodeWriteRequest(series, metadata)), samples: len(series)}
+
+	w.mu.Lock()
+	if len(w.queue) >= w.opts.QueueSize {
+		dropped := w.queue[0]
+		w.queue = w.queue[1:]
+		w.samples.WithLabelValues("dropped").Add(float64(dropped.samples))
+		slog.Warn("Remote write queue full, dropping oldest batch", "samples", dropped.samples)
+	}
+	w.queue = append(w.queue, batch)
+	w.mu.Unlock()
+
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// head returns the oldest queued batch, or nil if the queue is empty
+func (w *remoteWriter) head() *rwBatch {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.queue) == 0 {
+		return nil
+	}
+	return w.queue[0]
+}
+
+// remove removes a batch from the front of the queue, unless it was
+// already dropped because the queue overflowed while it was being sent
+func (w *remoteWriter) remove(batch *rwBatch) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.queue) > 0 && w.queue[0] == batch {
+		w.queue = w.queue[1:]
+	}
+}
+
+// send sends a batch. It returns errRemoteWriteRejected for client errors
+// other than 429, which retrying cannot fix, and the delay the endpoint
+// asked for, if any.
+func (w *remoteWriter) send(ctx context.Context, batch *rwBatch) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.opts.URL, bytes.NewReader(batch.data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "erdma-exporter")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if w.opts.Username != "" {
+		req.SetBasicAuth(w.opts.Username, w.password)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 == 2 {
+		return 0, nil
+	}
+
+	err = fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, fmt.Errorf("%w: %w", errRemoteWriteRejected, err)
+	}
+	retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+	return time.Duration(retryAfter) * time.Second, err
+}
+
+// sendLoop sends queued batches in order until ctx is done, retrying
+// recoverable failures with exponential backoff
+func (w *remoteWriter) sendLoop(ctx context.Context) {
+	backoff := remoteWriteMinBackoff
+	for {
+		batch := w.head()
+		if batch == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-w.notify:
+				continue
+			}
+		}
+
+		retryAfter, err := w.send(ctx, batch)
+		switch {
+		case err == nil:
+			w.remove(batch)
+			w.requests.WithLabelValues("success").Inc()
+			w.samples.WithLabelValues("sent").Add(float64(batch.samples))
+			w.lastSuccess.SetToCurrentTime()
+			backoff = remoteWriteMinBackoff
+			continue
+		case errors.Is(err, errRemoteWriteRejected):
+			w.remove(batch)
+			w.requests.WithLabelValues("rejected").Inc()
+			w.samples.WithLabelValues("rejected").Add(float64(batch.samples))
+			slog.Error("Remote write endpoint rejected samples", "url", w.opts.URL, "samples", batch.samples, "err", err)
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		w.requests.WithLabelValues("retried").Inc()
+		delay := max(backoff, retryAfter)
+		slog.Warn("Remote write failed, retrying", "url", w.opts.URL, "backoff", delay, "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		backoff = min(2*backoff, remoteWriteMaxBackoff)
+	}
+}
+
+// Run gathers every interval until ctx is done. On shutdown it gathers a
+// last time and keeps sending for up to timeout to empty the queue, which
+// must happen before running tools are stopped.
+func (w *remoteWriter) Run(ctx context.Context, timeout time.Duration) {
+	slog.Info("Sending metrics to remote write endpoint", "url", w.opts.URL, "interval", w.opts.Interval, "queue_size", w.opts.QueueSize)
+	sendCtx, cancelSend := context.WithCancel(context.Background())
+	defer cancelSend()
+	sent := make(chan struct{})
+	go func() {
+		w.sendLoop(sendCtx)
+		close(sent)
+	}()
+
+	ticker := time.NewTicker(w.opts.Interval)
+	defer ticker.Stop()
+	for {
+		w.enqueue()
+		select {
+		case <-ctx.Done():
+			w.flush(timeout)
+			cancelSend()
+			<-sent
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// flush gathers a last time and waits up to timeout for the queue to empty
+func (w *remoteWriter) flush(timeout time.Duration) {
+	w.enqueue()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if w.head() == nil {
+			slog.Info("Sent remaining samples to remote write endpoint", "url", w.opts.URL)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	w.mu.Lock()
+	remaining := len(w.queue)
+	w.mu.Unlock()
+	slog.Error("Remote write queue not empty at shutdown, samples are lost", "url", w.opts.URL, "batches", remaining)
+}
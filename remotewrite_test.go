@@ -0,0 +1,179 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoField is a decoded field of a protobuf message
+type protoField struct {
+	num   protowire.Number
+	value uint64
+	bytes []byte
+}
+
+// decodeProtoFields decodes the fields of a message, failing on wire types
+// a WriteRequest does not use
+func decodeProtoFields(t *testing.T, b []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+		f := protoField{num: num}
+		switch typ {
+		case protowire.VarintType:
+			f.value, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			f.value, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			t.Fatalf("field %d has unexpected wire type %d", num, typ)
+		}
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// decodeWriteRequest decodes a WriteRequest encoded by encodeWriteRequest
+func decodeWriteRequest(t *testing.T, b []byte) ([]rwSeries, []rwMetadata) {
+	t.Helper()
+	var series []rwSeries
+	var metadata []rwMetadata
+	for _, f := range decodeProtoFields(t, b) {
+		switch f.num {
+		case 1:
+			var s rwSeries
+			for _, tf := range decodeProtoFields(t, f.bytes) {
+				switch tf.num {
+				case 1:
+					var l rwLabel
+					for _, lf := range decodeProtoFields(t, tf.bytes) {
+						switch lf.num {
+						case 1:
+							l.Name = string(lf.bytes)
+						case 2:
+							l.Value = string(lf.bytes)
+						}
+					}
+					s.Labels = append(s.Labels, l)
+				case 2:
+					for _, sf := range decodeProtoFields(t, tf.bytes) {
+						switch sf.num {
+						case 1:
+							s.Value = math.Float64frombits(sf.value)
+						case 2:
+							s.Timestamp = int64(sf.value)
+						}
+					}
+				}
+			}
+			series = append(series, s)
+		case 3:
+			var md rwMetadata
+			for _, mf := range decodeProtoFields(t, f.bytes) {
+				switch mf.num {
+				case 1:
+					md.Type = mf.value
+				case 2:
+					md.Name = string(mf.bytes)
+				case 4:
+					md.Help = string(mf.bytes)
+				default:
+					t.Errorf("metadata has unexpected field %d", mf.num)
+				}
+			}
+			metadata = append(metadata, md)
+		default:
+			t.Errorf("write request has unexpected field %d", f.num)
+		}
+	}
+	return series, metadata
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "erdma_hw_tx_bytes_total", Help: "Bytes sent",
+	}, []string{"node", "device"})
+	counter.WithLabelValues("node-1", "erdma_0").Add(1234)
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "erdma_devices", Help: "Number of devices"})
+	gauge.Set(2)
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "erdma_collect_seconds", Help: "Collection duration", Buckets: []float64{0.5},
+	})
+	histogram.Observe(0.25)
+	histogram.Observe(1)
+	summary := prometheus.NewSummary(prometheus.SummaryOpts{
+		Name: "erdma_tool_seconds", Help: "Tool duration", Objectives: map[float64]float64{0.5: 0.05},
+	})
+	summary.Observe(3)
+	reg.MustRegister(counter, gauge, histogram, summary)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The device external label must not override the device of a metric
+	external := map[string]string{"zone": "cn-hangzhou-h", "device": "external", "cluster": "c1"}
+	const ts = 1700000000123
+	series, metadata := seriesFromFamilies(families, external, ts)
+	gotSeries, gotMetadata := decodeWriteRequest(t, encodeWriteRequest(series, metadata))
+
+	labels := func(pairs ...string) []rwLabel {
+		l := []rwLabel{}
+		for i := 0; i < len(pairs); i += 2 {
+			l = append(l, rwLabel{pairs[i], pairs[i+1]})
+		}
+		return l
+	}
+	wantSeries := []rwSeries{
+		{labels("__name__", "erdma_collect_seconds_bucket", "cluster", "c1", "device", "external", "le", "0.5", "zone", "cn-hangzhou-h"), 1, ts},
+		{labels("__name__", "erdma_collect_seconds_bucket", "cluster", "c1", "device", "external", "le", "+Inf", "zone", "cn-hangzhou-h"), 2, ts},
+		{labels("__name__", "erdma_collect_seconds_sum", "cluster", "c1", "device", "external", "zone", "cn-hangzhou-h"), 1.25, ts},
+		{labels("__name__", "erdma_collect_seconds_count", "cluster", "c1", "device", "external", "zone", "cn-hangzhou-h"), 2, ts},
+		{labels("__name__", "erdma_devices", "cluster", "c1", "device", "external", "zone", "cn-hangzhou-h"), 2, ts},
+		{labels("__name__", "erdma_hw_tx_bytes_total", "cluster", "c1", "device", "erdma_0", "node", "node-1", "zone", "cn-hangzhou-h"), 1234, ts},
+		{labels("__name__", "erdma_tool_seconds", "cluster", "c1", "device", "external", "quantile", "0.5", "zone", "cn-hangzhou-h"), 3, ts},
+		{labels("__name__", "erdma_tool_seconds_sum", "cluster", "c1", "device", "external", "zone", "cn-hangzhou-h"), 3, ts},
+		{labels("__name__", "erdma_tool_seconds_count", "cluster", "c1", "device", "external", "zone", "cn-hangzhou-h"), 1, ts},
+	}
+	if !reflect.DeepEqual(gotSeries, wantSeries) {
+		t.Errorf("series:\n got %v\nwant %v", gotSeries, wantSeries)
+	}
+	for _, s := range gotSeries {
+		for i := 1; i < len(s.Labels); i++ {
+			if s.Labels[i-1].Name >= s.Labels[i].Name {
+				t.Errorf("labels of %s are not sorted: %v", s.Labels[0].Value, s.Labels)
+			}
+		}
+	}
+
+	wantMetadata := []rwMetadata{
+		{Type: 3, Name: "erdma_collect_seconds", Help: "Collection duration"},
+		{Type: 2, Name: "erdma_devices", Help: "Number of devices"},
+		{Type: 1, Name: "erdma_hw_tx_bytes_total", Help: "Bytes sent"},
+		{Type: 5, Name: "erdma_tool_seconds", Help: "Tool duration"},
+	}
+	if !reflect.DeepEqual(gotMetadata, wantMetadata) {
+		t.Errorf("metadata:\n got %v\nwant %v", gotMetadata, wantMetadata)
+	}
+}
+
+func TestEncodeWriteRequestEmpty(t *testing.T) {
+	if b := encodeWriteRequest(nil, nil); len(b) != 0 {
+		t.Errorf("empty request encoded to %d bytes", len(b))
+	}
+}
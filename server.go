@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverLimits are the timeouts and size limits applied to every HTTP server
+type serverLimits struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+}
+
+// newHTTPServer creates a server for handler on addr with the given limits
+func newHTTPServer(addr string, handler http.Handler, limits serverLimits) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: limits.ReadHeaderTimeout,
+		ReadTimeout:       limits.ReadTimeout,
+		WriteTimeout:      limits.WriteTimeout,
+		IdleTimeout:       limits.IdleTimeout,
+		MaxHeaderBytes:    limits.MaxHeaderBytes,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelInfo),
+	}
+}
+
+// unixSocketPrefix marks a listen address as the path of a Unix domain socket
+const unixSocketPrefix = "unix:"
+
+// listen opens a TCP listener, or a Unix domain socket for addresses of
+// the form unix:/path. A stale socket file left by a previous run is removed.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixSocketPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Allow access to the owning user and group only
+	if err := os.Chmod(path, 0660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// serve runs server on ln until it is shut down, with TLS and basic auth if
+// a web config is given. It returns nil once the server has been shut down.
+func serve(server *http.Server, ln net.Listener, web *webConfigLoader) error {
+	if web != nil {
+		server.Handler = web.handler(server.Handler)
+		if _, tlsConfig := web.current(); tlsConfig != nil {
+			ln = tls.NewListener(ln, &tls.Config{GetConfigForClient: web.getConfigForClient})
+		}
+	}
+	if err := server.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// shutdownServers stops accepting connections and waits up to timeout for
+// in-flight requests to finish. Tools that are still running afterwards
+// are killed, and any remaining connections are closed.
+func shutdownServers(servers []*http.Server, timeout time.Duration) {
+	slog.Info("Shutting down, draining in-flight requests", "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				slog.Warn("In-flight requests did not finish in time", "address", server.Addr, "err", err)
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	stopTools()
+	for _, server := range servers {
+		server.Close()
+	}
+	slog.Info("Shutdown complete")
+}
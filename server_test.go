@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebServerLimits(t *testing.T) {
+	config := defaultConfig()
+	config.Timeouts.Tool = duration(5 * time.Second)
+	useConfig(t, config)
+
+	// eadm ver, ibv_devices and a stat per device, plus the margin
+	if got, want := scrapeTimeout(3), 35*time.Second; got != want {
+		t.Errorf("scrapeTimeout(3) = %v, want %v", got, want)
+	}
+	if got := webServerLimits(3); got.WriteTimeout != 35*time.Second || got.ReadHeaderTimeout != *readHeaderTimeout || got.MaxHeaderBytes != *maxHeaderBytes {
+		t.Errorf("limits %+v", got)
+	}
+
+	saved := *writeTimeout
+	t.Cleanup(func() { *writeTimeout = saved })
+	*writeTimeout = time.Minute
+	if got := webServerLimits(3).WriteTimeout; got != time.Minute {
+		t.Errorf("write timeout %v, want the flag", got)
+	}
+}
+
+// startTestServer serves handler with limits on a local port
+func startTestServer(t *testing.T, handler http.Handler, limits serverLimits) (*http.Server, string) {
+	t.Helper()
+	ln, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newHTTPServer(ln.Addr().String(), handler, limits)
+	go serve(server, ln, nil)
+	t.Cleanup(func() { server.Close() })
+	return server, ln.Addr().String()
+}
+
+func TestServerEnforcesLimits(t *testing.T) {
+	captureLogs(t)
+	_, addr := startTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}), serverLimits{ReadHeaderTimeout: 100 * time.Millisecond, MaxHeaderBytes: 1 << 10})
+
+	// Oversized headers are rejected
+	req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/", nil)
+	req.Header.Set("X-Padding", strings.Repeat("x", 8<<10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("status %d for large headers, want 431", resp.StatusCode)
+	}
+
+	// A client that never finishes its headers is disconnected
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("connection not closed by the server: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("slow client disconnected after %v", elapsed)
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	captureLogs(t)
+	path := filepath.Join(t.TempDir(), "exporter.sock")
+
+	// A socket left by a previous run is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listen(unixSocketPrefix + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o660 {
+		t.Errorf("socket mode %v, want 0660", perm)
+	}
+	server := newHTTPServer(unixSocketPrefix+path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}), serverLimits{})
+	go serve(server, ln, nil)
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", path)
+	}}}
+	resp, err := client.Get("http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("body %q", body)
+	}
+
+	// Other files are not removed
+	file := filepath.Join(t.TempDir(), "not-a-socket")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen(unixSocketPrefix + file); err == nil {
+		t.Error("listened on a regular file")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("regular file removed: %v", err)
+	}
+}
+
+// TestShutdownServersDrains checks that a request in flight when shutdown
+// starts gets its response, and that new connections are refused
+func TestShutdownServersDrains(t *testing.T) {
+	captureLogs(t)
+	savedCtx, savedCancel := toolContext, cancelTools
+	t.Cleanup(func() { toolContext, cancelTools = savedCtx, savedCancel })
+	toolContext, cancelTools = context.WithCancel(context.Background())
+
+	started := make(chan struct{})
+	server, addr := startTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "done")
+	}), serverLimits{})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	<-started
+
+	shutdownServers([]*http.Server{server}, 5*time.Second)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("in-flight request lost: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "done" {
+		t.Errorf("body %q", body)
+	}
+	if toolContext.Err() == nil {
+		t.Error("tools not stopped")
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Error("new connection accepted after shutdown")
+	}
+}
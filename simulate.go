@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// duration is a time.Duration that unmarshals from strings such as "30s"
+type duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Trajectory types supported in scenario files
+const (
+	trajectorySteady         = "steady"
+	trajectoryBurst          = "burst"
+	trajectoryConnectTimeout = "connect_timeout"
+	trajectoryReset          = "reset"
+	trajectoryDisappear      = "disappear"
+	trajectoryCmdqStall      = "cmdq_stall"
+)
+
+// Scenario describes the virtual devices served in --simulate mode
+type Scenario struct {
+	// NodeName is the node label of the simulated node; with several nodes an index is appended
+	NodeName      string           `json:"node_name"`
+	DriverVersion string           `json:"driver_version"`
+	Devices       []ScenarioDevice `json:"devices"`
+}
+
+// ScenarioDevice is a virtual ERDMA device and the trajectories driving its counters
+type ScenarioDevice struct {
+	Name         string       `json:"name"`
+	GUID         string       `json:"guid"`
+	Trajectories []Trajectory `json:"trajectories"`
+}
+
+// Trajectory drives a set of counters while its window is active.
+// Without a period the window opens at Start and lasts Duration (forever if zero);
+// with a period the window repeats every Period.
+type Trajectory struct {
+	Type     string   `json:"type"`
+	Start    duration `json:"start"`
+	Period   duration `json:"period"`
+	Duration duration `json:"duration"`
+
+	// Traffic in bytes per second and the average packet size
+	TxBps      float64 `json:"tx_bps"`
+	RxBps      float64 `json:"rx_bps"`
+	PacketSize float64 `json:"packet_size"`
+
+	// Hardware rate limits; traffic above them is counted as dropped
+	LimitBps float64 `json:"limit_bps"`
+	LimitPps float64 `json:"limit_pps"`
+
+	// Connection attempts per second and the share of them that time out
+	ConnectRate  float64 `json:"connect_rate"`
+	TimeoutRatio float64 `json:"timeout_ratio"`
+
+	// Command queue submissions per second
+	CmdqRate float64 `json:"cmdq_rate"`
+}
+
+// LoadScenario reads and validates a scenario file
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scenario: %w", err)
+	}
+	scenario := &Scenario{}
+	if err := json.Unmarshal(data, scenario); err != nil {
+		return nil, fmt.Errorf("failed to parse scenario: %w", err)
+	}
+	if scenario.DriverVersion == "" {
+		scenario.DriverVersion = "0.0.0-simulated"
+	}
+	if len(scenario.Devices) == 0 {
+		return nil, fmt.Errorf("scenario defines no devices")
+	}
+	for i, device := range scenario.Devices {
+		if device.Name == "" {
+			return nil, fmt.Errorf("device %d has no name", i)
+		}
+		if device.GUID == "" {
+			scenario.Devices[i].GUID = fmt.Sprintf("02163efffe%06x", i)
+		}
+		for j, t := range device.Trajectories {
+			switch t.Type {
+			case trajectorySteady, trajectoryBurst, trajectoryConnectTimeout,
+				trajectoryReset, trajectoryDisappear, trajectoryCmdqStall:
+			default:
+				return nil, fmt.Errorf("device %s trajectory %d: unknown type %q", device.Name, j, t.Type)
+			}
+			if t.Type == trajectoryReset && t.Period == 0 {
+				return nil, fmt.Errorf("device %s trajectory %d: reset requires a period", device.Name, j)
+			}
+			if t.PacketSize <= 0 {
+				scenario.Devices[i].Trajectories[j].PacketSize = 4096
+			}
+		}
+	}
+	return scenario, nil
+}
+
+// window returns the index of the window containing elapsed, or -1 if inactive
+func (t *Trajectory) window(elapsed time.Duration) int64 {
+	start := time.Duration(t.Start)
+	length := time.Duration(t.Duration)
+	if elapsed < start {
+		return -1
+	}
+	offset := elapsed - start
+	if t.Period == 0 {
+		if length == 0 || offset < length {
+			return 0
+		}
+		return -1
+	}
+	period := time.Duration(t.Period)
+	if length != 0 && offset%period >= length {
+		return -1
+	}
+	return int64(offset / period)
+}
+
+// simDevice holds the counter state of a virtual device
+type simDevice struct {
+	spec     ScenarioDevice
+	counters map[string]float64
+	resets   []int64
+	present  bool
+	// stalled is set while a cmdq_stall window is open; commands are still
+	// posted but none complete
+	stalled bool
+}
+
+// Simulator is a ToolBackend producing eadm and ibv_devices output for a scenario
+type Simulator struct {
+	scenario *Scenario
+
+	mu      sync.Mutex
+	start   time.Time
+	last    time.Time
+	devices []*simDevice
+}
+
+// NewSimulator creates a simulator starting at the current time
+func NewSimulator(scenario *Scenario) *Simulator {
+	now := time.Now()
+	s := &Simulator{scenario: scenario, start: now, last: now}
+	for _, spec := range scenario.Devices {
+		d := &simDevice{
+			spec:     spec,
+			counters: make(map[string]float64),
+			resets:   make([]int64, len(spec.Trajectories)),
+			present:  true,
+		}
+		for i := range d.resets {
+			d.resets[i] = -1
+		}
+		s.devices = append(s.devices, d)
+	}
+	return s
+}
+
+// advance integrates all trajectories up to now
+func (s *Simulator) advance(now time.Time) {
+	dt := now.Sub(s.last).Seconds()
+	elapsed := now.Sub(s.start)
+	s.last = now
+	if dt < 0 {
+		dt = 0
+	}
+
+	for _, d := range s.devices {
+		d.present = true
+		d.stalled = false
+		for i := range d.spec.Trajectories {
+			t := &d.spec.Trajectories[i]
+			if t.Type == trajectoryCmdqStall && t.window(elapsed) >= 0 {
+				d.stalled = true
+			}
+		}
+		for i := range d.spec.Trajectories {
+			t := &d.spec.Trajectories[i]
+			window := t.window(elapsed)
+			switch t.Type {
+			case trajectoryReset:
+				// Counters are zeroed when a new window opens, like a driver reload
+				if window >= 0 && window != d.resets[i] {
+					d.counters = make(map[string]float64)
+					d.resets[i] = window
+				}
+				continue
+			case trajectoryDisappear:
+				if window >= 0 {
+					d.present = false
+				}
+				continue
+			}
+			d.apply(t, window >= 0, dt)
+		}
+	}
+}
+
+// apply adds the counter increments of a trajectory over dt seconds
+func (d *simDevice) apply(t *Trajectory, active bool, dt float64) {
+	c := d.counters
+	switch t.Type {
+	case trajectoryCmdqStall:
+		if active {
+			c["cmdq_submitted_cnt"] += t.CmdqRate * dt
+			return
+		}
+		// Drain the backlog once the stall is over
+		c["cmdq_comp_cnt"] = math.Min(c["cmdq_submitted_cnt"], c["cmdq_comp_cnt"]+10*t.CmdqRate*dt)
+		return
+	}
+	if !active {
+		return
+	}
+
+	d.traffic("tx", t.TxBps, t, dt)
+	d.traffic("rx", t.RxBps, t, dt)
+
+	// Connections
+	connects := t.ConnectRate * dt
+	timeouts := 0.0
+	if t.Type == trajectoryConnectTimeout {
+		timeouts = connects * t.TimeoutRatio
+	}
+	c["connect_total_cnt"] += connects
+	c["connect_success_cnt"] += connects - timeouts
+	c["connect_failed_cnt"] += timeouts
+	c["connect_timeout_cnt"] += timeouts
+	c["accept_total_cnt"] += connects
+	c["accept_success_cnt"] += connects
+
+	// Each established connection creates and later destroys a QP and CQ
+	established := connects - timeouts
+	for _, obj := range []string{"qp", "cq"} {
+		c["verbs_create_"+obj+"_cnt"] += established
+		c["verbs_destroy_"+obj+"_cnt"] = math.Min(c["verbs_create_"+obj+"_cnt"], c["verbs_destroy_"+obj+"_cnt"]+established)
+	}
+	c["verbs_reg_usr_mr_cnt"] += established
+	c["verbs_dereg_mr_cnt"] = math.Min(c["verbs_reg_usr_mr_cnt"], c["verbs_dereg_mr_cnt"]+established)
+
+	// Command queue; a stalled queue completes nothing
+	c["cmdq_submitted_cnt"] += t.CmdqRate * dt
+	if d.stalled {
+		return
+	}
+	c["cmdq_comp_cnt"] += t.CmdqRate * dt
+	c["cmdq_eq_notify_cnt"] += t.CmdqRate * dt
+	c["cmdq_eq_event_cnt"] += t.CmdqRate * dt
+	c["cmdq_cq_armed_cnt"] += t.CmdqRate * dt
+}
+
+// traffic adds bytes and packets in one direction, counting traffic above the limits as drops
+func (d *simDevice) traffic(dir string, bps float64, t *Trajectory, dt float64) {
+	if bps <= 0 {
+		return
+	}
+	c := d.counters
+	pps := bps / t.PacketSize
+
+	bpsDrop, ppsDrop := 0.0, 0.0
+	if t.LimitBps > 0 && bps > t.LimitBps {
+		bpsDrop = (bps - t.LimitBps) / t.PacketSize
+		pps -= bpsDrop
+	}
+	if t.LimitPps > 0 && pps > t.LimitPps {
+		ppsDrop = pps - t.LimitPps
+		pps = t.LimitPps
+	}
+
+	c["hw_"+dir+"_packets_cnt"] += pps * dt
+	c["hw_"+dir+"_bytes_cnt"] += pps * t.PacketSize * dt
+	if dir == "tx" {
+		c["hw_tx_reqs_cnt"] += pps * dt
+		c["hw_bps_limit_drop_cnt"] += bpsDrop * dt
+		c["hw_pps_limit_drop_cnt"] += ppsDrop * dt
+		return
+	}
+	c["hw_rx_bps_limit_drop_cnt"] += bpsDrop * dt
+	c["hw_rx_pps_limit_drop_cnt"] += ppsDrop * dt
+}
+
+// simStatKeys lists every key printed by eadm stat, in output order
+var simStatKeys = []string{
+	"listen_create_cnt", "listen_ipv6_cnt", "listen_success_cnt", "listen_failed_cnt", "listen_destroy_cnt",
+	"accept_total_cnt", "accept_success_cnt", "accept_failed_cnt",
+	"reject_cnt", "reject_failed_cnt",
+	"connect_total_cnt", "connect_success_cnt", "connect_failed_cnt", "connect_timeout_cnt", "connect_reset_cnt",
+	"cmdq_submitted_cnt", "cmdq_comp_cnt", "cmdq_eq_notify_cnt", "cmdq_eq_event_cnt", "cmdq_cq_armed_cnt",
+	"erdma_aeq_event_cnt", "erdma_aeq_notify_cnt",
+	"verbs_alloc_mr_cnt", "verbs_alloc_mr_failed_cnt", "verbs_alloc_pd_cnt", "verbs_alloc_pd_failed_cnt",
+	"verbs_alloc_uctx_cnt", "verbs_alloc_uctx_failed_cnt", "verbs_create_cq_cnt", "verbs_create_cq_failed_cnt",
+	"verbs_create_qp_cnt", "verbs_create_qp_failed_cnt", "verbs_dealloc_pd_cnt", "verbs_dealloc_uctx_cnt",
+	"verbs_dereg_mr_cnt", "verbs_dereg_mr_failed_cnt", "verbs_destroy_cq_cnt", "verbs_destroy_cq_failed_cnt",
+	"verbs_destroy_qp_cnt", "verbs_destroy_qp_failed_cnt", "verbs_get_dma_mr_cnt", "verbs_get_dma_mr_failed_cnt",
+	"verbs_reg_usr_mr_cnt", "verbs_reg_usr_mr_failed_cnt",
+	"hw_tx_reqs_cnt", "hw_tx_packets_cnt", "hw_tx_bytes_cnt", "hw_disable_drop_cnt", "hw_bps_limit_drop_cnt",
+	"hw_pps_limit_drop_cnt", "hw_rx_packets_cnt", "hw_rx_bytes_cnt", "hw_rx_disable_drop_cnt",
+	"hw_rx_bps_limit_drop_cnt", "hw_rx_pps_limit_drop_cnt",
+}
+
+// Run implements ToolBackend by rendering the simulated state in the tools' output format
+func (s *Simulator) Run(name string, args ...string) ([]byte, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance(time.Now())
+
+	var out strings.Builder
+	switch {
+	case name == "eadm" && len(args) == 1 && args[0] == "ver":
+		fmt.Fprintf(&out, "Query kernel driver version: %s\n", s.scenario.DriverVersion)
+	case name == "ibv_devices" && len(args) == 0:
+		out.WriteString("    device          \t   node GUID\n")
+		out.WriteString("    ------          \t----------------\n")
+		for _, d := range s.devices {
+			if d.present {
+				fmt.Fprintf(&out, "    %-16s\t%s\n", d.spec.Name, d.spec.GUID)
+			}
+		}
+	case name == "eadm" && len(args) == 3 && args[0] == "stat" && args[1] == "-d":
+		d := s.device(args[2])
+		if d == nil {
+			msg := fmt.Sprintf("device %s not found\n", args[2])
+			return nil, []byte(msg), fmt.Errorf("simulated eadm stat failed: exit status 1")
+		}
+		for _, key := range simStatKeys {
+			fmt.Fprintf(&out, "%s : %d\n", key, uint64(d.counters[key]))
+		}
+	default:
+		return nil, nil, fmt.Errorf("simulator does not support %s %s", name, strings.Join(args, " "))
+	}
+	return []byte(out.String()), nil, nil
+}
+
+// device returns the present device with the given name
+func (s *Simulator) device(name string) *simDevice {
+	for _, d := range s.devices {
+		if d.spec.Name == name && d.present {
+			return d
+		}
+	}
+	return nil
+}
+
+// serveSimulatedNodes serves additional virtual nodes, each with its own
+// simulator and registry, on consecutive ports starting at basePort.
+// It returns the servers so that they can be shut down with the main one.
+func serveSimulatedNodes(scenario *Scenario, count int, basePort int, web *webConfigLoader) []*http.Server {
+	var servers []*http.Server
+	for i := 1; i < count; i++ {
+		collector, err := NewErdmaCollector()
+		if err != nil {
+			fatal("Failed to create ERDMA collector", "err", err)
+		}
+		collector.run = NewSimulator(scenario).Run
+		collector.nodeName = fmt.Sprintf("%s-%d", scenario.NodeName, i)
+
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(collector)
+
+		mux := http.NewServeMux()
+		mux.Handle(*metricsPath, promhttp.HandlerFor(reg, promhttp.HandlerOpts{MaxRequestsInFlight: *maxScrapes}))
+		server := newHTTPServer(fmt.Sprintf(":%d", basePort+i-1), mux, webServerLimits(len(scenario.Devices)))
+		servers = append(servers, server)
+
+		slog.Info("Serving simulated node", "node", collector.nodeName, "address", server.Addr)
+		ln, err := listen(server.Addr)
+		if err != nil {
+			fatal("Simulated node listener failed", "address", server.Addr, "err", err)
+		}
+		go func() {
+			if err := serve(server, ln, web); err != nil {
+				fatal("Simulated node listener failed", "address", server.Addr, "err", err)
+			}
+		}()
+	}
+	return servers
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadScenario(t *testing.T) {
+	scenario, err := LoadScenario(filepath.Join("grafana", "scenario.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scenario.Devices) != 2 || scenario.DriverVersion != "0.2.38" {
+		t.Errorf("scenario %+v", scenario)
+	}
+	if got := scenario.Devices[0].Trajectories[0].PacketSize; got != 4096 {
+		t.Errorf("default packet size %v, want 4096", got)
+	}
+
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name     string
+		scenario string
+		err      string
+	}{
+		{"no devices", `{"devices": []}`, "no devices"},
+		{"unnamed device", `{"devices": [{"guid": "x"}]}`, "device 0 has no name"},
+		{"unknown type", `{"devices": [{"name": "erdma_0", "trajectories": [{"type": "flap"}]}]}`, `unknown type "flap"`},
+		{"reset without period", `{"devices": [{"name": "erdma_0", "trajectories": [{"type": "reset"}]}]}`, "reset requires a period"},
+		{"numeric duration", `{"devices": [{"name": "erdma_0", "trajectories": [{"type": "steady", "start": 30}]}]}`, "duration must be a string"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.ReplaceAll(tc.name, " ", "_")+".json")
+			if err := os.WriteFile(path, []byte(tc.scenario), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadScenario(path); err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("error = %v, want %q", err, tc.err)
+			}
+		})
+	}
+
+	// Defaults fill in the driver version and GUIDs
+	path := filepath.Join(dir, "defaults.json")
+	if err := os.WriteFile(path, []byte(`{"devices": [{"name": "erdma_0"}, {"name": "erdma_1"}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	scenario, err = LoadScenario(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scenario.DriverVersion != "0.0.0-simulated" || scenario.Devices[1].GUID != "02163efffe000001" {
+		t.Errorf("defaults %+v", scenario)
+	}
+}
+
+func TestTrajectoryWindow(t *testing.T) {
+	min := func(m float64) time.Duration { return time.Duration(m * float64(time.Minute)) }
+	for _, tc := range []struct {
+		name    string
+		t       Trajectory
+		elapsed time.Duration
+		want    int64
+	}{
+		{"before start", Trajectory{Start: duration(min(2))}, min(1), -1},
+		{"open-ended", Trajectory{Start: duration(min(2))}, min(100), 0},
+		{"single window", Trajectory{Start: duration(min(2)), Duration: duration(min(1))}, min(2.5), 0},
+		{"after single window", Trajectory{Start: duration(min(2)), Duration: duration(min(1))}, min(3), -1},
+		{"periodic", Trajectory{Period: duration(min(5)), Duration: duration(min(1))}, min(10.5), 2},
+		{"between periods", Trajectory{Period: duration(min(5)), Duration: duration(min(1))}, min(11), -1},
+		{"periodic without duration", Trajectory{Start: duration(min(1)), Period: duration(min(5))}, min(14), 2},
+	} {
+		if got := tc.t.window(tc.elapsed); got != tc.want {
+			t.Errorf("%s: window(%v) = %d, want %d", tc.name, tc.elapsed, got, tc.want)
+		}
+	}
+}
+
+// newTestSimulator returns a simulator for devices that started at start
+func newTestSimulator(start time.Time, devices ...ScenarioDevice) *Simulator {
+	s := NewSimulator(&Scenario{DriverVersion: "0.2.41", Devices: devices})
+	s.start, s.last = start, start
+	return s
+}
+
+// assertCounters checks the counters of d against want, plus the values in
+// base, allowing for float rounding
+func assertCounters(t *testing.T, step string, d *simDevice, base, want map[string]float64) {
+	t.Helper()
+	for key, value := range want {
+		if got := d.counters[key] - base[key]; math.Abs(got-value) > 1e-6 {
+			t.Errorf("%s: %s increased by %v, want %v", step, key, got, value)
+		}
+	}
+}
+
+// snapshot copies the counters of d
+func snapshot(d *simDevice) map[string]float64 {
+	counters := make(map[string]float64, len(d.counters))
+	for key, value := range d.counters {
+		counters[key] = value
+	}
+	return counters
+}
+
+func TestSimulatorTraffic(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	s := newTestSimulator(start, ScenarioDevice{Name: "erdma_0", Trajectories: []Trajectory{
+		{Type: trajectorySteady, TxBps: 4000, RxBps: 2000, PacketSize: 100, ConnectRate: 2, CmdqRate: 3},
+		// Above both limits for a minute starting at 1m
+		{Type: trajectoryBurst, Start: duration(time.Minute), Duration: duration(time.Minute), TxBps: 10000, PacketSize: 100, LimitBps: 6000, LimitPps: 50},
+		{Type: trajectoryConnectTimeout, Start: duration(2 * time.Minute), ConnectRate: 10, TimeoutRatio: 0.5},
+	}})
+	d := s.devices[0]
+
+	// Increments are integrated with the windows active at the end of each
+	// step, so the steps below end inside the windows they test
+	s.advance(start.Add(10 * time.Second))
+	assertCounters(t, "steady", d, nil, map[string]float64{
+		"hw_tx_bytes_cnt": 40000, "hw_tx_packets_cnt": 400, "hw_tx_reqs_cnt": 400,
+		"hw_rx_bytes_cnt": 20000, "hw_rx_packets_cnt": 200,
+		"connect_total_cnt": 20, "connect_success_cnt": 20, "connect_timeout_cnt": 0,
+		"verbs_create_qp_cnt": 20, "verbs_destroy_qp_cnt": 20,
+		"cmdq_submitted_cnt": 30, "cmdq_comp_cnt": 30,
+	})
+
+	// During the burst, 40 pps exceed the byte limit and another 10 the
+	// packet limit of 50
+	s.advance(start.Add(59 * time.Second))
+	s.advance(start.Add(time.Minute))
+	base := snapshot(d)
+	s.advance(start.Add(time.Minute + 10*time.Second))
+	assertCounters(t, "burst", d, base, map[string]float64{
+		"hw_tx_packets_cnt":     400 + 500,
+		"hw_bps_limit_drop_cnt": 400,
+		"hw_pps_limit_drop_cnt": 100,
+	})
+
+	// Timeouts count as failed connections and create no QPs
+	s.advance(start.Add(2 * time.Minute))
+	base = snapshot(d)
+	s.advance(start.Add(2*time.Minute + 10*time.Second))
+	assertCounters(t, "connect timeout", d, base, map[string]float64{
+		"connect_total_cnt":   20 + 100,
+		"connect_timeout_cnt": 50,
+		"connect_failed_cnt":  50,
+		"verbs_create_qp_cnt": 20 + 50,
+	})
+}
+
+func TestSimulatorCmdqStall(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	s := newTestSimulator(start, ScenarioDevice{Name: "erdma_0", Trajectories: []Trajectory{
+		{Type: trajectorySteady, CmdqRate: 10},
+		{Type: trajectoryCmdqStall, Start: duration(time.Minute), Duration: duration(30 * time.Second), CmdqRate: 5},
+	}})
+	d := s.devices[0]
+
+	s.advance(start.Add(59 * time.Second))
+	assertCounters(t, "before the stall", d, nil, map[string]float64{"cmdq_submitted_cnt": 590, "cmdq_comp_cnt": 590})
+
+	// Commands keep being posted by both trajectories, none complete
+	s.advance(start.Add(time.Minute + 29*time.Second))
+	assertCounters(t, "during the stall", d, nil, map[string]float64{"cmdq_submitted_cnt": 590 + 300 + 150, "cmdq_comp_cnt": 590})
+
+	// Afterwards the backlog drains at ten times the stall rate
+	s.advance(start.Add(time.Minute + 30*time.Second))
+	if d.counters["cmdq_comp_cnt"] >= d.counters["cmdq_submitted_cnt"] {
+		t.Errorf("backlog drained at once: %v of %v", d.counters["cmdq_comp_cnt"], d.counters["cmdq_submitted_cnt"])
+	}
+	s.advance(start.Add(5 * time.Minute))
+	if d.counters["cmdq_comp_cnt"] != d.counters["cmdq_submitted_cnt"] {
+		t.Errorf("backlog not drained: %v of %v", d.counters["cmdq_comp_cnt"], d.counters["cmdq_submitted_cnt"])
+	}
+}
+
+func TestSimulatorResetAndDisappear(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	s := newTestSimulator(start, ScenarioDevice{Name: "erdma_0", Trajectories: []Trajectory{
+		{Type: trajectorySteady, TxBps: 1000, PacketSize: 100},
+		{Type: trajectoryReset, Start: duration(time.Minute), Period: duration(10 * time.Minute)},
+		{Type: trajectoryDisappear, Start: duration(3 * time.Minute), Duration: duration(time.Minute)},
+	}})
+	d := s.devices[0]
+
+	s.advance(start.Add(59 * time.Second))
+	if d.counters["hw_tx_bytes_cnt"] == 0 {
+		t.Fatal("no traffic before the reset")
+	}
+	s.advance(start.Add(time.Minute + 10*time.Second))
+	if got := d.counters["hw_tx_bytes_cnt"]; got != 0 {
+		t.Errorf("counter %v after the reset, want 0", got)
+	}
+	// Counters only reset once per window
+	s.advance(start.Add(time.Minute + 20*time.Second))
+	assertCounters(t, "after the reset", d, nil, map[string]float64{"hw_tx_bytes_cnt": 10000})
+
+	s.advance(start.Add(3*time.Minute + 10*time.Second))
+	if d.present || s.device("erdma_0") != nil {
+		t.Error("device present during disappear window")
+	}
+	s.advance(start.Add(4*time.Minute + 10*time.Second))
+	if !d.present {
+		t.Error("device still gone after disappear window")
+	}
+}
+
+// TestSimulatorRun checks the output of the simulated tools with the
+// parsers of the real ones
+func TestSimulatorRun(t *testing.T) {
+	s := newTestSimulator(time.Now().Add(-90*time.Second),
+		ScenarioDevice{Name: "erdma_0", GUID: "02163efffe5030b3", Trajectories: []Trajectory{{Type: trajectorySteady, TxBps: 1000, PacketSize: 100}}},
+		ScenarioDevice{Name: "erdma_1", GUID: "02163efffe5030b4", Trajectories: []Trajectory{{Type: trajectoryDisappear, Start: duration(time.Minute)}}},
+	)
+
+	out, _, err := s.Run("eadm", "ver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, _, err := parseVersionOutput(string(out))
+	if err != nil || version != "0.2.41" {
+		t.Errorf("version %q, %v", version, err)
+	}
+
+	out, _, err = s.Run("ibv_devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices, _, err := parseDevicesOutput(string(out), version)
+	if err != nil || len(devices) != 1 || devices[0].Name != "erdma_0" || devices[0].GUID != "02163efffe5030b3" {
+		t.Errorf("devices %+v, %v; want erdma_0 only", devices, err)
+	}
+
+	out, _, err = s.Run("eadm", "stat", "-d", "erdma_0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, _, err := parseStatsOutput(string(out), version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range simStatKeys {
+		if field, ok := statFields[key]; !ok || !field(stats).Present {
+			t.Errorf("%s not parsed into a field", key)
+		}
+	}
+	if got := stats.HwTx.Bytes.Value; got < 90000 {
+		t.Errorf("hw_tx_bytes_cnt = %d after 90s at 1000 B/s", got)
+	}
+
+	if _, stderr, err := s.Run("eadm", "stat", "-d", "erdma_1"); err == nil || !strings.Contains(string(stderr), "not found") {
+		t.Errorf("stat of a missing device: %q, %v", stderr, err)
+	}
+	if _, _, err := s.Run("eadm", "reset"); err == nil {
+		t.Error("unsupported command succeeded")
+	}
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sink types
+const (
+	sinkInfluxDB   = "influxdb"
+	sinkGraphite   = "graphite"
+	sinkStatsD     = "statsd"
+	sinkOpenFalcon = "open-falcon"
+	sinkZabbix     = "zabbix"
+	sinkCMS        = "cms"
+)
+
+// Defaults of a sink
+const (
+	sinkDefaultInterval = 15 * time.Second
+	sinkDefaultTimeout  = 10 * time.Second
+)
+
+// statsdMaxPacket keeps StatsD datagrams below a typical path MTU
+const statsdMaxPacket = 1432
+
+// sinkDefaults are the name template and tag mapping of each sink type
+var sinkDefaults = map[string]struct {
+	name string
+	tags map[string]string
+}{
+	sinkInfluxDB:   {"erdma_{{.Stat}}", map[string]string{"device": "device", "node": "host"}},
+	sinkGraphite:   {"erdma.{{.Node}}.{{.Device}}.{{.Stat}}", map[string]string{"device": "", "node": ""}},
+	sinkStatsD:     {"erdma.{{.Stat}}", map[string]string{"device": "device", "node": "host"}},
+	sinkOpenFalcon: {"erdma.{{.Stat}}", map[string]string{"device": "device", "node": ""}},
+	sinkZabbix:     {zabbixDefaultName, map[string]string{"device": "", "node": ""}},
+	sinkCMS:        {"{{.Stat}}", map[string]string{"device": "device", "node": "node"}},
+}
+
+// SinkConfig configures a sink that pushes the device statistics to a
+// monitoring system other than Prometheus
+type SinkConfig struct {
+	// ID names the sink in logs and metrics; defaults to the type
+	ID string `json:"id"`
+	// Type is influxdb, graphite, statsd, open-falcon, zabbix or cms
+	Type string `json:"type"`
+	// Address is the write URL for influxdb and open-falcon, and
+	// host:port for graphite (TCP), statsd (UDP) and the zabbix trapper.
+	// For cms it defaults to the CloudMonitor endpoint of the region.
+	Address  string   `json:"address"`
+	Interval duration `json:"interval"`
+	Timeout  duration `json:"timeout"`
+	// Headers are sent with HTTP requests, e.g. an InfluxDB token
+	Headers map[string]string `json:"headers"`
+	// Name is a text/template for the metric name, with the fields
+	// .Stat (the eadm stat key), .Device and .Node
+	Name string `json:"name"`
+	// Tags maps "device" and "node" to the tag names they are sent as;
+	// an empty name leaves the tag out
+	Tags map[string]string `json:"tags"`
+	// Host is the Zabbix host of the items; defaults to the node name
+	Host string `json:"host"`
+	// DiscoveryKey is the key of the Zabbix low-level discovery rule
+	DiscoveryKey string `json:"discovery_key"`
+
+	// Region of the CloudMonitor endpoint; defaults to the region of
+	// the ECS instance
+	Region string `json:"region"`
+	// GroupID is the CloudMonitor application group, or 0 for none
+	GroupID string `json:"group_id"`
+	// InstanceID is the instanceId dimension; defaults to the ECS instance
+	InstanceID string `json:"instance_id"`
+	// AccessKeyID and AccessKeySecretFile sign CloudMonitor requests.
+	// Without them the RAM role of the instance is used, RAMRole or the
+	// one attached if empty.
+	AccessKeyID         string `json:"access_key_id"`
+	AccessKeySecretFile string `json:"access_key_secret_file"`
+	RAMRole             string `json:"ram_role"`
+
+	name *template.Template
+}
+
+// validate checks the sink config, fills in defaults and parses the name
+// template
+func (c *SinkConfig) validate() error {
+	defaults, ok := sinkDefaults[c.Type]
+	if !ok {
+		return fmt.Errorf("unknown type %q: must be influxdb, graphite, statsd, open-falcon, zabbix or cms", c.Type)
+	}
+	if c.ID == "" {
+		c.ID = c.Type
+	}
+	if c.Address == "" && c.Type != sinkCMS {
+		return fmt.Errorf("address is required")
+	}
+	if c.Interval == 0 {
+		c.Interval = duration(sinkDefaultInterval)
+	}
+	if c.Timeout == 0 {
+		c.Timeout = duration(sinkDefaultTimeout)
+	}
+	if c.Interval < 0 || c.Timeout < 0 {
+		return fmt.Errorf("interval and timeout must be positive")
+	}
+	if c.Name == "" {
+		c.Name = defaults.name
+	}
+	if c.Tags == nil {
+		c.Tags = defaults.tags
+	}
+	if c.Type == sinkZabbix && c.DiscoveryKey == "" {
+		c.DiscoveryKey = zabbixDefaultDiscoveryKey
+	}
+	if c.Type == sinkCMS && c.GroupID == "" {
+		c.GroupID = "0"
+	}
+	for key := range c.Tags {
+		if key != "device" && key != "node" {
+			return fmt.Errorf("tags: unknown key %q: must be device or node", key)
+		}
+	}
+	tmpl, err := template.New(c.ID).Option("missingkey=error").Parse(c.Name)
+	if err != nil {
+		return fmt.Errorf("name: %w", err)
+	}
+	c.name = tmpl
+	return nil
+}
+
+// sinkTag is a tag of a point
+type sinkTag struct {
+	Name  string
+	Value string
+}
+
+// sinkPoint is a counter of a device at the time it was collected
+type sinkPoint struct {
+	Name   string
+	Tags   []sinkTag
+	Node   string
+	Device string
+	Stat   string
+	Value  uint64
+	Time   time.Time
+	// Rate is the per-second increase since the previous sample, if
+	// HasRate is set
+	Rate    float64
+	HasRate bool
+}
+
+// Sink sends points to a monitoring system. Sinks connect for each send,
+// so a sink that is unreachable for a while needs no reconnect logic.
+type Sink interface {
+	Send(ctx context.Context, points []sinkPoint) error
+}
+
+// discoverySink is a Sink that is also told which devices exist, so that
+// it can create items for new devices before their values arrive
+type discoverySink interface {
+	Sink
+	Discover(ctx context.Context, devices []Device, node string) error
+}
+
+// newSink creates the sink described by a validated config
+func newSink(c *SinkConfig) (Sink, error) {
+	client := &http.Client{Timeout: time.Duration(c.Timeout)}
+	switch c.Type {
+	case sinkInfluxDB:
+		return &influxSink{url: c.Address, headers: c.Headers, client: client}, nil
+	case sinkGraphite:
+		return &graphiteSink{address: c.Address}, nil
+	case sinkStatsD:
+		return &statsdSink{address: c.Address, last: map[string]uint64{}}, nil
+	case sinkOpenFalcon:
+		return &falconSink{url: c.Address, headers: c.Headers, client: client, step: time.Duration(c.Interval)}, nil
+	case sinkZabbix:
+		return &zabbixSink{address: c.Address, host: c.Host, discoveryKey: c.DiscoveryKey}, nil
+	case sinkCMS:
+		return newCMSSink(c)
+	}
+	return nil, fmt.Errorf("unknown sink type %q", c.Type)
+}
+
+// sinkNameData are the fields of a name template
+type sinkNameData struct {
+	Stat   string
+	Device string
+	Node   string
+}
+
+// graphiteSafe replaces characters that separate Graphite path components
+var graphiteSafe = strings.NewReplacer(".", "_", " ", "_", ";", "_")
+
+// statsdSafe replaces characters that delimit StatsD fields
+var statsdSafe = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_")
+
+// falconSafe replaces characters that delimit Open-Falcon tags
+var falconSafe = strings.NewReplacer(",", "_", "=", "_", " ", "_")
+
+// sinkPoints renders the points of the last successful sample of each
+// device for a sink, honouring the enabled collectors
+func sinkPoints(c *SinkConfig, node string, devices []deviceState) ([]sinkPoint, error) {
+	keys := make([]string, 0, len(statFields))
+	for key := range statFields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	enabled := activeConfig().Collectors
+	var points []sinkPoint
+	var name bytes.Buffer
+	for _, st := range devices {
+		if st.Err != nil || st.Last == nil {
+			continue
+		}
+		data := sinkNameData{Device: st.Device.Name, Node: node}
+		switch c.Type {
+		case sinkGraphite:
+			data.Device, data.Node = graphiteSafe.Replace(data.Device), graphiteSafe.Replace(data.Node)
+		case sinkStatsD:
+			data.Device, data.Node = statsdSafe.Replace(data.Device), statsdSafe.Replace(data.Node)
+		}
+		var tags []sinkTag
+		if tag := c.Tags["device"]; tag != "" {
+			tags = append(tags, sinkTag{tag, st.Device.Name})
+		}
+		if tag := c.Tags["node"]; tag != "" {
+			tags = append(tags, sinkTag{tag, node})
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+
+		for _, key := range keys {
+			field := statFields[key]
+			stat := *field(st.Last.Stats)
+			if !stat.Present || !enabled.Enabled(key) {
+				continue
+			}
+			rate, hasRate := counterRate(st.Previous, st.Last, func(s *DeviceStats) StatValue { return *field(s) })
+			data.Stat = key
+			name.Reset()
+			if err := c.name.Execute(&name, data); err != nil {
+				return nil, fmt.Errorf("name template: %w", err)
+			}
+			points = append(points, sinkPoint{
+				Name: name.String(), Tags: tags,
+				Node: node, Device: st.Device.Name, Stat: key,
+				Value: stat.Value, Time: st.Last.Time,
+				Rate: rate, HasRate: hasRate,
+			})
+		}
+	}
+	return points, nil
+}
+
+// postSink posts a body and fails on a non-2xx response
+func postSink(ctx context.Context, client *http.Client, url, contentType string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "erdma-exporter")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("server returned %s: %q", resp.Status, msg)
+	}
+	return nil
+}
+
+// influxSink writes InfluxDB line protocol to the v1 /write or v2
+// /api/v2/write endpoint. Values are unsigned integers, since counters may
+// exceed the signed range.
+type influxSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+func (s *influxSink) Send(ctx context.Context, points []sinkPoint) error {
+	var b bytes.Buffer
+	for _, p := range points {
+		b.WriteString(influxMeasurementEscaper.Replace(p.Name))
+		for _, tag := range p.Tags {
+			b.WriteString("," + influxTagEscaper.Replace(tag.Name) + "=" + influxTagEscaper.Replace(tag.Value))
+		}
+		fmt.Fprintf(&b, " value=%du %d\n", p.Value, p.Time.UnixNano())
+	}
+	return postSink(ctx, s.client, s.url, "text/plain; charset=utf-8", s.headers, b.Bytes())
+}
+
+// graphiteSink writes the Graphite plaintext protocol over TCP, with tags
+// in the tagged series format
+type graphiteSink struct {
+	address string
+}
+
+func (s *graphiteSink) Send(ctx context.Context, points []sinkPoint) error {
+	var b bytes.Buffer
+	for _, p := range points {
+		b.WriteString(p.Name)
+		for _, tag := range p.Tags {
+			b.WriteString(";" + tag.Name + "=" + graphiteSafe.Replace(tag.Value))
+		}
+		fmt.Fprintf(&b, " %d %d\n", p.Value, p.Time.Unix())
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	_, err = conn.Write(b.Bytes())
+	return err
+}
+
+// statsdSink sends the increase of each counter since the last send as a
+// StatsD counter over UDP, with tags in the DogStatsD format. The first
+// send of a series and sends after a counter reset only set the baseline.
+type statsdSink struct {
+	address string
+	last    map[string]uint64
+}
+
+func (s *statsdSink) Send(ctx context.Context, points []sinkPoint) error {
+	var lines []string
+	seen := make(map[string]uint64, len(points))
+	for _, p := range points {
+		key := p.Name + "\xff" + p.Device + "\xff" + p.Node
+		seen[key] = p.Value
+		last, ok := s.last[key]
+		if !ok || p.Value < last {
+			continue
+		}
+		line := p.Name + ":" + strconv.FormatUint(p.Value-last, 10) + "|c"
+		for i, tag := range p.Tags {
+			sep := ","
+			if i == 0 {
+				sep = "|#"
+			}
+			line += sep + statsdSafe.Replace(tag.Name) + ":" + statsdSafe.Replace(tag.Value)
+		}
+		lines = append(lines, line)
+	}
+	s.last = seen
+	if len(lines) == 0 {
+		return nil
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", s.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > statsdMaxPacket {
+			if _, err := conn.Write(packet); err != nil {
+				return err
+			}
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	_, err = conn.Write(packet)
+	return err
+}
+
+// falconSink posts to the Open-Falcon agent or transfer push API, which
+// Nightingale also accepts. Counters are sent with counterType COUNTER so
+// that the server stores their rate.
+type falconSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+	step    time.Duration
+}
+
+// falconItem is an item of the Open-Falcon push API
+type falconItem struct {
+	Endpoint    string `json:"endpoint"`
+	Metric      string `json:"metric"`
+	Timestamp   int64  `json:"timestamp"`
+	Step        int64  `json:"step"`
+	Value       uint64 `json:"value"`
+	CounterType string `json:"counterType"`
+	Tags        string `json:"tags"`
+}
+
+func (s *falconSink) Send(ctx context.Context, points []sinkPoint) error {
+	items := make([]falconItem, 0, len(points))
+	for _, p := range points {
+		tags := make([]string, 0, len(p.Tags))
+		for _, tag := range p.Tags {
+			tags = append(tags, falconSafe.Replace(tag.Name)+"="+falconSafe.Replace(tag.Value))
+		}
+		items = append(items, falconItem{
+			Endpoint:    p.Node,
+			Metric:      p.Name,
+			Timestamp:   p.Time.Unix(),
+			Step:        int64(s.step.Seconds()),
+			Value:       p.Value,
+			CounterType: "COUNTER",
+			Tags:        strings.Join(tags, ","),
+		})
+	}
+	body, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	return postSink(ctx, s.client, s.url, "application/json", s.headers, body)
+}
+
+// sinkState is a running sink and when it is due next
+type sinkState struct {
+	config *SinkConfig
+	sink   Sink
+	next   time.Time
+}
+
+// sinkRunner feeds the configured sinks from the collector's snapshot.
+// Sinks that are due share a collection cycle. They are recreated when the
+// configuration is reloaded.
+type sinkRunner struct {
+	collector *ErdmaCollector
+	config    *Config
+	sinks     []*sinkState
+
+	sends       *prometheus.CounterVec
+	points      *prometheus.CounterVec
+	lastSuccess *prometheus.GaugeVec
+}
+
+// newSinkRunner creates a runner for collector and registers its own
+// metrics with reg
+func newSinkRunner(collector *ErdmaCollector, reg *prometheus.Registry) *sinkRunner {
+	r := &sinkRunner{
+		collector: collector,
+		sends: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "exporter", Name: "sink_sends_total",
+			Help: "Total number of sends to push sinks",
+		}, []string{"sink", "result"}),
+		points: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "exporter", Name: "sink_points_total",
+			Help: "Total number of points sent to push sinks",
+		}, []string{"sink"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "exporter", Name: "sink_last_success_timestamp_seconds",
+			Help: "Timestamp of the last successful send to a push sink",
+		}, []string{"sink"}),
+	}
+	reg.MustRegister(r.sends, r.points, r.lastSuccess)
+	return r
+}
+
+// reconcile recreates the sinks if the configuration was reloaded
+func (r *sinkRunner) reconcile(now time.Time) {
+	config := activeConfig()
+	if config == r.config {
+		return
+	}
+	r.config = config
+	r.sinks = nil
+	for i := range config.Outputs.Sinks {
+		c := &config.Outputs.Sinks[i]
+		sink, err := newSink(c)
+		if err != nil {
+			slog.Error("Failed to set up sink", "sink", c.ID, "err", err)
+			continue
+		}
+		r.sinks = append(r.sinks, &sinkState{config: c, sink: sink, next: now})
+		slog.Info("Sending statistics to sink", "sink", c.ID, "type", c.Type, "address", c.Address, "interval", time.Duration(c.Interval))
+	}
+}
+
+// tick sends to the sinks that are due, after a collection cycle
+func (r *sinkRunner) tick(ctx context.Context, now time.Time) {
+	var due []*sinkState
+	for _, s := range r.sinks {
+		if !now.Before(s.next) {
+			due = append(due, s)
+			s.next = now.Add(time.Duration(s.config.Interval))
+		}
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	_, devices := r.collector.Refresh(cycleShareAge)
+	discovery := r.collector.LastDiscovery()
+	node := r.collector.NodeName()
+	for _, s := range due {
+		points, err := sinkPoints(s.config, node, devices)
+		if err == nil {
+			sendCtx, cancel := context.WithTimeout(ctx, time.Duration(s.config.Timeout))
+			if ds, ok := s.sink.(discoverySink); ok && discovery.Err == nil {
+				err = ds.Discover(sendCtx, discovery.Devices, node)
+			}
+			if err == nil {
+				err = s.sink.Send(sendCtx, points)
+			}
+			cancel()
+		}
+		if err != nil {
+			r.sends.WithLabelValues(s.config.ID, "failure").Inc()
+			if ctx.Err() == nil {
+				slog.Error("Sending statistics to sink failed", "sink", s.config.ID, "address", s.config.Address, "err", err)
+			}
+			continue
+		}
+		r.sends.WithLabelValues(s.config.ID, "success").Inc()
+		r.points.WithLabelValues(s.config.ID).Add(float64(len(points)))
+		r.lastSuccess.WithLabelValues(s.config.ID).SetToCurrentTime()
+	}
+}
+
+// Run sends to the configured sinks until ctx is done. It checks every
+// second which sinks are due, so that reloaded intervals apply at once.
+func (r *sinkRunner) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		r.reconcile(now)
+		r.tick(ctx, now)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var sinkTestTime = time.Unix(1700000000, 123)
+
+// newTestSink validates a sink config and creates the sink
+func newTestSink(t *testing.T, c *SinkConfig) Sink {
+	t.Helper()
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	sink, err := newSink(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+// httpSinkServer records the bodies posted to it
+type httpSinkServer struct {
+	*httptest.Server
+	requests chan *http.Request
+	bodies   chan string
+}
+
+func newHTTPSinkServer(t *testing.T, status int) *httpSinkServer {
+	s := &httpSinkServer{requests: make(chan *http.Request, 10), bodies: make(chan string, 10)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.requests <- r
+		s.bodies <- string(body)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestInfluxSink(t *testing.T) {
+	server := newHTTPSinkServer(t, http.StatusNoContent)
+	sink := newTestSink(t, &SinkConfig{
+		Type:    sinkInfluxDB,
+		Address: server.URL + "/write?db=erdma",
+		Headers: map[string]string{"Authorization": "Token secret"},
+	})
+	err := sink.Send(context.Background(), []sinkPoint{
+		{Name: "erdma_hw_tx_bytes_cnt", Tags: []sinkTag{{"device", "erdma_0"}, {"host", "node-1"}}, Value: 5, Time: sinkTestTime},
+		// Beyond the signed range, with characters to escape
+		{Name: "erdma,x y", Tags: []sinkTag{{"host", "node=1, a"}}, Value: 1<<63 + 5, Time: sinkTestTime},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-server.requests
+	if r.Method != http.MethodPost || r.URL.RawQuery != "db=erdma" || r.Header.Get("Authorization") != "Token secret" {
+		t.Errorf("request %s %s with Authorization %q", r.Method, r.URL, r.Header.Get("Authorization"))
+	}
+	want := "erdma_hw_tx_bytes_cnt,device=erdma_0,host=node-1 value=5u 1700000000000000123\n" +
+		`erdma\,x\ y,host=node\=1\,\ a value=9223372036854775813u 1700000000000000123` + "\n"
+	if got := <-server.bodies; got != want {
+		t.Errorf("body\n%s\nwant\n%s", got, want)
+	}
+
+	failing := newHTTPSinkServer(t, http.StatusBadRequest)
+	sink = newTestSink(t, &SinkConfig{Type: sinkInfluxDB, Address: failing.URL})
+	if err := sink.Send(context.Background(), nil); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("error = %v, want the status", err)
+	}
+}
+
+// acceptOnce returns what the next connection to ln sends until it closes
+func acceptOnce(ln net.Listener) <-chan string {
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(received)
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		received <- string(data)
+	}()
+	return received
+}
+
+func TestGraphiteSink(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	for _, tc := range []struct {
+		name string
+		tags map[string]string
+		want string
+	}{
+		// Separators in the node and device names become underscores
+		{"path", nil, "erdma.node-1_example_com.erdma_0.hw_rx_bytes_cnt 7 1700000000\n" +
+			"erdma.node-1_example_com.erdma_0.hw_tx_bytes_cnt 5 1700000000\n"},
+		{"tagged", map[string]string{"device": "device", "node": "host"},
+			"erdma.node-1_example_com.erdma_0.hw_rx_bytes_cnt;device=erdma_0;host=node-1_example_com 7 1700000000\n" +
+				"erdma.node-1_example_com.erdma_0.hw_tx_bytes_cnt;device=erdma_0;host=node-1_example_com 5 1700000000\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := &SinkConfig{Type: sinkGraphite, Address: ln.Addr().String(), Tags: tc.tags}
+			sink := newTestSink(t, config)
+			points, err := sinkPoints(config, "node-1.example.com", []deviceState{
+				{Device: Device{Name: "erdma.0"}, Last: &DeviceSample{Time: sinkTestTime, Stats: statsFromMap(map[string]uint64{"hw_tx_bytes_cnt": 5, "hw_rx_bytes_cnt": 7})}},
+				// Devices whose statistics failed are left out
+				{Device: Device{Name: "erdma_1"}, Err: errors.New("eadm failed")},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			received := acceptOnce(ln)
+			if err := sink.Send(context.Background(), points); err != nil {
+				t.Fatal(err)
+			}
+			if got := <-received; got != tc.want {
+				t.Errorf("sent\n%s\nwant\n%s", got, tc.want)
+			}
+		})
+	}
+}
+
+// readDatagrams returns the datagrams that arrive within a short time
+func readDatagrams(t *testing.T, conn net.PacketConn) []string {
+	t.Helper()
+	var packets []string
+	buf := make([]byte, 64<<10)
+	for {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return packets
+		}
+		packets = append(packets, string(buf[:n]))
+	}
+}
+
+func TestStatsDSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sink := newTestSink(t, &SinkConfig{Type: sinkStatsD, Address: conn.LocalAddr().String()})
+
+	point := func(device string, value uint64) sinkPoint {
+		return sinkPoint{
+			Name: "erdma.hw_tx_bytes_cnt", Tags: []sinkTag{{"device", device}, {"host", "node:1"}},
+			Device: device, Node: "node:1", Value: value, Time: sinkTestTime,
+		}
+	}
+	for i, step := range []struct {
+		points []sinkPoint
+		want   []string
+	}{
+		// The first send only sets the baseline
+		{[]sinkPoint{point("erdma_0", 100)}, nil},
+		{[]sinkPoint{point("erdma_0", 150), point("erdma_1", 7)}, []string{"erdma.hw_tx_bytes_cnt:50|c|#device:erdma_0,host:node_1"}},
+		// A reset of erdma_0 only sets a new baseline
+		{[]sinkPoint{point("erdma_0", 20), point("erdma_1", 9)}, []string{"erdma.hw_tx_bytes_cnt:2|c|#device:erdma_1,host:node_1"}},
+		{[]sinkPoint{point("erdma_0", 30), point("erdma_1", 9)}, []string{
+			"erdma.hw_tx_bytes_cnt:10|c|#device:erdma_0,host:node_1\nerdma.hw_tx_bytes_cnt:0|c|#device:erdma_1,host:node_1",
+		}},
+	} {
+		if err := sink.Send(context.Background(), step.points); err != nil {
+			t.Fatal(err)
+		}
+		if got := readDatagrams(t, conn); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("send %d: sent %q, want %q", i+1, got, step.want)
+		}
+	}
+
+	// Lines are split over datagrams that stay below the packet limit
+	var points []sinkPoint
+	for i := 0; i < 100; i++ {
+		points = append(points, sinkPoint{Name: "erdma.stat_" + strings.Repeat("x", i%10), Device: string(rune('a' + i%26)), Node: strings.Repeat("n", i), Value: 1})
+	}
+	if err := sink.Send(context.Background(), points); err != nil {
+		t.Fatal(err)
+	}
+	for i := range points {
+		points[i].Value = 2
+	}
+	if err := sink.Send(context.Background(), points); err != nil {
+		t.Fatal(err)
+	}
+	packets := readDatagrams(t, conn)
+	lines := 0
+	for _, packet := range packets {
+		if len(packet) > statsdMaxPacket {
+			t.Errorf("datagram of %d bytes", len(packet))
+		}
+		lines += strings.Count(packet, "\n") + 1
+	}
+	if len(packets) < 2 || lines != len(points) {
+		t.Errorf("sent %d lines in %d datagrams, want %d lines in several", lines, len(packets), len(points))
+	}
+}
+
+func TestFalconSink(t *testing.T) {
+	server := newHTTPSinkServer(t, http.StatusOK)
+	sink := newTestSink(t, &SinkConfig{Type: sinkOpenFalcon, Address: server.URL + "/v1/push", Interval: duration(time.Minute)})
+	err := sink.Send(context.Background(), []sinkPoint{
+		{Name: "erdma.hw_tx_bytes_cnt", Tags: []sinkTag{{"device", "erdma_0"}}, Node: "node-1", Value: 5, Time: sinkTestTime},
+		{Name: "erdma.hw_rx_bytes_cnt", Tags: []sinkTag{{"device", "erdma,0"}, {"rack id", "a=b"}}, Node: "node-1", Value: 7, Time: sinkTestTime},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := <-server.requests; r.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Content-Type = %q", r.Header.Get("Content-Type"))
+	}
+	var items []map[string]any
+	if err := json.Unmarshal([]byte(<-server.bodies), &items); err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]any{
+		{"endpoint": "node-1", "metric": "erdma.hw_tx_bytes_cnt", "timestamp": 1700000000.0, "step": 60.0, "value": 5.0, "counterType": "COUNTER", "tags": "device=erdma_0"},
+		{"endpoint": "node-1", "metric": "erdma.hw_rx_bytes_cnt", "timestamp": 1700000000.0, "step": 60.0, "value": 7.0, "counterType": "COUNTER", "tags": "device=erdma_0,rack_id=a_b"},
+	}
+	if !reflect.DeepEqual(items, want) {
+		t.Errorf("items\n%v\nwant\n%v", items, want)
+	}
+}
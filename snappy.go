@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+// snappyBlockSize is the size of the blocks the input is compressed in.
+// Copies never reach back across a block boundary, so offsets fit in the
+// two-byte copy element.
+const snappyBlockSize = 1 << 16
+
+// snappyMinMatch is the length of the sequences looked up in the hash table
+const snappyMinMatch = 4
+
+// snappyTableBits is the size of the hash table of recent sequences
+const snappyTableBits = 14
+
+// snappyEncode compresses src in the snappy block format, as required by
+// the remote write protocol. The output is a varint of the uncompressed
+// length followed by literal and copy elements.
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(make([]byte, 0, len(src)/2+16), uint64(len(src)))
+	for len(src) > 0 {
+		block := src
+		if len(block) > snappyBlockSize {
+			block = block[:snappyBlockSize]
+		}
+		src = src[len(block):]
+		dst = snappyEncodeBlock(dst, block)
+	}
+	return dst
+}
+
+// snappyEncodeBlock appends the elements of a block, greedily replacing
+// sequences seen before with copies
+func snappyEncodeBlock(dst, src []byte) []byte {
+	if len(src) < 2*snappyMinMatch {
+		return snappyAppendLiteral(dst, src)
+	}
+
+	// Positions plus one of the last occurrence of each hashed sequence
+	var table [1 << snappyTableBits]int32
+	literal := 0
+	for i := 0; i+snappyMinMatch <= len(src); {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := (seq * 0x1e35a7bd) >> (32 - snappyTableBits)
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || binary.LittleEndian.Uint32(src[candidate:]) != seq {
+			i++
+			continue
+		}
+
+		end := i + snappyMinMatch
+		for end < len(src) && src[end] == src[candidate+end-i] {
+			end++
+		}
+		dst = snappyAppendLiteral(dst, src[literal:i])
+		dst = snappyAppendCopy(dst, i-candidate, end-i)
+		i, literal = end, end
+	}
+	return snappyAppendLiteral(dst, src[literal:])
+}
+
+// snappyAppendLiteral appends a literal element
+func snappyAppendLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := len(lit) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	default:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	}
+	return append(dst, lit...)
+}
+
+// snappyAppendCopy appends copy elements for a match of length bytes at
+// offset bytes back. A copy element covers at most 64 bytes.
+func snappyAppendCopy(dst []byte, offset, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 63<<2|2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	// Leave at least 4 bytes for the last element
+	if length > 64 {
+		dst = append(dst, 59<<2|2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|1, byte(offset))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// snappyDecode is a reference decoder written from the snappy format
+// description, independently of the encoder
+func snappyDecode(src []byte) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 {
+		return nil, errors.New("invalid length")
+	}
+	src = src[k:]
+	dst := make([]byte, 0, n)
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 3 {
+		case 0:
+			length = int(tag >> 2)
+			src = src[1:]
+			if extra := length - 59; extra > 0 {
+				if extra > 4 || len(src) < extra {
+					return nil, errors.New("truncated literal length")
+				}
+				length = 0
+				for i := extra - 1; i >= 0; i-- {
+					length = length<<8 | int(src[i])
+				}
+				src = src[extra:]
+			}
+			length++
+			if len(src) < length {
+				return nil, errors.New("truncated literal")
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case 1:
+			if len(src) < 2 {
+				return nil, errors.New("truncated copy")
+			}
+			length = int(tag>>2&7) + 4
+			offset = int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+		case 2:
+			if len(src) < 3 {
+				return nil, errors.New("truncated copy")
+			}
+			length = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3:
+			if len(src) < 5 {
+				return nil, errors.New("truncated copy")
+			}
+			length = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) {
+			return nil, fmt.Errorf("invalid copy offset %d at %d", offset, len(dst))
+		}
+		// Copies may overlap their output, so go byte by byte
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, fmt.Errorf("decoded %d bytes, header says %d", len(dst), n)
+	}
+	return dst, nil
+}
+
+func TestSnappyRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rng.Read(b)
+		return b
+	}
+	// Text with repeated lines, like an exposition, with random values
+	var text strings.Builder
+	for text.Len() < 3*snappyBlockSize {
+		fmt.Fprintf(&text, "erdma_hw_tx_bytes_total{device=\"erdma_%d\",node=\"node-1\"} %d\n", rng.Intn(4), rng.Int63())
+	}
+	// Random runs of repeated bytes
+	var runs []byte
+	for len(runs) < 2*snappyBlockSize+100 {
+		runs = append(runs, bytes.Repeat([]byte{byte(rng.Intn(4))}, rng.Intn(300)+1)...)
+	}
+
+	for _, tc := range []struct {
+		name string
+		in   []byte
+		// max is the largest acceptable compressed size, 0 if any
+		max int
+	}{
+		{"empty", nil, 0},
+		{"one byte", []byte{'x'}, 0},
+		{"short", []byte("abcabcabc"), 0},
+		{"overlapping copy", bytes.Repeat([]byte("ab"), 100), 20},
+		{"random", random(3*snappyBlockSize + 17), 0},
+		{"random one block", random(snappyBlockSize), 0},
+		{"random past one block", random(snappyBlockSize + 1), 0},
+		{"zeros", make([]byte, 5*snappyBlockSize/2), 5 * snappyBlockSize / 2 / 20},
+		{"repeated phrase", bytes.Repeat([]byte("the quick brown fox "), 10000), 20000},
+		{"exposition", []byte(text.String()), text.Len() / 2},
+		{"runs", runs, 0},
+		{"random then repeated", append(random(snappyBlockSize-10), bytes.Repeat([]byte("x"), 1000)...), 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			encoded := snappyEncode(tc.in)
+			decoded, err := snappyDecode(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded, tc.in) {
+				t.Fatalf("round trip of %d bytes differs", len(tc.in))
+			}
+			if tc.max > 0 && len(encoded) > tc.max {
+				t.Errorf("compressed %d bytes to %d, want at most %d", len(tc.in), len(encoded), tc.max)
+			}
+		})
+	}
+}
+
+// TestSnappyBlocksIndependent checks that no copy reaches back across a
+// block boundary, as the two-byte offsets require
+func TestSnappyBlocksIndependent(t *testing.T) {
+	phrase := []byte("0123456789abcdef")
+	in := bytes.Repeat(phrase, 3*snappyBlockSize/len(phrase))
+	encoded := snappyEncode(in)
+
+	// The encoding must be the concatenation of the blocks encoded on their
+	// own, each of which decodes without the data before it
+	var parts []byte
+	for rest := in; len(rest) > 0; {
+		block := rest
+		if len(block) > snappyBlockSize {
+			block = block[:snappyBlockSize]
+		}
+		rest = rest[len(block):]
+		parts = snappyEncodeBlock(parts, block)
+		if _, err := snappyDecode(append(binary.AppendUvarint(nil, uint64(len(block))), snappyEncodeBlock(nil, block)...)); err != nil {
+			t.Fatalf("block does not decode on its own: %v", err)
+		}
+	}
+	if want := append(binary.AppendUvarint(nil, uint64(len(in))), parts...); !bytes.Equal(encoded, want) {
+		t.Error("encoding differs from the concatenation of its blocks")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DeviceSample is the statistics of a device at a point in time
+type DeviceSample struct {
+	Time  time.Time
+	Stats *DeviceStats
+}
+
+// deviceState is what the last collection cycles saw for a device
+type deviceState struct {
+	Device Device
+	// Last and Previous are the two most recent successful samples
+	Last     *DeviceSample
+	Previous *DeviceSample
+	// LastScrape is when statistics were last requested, successful or not
+	LastScrape time.Time
+	Err        error
+}
+
+// collectorState is what the last collection cycles saw
+type collectorState struct {
+	Version     string
+	VersionErr  error
+	VersionTime time.Time
+	Devices     map[string]*deviceState
+	// CycleTime and CycleErr are the end and outcome of the last collection cycle
+	CycleTime time.Time
+	CycleErr  error
+}
+
+// recordVersion stores the outcome of the last driver version query
+func (c *ErdmaCollector) recordVersion(version string, err error) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.state.VersionTime = time.Now()
+	c.state.VersionErr = err
+	if err == nil {
+		c.state.Version = version
+	}
+}
+
+// recordCycle stores the outcome of a collection cycle. A cycle fails if
+// the devices could not be discovered.
+func (c *ErdmaCollector) recordCycle(err error) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.state.CycleTime = time.Now()
+	c.state.CycleErr = err
+}
+
+// retainDevices drops the state of devices that are no longer discovered
+func (c *ErdmaCollector) retainDevices(devices []Device) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	present := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		present[device.Name] = true
+	}
+	for name := range c.state.Devices {
+		if !present[name] {
+			delete(c.state.Devices, name)
+		}
+	}
+	c.history.retain(present)
+}
+
+// recordStats stores the outcome of a statistics query for a device
+func (c *ErdmaCollector) recordStats(device Device, stats *DeviceStats, err error) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.state.Devices == nil {
+		c.state.Devices = make(map[string]*deviceState)
+	}
+	st, ok := c.state.Devices[device.Name]
+	if !ok {
+		st = &deviceState{}
+		c.state.Devices[device.Name] = st
+	}
+	now := time.Now()
+	st.Device = device
+	st.LastScrape = now
+	st.Err = err
+	if err == nil {
+		st.Previous = st.Last
+		st.Last = &DeviceSample{Time: now, Stats: stats}
+		c.history.record(device.Name, st.Last)
+	}
+}
+
+// Snapshot returns a copy of what the last collection cycles saw,
+// with devices sorted by name
+func (c *ErdmaCollector) Snapshot() (collectorState, []deviceState) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	devices := make([]deviceState, 0, len(c.state.Devices))
+	for _, st := range c.state.Devices {
+		devices = append(devices, *st)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Device.Name < devices[j].Device.Name
+	})
+	state := c.state
+	state.Devices = nil
+	return state, devices
+}
+
+// cycleShareAge is how old a collection cycle may be for a scrape or push
+// to reuse its metrics instead of running another, so that simultaneous
+// scrapes, such as those of a pair of Prometheus replicas, fork eadm once
+const cycleShareAge = time.Second
+
+// cycle returns the metrics of the last collection cycle, running a new
+// one unless the last finished within maxAge. Cycles never overlap, and
+// callers that waited for a running cycle usually get its metrics instead
+// of running another.
+func (c *ErdmaCollector) cycle(maxAge time.Duration) []prometheus.Metric {
+	c.cycleMu.Lock()
+	defer c.cycleMu.Unlock()
+	if !c.cycleEnd.IsZero() && time.Since(c.cycleEnd) <= maxAge {
+		return c.cycleMetrics
+	}
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	var metrics []prometheus.Metric
+	go func() {
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+		close(done)
+	}()
+	c.collect(ch)
+	close(ch)
+	<-done
+	c.cycleMetrics, c.cycleEnd = metrics, time.Now()
+	return metrics
+}
+
+// Refresh runs a collection cycle unless one finished within maxAge and
+// returns what the last cycles saw. Everything that needs fresh statistics
+// outside of scrapes uses it, so that eadm is not run for each of them.
+func (c *ErdmaCollector) Refresh(maxAge time.Duration) (collectorState, []deviceState) {
+	c.cycle(maxAge)
+	return c.Snapshot()
+}
+
+// counterRate returns the per-second rate of a counter between two samples.
+// It reports false if either sample lacks the counter or the counter was reset.
+func counterRate(prev, last *DeviceSample, field func(*DeviceStats) StatValue) (float64, bool) {
+	if prev == nil || last == nil {
+		return 0, false
+	}
+	a, b := field(prev.Stats), field(last.Stats)
+	dt := last.Time.Sub(prev.Time).Seconds()
+	if !a.Present || !b.Present || b.Value < a.Value || dt <= 0 {
+		return 0, false
+	}
+	return float64(b.Value-a.Value) / dt, true
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// Reasons for skipping a line of eadm stat output
+const (
+	parseErrorNoSeparator  = "no_separator"
+	parseErrorEmptyKey     = "empty_key"
+	parseErrorInvalidValue = "invalid_value"
+	parseErrorNegative     = "negative_value"
+	parseErrorOverflow     = "overflow"
+	parseErrorDuplicateKey = "duplicate_key"
+)
+
+// StatValue is a single counter from eadm stat output.
+// Present is false when the driver did not report the counter.
+type StatValue struct {
+	Value   uint64
+	Present bool
+}
+
+// ListenStats holds the listen counters
+type ListenStats struct {
+	Create  StatValue
+	Ipv6    StatValue
+	Success StatValue
+	Failed  StatValue
+	Destroy StatValue
+}
+
+// AcceptStats holds the accept and reject counters
+type AcceptStats struct {
+	Total        StatValue
+	Success      StatValue
+	Failed       StatValue
+	Reject       StatValue
+	RejectFailed StatValue
+}
+
+// ConnectStats holds the connect counters
+type ConnectStats struct {
+	Total   StatValue
+	Success StatValue
+	Failed  StatValue
+	Timeout StatValue
+	Reset   StatValue
+}
+
+// CmdqStats holds the command queue counters
+type CmdqStats struct {
+	Submitted StatValue
+	Completed StatValue
+	EqNotify  StatValue
+	EqEvent   StatValue
+	CqArmed   StatValue
+}
+
+// AeqStats holds the async event queue counters
+type AeqStats struct {
+	Event  StatValue
+	Notify StatValue
+}
+
+// VerbsStats holds the verbs API counters
+type VerbsStats struct {
+	AllocMr         StatValue
+	AllocMrFailed   StatValue
+	AllocPd         StatValue
+	AllocPdFailed   StatValue
+	AllocUctx       StatValue
+	AllocUctxFailed StatValue
+	CreateCq        StatValue
+	CreateCqFailed  StatValue
+	CreateQp        StatValue
+	CreateQpFailed  StatValue
+	DeallocPd       StatValue
+	DeallocUctx     StatValue
+	DeregMr         StatValue
+	DeregMrFailed   StatValue
+	DestroyCq       StatValue
+	DestroyCqFailed StatValue
+	DestroyQp       StatValue
+	DestroyQpFailed StatValue
+	GetDmaMr        StatValue
+	GetDmaMrFailed  StatValue
+	RegUsrMr        StatValue
+	RegUsrMrFailed  StatValue
+}
+
+// HwTxStats holds the hardware transmit counters
+type HwTxStats struct {
+	Requests     StatValue
+	Packets      StatValue
+	Bytes        StatValue
+	DisableDrop  StatValue
+	BpsLimitDrop StatValue
+	PpsLimitDrop StatValue
+}
+
+// HwRxStats holds the hardware receive counters
+type HwRxStats struct {
+	Packets      StatValue
+	Bytes        StatValue
+	DisableDrop  StatValue
+	BpsLimitDrop StatValue
+	PpsLimitDrop StatValue
+}
+
+// DeviceStats holds the statistics of a device as reported by eadm stat
+type DeviceStats struct {
+	Listen  ListenStats
+	Accept  AcceptStats
+	Connect ConnectStats
+	Cmdq    CmdqStats
+	Aeq     AeqStats
+	Verbs   VerbsStats
+	HwTx    HwTxStats
+	HwRx    HwRxStats
+
+	// Raw holds every parsed counter by key, including ones without a field
+	Raw map[string]uint64
+	// Output is the unparsed eadm stat output
+	Output string
+	// ParseErrors counts skipped lines by reason
+	ParseErrors map[string]int
+}
+
+// statFields maps eadm stat keys to the DeviceStats field they are stored in
+var statFields = map[string]func(*DeviceStats) *StatValue{
+	"listen_create_cnt":           func(s *DeviceStats) *StatValue { return &s.Listen.Create },
+	"listen_ipv6_cnt":             func(s *DeviceStats) *StatValue { return &s.Listen.Ipv6 },
+	"listen_success_cnt":          func(s *DeviceStats) *StatValue { return &s.Listen.Success },
+	"listen_failed_cnt":           func(s *DeviceStats) *StatValue { return &s.Listen.Failed },
+	"listen_destroy_cnt":          func(s *DeviceStats) *StatValue { return &s.Listen.Destroy },
+	"accept_total_cnt":            func(s *DeviceStats) *StatValue { return &s.Accept.Total },
+	"accept_success_cnt":          func(s *DeviceStats) *StatValue { return &s.Accept.Success },
+	"accept_failed_cnt":           func(s *DeviceStats) *StatValue { return &s.Accept.Failed },
+	"reject_cnt":                  func(s *DeviceStats) *StatValue { return &s.Accept.Reject },
+	"reject_failed_cnt":           func(s *DeviceStats) *StatValue { return &s.Accept.RejectFailed },
+	"connect_total_cnt":           func(s *DeviceStats) *StatValue { return &s.Connect.Total },
+	"connect_success_cnt":         func(s *DeviceStats) *StatValue { return &s.Connect.Success },
+	"connect_failed_cnt":          func(s *DeviceStats) *StatValue { return &s.Connect.Failed },
+	"connect_timeout_cnt":         func(s *DeviceStats) *StatValue { return &s.Connect.Timeout },
+	"connect_reset_cnt":           func(s *DeviceStats) *StatValue { return &s.Connect.Reset },
+	"cmdq_submitted_cnt":          func(s *DeviceStats) *StatValue { return &s.Cmdq.Submitted },
+	"cmdq_comp_cnt":               func(s *DeviceStats) *StatValue { return &s.Cmdq.Completed },
+	"cmdq_eq_notify_cnt":          func(s *DeviceStats) *StatValue { return &s.Cmdq.EqNotify },
+	"cmdq_eq_event_cnt":           func(s *DeviceStats) *StatValue { return &s.Cmdq.EqEvent },
+	"cmdq_cq_armed_cnt":           func(s *DeviceStats) *StatValue { return &s.Cmdq.CqArmed },
+	"erdma_aeq_event_cnt":         func(s *DeviceStats) *StatValue { return &s.Aeq.Event },
+	"erdma_aeq_notify_cnt":        func(s *DeviceStats) *StatValue { return &s.Aeq.Notify },
+	"verbs_alloc_mr_cnt":          func(s *DeviceStats) *StatValue { return &s.Verbs.AllocMr },
+	"verbs_alloc_mr_failed_cnt":   func(s *DeviceStats) *StatValue { return &s.Verbs.AllocMrFailed },
+	"verbs_alloc_pd_cnt":          func(s *DeviceStats) *StatValue { return &s.Verbs.AllocPd },
+	"verbs_alloc_pd_failed_cnt":   func(s *DeviceStats) *StatValue { return &s.Verbs.AllocPdFailed },
+	"verbs_alloc_uctx_cnt":        func(s *DeviceStats) *StatValue { return &s.Verbs.AllocUctx },
+	"verbs_alloc_uctx_failed_cnt": func(s *DeviceStats) *StatValue { return &s.Verbs.AllocUctxFailed },
+	"verbs_create_cq_cnt":         func(s *DeviceStats) *StatValue { return &s.Verbs.CreateCq },
+	"verbs_create_cq_failed_cnt":  func(s *DeviceStats) *StatValue { return &s.Verbs.CreateCqFailed },
+	"verbs_create_qp_cnt":         func(s *DeviceStats) *StatValue { return &s.Verbs.CreateQp },
+	"verbs_create_qp_failed_cnt":  func(s *DeviceStats) *StatValue { return &s.Verbs.CreateQpFailed },
+	"verbs_dealloc_pd_cnt":        func(s *DeviceStats) *StatValue { return &s.Verbs.DeallocPd },
+	"verbs_dealloc_uctx_cnt":      func(s *DeviceStats) *StatValue { return &s.Verbs.DeallocUctx },
+	"verbs_dereg_mr_cnt":          func(s *DeviceStats) *StatValue { return &s.Verbs.DeregMr },
+	"verbs_dereg_mr_failed_cnt":   func(s *DeviceStats) *StatValue { return &s.Verbs.DeregMrFailed },
+	"verbs_destroy_cq_cnt":        func(s *DeviceStats) *StatValue { return &s.Verbs.DestroyCq },
+	"verbs_destroy_cq_failed_cnt": func(s *DeviceStats) *StatValue { return &s.Verbs.DestroyCqFailed },
+	"verbs_destroy_qp_cnt":        func(s *DeviceStats) *StatValue { return &s.Verbs.DestroyQp },
+	"verbs_destroy_qp_failed_cnt": func(s *DeviceStats) *StatValue { return &s.Verbs.DestroyQpFailed },
+	"verbs_get_dma_mr_cnt":        func(s *DeviceStats) *StatValue { return &s.Verbs.GetDmaMr },
+	"verbs_get_dma_mr_failed_cnt": func(s *DeviceStats) *StatValue { return &s.Verbs.GetDmaMrFailed },
+	"verbs_reg_usr_mr_cnt":        func(s *DeviceStats) *StatValue { return &s.Verbs.RegUsrMr },
+	"verbs_reg_usr_mr_failed_cnt": func(s *DeviceStats) *StatValue { return &s.Verbs.RegUsrMrFailed },
+	"hw_tx_reqs_cnt":              func(s *DeviceStats) *StatValue { return &s.HwTx.Requests },
+	"hw_tx_packets_cnt":           func(s *DeviceStats) *StatValue { return &s.HwTx.Packets },
+	"hw_tx_bytes_cnt":             func(s *DeviceStats) *StatValue { return &s.HwTx.Bytes },
+	"hw_disable_drop_cnt":         func(s *DeviceStats) *StatValue { return &s.HwTx.DisableDrop },
+	"hw_bps_limit_drop_cnt":       func(s *DeviceStats) *StatValue { return &s.HwTx.BpsLimitDrop },
+	"hw_pps_limit_drop_cnt":       func(s *DeviceStats) *StatValue { return &s.HwTx.PpsLimitDrop },
+	"hw_rx_packets_cnt":           func(s *DeviceStats) *StatValue { return &s.HwRx.Packets },
+	"hw_rx_bytes_cnt":             func(s *DeviceStats) *StatValue { return &s.HwRx.Bytes },
+	"hw_rx_disable_drop_cnt":      func(s *DeviceStats) *StatValue { return &s.HwRx.DisableDrop },
+	"hw_rx_bps_limit_drop_cnt":    func(s *DeviceStats) *StatValue { return &s.HwRx.BpsLimitDrop },
+	"hw_rx_pps_limit_drop_cnt":    func(s *DeviceStats) *StatValue { return &s.HwRx.PpsLimitDrop },
+}
+
+// Get returns a counter by its eadm stat key
+func (s *DeviceStats) Get(key string) (uint64, bool) {
+	val, ok := s.Raw[key]
+	return val, ok
+}
+
+// set stores a parsed counter, returning false if the key was already set
+func (s *DeviceStats) set(key string, val uint64) bool {
+	_, dup := s.Raw[key]
+	s.Raw[key] = val
+	if field, ok := statFields[key]; ok {
+		*field(s) = StatValue{Value: val, Present: true}
+	}
+	return !dup
+}
+
+// newDeviceStats creates empty device statistics
+func newDeviceStats() *DeviceStats {
+	return &DeviceStats{
+		Raw:         make(map[string]uint64),
+		ParseErrors: make(map[string]int),
+	}
+}
+
+// statSplitter splits a line of eadm stat output into key and value
+type statSplitter func(line string) (string, string, bool)
+
+// splitColonStat splits "key : value" lines on the last colon so that keys
+// containing colons still parse
+func splitColonStat(line string) (string, string, bool) {
+	idx := strings.LastIndex(line, ":")
+	if idx < 0 {
+		return "", "", false
+	}
+	return line[:idx], line[idx+1:], true
+}
+
+// splitColumnStat splits "key    value" lines on the last run of whitespace
+func splitColumnStat(line string) (string, string, bool) {
+	idx := strings.LastIndexAny(line, " \t")
+	if idx < 0 {
+		return "", "", false
+	}
+	return line[:idx], line[idx+1:], true
+}
+
+// parseDeviceStats parses eadm stat output of "key : value" lines
+func parseDeviceStats(output string) *DeviceStats {
+	return parseDeviceStatsWith(output, splitColonStat)
+}
+
+// parseDeviceStatsWith parses eadm stat output using the given line splitter.
+// Values may be decimal or 0x-prefixed hex.
+// Section headers such as "[hw]", "Hardware:" or "=== cm ===" are tracked so
+// that keys inside a section can be resolved with the section as prefix.
+// Lines that cannot be parsed are skipped and counted in ParseErrors.
+func parseDeviceStatsWith(output string, split statSplitter) *DeviceStats {
+	stats := newDeviceStats()
+	section := ""
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if name, ok := parseSectionHeader(line); ok {
+			section = name
+			continue
+		}
+
+		rawKey, rawVal, ok := split(line)
+		if !ok {
+			stats.skip(line, parseErrorNoSeparator)
+			continue
+		}
+		key := normalizeStatKey(rawKey)
+		valStr := strings.TrimSpace(rawVal)
+		if key == "" {
+			stats.skip(line, parseErrorEmptyKey)
+			continue
+		}
+
+		val, reason := parseStatValue(valStr)
+		if reason != "" {
+			stats.skip(line, reason)
+			continue
+		}
+
+		if _, known := statFields[key]; !known && section != "" {
+			if _, known := statFields[section+"_"+key]; known {
+				key = section + "_" + key
+			}
+		}
+		if !stats.set(key, val) {
+			stats.skip(line, parseErrorDuplicateKey)
+		}
+	}
+
+	return stats
+}
+
+// skip records a line that could not be parsed
+func (s *DeviceStats) skip(line string, reason string) {
+	slog.Debug("Skipping eadm stat line", "reason", reason, "line", line)
+	s.ParseErrors[reason]++
+}
+
+// parseSectionHeader recognizes section header lines and returns the section name
+func parseSectionHeader(line string) (string, bool) {
+	switch {
+	case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+		return normalizeStatKey(line[1 : len(line)-1]), true
+	case strings.HasSuffix(line, ":") && strings.Count(line, ":") == 1:
+		// A known key with a missing value is not a header
+		name := normalizeStatKey(strings.TrimSuffix(line, ":"))
+		if _, known := statFields[name]; known {
+			return "", false
+		}
+		return name, true
+	case strings.Trim(line, "=-# ") != line && !strings.Contains(line, ":"):
+		return normalizeStatKey(strings.Trim(line, "=-# ")), true
+	}
+	return "", false
+}
+
+// normalizeStatKey lowercases a key and replaces separators with underscores
+func normalizeStatKey(key string) string {
+	key = strings.ToLower(strings.TrimSpace(key))
+	return strings.Join(strings.FieldsFunc(key, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == ':' || r == '-'
+	}), "_")
+}
+
+// parseStatValue parses a decimal or hex counter value, returning a parse error reason on failure
+func parseStatValue(valStr string) (uint64, string) {
+	if strings.HasPrefix(valStr, "-") {
+		return 0, parseErrorNegative
+	}
+	base := 10
+	if strings.HasPrefix(valStr, "0x") || strings.HasPrefix(valStr, "0X") {
+		base = 16
+		valStr = valStr[2:]
+	}
+	val, err := strconv.ParseUint(valStr, base, 64)
+	if err != nil {
+		if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+			return 0, parseErrorOverflow
+		}
+		return 0, parseErrorInvalidValue
+	}
+	return val, ""
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStatValue(t *testing.T) {
+	for _, tc := range []struct {
+		in     string
+		want   uint64
+		reason string
+	}{
+		{"42", 42, ""},
+		{"0", 0, ""},
+		{"0x1F", 31, ""},
+		{"0XfF", 255, ""},
+		{"18446744073709551615", 1<<64 - 1, ""},
+		{"18446744073709551616", 0, parseErrorOverflow},
+		{"0x10000000000000000", 0, parseErrorOverflow},
+		{"-1", 0, parseErrorNegative},
+		{"", 0, parseErrorInvalidValue},
+		{"12 packets", 0, parseErrorInvalidValue},
+		{"0x", 0, parseErrorInvalidValue},
+		{"1.5", 0, parseErrorInvalidValue},
+	} {
+		got, reason := parseStatValue(tc.in)
+		if got != tc.want || reason != tc.reason {
+			t.Errorf("parseStatValue(%q) = %d, %q, want %d, %q", tc.in, got, reason, tc.want, tc.reason)
+		}
+	}
+}
+
+func TestParseSectionHeader(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want string
+		ok   bool
+	}{
+		{"[hw]", "hw", true},
+		{"[HW Tx]", "hw_tx", true},
+		{"Hardware:", "hardware", true},
+		{"=== cm ===", "cm", true},
+		{"--- cmdq ---", "cmdq", true},
+		// A known key with a missing value is a line to skip, not a header
+		{"hw_tx_bytes_cnt:", "", false},
+		{"hw_tx_bytes_cnt : 5", "", false},
+		{"=== a: b ===", "", false},
+	} {
+		got, ok := parseSectionHeader(tc.line)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("parseSectionHeader(%q) = %q, %v, want %q, %v", tc.line, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestParseDeviceStats(t *testing.T) {
+	stats := parseDeviceStats(`listen_create_cnt : 3
+Connect-Timeout CNT : 0x10
+
+[hw]
+tx_bytes_cnt : 100
+rx_bytes_cnt : 200
+=== cmdq ===
+submitted_cnt : 7
+vendor_private_cnt : 9
+
+hw_tx_bytes_cnt : 101
+hw_rx_packets_cnt : -4
+listen_failed_cnt : many
+no separator here
+ : 5
+hw_tx_packets_cnt : 18446744073709551616
+`)
+
+	// Keys are normalized, hex is accepted and keys inside sections
+	// resolve with the section as prefix
+	for key, want := range map[string]uint64{
+		"listen_create_cnt":   3,
+		"connect_timeout_cnt": 16,
+		"hw_tx_bytes_cnt":     101,
+		"hw_rx_bytes_cnt":     200,
+		"cmdq_submitted_cnt":  7,
+		// Unknown keys are kept without their section
+		"vendor_private_cnt": 9,
+	} {
+		if got, ok := stats.Get(key); !ok || got != want {
+			t.Errorf("%s = %d, %v, want %d", key, got, ok, want)
+		}
+	}
+	if stats.Listen.Create != (StatValue{Value: 3, Present: true}) || stats.Connect.Timeout.Value != 16 ||
+		stats.HwRx.Bytes.Value != 200 || stats.Cmdq.Submitted.Value != 7 {
+		t.Errorf("typed fields not set: %+v", stats)
+	}
+	// A repeated key keeps the last value and counts as a parse error
+	if stats.HwTx.Bytes.Value != 101 {
+		t.Errorf("duplicate hw_tx_bytes_cnt = %d, want the last value", stats.HwTx.Bytes.Value)
+	}
+	for _, key := range []string{"hw_rx_packets_cnt", "listen_failed_cnt", "hw_tx_packets_cnt"} {
+		if _, ok := stats.Get(key); ok {
+			t.Errorf("%s parsed from an invalid line", key)
+		}
+	}
+	if stats.HwRx.Packets.Present || stats.Listen.Failed.Present || stats.Accept.Total.Present {
+		t.Error("missing counters marked present")
+	}
+
+	want := map[string]int{
+		parseErrorDuplicateKey: 1,
+		parseErrorNegative:     1,
+		parseErrorInvalidValue: 1,
+		parseErrorNoSeparator:  1,
+		parseErrorEmptyKey:     1,
+		parseErrorOverflow:     1,
+	}
+	if !reflect.DeepEqual(stats.ParseErrors, want) {
+		t.Errorf("parse errors %v, want %v", stats.ParseErrors, want)
+	}
+}
+
+func TestParseDeviceStatsColumns(t *testing.T) {
+	stats := parseDeviceStatsWith("[hw]\ntx bytes cnt    12\nhw_rx_bytes_cnt\t0x20\n", splitColumnStat)
+	if stats.HwTx.Bytes.Value != 12 || stats.HwRx.Bytes.Value != 32 || len(stats.ParseErrors) != 0 {
+		t.Errorf("tx %d, rx %d, errors %v", stats.HwTx.Bytes.Value, stats.HwRx.Bytes.Value, stats.ParseErrors)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sysClassInfiniband is where the kernel exposes RDMA devices
+const sysClassInfiniband = "/sys/class/infiniband"
+
+// devicePort is the state of a port of an RDMA device
+type devicePort struct {
+	Number    string
+	State     string
+	LinkLayer string
+	Rate      string
+}
+
+// deviceTopology is where a device sits on the host, read from sysfs
+type deviceTopology struct {
+	PCIAddress string
+	NumaNode   string
+	Netdevs    []string
+	Ports      []devicePort
+}
+
+// readSysfs reads a sysfs attribute, returning "" if it is missing
+func readSysfs(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// readTopology reads the PCI address, NUMA node, netdevs and ports of a device
+func readTopology(device string) deviceTopology {
+	dir := filepath.Join(sysClassInfiniband, device)
+	topo := deviceTopology{}
+
+	if target, err := filepath.EvalSymlinks(filepath.Join(dir, "device")); err == nil {
+		topo.PCIAddress = filepath.Base(target)
+	}
+	topo.NumaNode = readSysfs(filepath.Join(dir, "device", "numa_node"))
+
+	if entries, err := os.ReadDir(filepath.Join(dir, "device", "net")); err == nil {
+		for _, entry := range entries {
+			topo.Netdevs = append(topo.Netdevs, entry.Name())
+		}
+	}
+	if entries, err := os.ReadDir(filepath.Join(dir, "ports")); err == nil {
+		for _, entry := range entries {
+			portDir := filepath.Join(dir, "ports", entry.Name())
+			topo.Ports = append(topo.Ports, devicePort{
+				Number:    entry.Name(),
+				State:     readSysfs(filepath.Join(portDir, "state")),
+				LinkLayer: readSysfs(filepath.Join(portDir, "link_layer")),
+				Rate:      readSysfs(filepath.Join(portDir, "rate")),
+			})
+		}
+	}
+	return topo
+}
+
+// statusDevice is a device as shown on the status page
+type statusDevice struct {
+	Name       string
+	GUID       string
+	Topology   deviceTopology
+	LastScrape string
+	LastSample string
+	Error      string
+	TxRate     string
+	RxRate     string
+	TxPktRate  string
+	RxPktRate  string
+	Output     string
+}
+
+// statusData is rendered by statusTemplate
+type statusData struct {
+	Node         string
+	Version      string
+	VersionError string
+	MetricsPath  string
+	Now          string
+	Discovery    string
+	DiscoveryErr string
+	Devices      []statusDevice
+}
+
+// formatTime formats a time for the status page, or "never" if unset
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return fmt.Sprintf("%s (%s ago)", t.Format(time.RFC3339), time.Since(t).Round(time.Second))
+}
+
+// formatRate formats a per-second rate with a decimal unit prefix
+func formatRate(rate float64, ok bool, unit string) string {
+	if !ok {
+		return "n/a"
+	}
+	prefixes := []string{"", "k", "M", "G", "T"}
+	i := 0
+	for rate >= 1000 && i < len(prefixes)-1 {
+		rate /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.2f %s%s/s", rate, prefixes[i], unit)
+}
+
+// buildStatus collects what the exporter currently sees
+func buildStatus(collector *ErdmaCollector) statusData {
+	state, devices := collector.Snapshot()
+	discovery := collector.LastDiscovery()
+
+	data := statusData{
+		Node:        collector.NodeName(),
+		Version:     state.Version,
+		MetricsPath: *metricsPath,
+		Now:         time.Now().Format(time.RFC3339),
+		Discovery:   formatTime(discovery.Time),
+	}
+	if state.VersionErr != nil {
+		data.VersionError = state.VersionErr.Error()
+	}
+	if discovery.Err != nil {
+		data.DiscoveryErr = discovery.Err.Error()
+	}
+
+	for _, st := range devices {
+		d := statusDevice{
+			Name:       st.Device.Name,
+			GUID:       st.Device.GUID,
+			Topology:   readTopology(st.Device.Name),
+			LastScrape: formatTime(st.LastScrape),
+		}
+		if st.Err != nil {
+			d.Error = st.Err.Error()
+		}
+		if st.Last != nil {
+			d.LastSample = formatTime(st.Last.Time)
+			d.Output = st.Last.Stats.Output
+		}
+		rate := func(field func(*DeviceStats) StatValue, unit string) string {
+			r, ok := counterRate(st.Previous, st.Last, field)
+			return formatRate(r, ok, unit)
+		}
+		d.TxRate = rate(func(s *DeviceStats) StatValue { return s.HwTx.Bytes }, "B")
+		d.RxRate = rate(func(s *DeviceStats) StatValue { return s.HwRx.Bytes }, "B")
+		d.TxPktRate = rate(func(s *DeviceStats) StatValue { return s.HwTx.Packets }, "pkt")
+		d.RxPktRate = rate(func(s *DeviceStats) StatValue { return s.HwRx.Packets }, "pkt")
+		data.Devices = append(data.Devices, d)
+	}
+	return data
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<html>
+<head>
+<title>ERDMA Exporter</title>
+<meta http-equiv="refresh" content="30">
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+.error { color: #b00; }
+pre { background: #f4f4f4; padding: 8px; max-height: 20em; overflow: auto; }
+</style>
+</head>
+<body>
+<h1>ERDMA Exporter</h1>
+<p><a href="{{.MetricsPath}}">Metrics</a> · <a href="/readyz">Readiness</a> · <a href="/api/v1/devices">API</a></p>
+<table>
+<tr><th>Node</th><td>{{.Node}}</td></tr>
+<tr><th>Driver version</th><td>{{if .Version}}{{.Version}}{{else}}unknown{{end}}{{if .VersionError}} <span class="error">{{.VersionError}}</span>{{end}}</td></tr>
+<tr><th>Last discovery</th><td>{{.Discovery}}{{if .DiscoveryErr}} <span class="error">{{.DiscoveryErr}}</span>{{end}}</td></tr>
+<tr><th>Page generated</th><td>{{.Now}}</td></tr>
+</table>
+{{if not .Devices}}<p>No devices seen yet. Statistics are gathered when <a href="{{.MetricsPath}}">{{.MetricsPath}}</a> is scraped.</p>{{end}}
+{{range .Devices}}
+<h2>{{.Name}}</h2>
+<table>
+<tr><th>GUID</th><td>{{.GUID}}</td></tr>
+<tr><th>PCI address</th><td>{{.Topology.PCIAddress}}</td></tr>
+<tr><th>NUMA node</th><td>{{.Topology.NumaNode}}</td></tr>
+<tr><th>Netdevs</th><td>{{range .Topology.Netdevs}}{{.}} {{end}}</td></tr>
+<tr><th>Ports</th><td>{{range .Topology.Ports}}port {{.Number}}: {{.State}} {{.LinkLayer}} {{.Rate}}<br>{{end}}</td></tr>
+<tr><th>Last scrape</th><td>{{.LastScrape}}</td></tr>
+<tr><th>Last successful sample</th><td>{{.LastSample}}</td></tr>
+{{if .Error}}<tr><th>Error</th><td class="error">{{.Error}}</td></tr>{{end}}
+<tr><th>TX</th><td>{{.TxRate}}, {{.TxPktRate}}</td></tr>
+<tr><th>RX</th><td>{{.RxRate}}, {{.RxPktRate}}</td></tr>
+</table>
+<details><summary>Last eadm stat output</summary><pre>{{.Output}}</pre></details>
+{{end}}
+</body>
+</html>
+`))
+
+// statusHandler serves the live status page
+func statusHandler(collector *ErdmaCollector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := statusTemplate.Execute(w, buildStatus(collector)); err != nil {
+			slog.Error("Failed to render status page", "err", err)
+		}
+	})
+}
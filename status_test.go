@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFormatRate(t *testing.T) {
+	for _, tc := range []struct {
+		rate float64
+		ok   bool
+		unit string
+		want string
+	}{
+		{0, false, "B", "n/a"},
+		{0, true, "B", "0.00 B/s"},
+		{999, true, "pkt", "999.00 pkt/s"},
+		{1500, true, "pkt", "1.50 kpkt/s"},
+		{1.25e9, true, "B", "1.25 GB/s"},
+		// Beyond the largest prefix the value grows instead
+		{2e15, true, "B", "2000.00 TB/s"},
+	} {
+		if got := formatRate(tc.rate, tc.ok, tc.unit); got != tc.want {
+			t.Errorf("formatRate(%v, %v, %q) = %q, want %q", tc.rate, tc.ok, tc.unit, got, tc.want)
+		}
+	}
+	if got := formatTime(time.Time{}); got != "never" {
+		t.Errorf("formatTime(zero) = %q", got)
+	}
+}
+
+func TestCounterRate(t *testing.T) {
+	now := time.Now()
+	sample := func(at time.Time, stats map[string]uint64) *DeviceSample {
+		return &DeviceSample{Time: at, Stats: statsFromMap(stats)}
+	}
+	txBytes := func(s *DeviceStats) StatValue { return s.HwTx.Bytes }
+	for _, tc := range []struct {
+		name       string
+		prev, last *DeviceSample
+		want       float64
+		ok         bool
+	}{
+		{"rate", sample(now, map[string]uint64{"hw_tx_bytes_cnt": 100}), sample(now.Add(2*time.Second), map[string]uint64{"hw_tx_bytes_cnt": 300}), 100, true},
+		{"single sample", nil, sample(now, map[string]uint64{"hw_tx_bytes_cnt": 100}), 0, false},
+		{"reset", sample(now, map[string]uint64{"hw_tx_bytes_cnt": 300}), sample(now.Add(time.Second), map[string]uint64{"hw_tx_bytes_cnt": 5}), 0, false},
+		{"missing counter", sample(now, map[string]uint64{"hw_rx_bytes_cnt": 1}), sample(now.Add(time.Second), map[string]uint64{"hw_tx_bytes_cnt": 5}), 0, false},
+		{"same time", sample(now, map[string]uint64{"hw_tx_bytes_cnt": 1}), sample(now, map[string]uint64{"hw_tx_bytes_cnt": 5}), 0, false},
+	} {
+		if got, ok := counterRate(tc.prev, tc.last, txBytes); got != tc.want || ok != tc.ok {
+			t.Errorf("%s: rate %v, %v, want %v, %v", tc.name, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	captureLogs(t)
+	c, err := NewErdmaCollector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tx atomic.Int64
+	c.run = func(name string, args ...string) ([]byte, []byte, error) {
+		switch {
+		case name == "ibv_devices":
+			return []byte("erdma_0 0216:3eff:fe50:30b0\n"), nil, nil
+		case args[0] == "ver":
+			return []byte("Query kernel driver version: 0.2.41\n"), nil, nil
+		default:
+			// The counter grows between cycles, and a key to escape
+			out := fmt.Sprintf("hw_tx_bytes_cnt : %d\n<b>vendor_cnt</b> : 1\n", tx.Add(1000))
+			return []byte(out), nil, nil
+		}
+	}
+	c.nodeName = "node-1"
+	handler := statusHandler(c)
+	page := func(path string) (int, string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code, w.Body.String()
+	}
+
+	if code, body := page("/"); code != http.StatusOK || !strings.Contains(body, "No devices seen yet") || !strings.Contains(body, "<td>node-1</td>") {
+		t.Errorf("before a scrape: status %d\n%s", code, body)
+	}
+	if code, _ := page("/favicon.ico"); code != http.StatusNotFound {
+		t.Errorf("status %d for another path, want 404", code)
+	}
+
+	c.Refresh(0)
+	time.Sleep(10 * time.Millisecond)
+	c.Refresh(0)
+	code, body := page("/")
+	if code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	for _, want := range []string{
+		"<h2>erdma_0</h2>", "<td>0216:3eff:fe50:30b0</td>", "<td>0.2.41</td>",
+		// Tool output is escaped
+		"&lt;b&gt;vendor_cnt&lt;/b&gt; : 1",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("page does not contain %q\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "No devices seen yet") || strings.Contains(body, "<th>TX</th><td>n/a") {
+		t.Errorf("no device or TX rate after two cycles\n%s", body)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits of the server-sent events stream
+const (
+	streamDefaultInterval = 5 * time.Second
+	streamMaxClients      = 64
+)
+
+// streamCounter is a counter in a stream event. Rate is the per-second
+// increase since the previous event of the client, absent in the first
+// event and after a counter reset.
+type streamCounter struct {
+	Value uint64   `json:"value"`
+	Rate  *float64 `json:"rate,omitempty"`
+}
+
+// streamDevice is a device in a stream event
+type streamDevice struct {
+	Name     string                   `json:"name"`
+	Time     time.Time                `json:"time"`
+	Counters map[string]streamCounter `json:"counters"`
+	Error    string                   `json:"error,omitempty"`
+}
+
+// streamEvent is the data of a "sample" event
+type streamEvent struct {
+	apiResponse
+	Time    time.Time      `json:"time"`
+	Devices []streamDevice `json:"devices"`
+}
+
+// streamSub is a client of the stream. It receives a snapshot every
+// interval; a client that falls behind misses snapshots instead of
+// holding up the others.
+type streamSub struct {
+	interval time.Duration
+	next     time.Time
+	ch       chan []deviceState
+}
+
+// streamSampler runs collection cycles for all stream clients together,
+// so that N clients do not fork eadm N times as often. Clients due within
+// half the minimum interval of each other share a cycle, which bounds the
+// cycles to two per minimum interval however many clients there are. It
+// runs only while there are clients.
+type streamSampler struct {
+	collector   *ErdmaCollector
+	minInterval time.Duration
+	done        <-chan struct{}
+
+	mu      sync.Mutex
+	subs    map[*streamSub]bool
+	running bool
+	wake    chan struct{}
+}
+
+// newStreamSampler creates a sampler that stops when done is closed
+func newStreamSampler(collector *ErdmaCollector, minInterval time.Duration, done <-chan struct{}) *streamSampler {
+	return &streamSampler{
+		collector:   collector,
+		minInterval: minInterval,
+		done:        done,
+		subs:        map[*streamSub]bool{},
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// subscribe adds a client, starting the sampler if it is the first
+func (s *streamSampler) subscribe(interval time.Duration) (*streamSub, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.subs) >= streamMaxClients {
+		return nil, fmt.Errorf("too many stream clients (%d)", streamMaxClients)
+	}
+	sub := &streamSub{interval: interval, next: time.Now(), ch: make(chan []deviceState, 1)}
+	s.subs[sub] = true
+	if !s.running {
+		s.running = true
+		go s.run()
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return sub, nil
+}
+
+// unsubscribe removes a client
+func (s *streamSampler) unsubscribe(sub *streamSub) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subs, sub)
+}
+
+// due returns the clients whose next sample is due and when the next
+// client after them is due. It stops the sampler if there are no clients.
+func (s *streamSampler) due(now time.Time) ([]*streamSub, time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.subs) == 0 {
+		s.running = false
+		return nil, time.Time{}, false
+	}
+	var due []*streamSub
+	var next time.Time
+	for sub := range s.subs {
+		if !now.Add(s.minInterval / 2).Before(sub.next) {
+			due = append(due, sub)
+			// Stay on the client's schedule unless a cycle overran it
+			sub.next = sub.next.Add(sub.interval)
+			if sub.next.Before(now) {
+				sub.next = now.Add(sub.interval)
+			}
+		}
+		if next.IsZero() || sub.next.Before(next) {
+			next = sub.next
+		}
+	}
+	return due, next, true
+}
+
+// run samples for the due clients until there are none left
+func (s *streamSampler) run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.done:
+			s.mu.Lock()
+			s.running = false
+			s.mu.Unlock()
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+		due, next, ok := s.due(time.Now())
+		if !ok {
+			return
+		}
+		if len(due) > 0 {
+			_, devices := s.collector.Refresh(s.minInterval / 2)
+			for _, sub := range due {
+				// Replace a snapshot the client has not read yet
+				select {
+				case <-sub.ch:
+				default:
+				}
+				sub.ch <- devices
+			}
+		}
+		timer.Stop()
+		select {
+		case <-timer.C:
+		default:
+		}
+		timer.Reset(time.Until(next))
+	}
+}
+
+// streamHandler serves /api/v1/stream, which pushes samples of the selected
+// devices and counters as server-sent events. Query parameters:
+//
+//	interval  time between events, at least the server minimum
+//	device    device names, comma-separated or repeated; all if absent
+//	counter   eadm stat keys, comma-separated or repeated; all if absent
+//
+// Names of devices and counters may end in * to select a prefix.
+type streamHandler struct {
+	collector   *ErdmaCollector
+	sampler     *streamSampler
+	minInterval time.Duration
+	done        <-chan struct{}
+}
+
+// newStreamHandler creates the stream of collector. Streams end when ctx
+// is done, so that they do not hold up a graceful shutdown.
+func newStreamHandler(ctx context.Context, collector *ErdmaCollector, minInterval time.Duration) *streamHandler {
+	return &streamHandler{
+		collector:   collector,
+		sampler:     newStreamSampler(collector, minInterval, ctx.Done()),
+		minInterval: minInterval,
+		done:        ctx.Done(),
+	}
+}
+
+// queryList returns the comma-separated or repeated values of a parameter
+func queryList(values []string) []string {
+	var list []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// matchPattern reports whether a device or counter name is selected by
+// patterns, which are names or prefixes followed by *
+func matchPattern(patterns []string, key string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok && strings.HasPrefix(key, prefix) || p == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *streamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	base := apiResponse{Node: h.collector.NodeName()}
+	interval := streamDefaultInterval
+	if v := query.Get("interval"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			base.Error = fmt.Sprintf("invalid interval %q", v)
+			writeJSONStatus(w, http.StatusBadRequest, base)
+			return
+		}
+		interval = d
+	}
+	interval = max(interval, h.minInterval)
+	devices := queryList(query["device"])
+	counters := queryList(query["counter"])
+
+	sub, err := h.sampler.subscribe(interval)
+	if err != nil {
+		base.Error = err.Error()
+		writeJSONStatus(w, http.StatusServiceUnavailable, base)
+		return
+	}
+	defer h.sampler.unsubscribe(sub)
+
+	// Events go on for longer than the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		slog.Debug("Cannot clear write deadline of stream", "err", err)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", interval.Milliseconds())
+	rc.Flush()
+
+	// Previous sample sent per device, for rates
+	prev := map[string]*DeviceSample{}
+	for {
+		var snapshot []deviceState
+		select {
+		case <-r.Context().Done():
+			return
+		case <-h.done:
+			return
+		case snapshot = <-sub.ch:
+		}
+
+		state, _ := h.collector.Snapshot()
+		event := streamEvent{apiResponse: base, Time: time.Now(), Devices: []streamDevice{}}
+		event.DriverVersion = state.Version
+		for _, st := range snapshot {
+			if len(devices) > 0 && !matchPattern(devices, st.Device.Name) {
+				continue
+			}
+			d := streamDevice{Name: st.Device.Name, Counters: map[string]streamCounter{}}
+			if st.Err != nil {
+				d.Error = st.Err.Error()
+			}
+			if st.Last != nil {
+				d.Time = st.Last.Time
+				last := prev[st.Device.Name]
+				seconds := 0.0
+				if last != nil {
+					seconds = st.Last.Time.Sub(last.Time).Seconds()
+				}
+				keys := make([]string, 0, len(st.Last.Stats.Raw))
+				for key := range st.Last.Stats.Raw {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+				for _, key := range keys {
+					if !matchPattern(counters, key) {
+						continue
+					}
+					value := st.Last.Stats.Raw[key]
+					c := streamCounter{Value: value}
+					if last != nil && seconds > 0 {
+						if before, ok := last.Stats.Raw[key]; ok && value >= before {
+							rate := float64(value-before) / seconds
+							c.Rate = &rate
+						}
+					}
+					d.Counters[key] = c
+				}
+				prev[st.Device.Name] = st.Last
+			}
+			event.Devices = append(event.Devices, d)
+		}
+
+		data, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+		if _, err := fmt.Fprintf(w, "event: sample\ndata: %s\n\n", data); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryList(t *testing.T) {
+	got := queryList([]string{"erdma_0, erdma_1", "", "erdma_2,,"})
+	if want := []string{"erdma_0", "erdma_1", "erdma_2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("queryList = %q, want %q", got, want)
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	patterns := []string{"hw_tx_*", "listen_ipv6_cnt"}
+	for key, want := range map[string]bool{
+		"hw_tx_bytes_cnt":   true,
+		"hw_tx_packets_cnt": true,
+		"listen_ipv6_cnt":   true,
+		"listen_ipv6_cnt2":  false,
+		"hw_rx_bytes_cnt":   false,
+	} {
+		if got := matchPattern(patterns, key); got != want {
+			t.Errorf("matchPattern(%q) = %v, want %v", key, got, want)
+		}
+	}
+	if !matchPattern(nil, "anything") {
+		t.Error("no patterns should select everything")
+	}
+}
+
+func TestStreamClientCap(t *testing.T) {
+	c, _ := newAPITestCollector(t, false)
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	s := newStreamSampler(c, time.Hour, done)
+
+	var subs []*streamSub
+	for i := 0; i < streamMaxClients; i++ {
+		sub, err := s.subscribe(time.Hour)
+		if err != nil {
+			t.Fatalf("client %d: %v", i+1, err)
+		}
+		subs = append(subs, sub)
+	}
+	if _, err := s.subscribe(time.Hour); err == nil {
+		t.Fatal("client over the cap subscribed")
+	}
+
+	// The handler turns the cap into 503
+	h := &streamHandler{collector: c, sampler: s, minInterval: time.Second, done: done}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/stream", nil))
+	var resp apiResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(resp.Error, "too many stream clients") {
+		t.Errorf("status %d, error %q", w.Code, resp.Error)
+	}
+
+	// A client leaving makes room for another
+	s.unsubscribe(subs[0])
+	if _, err := s.subscribe(time.Hour); err != nil {
+		t.Errorf("subscribe after a client left: %v", err)
+	}
+}
+
+// readEvent reads the next server-sent event and returns its fields
+func readEvent(t *testing.T, r *bufio.Reader) map[string]string {
+	t.Helper()
+	fields := map[string]string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return fields
+		}
+		name, value, _ := strings.Cut(line, ": ")
+		fields[name] = value
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	c, tx := newAPITestCollector(t, false)
+	tx.Store(100)
+	// Every cycle sees a higher counter
+	c.run = func(run func(string, ...string) ([]byte, []byte, error)) func(string, ...string) ([]byte, []byte, error) {
+		return func(name string, args ...string) ([]byte, []byte, error) {
+			if name != "ibv_devices" && args[0] != "ver" {
+				tx.Add(10)
+			}
+			return run(name, args...)
+		}
+	}(c.run)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := httptest.NewServer(newStreamHandler(ctx, c, 10*time.Millisecond))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/v1/stream?interval=20ms&device=erdma_*&counter=hw_tx_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	r := bufio.NewReader(resp.Body)
+	if retry := readEvent(t, r)["retry"]; retry != "20" {
+		t.Errorf("retry %q, want 20", retry)
+	}
+
+	var rated bool
+	for i := 0; i < 5 && !rated; i++ {
+		fields := readEvent(t, r)
+		if fields["event"] != "sample" {
+			t.Fatalf("event %q", fields["event"])
+		}
+		var event streamEvent
+		if err := json.Unmarshal([]byte(fields["data"]), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Node != "node-1" || event.DriverVersion != "0.2.41" || len(event.Devices) != 1 || event.Devices[0].Name != "erdma_0" {
+			t.Fatalf("event %+v", event)
+		}
+		counters := event.Devices[0].Counters
+		// Only the selected counters are sent
+		if _, ok := counters["hw_rx_bytes_cnt"]; ok || len(counters) != 1 {
+			t.Fatalf("counters %+v", counters)
+		}
+		counter := counters["hw_tx_bytes_cnt"]
+		if i == 0 && counter.Rate != nil {
+			t.Errorf("first event has a rate %v", *counter.Rate)
+		}
+		if counter.Rate != nil {
+			rated = *counter.Rate > 0
+		}
+	}
+	if !rated {
+		t.Error("no event with a rate")
+	}
+
+	// Streams end on shutdown
+	cancel()
+	if _, err := io.ReadAll(r); err != nil {
+		t.Errorf("stream did not end cleanly: %v", err)
+	}
+}
+
+func TestStreamInvalidInterval(t *testing.T) {
+	c, _ := newAPITestCollector(t, false)
+	for _, interval := range []string{"soon", "0s", "-1s"} {
+		w := httptest.NewRecorder()
+		newStreamHandler(context.Background(), c, time.Second).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/stream?interval="+interval, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("interval %s: status %d, want 400", interval, w.Code)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// sdNotify sends a state change to systemd if the exporter runs as a
+// Type=notify service. It is a no-op otherwise.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	// Abstract sockets are given with a leading @
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("Failed to connect to systemd notify socket", "err", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		slog.Warn("Failed to notify systemd", "state", state, "err", err)
+	}
+}
+
+// sdReadyTimeout is how long startup waits for a successful collection cycle
+// before reporting readiness anyway. It stays below the default
+// TimeoutStartSec of 90s, so that a node whose devices are not up yet is
+// not failed by systemd.
+const sdReadyTimeout = time.Minute
+
+// sdReadyRetry is how long to wait after a failed cycle before the next one
+const sdReadyRetry = 5 * time.Second
+
+// notifyReady sends READY=1 to systemd once a collection cycle discovered
+// the devices, so that units ordered after the exporter start with metrics
+// available. It retries failed cycles and reports readiness anyway after
+// timeout, with a status that says so.
+func notifyReady(collector *ErdmaCollector, status string, timeout, retry time.Duration, done <-chan struct{}) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	timedOut := func() {
+		slog.Warn("No collection cycle succeeded during startup, notifying systemd anyway", "timeout", timeout)
+		sdNotify("READY=1\nSTATUS=" + status + ", no collection cycle succeeded yet")
+	}
+	for {
+		// A hanging tool must not hold up the notification past the
+		// deadline. A cycle a scrape just ran counts, a failed one from
+		// before the retry does not.
+		cycle := make(chan error, 1)
+		go func() {
+			state, _ := collector.Refresh(retry / 2)
+			cycle <- state.CycleErr
+		}()
+		select {
+		case err := <-cycle:
+			if err == nil {
+				sdNotify("READY=1\nSTATUS=" + status)
+				return
+			}
+			slog.Warn("Collection cycle failed during startup, not notifying systemd yet", "err", err)
+		case <-deadline.C:
+			timedOut()
+			return
+		case <-done:
+			return
+		}
+
+		select {
+		case <-time.After(retry):
+		case <-deadline.C:
+			timedOut()
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// sdWatchdogInterval returns the watchdog timeout systemd expects pings
+// within, or 0 if the watchdog is not enabled for this process
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runWatchdog pings the systemd watchdog while collection cycles succeed.
+// If no scrape has run a cycle recently, it runs one itself, so that a
+// hanging eadm or a node without devices makes systemd restart the service.
+func runWatchdog(collector *ErdmaCollector, timeout time.Duration, done <-chan struct{}) {
+	interval := timeout / 2
+	slog.Info("systemd watchdog enabled", "timeout", timeout)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		state, _ := collector.Refresh(interval)
+		if state.CycleErr != nil {
+			slog.Warn("Not pinging systemd watchdog, last collection cycle failed", "err", state.CycleErr)
+			continue
+		}
+		sdNotify("WATCHDOG=1")
+	}
+}
+
+// sdListenFdsStart is the first file descriptor passed by socket activation
+const sdListenFdsStart = 3
+
+// systemdListeners returns the sockets passed by systemd socket activation
+func systemdListeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, fmt.Errorf("no sockets passed by systemd (LISTEN_PID is not this process)")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("no sockets passed by systemd (LISTEN_FDS=%q)", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(sdListenFdsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(sdListenFdsStart+i), name)
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %s: %w", name, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	// Do not pass the sockets on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	return listeners, nil
+}
+
+// systemdUnitOptions are substituted into the unit file templates
+type systemdUnitOptions struct {
+	Binary     string
+	Args       string
+	Socket     bool
+	ListenPort string
+	Watchdog   time.Duration
+}
+
+var systemdServiceTemplate = template.Must(template.New("service").Parse(`[Unit]
+Description=ERDMA Prometheus exporter
+Documentation=https://github.com/shaowenchen/erdma-exporter
+After=network-online.target
+Wants=network-online.target
+{{- if .Socket}}
+Requires=erdma-exporter.socket
+{{- end}}
+
+[Service]
+Type=notify
+ExecStart={{.Binary}}{{if .Socket}} --web.systemd-socket{{end}}{{if .Args}} {{.Args}}{{end}}
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=on-failure
+RestartSec=5s
+TimeoutStopSec=30s
+{{- if .Watchdog}}
+WatchdogSec={{.Watchdog.Seconds}}s
+{{- end}}
+
+# eadm and ibv_devices need the RDMA devices and sysfs; everything else is locked down
+NoNewPrivileges=yes
+ProtectSystem=strict
+ProtectHome=yes
+PrivateTmp=yes
+ProtectKernelTunables=yes
+ProtectKernelModules=yes
+ProtectKernelLogs=yes
+ProtectControlGroups=yes
+ProtectClock=yes
+ProtectHostname=yes
+RestrictAddressFamilies=AF_UNIX AF_INET AF_INET6 AF_NETLINK
+RestrictNamespaces=yes
+RestrictRealtime=yes
+RestrictSUIDSGID=yes
+LockPersonality=yes
+MemoryDenyWriteExecute=yes
+SystemCallArchitectures=native
+SystemCallFilter=@system-service
+RemoveIPC=yes
+UMask=0077
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+var systemdSocketTemplate = template.Must(template.New("socket").Parse(`[Unit]
+Description=ERDMA Prometheus exporter socket
+
+[Socket]
+ListenStream={{.ListenPort}}
+NoDelay=true
+
+[Install]
+WantedBy=sockets.target
+`))
+
+// runInstallSystemdCommand implements "erdma-exporter install-systemd",
+// which writes a hardened unit file for running the exporter under systemd
+func runInstallSystemdCommand(args []string) int {
+	fs := flag.NewFlagSet("install-systemd", flag.ContinueOnError)
+	dir := fs.String("dir", "/etc/systemd/system", "Directory to write the unit files to, or - to print them.")
+	binary := fs.String("binary", "", "Path of the exporter binary (default: this executable).")
+	extraArgs := fs.String("args", "", "Additional command-line arguments for the exporter.")
+	socket := fs.Bool("socket", false, "Also write a socket unit and use socket activation.")
+	listen := fs.String("listen", "9101", "Address of the socket unit, as accepted by ListenStream=.")
+	watchdog := fs.Duration("watchdog", 2*time.Minute, "Watchdog timeout; must exceed a collection cycle (0 disables).")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	opts := systemdUnitOptions{
+		Binary:     *binary,
+		Args:       *extraArgs,
+		Socket:     *socket,
+		ListenPort: *listen,
+		Watchdog:   *watchdog,
+	}
+	if opts.Binary == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "cannot determine the binary path, use --binary:", err)
+			return 1
+		}
+		opts.Binary = exe
+	}
+
+	type unit struct {
+		name string
+		tmpl *template.Template
+	}
+	units := []unit{{"erdma-exporter.service", systemdServiceTemplate}}
+	if opts.Socket {
+		units = append(units, unit{"erdma-exporter.socket", systemdSocketTemplate})
+	}
+
+	for _, unit := range units {
+		var b strings.Builder
+		if err := unit.tmpl.Execute(&b, opts); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if *dir == "-" {
+			fmt.Printf("# %s\n%s\n", unit.name, b.String())
+			continue
+		}
+		path := filepath.Join(*dir, unit.name)
+		if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println("Wrote", path)
+	}
+
+	if *dir != "-" {
+		enable := "erdma-exporter.service"
+		if opts.Socket {
+			enable = "erdma-exporter.socket erdma-exporter.service"
+		}
+		fmt.Printf("Run: systemctl daemon-reload && systemctl enable --now %s\n", enable)
+	}
+	return 0
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listenNotifySocket points NOTIFY_SOCKET to a socket the test reads from
+func listenNotifySocket(t *testing.T) *net.UnixConn {
+	t.Helper()
+	// Socket paths are limited to about 100 bytes, t.TempDir() may be longer
+	dir, err := os.MkdirTemp("", "sd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+// readNotify returns the next message sent to the notify socket, or "" if
+// there is none
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
+
+// newDiscoveryCollector returns a collector whose device discovery fails
+// until failures calls to ibv_devices have been made, or forever if
+// failures is negative, and the counter of those calls
+func newDiscoveryCollector(t *testing.T, failures int32) (*ErdmaCollector, *atomic.Int32) {
+	t.Helper()
+	c, err := NewErdmaCollector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls atomic.Int32
+	c.run = func(name string, args ...string) ([]byte, []byte, error) {
+		switch {
+		case name == "ibv_devices":
+			if n := calls.Add(1); failures < 0 || n <= failures {
+				return nil, []byte("no devices"), errors.New("exit status 1")
+			}
+			return []byte("erdma_0 0216:3eff:fe50:30b0\n"), nil, nil
+		case args[0] == "ver":
+			return []byte("Query kernel driver version: 0.2.41\n"), nil, nil
+		default:
+			return []byte("hw_tx_bytes_cnt : 1\n"), nil, nil
+		}
+	}
+	c.nodeName = "node-1"
+	return c, &calls
+}
+
+func TestNotifyReadyAfterCycle(t *testing.T) {
+	captureLogs(t)
+	conn := listenNotifySocket(t)
+	c, calls := newDiscoveryCollector(t, 2)
+
+	notifyReady(c, "Serving on [::]:9101", 10*time.Second, 10*time.Millisecond, nil)
+	if got := calls.Load(); got != 3 {
+		t.Errorf("discovery ran %d times, want 3", got)
+	}
+	if got, want := readNotify(t, conn), "READY=1\nSTATUS=Serving on [::]:9101"; got != want {
+		t.Errorf("notified %q, want %q", got, want)
+	}
+	if got := readNotify(t, conn); got != "" {
+		t.Errorf("notified again: %q", got)
+	}
+}
+
+func TestNotifyReadyTimeout(t *testing.T) {
+	logs := captureLogs(t)
+	conn := listenNotifySocket(t)
+	c, calls := newDiscoveryCollector(t, -1)
+
+	notifyReady(c, "Serving on [::]:9101", 100*time.Millisecond, 10*time.Millisecond, nil)
+	if got := calls.Load(); got < 2 {
+		t.Errorf("discovery ran %d times, want retries", got)
+	}
+	if got := readNotify(t, conn); !strings.HasPrefix(got, "READY=1\n") || !strings.Contains(got, "no collection cycle succeeded yet") {
+		t.Errorf("notified %q, want readiness with a failure status", got)
+	}
+	if !strings.Contains(logs.String(), "notifying systemd anyway") {
+		t.Errorf("timeout not logged:\n%s", logs)
+	}
+}
+
+// TestNotifyReadyHangingTool checks that a tool that hangs does not hold up
+// the notification past the timeout
+func TestNotifyReadyHangingTool(t *testing.T) {
+	captureLogs(t)
+	conn := listenNotifySocket(t)
+	c, _ := newDiscoveryCollector(t, 0)
+	release := make(chan struct{})
+	defer close(release)
+	c.run = func(name string, args ...string) ([]byte, []byte, error) {
+		<-release
+		return nil, nil, errors.New("killed")
+	}
+
+	start := time.Now()
+	notifyReady(c, "Serving", 100*time.Millisecond, 10*time.Millisecond, nil)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("notified after %s", elapsed)
+	}
+	if got := readNotify(t, conn); !strings.Contains(got, "READY=1") {
+		t.Errorf("notified %q, want readiness", got)
+	}
+}
+
+func TestNotifyReadyWithoutSystemd(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	c, calls := newDiscoveryCollector(t, 0)
+	notifyReady(c, "Serving", time.Second, 10*time.Millisecond, nil)
+	if got := calls.Load(); got != 0 {
+		t.Errorf("discovery ran %d times without systemd", got)
+	}
+}
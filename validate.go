@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// statRule is an invariant that must hold between eadm statistics.
+// A rule holds when the sum of the Lower keys is at most the sum of the Upper keys.
+type statRule struct {
+	Name  string
+	Lower []string
+	Upper []string
+}
+
+// statRules is the built-in rule set evaluated after every getDeviceStats call
+var statRules = []statRule{
+	{Name: "connect_outcomes_le_total", Lower: []string{"connect_success_cnt", "connect_failed_cnt"}, Upper: []string{"connect_total_cnt"}},
+	{Name: "accept_outcomes_le_total", Lower: []string{"accept_success_cnt", "accept_failed_cnt"}, Upper: []string{"accept_total_cnt"}},
+	{Name: "cmdq_completed_le_submitted", Lower: []string{"cmdq_comp_cnt"}, Upper: []string{"cmdq_submitted_cnt"}},
+	{Name: "verbs_destroy_cq_le_create", Lower: []string{"verbs_destroy_cq_cnt"}, Upper: []string{"verbs_create_cq_cnt"}},
+	{Name: "verbs_destroy_qp_le_create", Lower: []string{"verbs_destroy_qp_cnt"}, Upper: []string{"verbs_create_qp_cnt"}},
+	{Name: "verbs_dealloc_pd_le_alloc", Lower: []string{"verbs_dealloc_pd_cnt"}, Upper: []string{"verbs_alloc_pd_cnt"}},
+	{Name: "verbs_dealloc_uctx_le_alloc", Lower: []string{"verbs_dealloc_uctx_cnt"}, Upper: []string{"verbs_alloc_uctx_cnt"}},
+	{Name: "verbs_dereg_mr_le_reg", Lower: []string{"verbs_dereg_mr_cnt"}, Upper: []string{"verbs_alloc_mr_cnt", "verbs_get_dma_mr_cnt", "verbs_reg_usr_mr_cnt"}},
+}
+
+// sumStats sums the given keys, reporting false if any key is missing
+func sumStats(stats *DeviceStats, keys []string) (uint64, bool) {
+	var sum uint64
+	for _, key := range keys {
+		val, ok := stats.Get(key)
+		if !ok {
+			return 0, false
+		}
+		sum += val
+	}
+	return sum, true
+}
+
+// check evaluates the rule, returning a description of the violation if it does not hold.
+// Rules whose keys are not all present are skipped.
+func (r statRule) check(stats *DeviceStats) (string, bool) {
+	lower, ok := sumStats(stats, r.Lower)
+	if !ok {
+		return "", false
+	}
+	upper, ok := sumStats(stats, r.Upper)
+	if !ok {
+		return "", false
+	}
+	if lower <= upper {
+		return "", false
+	}
+	return fmt.Sprintf("%v=%d exceeds %v=%d", r.Lower, lower, r.Upper, upper), true
+}
+
+// StatValidator checks device statistics against statRules
+type StatValidator struct {
+	violations *prometheus.CounterVec
+
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+// NewStatValidator creates a new statistics validator
+func NewStatValidator() *StatValidator {
+	return &StatValidator{
+		violations: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "stat",
+				Name:      "invariant_violations_total",
+				Help:      "Total number of times a device statistics invariant was found violated",
+			},
+			[]string{"device", "rule"},
+		),
+		active: make(map[string]bool),
+	}
+}
+
+// Validate evaluates all rules against the statistics of a device.
+// A violation is counted and logged when it first appears; it is counted
+// again only after the rule has held in between.
+func (v *StatValidator) Validate(device string, stats *DeviceStats) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for _, rule := range statRules {
+		key := device + "/" + rule.Name
+		detail, violated := rule.check(stats)
+		if !violated {
+			delete(v.active, key)
+			continue
+		}
+		if v.active[key] {
+			continue
+		}
+		v.active[key] = true
+		v.violations.WithLabelValues(device, rule.Name).Inc()
+		slog.Warn("Stat invariant violated", "device", device, "rule", rule.Name, "detail", detail)
+	}
+}
+
+// Describe implements prometheus.Collector
+func (v *StatValidator) Describe(ch chan<- *prometheus.Desc) {
+	v.violations.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (v *StatValidator) Collect(ch chan<- prometheus.Metric) {
+	v.violations.Collect(ch)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// captureLogs sends the default logger to a buffer for the rest of the test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return &buf
+}
+
+// counterValue returns the value of a counter
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// statsFromMap creates device statistics holding the given counters
+func statsFromMap(raw map[string]uint64) *DeviceStats {
+	stats := newDeviceStats()
+	for key, val := range raw {
+		stats.set(key, val)
+	}
+	return stats
+}
+
+func TestStatRules(t *testing.T) {
+	for _, tc := range []struct {
+		rule     string
+		holds    map[string]uint64
+		violated map[string]uint64
+	}{
+		{"connect_outcomes_le_total",
+			map[string]uint64{"connect_success_cnt": 18, "connect_failed_cnt": 2, "connect_total_cnt": 20},
+			map[string]uint64{"connect_success_cnt": 18, "connect_failed_cnt": 3, "connect_total_cnt": 20}},
+		{"accept_outcomes_le_total",
+			map[string]uint64{"accept_success_cnt": 5, "accept_failed_cnt": 0, "accept_total_cnt": 6},
+			map[string]uint64{"accept_success_cnt": 5, "accept_failed_cnt": 2, "accept_total_cnt": 6}},
+		{"cmdq_completed_le_submitted",
+			map[string]uint64{"cmdq_comp_cnt": 500, "cmdq_submitted_cnt": 500},
+			map[string]uint64{"cmdq_comp_cnt": 501, "cmdq_submitted_cnt": 500}},
+		{"verbs_destroy_cq_le_create",
+			map[string]uint64{"verbs_destroy_cq_cnt": 3, "verbs_create_cq_cnt": 4},
+			map[string]uint64{"verbs_destroy_cq_cnt": 5, "verbs_create_cq_cnt": 4}},
+		{"verbs_destroy_qp_le_create",
+			map[string]uint64{"verbs_destroy_qp_cnt": 4, "verbs_create_qp_cnt": 4},
+			map[string]uint64{"verbs_destroy_qp_cnt": 5, "verbs_create_qp_cnt": 4}},
+		{"verbs_dealloc_pd_le_alloc",
+			map[string]uint64{"verbs_dealloc_pd_cnt": 0, "verbs_alloc_pd_cnt": 0},
+			map[string]uint64{"verbs_dealloc_pd_cnt": 1, "verbs_alloc_pd_cnt": 0}},
+		{"verbs_dealloc_uctx_le_alloc",
+			map[string]uint64{"verbs_dealloc_uctx_cnt": 1, "verbs_alloc_uctx_cnt": 2},
+			map[string]uint64{"verbs_dealloc_uctx_cnt": 3, "verbs_alloc_uctx_cnt": 2}},
+		{"verbs_dereg_mr_le_reg",
+			map[string]uint64{"verbs_dereg_mr_cnt": 6, "verbs_alloc_mr_cnt": 1, "verbs_get_dma_mr_cnt": 2, "verbs_reg_usr_mr_cnt": 3},
+			map[string]uint64{"verbs_dereg_mr_cnt": 7, "verbs_alloc_mr_cnt": 1, "verbs_get_dma_mr_cnt": 2, "verbs_reg_usr_mr_cnt": 3}},
+	} {
+		t.Run(tc.rule, func(t *testing.T) {
+			var rule *statRule
+			for i := range statRules {
+				if statRules[i].Name == tc.rule {
+					rule = &statRules[i]
+				}
+			}
+			if rule == nil {
+				t.Fatalf("no rule %s", tc.rule)
+			}
+			if detail, violated := rule.check(statsFromMap(tc.holds)); violated {
+				t.Errorf("violated by %v: %s", tc.holds, detail)
+			}
+			if _, violated := rule.check(statsFromMap(tc.violated)); !violated {
+				t.Errorf("not violated by %v", tc.violated)
+			}
+			// A rule with a missing counter is skipped
+			for key := range tc.violated {
+				partial := statsFromMap(tc.violated)
+				delete(partial.Raw, key)
+				if _, violated := rule.check(partial); violated {
+					t.Errorf("violated without %s", key)
+				}
+			}
+		})
+	}
+	if len(statRules) != 8 {
+		t.Errorf("%d rules, the test covers 8", len(statRules))
+	}
+}
+
+// TestStatValidatorTransitions checks that a violation is counted and logged
+// once when it appears, and again only after the rule has held in between
+func TestStatValidatorTransitions(t *testing.T) {
+	logs := captureLogs(t)
+	v := NewStatValidator()
+	ok := statsFromMap(map[string]uint64{"cmdq_comp_cnt": 10, "cmdq_submitted_cnt": 10})
+	bad := statsFromMap(map[string]uint64{"cmdq_comp_cnt": 11, "cmdq_submitted_cnt": 10})
+
+	for i, step := range []struct {
+		stats *DeviceStats
+		count float64
+		logs  int
+	}{
+		{ok, 0, 0},
+		{bad, 1, 1},
+		{bad, 1, 1},
+		{bad, 1, 1},
+		{ok, 1, 1},
+		{bad, 2, 2},
+		{bad, 2, 2},
+	} {
+		v.Validate("erdma_0", step.stats)
+		if got := counterValue(t, v.violations.WithLabelValues("erdma_0", "cmdq_completed_le_submitted")); got != step.count {
+			t.Errorf("step %d: count = %v, want %v", i, got, step.count)
+		}
+		if got := strings.Count(logs.String(), "Stat invariant violated"); got != step.logs {
+			t.Errorf("step %d: logged %d times, want %d", i, got, step.logs)
+		}
+	}
+
+	// Devices are tracked separately
+	v.Validate("erdma_1", bad)
+	if got := counterValue(t, v.violations.WithLabelValues("erdma_1", "cmdq_completed_le_submitted")); got != 1 {
+		t.Errorf("erdma_1 count = %v, want 1", got)
+	}
+	if !strings.Contains(logs.String(), "device=erdma_1") {
+		t.Errorf("violation of erdma_1 not logged:\n%s", logs)
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webConfigCheckInterval bounds how often the web config and the files it
+// references are checked for changes
+const webConfigCheckInterval = time.Second
+
+// webConfigDummyHash is compared against for unknown users, so that
+// response times do not reveal which users exist
+const webConfigDummyHash = "$2y$10$L0WFP7gspWE6mlTdwT.J2.OaMDXHjWVBBWpBWt1z4Z3nrB9zWvdNe"
+
+// webConfigProbePaths are served without basic auth, so that the kubelet
+// probes of the DaemonSet keep working when basic_auth_users is set. They
+// reveal no more than whether the exporter is up and sees ERDMA devices.
+var webConfigProbePaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// webConfigAllowedHeaders are the response headers http_server_config may set
+var webConfigAllowedHeaders = []string{
+	"Strict-Transport-Security",
+	"X-Content-Type-Options",
+	"X-Frame-Options",
+	"X-XSS-Protection",
+	"Content-Security-Policy",
+}
+
+// webConfig is the web configuration file, in the format of the
+// Prometheus exporter-toolkit
+type webConfig struct {
+	TLSServerConfig  *tlsServerConfig  `json:"tls_server_config"`
+	HTTPServerConfig httpServerConfig  `json:"http_server_config"`
+	BasicAuthUsers   map[string]string `json:"basic_auth_users"`
+}
+
+// tlsServerConfig configures TLS and client certificate verification
+type tlsServerConfig struct {
+	Certificate       string   `json:"cert"`
+	CertFile          string   `json:"cert_file"`
+	Key               string   `json:"key"`
+	KeyFile           string   `json:"key_file"`
+	ClientAuth        string   `json:"client_auth_type"`
+	ClientCAs         string   `json:"client_ca"`
+	ClientCAFile      string   `json:"client_ca_file"`
+	ClientAllowedSans []string `json:"client_allowed_sans"`
+	CipherSuites      []string `json:"cipher_suites"`
+	CurvePreferences  []string `json:"curve_preferences"`
+	MinVersion        string   `json:"min_version"`
+	MaxVersion        string   `json:"max_version"`
+	// PreferServerCipherSuites is accepted for compatibility; Go ignores it
+	PreferServerCipherSuites bool `json:"prefer_server_cipher_suites"`
+}
+
+// httpServerConfig configures the HTTP server
+type httpServerConfig struct {
+	HTTP2   *bool             `json:"http2"`
+	Headers map[string]string `json:"headers"`
+}
+
+// loadWebConfig reads and validates a web config file. Relative paths in
+// the file are resolved against its directory.
+func loadWebConfig(path string) (*webConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &webConfig{}
+	if err := decodeYAML(data, config); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	dir := filepath.Dir(path)
+	if tc := config.TLSServerConfig; tc != nil {
+		for _, p := range []*string{&tc.CertFile, &tc.KeyFile, &tc.ClientCAFile} {
+			if *p != "" && !filepath.IsAbs(*p) {
+				*p = filepath.Join(dir, *p)
+			}
+		}
+	}
+
+	for user, hash := range config.BasicAuthUsers {
+		if _, err := parseBcryptHash(hash); err != nil {
+			return nil, fmt.Errorf("basic auth user %q: %w", user, err)
+		}
+	}
+	for name := range config.HTTPServerConfig.Headers {
+		allowed := false
+		for _, h := range webConfigAllowedHeaders {
+			if http.CanonicalHeaderKey(name) == h {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return nil, fmt.Errorf("header %q may not be set, allowed headers are %s", name, strings.Join(webConfigAllowedHeaders, ", "))
+		}
+	}
+	return config, nil
+}
+
+// files returns the files whose changes require a reload
+func (c *webConfig) files() []string {
+	tc := c.TLSServerConfig
+	if tc == nil {
+		return nil
+	}
+	var files []string
+	for _, f := range []string{tc.CertFile, tc.KeyFile, tc.ClientCAFile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// http2 reports whether HTTP/2 is enabled, which it is by default
+func (c *webConfig) http2() bool {
+	return c.HTTPServerConfig.HTTP2 == nil || *c.HTTPServerConfig.HTTP2
+}
+
+// tlsVersions maps config names to TLS versions
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// tlsCurves maps config names to elliptic curves
+var tlsCurves = map[string]tls.CurveID{
+	"CurveP256": tls.CurveP256,
+	"CurveP384": tls.CurveP384,
+	"CurveP521": tls.CurveP521,
+	"X25519":    tls.X25519,
+}
+
+// tlsClientAuthTypes maps config names to client authentication policies
+var tlsClientAuthTypes = map[string]tls.ClientAuthType{
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// tlsConfig builds the server TLS configuration, reading the certificate,
+// key and client CA from disk
+func (c *webConfig) tlsConfig() (*tls.Config, error) {
+	tc := c.TLSServerConfig
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	certPEM, err := inlineOrFile("cert", tc.Certificate, tc.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := inlineOrFile("key", tc.Key, tc.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if certPEM == nil || keyPEM == nil {
+		return nil, errors.New("tls_server_config requires a certificate and a key")
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate: %w", err)
+	}
+	cfg.Certificates = []tls.Certificate{cert}
+
+	if tc.MinVersion != "" {
+		v, ok := tlsVersions[tc.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", tc.MinVersion)
+		}
+		cfg.MinVersion = v
+	}
+	if tc.MaxVersion != "" {
+		v, ok := tlsVersions[tc.MaxVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", tc.MaxVersion)
+		}
+		cfg.MaxVersion = v
+	}
+
+	for _, name := range tc.CipherSuites {
+		found := false
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name == name {
+				cfg.CipherSuites = append(cfg.CipherSuites, suite.ID)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+	}
+	for _, name := range tc.CurvePreferences {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q", name)
+		}
+		cfg.CurvePreferences = append(cfg.CurvePreferences, curve)
+	}
+
+	if tc.ClientAuth != "" {
+		auth, ok := tlsClientAuthTypes[tc.ClientAuth]
+		if !ok {
+			return nil, fmt.Errorf("unknown client_auth_type %q", tc.ClientAuth)
+		}
+		cfg.ClientAuth = auth
+	}
+	caPEM, err := inlineOrFile("client_ca", tc.ClientCAs, tc.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	if caPEM != nil {
+		if cfg.ClientAuth == tls.NoClientCert {
+			return nil, errors.New("client CA configured without a verifying client_auth_type")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("no certificates found in client CA")
+		}
+		cfg.ClientCAs = pool
+	}
+	verifies := cfg.ClientAuth == tls.VerifyClientCertIfGiven || cfg.ClientAuth == tls.RequireAndVerifyClientCert
+	if verifies && cfg.ClientCAs == nil {
+		return nil, fmt.Errorf("client_auth_type %s requires a client CA", tc.ClientAuth)
+	}
+	if len(tc.ClientAllowedSans) > 0 {
+		if !verifies {
+			return nil, errors.New("client_allowed_sans requires a verifying client_auth_type")
+		}
+		cfg.VerifyPeerCertificate = verifyClientSANs(tc.ClientAllowedSans)
+	}
+
+	cfg.NextProtos = []string{"http/1.1"}
+	if c.http2() {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+	return cfg, nil
+}
+
+// inlineOrFile returns the inline value or the content of the file,
+// whichever is set, or nil if neither is
+func inlineOrFile(name, inline, file string) ([]byte, error) {
+	switch {
+	case inline != "" && file != "":
+		return nil, fmt.Errorf("%s and %s_file are mutually exclusive", name, name)
+	case inline != "":
+		return []byte(inline), nil
+	case file != "":
+		return os.ReadFile(file)
+	}
+	return nil, nil
+}
+
+// verifyClientSANs accepts a client certificate only if one of its subject
+// alternative names is in allowed
+func verifyClientSANs(allowed []string) func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, chains [][]*x509.Certificate) error {
+		if len(chains) == 0 || len(chains[0]) == 0 {
+			return nil
+		}
+		cert := chains[0][0]
+		var sans []string
+		sans = append(sans, cert.DNSNames...)
+		sans = append(sans, cert.EmailAddresses...)
+		for _, ip := range cert.IPAddresses {
+			sans = append(sans, ip.String())
+		}
+		for _, uri := range cert.URIs {
+			sans = append(sans, uri.String())
+		}
+		for _, san := range sans {
+			for _, a := range allowed {
+				if san == a {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("client certificate SANs %v are not allowed", sans)
+	}
+}
+
+// webConfigLoader holds the web config and reloads it when the file or
+// the certificates it references change
+type webConfigLoader struct {
+	path string
+
+	mu        sync.Mutex
+	config    *webConfig
+	tls       *tls.Config
+	mtimes    map[string]time.Time
+	lastCheck time.Time
+
+	// authCache remembers recent basic auth outcomes, as bcrypt is slow
+	authMu    sync.Mutex
+	authCache map[[sha256.Size]byte]bool
+}
+
+// newWebConfigLoader loads the web config file, failing if it is invalid
+func newWebConfigLoader(path string) (*webConfigLoader, error) {
+	l := &webConfigLoader{path: path, authCache: make(map[[sha256.Size]byte]bool)}
+	config, tlsConfig, mtimes, err := l.load()
+	if err != nil {
+		return nil, err
+	}
+	l.config, l.tls, l.mtimes = config, tlsConfig, mtimes
+	l.lastCheck = time.Now()
+	return l, nil
+}
+
+// load reads the config and the files it references
+func (l *webConfigLoader) load() (*webConfig, *tls.Config, map[string]time.Time, error) {
+	mtimes := map[string]time.Time{}
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	mtimes[l.path] = info.ModTime()
+
+	config, err := loadWebConfig(l.path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, f := range config.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		mtimes[f] = info.ModTime()
+	}
+
+	var tlsConfig *tls.Config
+	if config.TLSServerConfig != nil {
+		if tlsConfig, err = config.tlsConfig(); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return config, tlsConfig, mtimes, nil
+}
+
+// changed reports whether any file has changed since it was loaded
+func (l *webConfigLoader) changed() bool {
+	for f, mtime := range l.mtimes {
+		info, err := os.Stat(f)
+		if err != nil || !info.ModTime().Equal(mtime) {
+			return true
+		}
+	}
+	return false
+}
+
+// current returns the config, reloading it first if a file has changed.
+// If the reload fails, the last valid config stays in use.
+func (l *webConfigLoader) current() (*webConfig, *tls.Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.lastCheck) < webConfigCheckInterval {
+		return l.config, l.tls
+	}
+	l.lastCheck = time.Now()
+	if !l.changed() {
+		return l.config, l.tls
+	}
+
+	config, tlsConfig, mtimes, err := l.load()
+	if err == nil && (tlsConfig == nil) != (l.tls == nil) {
+		err = errors.New("enabling or disabling TLS requires a restart")
+	}
+	if err != nil {
+		slog.Error("Failed to reload web config, keeping the previous one", "file", l.path, "err", err)
+		// Remember the new mtimes so the error is not logged on every request
+		for f := range l.mtimes {
+			if info, statErr := os.Stat(f); statErr == nil {
+				l.mtimes[f] = info.ModTime()
+			}
+		}
+		return l.config, l.tls
+	}
+
+	l.config, l.tls, l.mtimes = config, tlsConfig, mtimes
+	l.authMu.Lock()
+	l.authCache = make(map[[sha256.Size]byte]bool)
+	l.authMu.Unlock()
+	slog.Info("Reloaded web config", "file", l.path)
+	return l.config, l.tls
+}
+
+// getConfigForClient serves the current TLS config for each handshake
+func (l *webConfigLoader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	_, tlsConfig := l.current()
+	return tlsConfig, nil
+}
+
+// checkPassword reports whether password is valid for user
+func (l *webConfigLoader) checkPassword(users map[string]string, user, password string) bool {
+	hash, known := users[user]
+	if !known {
+		hash = webConfigDummyHash
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + password))
+
+	l.authMu.Lock()
+	ok, cached := l.authCache[key]
+	l.authMu.Unlock()
+	if !cached {
+		ok = bcryptCompare(hash, []byte(password)) == nil
+		l.authMu.Lock()
+		if len(l.authCache) > 1000 {
+			l.authCache = make(map[[sha256.Size]byte]bool)
+		}
+		l.authCache[key] = ok
+		l.authMu.Unlock()
+	}
+	return ok && known
+}
+
+// handler applies basic auth, except to the probe endpoints, and the
+// configured response headers
+func (l *webConfigLoader) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config, _ := l.current()
+		for name, value := range config.HTTPServerConfig.Headers {
+			w.Header().Set(name, value)
+		}
+
+		if len(config.BasicAuthUsers) > 0 && !webConfigProbePaths[r.URL.Path] {
+			user, password, ok := r.BasicAuth()
+			if !ok || !l.checkPassword(config.BasicAuthUsers, user, password) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="erdma-exporter", charset="UTF-8"`)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
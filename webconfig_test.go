@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestWebConfigLoader writes a web config to a temporary file and loads it
+func newTestWebConfigLoader(t *testing.T, config string) *webConfigLoader {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "web.yml")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	l, err := newWebConfigLoader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestWebConfigDummyHash(t *testing.T) {
+	if _, err := parseBcryptHash(webConfigDummyHash); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebConfigBasicAuth(t *testing.T) {
+	// The password of alice is "secret"
+	l := newTestWebConfigLoader(t, `
+basic_auth_users:
+  alice: $2b$04$abcdefghijklmnopqrstuu2r9OfJnfCsdneAXAGHnS4UpFFP8WIrW
+http_server_config:
+  headers:
+    X-Frame-Options: deny
+`)
+	handler := l.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, tc := range []struct {
+		name     string
+		user     string
+		password string
+		auth     bool
+		want     int
+	}{
+		{"valid", "alice", "secret", true, http.StatusNoContent},
+		{"wrong password", "alice", "wrong", true, http.StatusUnauthorized},
+		{"unknown user", "mallory", "secret", true, http.StatusUnauthorized},
+		{"no credentials", "", "", false, http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tc.auth {
+				r.SetBasicAuth(tc.user, tc.password)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Errorf("status = %d, want %d", w.Code, tc.want)
+			}
+			if got := w.Header().Get("X-Frame-Options"); got != "deny" {
+				t.Errorf("X-Frame-Options = %q, want deny", got)
+			}
+			if tc.want == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("no WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+// TestWebConfigUnknownUser checks that an unknown user is rejected after a
+// comparison against the dummy hash, so that it takes as long as a known one
+func TestWebConfigUnknownUser(t *testing.T) {
+	l := newTestWebConfigLoader(t, `
+basic_auth_users:
+  alice: $2b$04$abcdefghijklmnopqrstuu2r9OfJnfCsdneAXAGHnS4UpFFP8WIrW
+`)
+	config, _ := l.current()
+	if l.checkPassword(config.BasicAuthUsers, "mallory", "secret") {
+		t.Fatal("unknown user accepted")
+	}
+	key := sha256.Sum256([]byte("mallory\x00" + webConfigDummyHash + "\x00secret"))
+	if _, ok := l.authCache[key]; !ok || len(l.authCache) != 1 {
+		t.Errorf("unknown user was not compared against the dummy hash, cache has %d entries", len(l.authCache))
+	}
+}
+
+// TestWebConfigProbesWithoutAuth checks that the kubelet probes need no
+// credentials while everything else does
+func TestWebConfigProbesWithoutAuth(t *testing.T) {
+	l := newTestWebConfigLoader(t, `
+basic_auth_users:
+  alice: $2b$04$abcdefghijklmnopqrstuu2r9OfJnfCsdneAXAGHnS4UpFFP8WIrW
+`)
+	handler := l.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for path, want := range map[string]int{
+		"/healthz":         http.StatusNoContent,
+		"/readyz":          http.StatusNoContent,
+		"/healthz/":        http.StatusUnauthorized,
+		"/metrics":         http.StatusUnauthorized,
+		"/api/v1/devices":  http.StatusUnauthorized,
+		"/-/log-level":     http.StatusUnauthorized,
+		"/readyz?verbose=": http.StatusNoContent,
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != want {
+			t.Errorf("%s: status = %d, want %d", path, w.Code, want)
+		}
+	}
+}
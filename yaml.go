@@ -0,0 +1,416 @@
+package main
+
+// A decoder for the subset of YAML used by configuration files: block
+// mappings and sequences, flow sequences and mappings, plain and quoted
+// scalars, literal and folded block scalars, and comments. Anchors, tags,
+// multi-document streams and complex keys are not supported.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// yamlLine is a non-empty line with its indentation and comment removed
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+	// raw is the line without indentation, kept for block scalars
+	raw string
+}
+
+// yamlParser parses a sequence of lines into generic values
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+	// all holds every line including blank ones, for block scalars
+	all []string
+}
+
+// decodeYAML decodes data into v, rejecting fields that v does not have.
+// Values are converted through JSON, so v uses json struct tags.
+func decodeYAML(data []byte, v any) error {
+	value, err := parseYAML(data)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		value = map[string]any{}
+	}
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// parseYAML parses data into maps, slices and scalars
+func parseYAML(data []byte) (any, error) {
+	p := &yamlParser{all: strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")}
+	for i, line := range p.all {
+		trimmed := strings.TrimLeft(line, " ")
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		if trimmed == "---" && len(p.lines) == 0 {
+			continue
+		}
+		text := strings.TrimSpace(stripYAMLComment(trimmed))
+		if text == "" {
+			continue
+		}
+		p.lines = append(p.lines, yamlLine{num: i + 1, indent: len(line) - len(trimmed), text: text, raw: trimmed})
+	}
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+	value, err := p.parseBlock(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].num)
+	}
+	return value, nil
+}
+
+// stripYAMLComment removes a trailing comment outside of quotes
+func stripYAMLComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || strings.ContainsRune(" :-[{,", rune(s[i-1])) {
+				quote = c
+			}
+		case c == '#':
+			if i == 0 || s[i-1] == ' ' {
+				return s[:i]
+			}
+		}
+	}
+	return s
+}
+
+// parseBlock parses the mapping or sequence starting at the current line
+func (p *yamlParser) parseBlock(indent int) (any, error) {
+	line := p.lines[p.pos]
+	if line.text == "-" || strings.HasPrefix(line.text, "- ") {
+		return p.parseSequence(indent)
+	}
+	if _, _, ok := splitYAMLKey(line.text); ok {
+		return p.parseMapping(indent)
+	}
+	p.pos++
+	return parseYAMLScalar(line.text, line.num)
+}
+
+// parseSequence parses "- item" lines at indent
+func (p *yamlParser) parseSequence(indent int) ([]any, error) {
+	seq := []any{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", line.num)
+		}
+		if line.text != "-" && !strings.HasPrefix(line.text, "- ") {
+			break
+		}
+
+		content := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+		if content == "" {
+			p.pos++
+			value, err := p.parseNested(indent, line.num)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, value)
+			continue
+		}
+
+		// Parse the content of the item as if it started its own line, so
+		// that "- key: value" begins a mapping indented past the dash
+		offset := len(line.text) - len(content)
+		p.lines[p.pos] = yamlLine{num: line.num, indent: indent + offset, text: content, raw: content}
+		value, err := p.parseBlock(indent + offset)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, value)
+	}
+	return seq, nil
+}
+
+// parseMapping parses "key: value" lines at indent
+func (p *yamlParser) parseMapping(indent int) (map[string]any, error) {
+	m := map[string]any{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", line.num)
+		}
+		key, rest, ok := splitYAMLKey(line.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", line.num)
+		}
+		if _, dup := m[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", line.num, key)
+		}
+		p.pos++
+
+		var value any
+		var err error
+		switch {
+		case rest == "":
+			value, err = p.parseNested(indent, line.num)
+		case rest[0] == '|' || rest[0] == '>':
+			value, err = p.parseBlockScalar(indent, line, rest)
+		default:
+			value, err = parseYAMLScalar(rest, line.num)
+		}
+		if err != nil {
+			return nil, err
+		}
+		m[key] = value
+	}
+	return m, nil
+}
+
+// parseNested parses the value of a key or dash with nothing after it.
+// A sequence may sit at the same indentation as its key.
+func (p *yamlParser) parseNested(indent int, num int) (any, error) {
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	next := p.lines[p.pos]
+	if next.indent > indent {
+		return p.parseBlock(next.indent)
+	}
+	if next.indent == indent && (next.text == "-" || strings.HasPrefix(next.text, "- ")) {
+		return p.parseSequence(indent)
+	}
+	return nil, nil
+}
+
+// parseBlockScalar parses a "|" or ">" scalar following line
+func (p *yamlParser) parseBlockScalar(indent int, line yamlLine, header string) (string, error) {
+	folded := header[0] == '>'
+	chomp := strings.TrimSpace(header[1:])
+	if chomp != "" && chomp != "-" && chomp != "+" {
+		return "", fmt.Errorf("line %d: unsupported block scalar header %q", line.num, header)
+	}
+
+	// Consume the parsed lines that belong to the scalar
+	for p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+		p.pos++
+	}
+	end := len(p.all)
+	if p.pos < len(p.lines) {
+		end = p.lines[p.pos].num - 1
+	}
+
+	var body []string
+	blockIndent := -1
+	for _, raw := range p.all[line.num:end] {
+		trimmed := strings.TrimLeft(raw, " ")
+		if trimmed == "" {
+			body = append(body, "")
+			continue
+		}
+		if blockIndent < 0 {
+			blockIndent = len(raw) - len(trimmed)
+		}
+		if len(raw)-len(trimmed) < blockIndent {
+			return "", fmt.Errorf("line %d: block scalar is less indented than its first line", line.num)
+		}
+		body = append(body, raw[blockIndent:])
+	}
+	for len(body) > 0 && body[len(body)-1] == "" && chomp != "+" {
+		body = body[:len(body)-1]
+	}
+
+	sep := "\n"
+	if folded {
+		sep = " "
+	}
+	s := strings.Join(body, sep)
+	if chomp != "-" && len(body) > 0 {
+		s += "\n"
+	}
+	return s, nil
+}
+
+// splitYAMLKey splits "key: value" and "key:" lines
+func splitYAMLKey(s string) (string, string, bool) {
+	if s == "" || s[0] == '[' || s[0] == '{' {
+		return "", "", false
+	}
+	if s[0] == '"' || s[0] == '\'' {
+		end := closingQuote(s)
+		if end < 0 || end+1 >= len(s) || s[end+1] != ':' {
+			return "", "", false
+		}
+		key, err := parseYAMLScalar(s[:end+1], 0)
+		if err != nil {
+			return "", "", false
+		}
+		rest := s[end+2:]
+		if rest != "" && rest[0] != ' ' {
+			return "", "", false
+		}
+		return fmt.Sprint(key), strings.TrimSpace(rest), true
+	}
+	if strings.HasSuffix(s, ":") {
+		return s[:len(s)-1], "", true
+	}
+	i := strings.Index(s, ": ")
+	if i < 0 {
+		return "", "", false
+	}
+	return s[:i], strings.TrimSpace(s[i+2:]), true
+}
+
+// closingQuote returns the index of the quote closing the one at s[0]
+func closingQuote(s string) int {
+	q := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case q == '"' && s[i] == '\\':
+			i++
+		case q == '\'' && s[i] == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		case s[i] == q:
+			return i
+		}
+	}
+	return -1
+}
+
+// parseYAMLScalar parses a scalar or a flow collection
+func parseYAMLScalar(s string, num int) (any, error) {
+	switch s[0] {
+	case '"':
+		if closingQuote(s) != len(s)-1 {
+			return nil, fmt.Errorf("line %d: unterminated string %s", num, s)
+		}
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid string %s", num, s)
+		}
+		return v, nil
+	case '\'':
+		if closingQuote(s) != len(s)-1 {
+			return nil, fmt.Errorf("line %d: unterminated string %s", num, s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case '[', '{':
+		return parseYAMLFlow(s, num)
+	case '&', '*', '!':
+		return nil, fmt.Errorf("line %d: anchors, aliases and tags are not supported", num)
+	}
+
+	switch s {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && !strings.ContainsAny(s, "xXnN_") {
+		return f, nil
+	}
+	return s, nil
+}
+
+// parseYAMLFlow parses a single-line "[a, b]" or "{a: b}" collection
+func parseYAMLFlow(s string, num int) (any, error) {
+	open, closing := s[0], byte(']')
+	if open == '{' {
+		closing = '}'
+	}
+	if s[len(s)-1] != closing {
+		return nil, fmt.Errorf("line %d: unterminated flow collection %s", num, s)
+	}
+
+	// Split the items on commas outside of quotes and nested collections
+	var items []string
+	depth, start := 0, 1
+	for i := 1; i < len(s)-1; i++ {
+		switch s[i] {
+		case '"', '\'':
+			end := closingQuote(s[i:])
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated string in %s", num, s)
+			}
+			i += end
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				items = append(items, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	items = append(items, s[start:len(s)-1])
+
+	if open == '[' {
+		seq := []any{}
+		for _, item := range items {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			v, err := parseYAMLScalar(item, num)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+		}
+		return seq, nil
+	}
+
+	m := map[string]any{}
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		key, rest, ok := splitYAMLKey(item)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"key: value\" in %s", num, s)
+		}
+		var v any
+		if rest != "" {
+			var err error
+			if v, err = parseYAMLScalar(rest, num); err != nil {
+				return nil, err
+			}
+		}
+		m[key] = v
+	}
+	return m, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+		want any
+	}{
+		{"empty", "", nil},
+		{"comments only", "# comment\n\n---\n", nil},
+		{"scalars", `
+int: 42
+negative: -7
+float: 1.5
+true: true
+false: False
+null: ~
+plain: hello world
+double: "tab\there # not a comment"
+single: 'it''s'
+hex: 0x1f
+`, map[string]any{
+			"int": int64(42), "negative": int64(-7), "float": 1.5,
+			"true": true, "false": false, "null": nil,
+			"plain": "hello world", "double": "tab\there # not a comment", "single": "it's",
+			"hex": "0x1f",
+		}},
+		{"nested mappings", `
+a:
+  b:
+    c: 1 # trailing comment
+  d: 2
+e: 3
+`, map[string]any{"a": map[string]any{"b": map[string]any{"c": int64(1)}, "d": int64(2)}, "e": int64(3)}},
+		{"sequences", `
+indented:
+  - a
+  - "b"
+same_indent:
+- 1
+- 2
+nested:
+  -
+    - x
+`, map[string]any{
+			"indented":    []any{"a", "b"},
+			"same_indent": []any{int64(1), int64(2)},
+			"nested":      []any{[]any{"x"}},
+		}},
+		{"sequence of mappings", `
+targets:
+  - name: a
+    port: 1
+  - name: b
+    port: 2
+`, map[string]any{"targets": []any{
+			map[string]any{"name": "a", "port": int64(1)},
+			map[string]any{"name": "b", "port": int64(2)},
+		}}},
+		{"flow collections", `
+seq: [a, "b, c", 3, [4, 5]]
+map: {a: 1, "b c": [x, y], d: {e: f}, g:}
+empty_seq: []
+empty_map: {}
+`, map[string]any{
+			"seq":       []any{"a", "b, c", int64(3), []any{int64(4), int64(5)}},
+			"map":       map[string]any{"a": int64(1), "b c": []any{"x", "y"}, "d": map[string]any{"e": "f"}, "g": nil},
+			"empty_seq": []any{},
+			"empty_map": map[string]any{},
+		}},
+		{"quoted keys", `
+"a: b": 1
+'c': 2
+`, map[string]any{"a: b": int64(1), "c": int64(2)}},
+		{"block scalars", `
+literal: |
+  line one
+
+  line three
+folded: >
+  folded
+  text
+strip: |-
+  no newline
+keep: |+
+  kept
+
+next: 1
+`, map[string]any{
+			"literal": "line one\n\nline three\n",
+			"folded":  "folded text\n",
+			"strip":   "no newline",
+			"keep":    "kept\n\n",
+			"next":    int64(1),
+		}},
+		{"top-level sequence", "- a\n- b\n", []any{"a", "b"}},
+		{"CRLF line endings", "a: 1\r\nb: 2\r\n", map[string]any{"a": int64(1), "b": int64(2)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseYAML([]byte(tc.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %#v, want %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+		err  string
+	}{
+		{"tab indentation", "a:\n\tb: 1\n", "line 2: tabs"},
+		{"duplicate key", "a: 1\na: 2\n", "line 2: duplicate key"},
+		{"unexpected indentation", "a: 1\n  b: 2\n", "line 2: unexpected indentation"},
+		{"not a mapping", "a: 1\nb\n", "line 2: expected"},
+		{"anchor", "a: &x 1\n", "anchors"},
+		{"alias", "a: *x\n", "anchors"},
+		{"tag", "a: !!str 1\n", "tags"},
+		{"unterminated string", "a: \"b\n", "line 1: unterminated string"},
+		{"unterminated flow", "a: [1, 2\n", "line 1: unterminated flow"},
+		{"bad flow mapping", "a: {b}\n", "line 1: expected"},
+		{"block scalar header", "a: |2\n  b\n", "line 1: unsupported block scalar header"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseYAML([]byte(tc.in))
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("error = %v, want one containing %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestDecodeYAML(t *testing.T) {
+	var config struct {
+		Name    string            `json:"name"`
+		Port    int               `json:"port"`
+		Enabled *bool             `json:"enabled"`
+		Tags    []string          `json:"tags"`
+		Headers map[string]string `json:"headers"`
+	}
+	err := decodeYAML([]byte(`
+name: node-1
+port: 9101
+enabled: false
+tags: [a, b]
+headers:
+  X-Frame-Options: deny
+`), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Name != "node-1" || config.Port != 9101 || config.Enabled == nil || *config.Enabled ||
+		!reflect.DeepEqual(config.Tags, []string{"a", "b"}) ||
+		!reflect.DeepEqual(config.Headers, map[string]string{"X-Frame-Options": "deny"}) {
+		t.Errorf("decoded %+v", config)
+	}
+
+	if err := decodeYAML([]byte("nmae: node-1\n"), &config); err == nil || !strings.Contains(err.Error(), "unknown field") {
+		t.Errorf("unknown field: error = %v", err)
+	}
+	if err := decodeYAML([]byte("port: abc\n"), &config); err == nil {
+		t.Error("decoding a string into an int succeeded")
+	}
+	if err := decodeYAML(nil, &config); err != nil {
+		t.Errorf("empty document: %v", err)
+	}
+}
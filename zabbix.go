@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// zabbixHeader starts every message of the Zabbix sender protocol, followed
+// by the flags byte and the little-endian 64-bit length of the JSON data
+const zabbixHeader = "ZBXD\x01"
+
+// zabbixMaxResponse bounds the size of a trapper response
+const zabbixMaxResponse = 64 << 10
+
+// zabbixDiscoveryInterval is how often the device discovery is resent when
+// the devices do not change
+const zabbixDiscoveryInterval = time.Hour
+
+// Defaults of a Zabbix sink
+const (
+	zabbixDefaultName         = "erdma.stat[{{.Device}},{{.Stat}}]"
+	zabbixDefaultDiscoveryKey = "erdma.device.discovery"
+)
+
+// zabbixItem is a value of the sender protocol
+type zabbixItem struct {
+	Host  string `json:"host"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Clock int64  `json:"clock,omitempty"`
+	NS    int64  `json:"ns,omitempty"`
+}
+
+// zabbixRequest is a "sender data" request
+type zabbixRequest struct {
+	Request string       `json:"request"`
+	Data    []zabbixItem `json:"data"`
+	Clock   int64        `json:"clock"`
+	NS      int64        `json:"ns"`
+}
+
+// zabbixResponse is the reply of a trapper
+type zabbixResponse struct {
+	Response string `json:"response"`
+	Info     string `json:"info"`
+}
+
+// zabbixInfoRE parses the info of a trapper response
+var zabbixInfoRE = regexp.MustCompile(`processed: (\d+); failed: (\d+); total: (\d+)`)
+
+// Failed returns how many values the server did not accept, usually
+// because there is no trapper item with their key (yet)
+func (r zabbixResponse) Failed() int {
+	m := zabbixInfoRE.FindStringSubmatch(r.Info)
+	if m == nil {
+		return 0
+	}
+	failed, _ := strconv.Atoi(m[2])
+	return failed
+}
+
+// zabbixSend sends items to a Zabbix server or proxy trapper and returns its
+// response
+func zabbixSend(ctx context.Context, address string, items []zabbixItem) (zabbixResponse, error) {
+	var resp zabbixResponse
+	now := time.Now()
+	data, err := json.Marshal(zabbixRequest{
+		Request: "sender data", Data: items,
+		Clock: now.Unix(), NS: int64(now.Nanosecond()),
+	})
+	if err != nil {
+		return resp, err
+	}
+	msg := make([]byte, 0, len(zabbixHeader)+8+len(data))
+	msg = append(msg, zabbixHeader...)
+	msg = binary.LittleEndian.AppendUint64(msg, uint64(len(data)))
+	msg = append(msg, data...)
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return resp, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return resp, err
+	}
+
+	header := make([]byte, len(zabbixHeader)+8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return resp, fmt.Errorf("read response: %w", err)
+	}
+	if !bytes.Equal(header[:len(zabbixHeader)], []byte(zabbixHeader)) {
+		return resp, fmt.Errorf("invalid response header %q", header[:len(zabbixHeader)])
+	}
+	size := binary.LittleEndian.Uint64(header[len(zabbixHeader):])
+	if size > zabbixMaxResponse {
+		return resp, fmt.Errorf("response of %d bytes is too large", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return resp, fmt.Errorf("read response: %w", err)
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return resp, fmt.Errorf("decode response: %w", err)
+	}
+	if resp.Response != "success" {
+		return resp, fmt.Errorf("server responded %q: %s", resp.Response, resp.Info)
+	}
+	return resp, nil
+}
+
+// zabbixDiscovery returns the low-level discovery JSON of devices, with
+// the macros {#DEVICE}, {#GUID} and {#NODE}
+func zabbixDiscovery(devices []Device, node string) string {
+	entries := make([]map[string]string, 0, len(devices))
+	for _, device := range devices {
+		entries = append(entries, map[string]string{
+			"{#DEVICE}": device.Name,
+			"{#GUID}":   device.GUID,
+			"{#NODE}":   node,
+		})
+	}
+	data, _ := json.Marshal(entries)
+	return string(data)
+}
+
+// zabbixSink sends values to Zabbix trapper items with the sender protocol,
+// and the devices to a low-level discovery rule so that the items are
+// created per device from prototypes
+type zabbixSink struct {
+	address      string
+	host         string
+	discoveryKey string
+
+	// The devices last discovered and when they were sent
+	discovered     []Device
+	discoveredTime time.Time
+}
+
+// Discover sends the devices to the discovery rule when they changed or
+// have not been sent for zabbixDiscoveryInterval
+func (s *zabbixSink) Discover(ctx context.Context, devices []Device, node string) error {
+	if slices.Equal(devices, s.discovered) && time.Since(s.discoveredTime) < zabbixDiscoveryInterval {
+		return nil
+	}
+	host := s.host
+	if host == "" {
+		host = node
+	}
+	if _, err := zabbixSend(ctx, s.address, []zabbixItem{{
+		Host: host, Key: s.discoveryKey, Value: zabbixDiscovery(devices, node),
+	}}); err != nil {
+		return fmt.Errorf("discovery: %w", err)
+	}
+	s.discovered = slices.Clone(devices)
+	s.discoveredTime = time.Now()
+	return nil
+}
+
+func (s *zabbixSink) Send(ctx context.Context, points []sinkPoint) error {
+	if len(points) == 0 {
+		return nil
+	}
+	items := make([]zabbixItem, 0, len(points))
+	for _, p := range points {
+		host := s.host
+		if host == "" {
+			host = p.Node
+		}
+		items = append(items, zabbixItem{
+			Host: host, Key: p.Name,
+			Value: strconv.FormatUint(p.Value, 10),
+			Clock: p.Time.Unix(), NS: int64(p.Time.Nanosecond()),
+		})
+	}
+	resp, err := zabbixSend(ctx, s.address, items)
+	if err != nil {
+		return err
+	}
+	if failed := resp.Failed(); failed > 0 {
+		slog.Warn("Zabbix did not accept some values, check the trapper items and the host name",
+			"address", s.address, "failed", failed, "info", resp.Info)
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// trapperRequest is a message received by a fake trapper
+type trapperRequest struct {
+	Header string
+	Length uint64
+	Body   []byte
+	// Extra are bytes sent after the length given in the header
+	Extra int
+}
+
+// fakeTrapper is a Zabbix trapper that answers every message with the
+// response of respond
+type fakeTrapper struct {
+	ln       net.Listener
+	requests chan trapperRequest
+}
+
+func newFakeTrapper(t *testing.T, respond func(zabbixRequest) []byte) *fakeTrapper {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	f := &fakeTrapper{ln: ln, requests: make(chan trapperRequest, 10)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.serve(conn, respond)
+		}
+	}()
+	return f
+}
+
+func (f *fakeTrapper) serve(conn net.Conn, respond func(zabbixRequest) []byte) {
+	defer conn.Close()
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	req := trapperRequest{Header: string(header[:5]), Length: binary.LittleEndian.Uint64(header[5:])}
+	if req.Length > 1<<20 {
+		return
+	}
+	req.Body = make([]byte, req.Length)
+	if _, err := io.ReadFull(conn, req.Body); err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	req.Extra, _ = conn.Read(make([]byte, 1))
+	f.requests <- req
+
+	var decoded zabbixRequest
+	json.Unmarshal(req.Body, &decoded)
+	conn.Write(respond(decoded))
+}
+
+// zabbixMessage frames a response of the sender protocol
+func zabbixMessage(header string, v any) []byte {
+	data, _ := json.Marshal(v)
+	msg := append([]byte(header), binary.LittleEndian.AppendUint64(nil, uint64(len(data)))...)
+	return append(msg, data...)
+}
+
+// acceptAll answers that every value was processed
+func acceptAll(req zabbixRequest) []byte {
+	n := len(req.Data)
+	return zabbixMessage(zabbixHeader, zabbixResponse{Response: "success", Info: zabbixInfo(n, 0, n)})
+}
+
+// zabbixInfo returns the info of a trapper response
+func zabbixInfo(processed, failed, total int) string {
+	return fmt.Sprintf("processed: %d; failed: %d; total: %d; seconds spent: 0.000055", processed, failed, total)
+}
+
+// nextRequest returns the next message the trapper received, decoded
+func (f *fakeTrapper) nextRequest(t *testing.T) zabbixRequest {
+	t.Helper()
+	var raw trapperRequest
+	select {
+	case raw = <-f.requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request")
+	}
+	if raw.Header != zabbixHeader {
+		t.Errorf("header %q, want %q", raw.Header, zabbixHeader)
+	}
+	if raw.Extra != 0 {
+		t.Errorf("data continues after the length of %d given in the header", raw.Length)
+	}
+	var req zabbixRequest
+	if err := json.Unmarshal(raw.Body, &req); err != nil {
+		t.Fatalf("body of %d bytes is not JSON: %v", raw.Length, err)
+	}
+	if req.Request != "sender data" || req.Clock == 0 {
+		t.Errorf("request %q with clock %d", req.Request, req.Clock)
+	}
+	return req
+}
+
+func TestZabbixSink(t *testing.T) {
+	trapper := newFakeTrapper(t, acceptAll)
+	config := &SinkConfig{Type: sinkZabbix, Address: trapper.ln.Addr().String()}
+	sink := newTestSink(t, config).(*zabbixSink)
+	points, err := sinkPoints(config, "node-1", []deviceState{
+		{Device: Device{Name: "erdma_0"}, Last: &DeviceSample{Time: sinkTestTime, Stats: statsFromMap(map[string]uint64{"hw_tx_bytes_cnt": 5, "hw_rx_bytes_cnt": 1 << 63})}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Send(context.Background(), points); err != nil {
+		t.Fatal(err)
+	}
+	want := []zabbixItem{
+		{Host: "node-1", Key: "erdma.stat[erdma_0,hw_rx_bytes_cnt]", Value: "9223372036854775808", Clock: 1700000000, NS: 123},
+		{Host: "node-1", Key: "erdma.stat[erdma_0,hw_tx_bytes_cnt]", Value: "5", Clock: 1700000000, NS: 123},
+	}
+	if got := trapper.nextRequest(t).Data; !reflect.DeepEqual(got, want) {
+		t.Errorf("items\n%+v\nwant\n%+v", got, want)
+	}
+
+	// A configured host replaces the node name
+	sink.host = "erdma-node-1"
+	if err := sink.Send(context.Background(), points[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if got := trapper.nextRequest(t).Data[0].Host; got != "erdma-node-1" {
+		t.Errorf("host = %q", got)
+	}
+}
+
+func TestZabbixDiscovery(t *testing.T) {
+	trapper := newFakeTrapper(t, acceptAll)
+	sink := newTestSink(t, &SinkConfig{Type: sinkZabbix, Address: trapper.ln.Addr().String()}).(*zabbixSink)
+	devices := []Device{{Name: "erdma_0", GUID: "02163efffe5030b3"}, {Name: "erdma_1", GUID: "02163efffe5030b4"}}
+
+	if err := sink.Discover(context.Background(), devices, "node-1"); err != nil {
+		t.Fatal(err)
+	}
+	req := trapper.nextRequest(t)
+	if len(req.Data) != 1 || req.Data[0].Key != "erdma.device.discovery" || req.Data[0].Host != "node-1" {
+		t.Fatalf("discovery sent as %+v", req.Data)
+	}
+	var lld []map[string]string
+	if err := json.Unmarshal([]byte(req.Data[0].Value), &lld); err != nil {
+		t.Fatal(err)
+	}
+	wantLLD := []map[string]string{
+		{"{#DEVICE}": "erdma_0", "{#GUID}": "02163efffe5030b3", "{#NODE}": "node-1"},
+		{"{#DEVICE}": "erdma_1", "{#GUID}": "02163efffe5030b4", "{#NODE}": "node-1"},
+	}
+	if !reflect.DeepEqual(lld, wantLLD) {
+		t.Errorf("LLD %v, want %v", lld, wantLLD)
+	}
+
+	// Unchanged devices are not sent again until the interval passed
+	if err := sink.Discover(context.Background(), devices, "node-1"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-trapper.requests:
+		t.Error("unchanged devices sent again")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := sink.Discover(context.Background(), devices[:1], "node-1"); err != nil {
+		t.Fatal(err)
+	}
+	if req := trapper.nextRequest(t); !strings.Contains(req.Data[0].Value, "erdma_0") || strings.Contains(req.Data[0].Value, "erdma_1") {
+		t.Errorf("changed devices sent as %s", req.Data[0].Value)
+	}
+	sink.discoveredTime = time.Now().Add(-zabbixDiscoveryInterval)
+	if err := sink.Discover(context.Background(), devices[:1], "node-1"); err != nil {
+		t.Fatal(err)
+	}
+	trapper.nextRequest(t)
+}
+
+// TestZabbixFailedValues checks that values the server rejects, such as
+// those of items not created yet, are logged and do not fail the send
+func TestZabbixFailedValues(t *testing.T) {
+	logs := captureLogs(t)
+	trapper := newFakeTrapper(t, func(req zabbixRequest) []byte {
+		return zabbixMessage(zabbixHeader, zabbixResponse{Response: "success", Info: zabbixInfo(1, 2, 3)})
+	})
+	sink := newTestSink(t, &SinkConfig{Type: sinkZabbix, Address: trapper.ln.Addr().String()})
+	points := []sinkPoint{{Name: "a", Node: "node-1"}, {Name: "b", Node: "node-1"}, {Name: "c", Node: "node-1"}}
+	if err := sink.Send(context.Background(), points); err != nil {
+		t.Fatal(err)
+	}
+	trapper.nextRequest(t)
+	if !strings.Contains(logs.String(), "Zabbix did not accept some values") || !strings.Contains(logs.String(), "failed=2") {
+		t.Errorf("rejected values not logged:\n%s", logs)
+	}
+}
+
+func TestZabbixResponseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		response []byte
+		want     string
+	}{
+		{"failed", zabbixMessage(zabbixHeader, zabbixResponse{Response: "failed", Info: "host is not monitored"}), "host is not monitored"},
+		{"bad header", zabbixMessage("HTTP/", zabbixResponse{Response: "success"}), "invalid response header"},
+		{"too large", append([]byte(zabbixHeader), binary.LittleEndian.AppendUint64(nil, zabbixMaxResponse+1)...), "too large"},
+		{"not JSON", append(append([]byte(zabbixHeader), binary.LittleEndian.AppendUint64(nil, 3)...), "abc"...), "decode response"},
+		{"short", []byte(zabbixHeader), "read response"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			trapper := newFakeTrapper(t, func(zabbixRequest) []byte { return tc.response })
+			_, err := zabbixSend(context.Background(), trapper.ln.Addr().String(), []zabbixItem{{Host: "node-1", Key: "a", Value: "1"}})
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("error = %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestZabbixResponseFailed(t *testing.T) {
+	for info, want := range map[string]int{
+		"processed: 3; failed: 0; total: 3; seconds spent: 0.000055": 0,
+		"processed: 1; failed: 12; total: 13; seconds spent: 0.1":    12,
+		"": 0,
+	} {
+		if got := (zabbixResponse{Info: info}).Failed(); got != want {
+			t.Errorf("Failed(%q) = %d, want %d", info, got, want)
+		}
+	}
+}